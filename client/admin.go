@@ -0,0 +1,209 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"heckel.io/pcopy/crypto"
+	"heckel.io/pcopy/server"
+	"heckel.io/pcopy/util"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// AdminClient talks to the admin API of a pcopy server (see AdminListenAddr). Requests are authenticated
+// with the admin key.
+type AdminClient struct {
+	baseURL    string
+	key        *crypto.Key
+	httpClient *http.Client
+}
+
+// NewAdminClient creates a new admin client for the given admin listen address, e.g. "127.0.0.1:2587",
+// ":2587", "10.0.0.1:2587/https" or "unix:/run/pcopy/admin.sock". HTTPS server certificates are verified
+// against the system's trusted CAs, see NewAdminClientWithCert.
+func NewAdminClient(addr string, key *crypto.Key) (*AdminClient, error) {
+	return NewAdminClientWithCert(addr, key, nil)
+}
+
+// NewAdminClientWithCert is like NewAdminClient, but if the admin API is served via HTTPS, the server
+// certificate must match the given pinned certificate (see util.NewHTTPClientWithPinnedCert).
+func NewAdminClientWithCert(addr string, key *crypto.Key, cert *x509.Certificate) (*AdminClient, error) {
+	if addr == "" {
+		return nil, errors.New("admin API not enabled, AdminListenAddr is not set")
+	} else if key == nil {
+		return nil, errors.New("admin key missing, AdminKey is not set")
+	}
+	scheme := "http"
+	if strings.HasSuffix(strings.ToLower(addr), "/https") {
+		scheme = "https"
+		addr = addr[:len(addr)-len("/https")]
+	}
+	httpClient := util.NewHTTPClient()
+	if cert != nil {
+		var err error
+		if httpClient, err = util.NewHTTPClientWithPinnedCert(cert); err != nil {
+			return nil, err
+		}
+	}
+	httpClient = util.WithTimeout(httpClient)
+	baseURL := ""
+	if strings.HasPrefix(addr, "unix:") {
+		if scheme == "https" {
+			return nil, errors.New("admin API via HTTPS is not supported for Unix sockets")
+		}
+		socket := strings.TrimPrefix(addr, "unix:")
+		httpClient.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}
+		baseURL = "http://localhost"
+	} else {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if host == "" {
+			host = "localhost"
+		}
+		baseURL = fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(host, port))
+	}
+	return &AdminClient{
+		baseURL:    baseURL,
+		key:        key,
+		httpClient: httpClient,
+	}, nil
+}
+
+// Clipboards returns all clipboards of the server
+func (c *AdminClient) Clipboards() ([]*server.AdminClipboard, error) {
+	clipboards := make([]*server.AdminClipboard, 0)
+	if err := c.do(http.MethodGet, "/clipboards", nil, nil, &clipboards); err != nil {
+		return nil, err
+	}
+	return clipboards, nil
+}
+
+// AddClipboard adds a new clipboard to the server and returns it
+func (c *AdminClient) AddClipboard(req *server.AdminClipboardRequest) (*server.AdminClipboard, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	clipboard := &server.AdminClipboard{}
+	if err := c.do(http.MethodPost, "/clipboards", nil, body, clipboard); err != nil {
+		return nil, err
+	}
+	return clipboard, nil
+}
+
+// RemoveClipboard removes a clipboard that was added via the admin API. If purge is true, the clipboard
+// directory is removed as well.
+func (c *AdminClient) RemoveClipboard(name string, purge bool) error {
+	query := url.Values{}
+	if purge {
+		query.Set("purge", "1")
+	}
+	return c.do(http.MethodDelete, "/clipboards/"+url.PathEscape(name), query, nil, nil)
+}
+
+// Entries returns the entries of the given clipboard. The clipboard may be the name of a clipboard that was
+// added via the admin API, or a server address; if it is empty, the server's own clipboard is used.
+func (c *AdminClient) Entries(clipboard string) ([]*server.AdminEntry, error) {
+	entries := make([]*server.AdminEntry, 0)
+	if err := c.do(http.MethodGet, "/entries", clipboardQuery(clipboard), nil, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// UpdateEntry changes the expiry of a clipboard entry, see server.AdminEntryRequest
+func (c *AdminClient) UpdateEntry(clipboard string, id string, req *server.AdminEntryRequest) (*server.AdminEntry, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	entry := &server.AdminEntry{}
+	if err := c.do(http.MethodPatch, "/entries/"+url.PathEscape(id), clipboardQuery(clipboard), body, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// DeleteEntry deletes a clipboard entry, regardless of its mode or file password
+func (c *AdminClient) DeleteEntry(clipboard string, id string) error {
+	return c.do(http.MethodDelete, "/entries/"+url.PathEscape(id), clipboardQuery(clipboard), nil, nil)
+}
+
+// Stats returns the usage and visitor stats of the given clipboard
+func (c *AdminClient) Stats(clipboard string) (*server.AdminStats, error) {
+	stats := &server.AdminStats{}
+	if err := c.do(http.MethodGet, "/stats", clipboardQuery(clipboard), nil, stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// Expire removes the expired entries of the given clipboard right away, instead of waiting for the next
+// run of the server's manager. It returns the removed entries.
+func (c *AdminClient) Expire(clipboard string) ([]*server.AdminEntry, error) {
+	entries := make([]*server.AdminEntry, 0)
+	if err := c.do(http.MethodPost, "/expire", clipboardQuery(clipboard), nil, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func clipboardQuery(clipboard string) url.Values {
+	query := url.Values{}
+	if clipboard != "" {
+		query.Set("clipboard", clipboard)
+	}
+	return query
+}
+
+func (c *AdminClient) do(method string, path string, query url.Values, body []byte, v interface{}) error {
+	u := c.baseURL + path
+	rawQuery := query.Encode()
+	if rawQuery != "" {
+		u += "?" + rawQuery
+	}
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, u, reader)
+	if err != nil {
+		return err
+	}
+	auth, err := crypto.GenerateAdminAuthHMAC(c.key.Bytes, method, path, rawQuery, body, useDefaultAuthTTL)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", auth)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("admin request failed: %s", strings.TrimSpace(string(msg)))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
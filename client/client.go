@@ -16,13 +16,18 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"os/exec"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	useDefaultAuthTTL = 0
+	useDefaultAuthTTL  = 0
+	clockSkewTolerance = 30 * time.Second
 )
 
 // Client represents a pcopy client. It can be used to communicate with the server to
@@ -30,6 +35,39 @@ const (
 type Client struct {
 	config     *config.Config
 	httpClient *http.Client // Allow injecting HTTP client for testing
+	timeOffset int64        // Clock skew (in seconds) between client and server, accessed atomically
+	clockSync  int32        // Set to 1 once the clock skew was fetched from the server, see syncClock
+	keyRotated int32        // Set to 1 if the server reported that a previous key was used, accessed atomically
+	key        *crypto.Key  // Key resolved from the config, see resolveKey
+	keyMu      sync.Mutex
+
+	allowSecrets bool // Skip the server's detection of secrets in Copy and CopyFiles, see SetAllowSecrets
+}
+
+// ErrClockSkew is returned if the server rejected a request because the client's clock is off by
+// too much, and the request could not be retried with a corrected timestamp.
+type ErrClockSkew struct {
+	Skew time.Duration
+}
+
+func (e ErrClockSkew) Error() string {
+	return fmt.Sprintf("clock skew of %d seconds between client and server, please synchronize your clock", int(e.Skew.Seconds()))
+}
+
+// ErrPinnedCertMismatch is returned if the server presented a TLS certificate that does not match the pinned
+// certificate (see CertFile), e.g. because the server certificate was replaced
+type ErrPinnedCertMismatch struct {
+	CertFile string
+	Err      error
+}
+
+func (e ErrPinnedCertMismatch) Error() string {
+	return fmt.Sprintf("server certificate does not match pinned certificate %s (%s); if the server certificate was "+
+		"changed, verify its fingerprint and run 'pcopy repin'", e.CertFile, e.Err.Error())
+}
+
+func (e ErrPinnedCertMismatch) Unwrap() error {
+	return e.Err
 }
 
 // NewClient creates a new pcopy client. It fails if the ServerAddr is not filled.
@@ -42,15 +80,51 @@ func NewClient(conf *config.Config) (*Client, error) {
 	}, nil
 }
 
+// SetAllowSecrets defines whether the server should skip checking the data of Copy and CopyFiles for
+// secrets (see config.SecretDetection). By default, the data is checked.
+func (c *Client) SetAllowSecrets(allow bool) {
+	c.allowSecrets = allow
+}
+
 // Copy streams the data from reader to the server via a HTTP PUT request. The id parameter
 // is the file identifier that can be used to paste the data later using Paste.
 func (c *Client) Copy(reader io.ReadCloser, id string, ttl time.Duration, mode string, stream bool) (*server.File, error) {
+	url := fmt.Sprintf("%s/%s", config.ExpandServerAddr(c.config.ServerAddr), id)
+	return c.copy(reader, url, ttl, mode, stream, c.allowSecrets)
+}
+
+// CopyFiles creates a ZIP archive of the given files and streams it to the server using the Copy
+// method. No temporary ZIP archive is created on disk. It's all streamed.
+func (c *Client) CopyFiles(files []string, id string, ttl time.Duration, mode string, stream bool) (*server.File, error) {
+	zipReader, err := util.NewZIPReader(files)
+	if err != nil {
+		return nil, err
+	}
+	return c.Copy(zipReader, id, ttl, mode, stream)
+}
+
+// CopyToSlot streams the data from reader to the given upload slot URL (see Request). The URL contains the
+// secret that authorizes the upload, so no key is needed.
+func (c *Client) CopyToSlot(reader io.ReadCloser, slotURL string) (*server.File, error) {
+	return c.copy(reader, slotURL, 0, "", false, false)
+}
+
+// CopyFilesToSlot creates a ZIP archive of the given files and streams it to the given upload slot URL,
+// see CopyToSlot.
+func (c *Client) CopyFilesToSlot(files []string, slotURL string) (*server.File, error) {
+	zipReader, err := util.NewZIPReader(files)
+	if err != nil {
+		return nil, err
+	}
+	return c.CopyToSlot(zipReader, slotURL)
+}
+
+func (c *Client) copy(reader io.ReadCloser, url string, ttl time.Duration, mode string, stream bool, allowSecrets bool) (*server.File, error) {
 	client, err := c.newHTTPClient(nil)
 	if err != nil {
 		return nil, err
 	}
 
-	url := fmt.Sprintf("%s/%s", config.ExpandServerAddr(c.config.ServerAddr), id)
 	req, err := http.NewRequest(http.MethodPut, url, c.withProgressReader(reader, -1))
 	if err != nil {
 		return nil, err
@@ -68,14 +142,23 @@ func (c *Client) Copy(reader io.ReadCloser, id string, ttl time.Duration, mode s
 	if stream {
 		req.Header.Set(server.HeaderStream, server.HeaderStreamDelayHeaders)
 	}
+	if allowSecrets {
+		req.Header.Set(server.HeaderAllowSecrets, server.HeaderAllowSecretsEnabled)
+	}
 
-	resp, err := client.Do(req)
+	resp, err := c.do(client, req, nil)
 	if err != nil {
 		return nil, err
 	} else if resp.StatusCode == http.StatusPartialContent {
 		return nil, server.ErrHTTPPartialContent
 	} else if resp.StatusCode == http.StatusRequestEntityTooLarge {
 		return nil, server.ErrHTTPPayloadTooLarge
+	} else if resp.StatusCode == http.StatusConflict {
+		return nil, server.ErrHTTPConflict
+	} else if resp.StatusCode == http.StatusUnprocessableEntity || resp.StatusCode == http.StatusUnsupportedMediaType {
+		// The server rejected the content (e.g. because of UploadScan or ContentPolicies), and explains why in the body
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, &server.ErrHTTP{Code: resp.StatusCode, Status: strings.TrimSpace(string(msg))}
 	} else if resp.StatusCode != http.StatusCreated {
 		return nil, &server.ErrHTTP{Code: resp.StatusCode, Status: resp.Status}
 	}
@@ -83,16 +166,6 @@ func (c *Client) Copy(reader io.ReadCloser, id string, ttl time.Duration, mode s
 	return c.parseFileInfoResponse(resp)
 }
 
-// CopyFiles creates a ZIP archive of the given files and streams it to the server using the Copy
-// method. No temporary ZIP archive is created on disk. It's all streamed.
-func (c *Client) CopyFiles(files []string, id string, ttl time.Duration, mode string, stream bool) (*server.File, error) {
-	zipReader, err := util.NewZIPReader(files)
-	if err != nil {
-		return nil, err
-	}
-	return c.Copy(zipReader, id, ttl, mode, stream)
-}
-
 // Reserve requests a file name from the server and reserves it for a very short period
 // of time. This is a workaround to be able to stream to a random file ID.
 func (c *Client) Reserve(id string) (*server.File, error) {
@@ -111,7 +184,7 @@ func (c *Client) Reserve(id string) (*server.File, error) {
 	}
 	req.Header.Set(server.HeaderReserve, server.HeaderReserveEnabled)
 
-	resp, err := client.Do(req)
+	resp, err := c.do(client, req, nil)
 	if err != nil {
 		return nil, err
 	} else if resp.StatusCode != http.StatusCreated {
@@ -121,6 +194,47 @@ func (c *Client) Reserve(id string) (*server.File, error) {
 	return c.parseFileInfoResponse(resp)
 }
 
+// Request creates an upload slot with the given id on the server. The returned URL allows anyone holding it
+// to upload a file to the slot exactly once, without a key, until the slot expires (see ttl). If maxSize is
+// larger than zero, the size of the uploaded file is limited to maxSize bytes.
+func (c *Client) Request(id string, ttl time.Duration, maxSize int64) (*server.File, error) {
+	client, err := c.newHTTPClient(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	url := fmt.Sprintf("%s/%s", config.ExpandServerAddr(c.config.ServerAddr), id)
+	req, err := http.NewRequest(http.MethodPut, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.addAuthHeader(req, nil); err != nil {
+		return nil, err
+	}
+	req.Header.Set(server.HeaderReserve, server.HeaderReserveSlot)
+	req.Header.Set(server.HeaderFormat, server.HeaderFormatNone)
+	if ttl > 0 {
+		req.Header.Set(server.HeaderTTL, ttl.String())
+	}
+	if maxSize > 0 {
+		req.Header.Set(server.HeaderMaxSize, fmt.Sprintf("%d", maxSize))
+	}
+
+	resp, err := c.do(client, req, nil)
+	if err != nil {
+		return nil, err
+	} else if resp.StatusCode != http.StatusCreated {
+		return nil, &server.ErrHTTP{Code: resp.StatusCode, Status: resp.Status}
+	}
+
+	info, err := c.parseFileInfoResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+	info.Slot = true
+	return info, nil
+}
+
 // Paste reads the file with the given id from the server and writes it to writer.
 func (c *Client) Paste(writer io.Writer, id string) error {
 	client, err := c.newHTTPClient(nil)
@@ -137,7 +251,7 @@ func (c *Client) Paste(writer io.Writer, id string) error {
 		return err
 	}
 
-	resp, err := client.Do(req)
+	resp, err := c.do(client, req, nil)
 	if err != nil {
 		return err
 	} else if resp.Body == nil {
@@ -210,7 +324,7 @@ func (c *Client) FileInfo(id string) (*server.File, error) {
 		return nil, err
 	}
 
-	resp, err := client.Do(req)
+	resp, err := c.do(client, req, nil)
 	if err != nil {
 		return nil, err
 	} else if resp.StatusCode != http.StatusOK {
@@ -220,6 +334,42 @@ func (c *Client) FileInfo(id string) (*server.File, error) {
 	return c.parseFileInfoResponse(resp)
 }
 
+// Health queries the server's readiness endpoint (/readyz), or the liveness endpoint (/healthz) if live is
+// true. A server that is not ready is not an error; in that case, the returned Health is not OK. If the
+// config contains a key, the request is authorized, so that the server returns the details of each check.
+func (c *Client) Health(live bool) (*server.Health, error) {
+	client, err := c.newHTTPClient(nil)
+	if err != nil {
+		return nil, err
+	}
+	path := "readyz"
+	if live {
+		path = "healthz"
+	}
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/%s", config.ExpandServerAddr(c.config.ServerAddr), path), nil)
+	if err != nil {
+		return nil, err
+	}
+	if !live && c.config.Key != nil {
+		if err := c.addAuthHeader(req, c.config.Key); err != nil {
+			return nil, err
+		}
+	}
+	resp, err := util.WithTimeout(client).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusServiceUnavailable {
+		return nil, &server.ErrHTTP{Code: resp.StatusCode, Status: resp.Status}
+	}
+	var health server.Health
+	if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+		return nil, err
+	}
+	return &health, nil
+}
+
 // ServerInfo queries the server for information (password salt, advertised address) required during the
 // join operation. This method will first attempt to securely connect over HTTPS, and (if that fails)
 // fall back to skipping certificate verification. In the latter case, it will download and return
@@ -269,7 +419,7 @@ func (c *Client) Verify(cert *x509.Certificate, key *crypto.Key) error {
 		return err
 	}
 
-	resp, err := client.Do(req)
+	resp, err := c.do(client, req, key)
 	if err != nil {
 		return err
 	} else if resp.StatusCode != http.StatusOK {
@@ -281,13 +431,18 @@ func (c *Client) Verify(cert *x509.Certificate, key *crypto.Key) error {
 
 func (c *Client) addAuthHeader(req *http.Request, key *crypto.Key) error {
 	if key == nil {
-		key = c.config.Key
+		var err error
+		key, err = c.resolveKey()
+		if err != nil {
+			return err
+		}
 	}
 	if key == nil {
 		return nil // No auth configured
 	}
 
-	auth, err := crypto.GenerateAuthHMAC(key.Bytes, req.Method, req.URL.Path, useDefaultAuthTTL) // RequestURI is empty!
+	timestamp := time.Now().Add(time.Duration(atomic.LoadInt64(&c.timeOffset)) * time.Second)
+	auth, err := crypto.GenerateAuthHMACWithTime(timestamp, key.Bytes, req.Method, req.URL.Path, useDefaultAuthTTL) // RequestURI is empty!
 	if err != nil {
 		return err
 	}
@@ -296,6 +451,165 @@ func (c *Client) addAuthHeader(req *http.Request, key *crypto.Key) error {
 	return nil
 }
 
+// resolveKey returns the clipboard key. If the key is not set in the config, it is fetched by running the
+// KeyCommand, or decrypted from the KeyEncryptedFile. This is done lazily (only when a key is needed) and only
+// once per client, so that commands and passphrase prompts are not repeated.
+func (c *Client) resolveKey() (*crypto.Key, error) {
+	if c.config.Key != nil {
+		return c.config.Key, nil
+	}
+	c.keyMu.Lock()
+	defer c.keyMu.Unlock()
+	if c.key != nil {
+		return c.key, nil
+	}
+	var err error
+	if c.config.KeyCommand != "" {
+		c.key, err = c.runKeyCommand()
+	} else if c.config.KeyEncryptedFile != "" {
+		c.key, err = c.decryptKeyFile()
+	}
+	return c.key, err
+}
+
+func (c *Client) runKeyCommand() (*crypto.Key, error) {
+	cmd := exec.Command("sh", "-c", c.config.KeyCommand)
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("key command failed: %w", err)
+	}
+	key, err := crypto.DecodeKey(strings.TrimSpace(string(output)))
+	if err != nil {
+		return nil, fmt.Errorf("key command returned invalid key: %w", err)
+	}
+	return key, nil
+}
+
+func (c *Client) decryptKeyFile() (*crypto.Key, error) {
+	if c.config.KeyPassphraseFunc == nil {
+		return nil, errMissingKeyPassphrase
+	}
+	encrypted, err := ioutil.ReadFile(c.config.KeyEncryptedFile)
+	if err != nil {
+		return nil, err
+	}
+	passphrase, err := c.config.KeyPassphraseFunc()
+	if err != nil {
+		return nil, err
+	}
+	key, err := crypto.DecryptKey(encrypted, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt key file %s: %w", c.config.KeyEncryptedFile, err)
+	}
+	return key, nil
+}
+
+// do executes the given request. If the server rejects the request with a 401 and its time (see
+// server.HeaderServerTime) differs significantly from the local time, the request is retried once with a
+// corrected HMAC timestamp. Since requests whose body cannot be replayed (e.g. uploads) cannot be retried,
+// the clock skew is fetched from the server before sending them (see syncClock). If they are rejected
+// nonetheless, ErrClockSkew is returned.
+func (c *Client) do(client *http.Client, req *http.Request, key *crypto.Key) (*http.Response, error) {
+	if req.Body != nil && req.GetBody == nil && req.Header.Get("Authorization") != "" {
+		if err := c.syncClock(client, req, key); err != nil {
+			return nil, err
+		}
+	}
+	resp, err := c.send(client, req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	skew, ok := c.detectClockSkew(resp)
+	if !ok {
+		return resp, nil
+	}
+	atomic.StoreInt64(&c.timeOffset, int64(skew.Seconds()))
+	if req.Body != nil && req.GetBody == nil {
+		resp.Body.Close()
+		return nil, &ErrClockSkew{Skew: skew}
+	}
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		retry.Body, err = req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := c.addAuthHeader(retry, key); err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	resp, err = c.send(client, retry)
+	if err != nil {
+		return nil, err
+	} else if resp.StatusCode == http.StatusUnauthorized {
+		if _, stillSkewed := c.detectClockSkew(resp); stillSkewed {
+			resp.Body.Close()
+			return nil, &ErrClockSkew{Skew: skew}
+		}
+	}
+	return resp, nil
+}
+
+// syncClock fetches the server time from the /info endpoint (see server.HeaderServerTime) and re-signs the given
+// request with a corrected HMAC timestamp if the local clock is off by too much. This is only done once per
+// client. If the server time cannot be determined, the request is left unchanged.
+func (c *Client) syncClock(client *http.Client, req *http.Request, key *crypto.Key) error {
+	if !atomic.CompareAndSwapInt32(&c.clockSync, 0, 1) {
+		return nil
+	}
+	infoReq, err := http.NewRequestWithContext(req.Context(), http.MethodGet, fmt.Sprintf("%s/info", config.ExpandServerAddr(c.config.ServerAddr)), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.send(client, infoReq)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	skew, ok := c.detectClockSkew(resp)
+	if !ok {
+		return nil
+	}
+	atomic.StoreInt64(&c.timeOffset, int64(skew.Seconds()))
+	return c.addAuthHeader(req, key)
+}
+
+// send executes the given request and remembers if the server reported that the request was authorized using
+// a previous (rotated) key, see KeyRotated. If the server certificate does not match the pinned certificate,
+// ErrPinnedCertMismatch is returned.
+func (c *Client) send(client *http.Client, req *http.Request) (*http.Response, error) {
+	resp, err := client.Do(req)
+	if err != nil && c.config.CertFile != "" && isCertError(err) {
+		return nil, &ErrPinnedCertMismatch{CertFile: c.config.CertFile, Err: err}
+	} else if err == nil && resp.Header.Get(server.HeaderKeyRotated) == server.HeaderKeyRotatedEnabled {
+		atomic.StoreInt32(&c.keyRotated, 1)
+	}
+	return resp, err
+}
+
+// KeyRotated returns true if the server reported that the clipboard key was rotated, and that this client
+// authenticated using a previous key. The client should re-join the clipboard to pick up the new key.
+func (c *Client) KeyRotated() bool {
+	return atomic.LoadInt32(&c.keyRotated) == 1
+}
+
+// detectClockSkew compares the server time in the response with the local time and returns the
+// difference if it is larger than the tolerated clock skew.
+func (c *Client) detectClockSkew(resp *http.Response) (time.Duration, bool) {
+	serverTime, err := strconv.ParseInt(resp.Header.Get(server.HeaderServerTime), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	skew := time.Duration(serverTime-time.Now().Unix()) * time.Second
+	correctedSkew := skew - time.Duration(atomic.LoadInt64(&c.timeOffset))*time.Second
+	if correctedSkew < clockSkewTolerance && correctedSkew > -clockSkewTolerance {
+		return skew, false
+	}
+	return skew, true
+}
+
 func (c *Client) withProgressReader(reader io.ReadCloser, total int64) io.ReadCloser {
 	if c.config.ProgressFunc != nil {
 		return util.NewProgressReader(reader, total, c.config.ProgressFunc)
@@ -312,12 +626,18 @@ func (c *Client) parseFileInfoResponse(resp *http.Response) (*server.File, error
 	if err != nil {
 		ttl = 0
 	}
+	var secrets []string
+	if resp.Header.Get(server.HeaderSecrets) != "" {
+		secrets = strings.Split(resp.Header.Get(server.HeaderSecrets), ",")
+	}
 	return &server.File{
 		File:    resp.Header.Get(server.HeaderFile),
 		URL:     resp.Header.Get(server.HeaderURL),
 		Expires: time.Unix(expires, 0),
 		TTL:     time.Duration(ttl) * time.Second,
-		Curl:    resp.Header.Get(server.HeaderCurl),
+		Curl:    c.localCurlCommand(resp.Header.Get(server.HeaderCurl)),
+		Secrets: secrets,
+		Burn:    resp.Header.Get(server.HeaderBurn) == server.HeaderBurnEnabled,
 	}, nil
 }
 
@@ -336,7 +656,15 @@ func (c *Client) retrieveInfo(client *http.Client) (*server.Info, error) {
 	return &info, nil
 }
 
-// retrieveCert opens a raw TLS connection and retrieves the leaf certificate
+// RetrieveCert retrieves the server certificate (or the CA that issued it) without verifying it, so that it can
+// be pinned, see retrieveCert. The certificate must be verified out of band, e.g. via its fingerprint.
+func (c *Client) RetrieveCert() (*x509.Certificate, error) {
+	return c.retrieveCert()
+}
+
+// retrieveCert opens a raw TLS connection and retrieves the certificate to pin. If the server certificate
+// was issued by a self-signed CA that is part of the certificate chain, the CA certificate is returned, so that
+// the server certificate can be renewed without breaking the pin. Otherwise, the leaf certificate is returned.
 func (c *Client) retrieveCert() (*x509.Certificate, error) {
 	u, err := url.Parse(config.ExpandServerAddr(c.config.ServerAddr))
 	if err != nil {
@@ -354,28 +682,86 @@ func (c *Client) retrieveCert() (*x509.Certificate, error) {
 	}
 	defer conn.Close()
 
-	if len(conn.ConnectionState().PeerCertificates) == 0 {
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
 		return nil, errNoPeerCert
 	}
-	return conn.ConnectionState().PeerCertificates[0], nil
+	if ca := certs[len(certs)-1]; len(certs) > 1 && crypto.IsCA(ca) {
+		roots := x509.NewCertPool()
+		roots.AddCert(ca)
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1 : len(certs)-1] {
+			intermediates.AddCert(cert)
+		}
+		opts := x509.VerifyOptions{DNSName: u.Hostname(), Roots: roots, Intermediates: intermediates}
+		if _, err := certs[0].Verify(opts); err == nil {
+			return ca, nil
+		}
+	}
+	return certs[0], nil
+}
+
+// localCurlCommand replaces the pinned server public key in a curl command (see --pinnedpubkey) with the
+// locally pinned CA certificate (see --cacert), if there is one, so that the command survives cert renewals
+func (c *Client) localCurlCommand(curl string) string {
+	if c.config.CertFile == "" || !curlPinnedPubKeyRegex.MatchString(curl) {
+		return curl
+	}
+	cert, err := crypto.LoadCertFromFile(c.config.CertFile)
+	if err != nil || !crypto.IsCA(cert) {
+		return curl
+	}
+	return curlPinnedPubKeyRegex.ReplaceAllLiteralString(curl, fmt.Sprintf("-sSL --cacert '%s'", c.config.CertFile))
 }
 
 func (c *Client) newHTTPClient(cert *x509.Certificate) (*http.Client, error) {
 	if c.httpClient != nil { // For testing only!
 		return c.httpClient, nil
-	} else if cert != nil {
-		return util.NewHTTPClientWithPinnedCert(cert)
+	}
+	var client *http.Client
+	var err error
+	if cert != nil {
+		client, err = util.NewHTTPClientWithPinnedCert(cert)
 	} else if c.config.CertFile != "" {
-		cert, err := crypto.LoadCertFromFile(c.config.CertFile)
+		cert, err = crypto.LoadCertFromFile(c.config.CertFile)
 		if err != nil {
 			return nil, err
 		}
-		return util.NewHTTPClientWithPinnedCert(cert)
+		client, err = util.NewHTTPClientWithPinnedCert(cert)
 	} else {
-		return util.NewHTTPClient(), nil
+		client = util.NewHTTPClient()
 	}
+	if err != nil {
+		return nil, err
+	}
+	return c.withClientCert(client)
 }
 
+// withClientCert loads the TLS client certificate and key (if configured) and adds them to the given client
+func (c *Client) withClientCert(client *http.Client) (*http.Client, error) {
+	if c.config.ClientCertFile == "" {
+		return client, nil
+	}
+	keyFile := c.config.ClientKeyFile
+	if keyFile == "" {
+		keyFile = c.config.ClientCertFile // Cert and key may be in the same PEM file
+	}
+	clientCert, err := tls.LoadX509KeyPair(c.config.ClientCertFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load client certificate: %w", err)
+	}
+	return util.WithClientCert(client, clientCert), nil
+}
+
+// isCertError returns true if the error is the result of a failed TLS certificate verification
+func isCertError(err error) bool {
+	return errors.Is(err, util.ErrPinnedCertMismatch) || errors.As(err, &x509.UnknownAuthorityError{}) ||
+		errors.As(err, &x509.HostnameError{}) || errors.As(err, &x509.CertificateInvalidError{})
+}
+
+var curlPinnedPubKeyRegex = regexp.MustCompile(`-sSLk --pinnedpubkey \S+`)
+
 var errMissingServerAddr = errors.New("server address missing")
+var errMissingKeyPassphrase = errors.New("key file is encrypted, but no passphrase was provided")
 var errResponseBodyEmpty = errors.New("response body was empty")
 var errNoPeerCert = errors.New("no peer cert found")
@@ -5,7 +5,10 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"heckel.io/pcopy/clipboard/clipboardtest"
 	"heckel.io/pcopy/config"
+	"heckel.io/pcopy/config/configtest"
 	"heckel.io/pcopy/crypto"
 	"heckel.io/pcopy/server"
 	"heckel.io/pcopy/test"
@@ -16,6 +19,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -38,12 +42,31 @@ func TestClient_CopyNoAuthSuccess(t *testing.T) {
 	}
 }
 
+func TestClient_CopyAllowSecrets(t *testing.T) {
+	conf := config.New()
+	client, serv := newTestClientAndServer(t, conf, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(server.HeaderAllowSecrets) != server.HeaderAllowSecretsEnabled {
+			t.Fatalf("expected %s header, got none", server.HeaderAllowSecrets)
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer serv.Close()
+
+	client.SetAllowSecrets(true)
+	if _, err := client.Copy(ioutil.NopCloser(strings.NewReader("password=hunter2")), "default", time.Hour, config.FileModeReadWrite, false); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestClient_CopyWithHMACAuthSuccess(t *testing.T) {
 	conf := config.New()
 	conf.Key = crypto.DeriveKey([]byte("some password"), []byte("some salt"))
 	client, serv := newTestClientAndServer(t, conf, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Only check that HMAC header is there, the in-depth tests are in the server package
 
+		if r.URL.Path == "/info" {
+			return // Clock skew is fetched before the upload, see syncClock
+		}
 		if r.URL.Path != "/hi-there" {
 			t.Fatalf("expected path %s, got %s", "/hi-there", r.URL.Path)
 		}
@@ -312,6 +335,96 @@ func TestClient_VerifyWithPinnedCertNoAuthSuccess(t *testing.T) {
 	}
 }
 
+func TestClient_PasteWithClockSkewRetrySuccess(t *testing.T) {
+	conf := config.New()
+	conf.Key = crypto.DeriveKey([]byte("some password"), []byte("some salt"))
+	serverTime := time.Now().Add(10 * time.Minute)
+	requests := 0
+	auths := make([]string, 0)
+	client, serv := newTestClientAndServer(t, conf, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		auths = append(auths, r.Header.Get("Authorization"))
+		var timestamp int64
+		fmt.Sscanf(r.Header.Get("Authorization"), "HMAC %d", &timestamp)
+		if timestamp < serverTime.Add(-time.Minute).Unix() {
+			w.Header().Set(server.HeaderServerTime, fmt.Sprintf("%d", serverTime.Unix()))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("in sync now"))
+	}))
+	defer serv.Close()
+
+	var buf bytes.Buffer
+	if err := client.Paste(&buf, "default"); err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, "in sync now", buf.String())
+	test.Int64Equals(t, 2, int64(requests))
+	if auths[0] == auths[1] {
+		t.Fatalf("expected retry to carry a new signature, got %s twice", auths[0])
+	}
+}
+
+func TestClient_CopyWithClockSkewFailure(t *testing.T) {
+	conf := config.New()
+	conf.Key = crypto.DeriveKey([]byte("some password"), []byte("some salt"))
+	client, serv := newTestClientAndServer(t, conf, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/info" {
+			w.WriteHeader(http.StatusNotFound) // Server time cannot be fetched before the upload
+			return
+		}
+		w.Header().Set(server.HeaderServerTime, fmt.Sprintf("%d", time.Now().Add(-5*time.Minute).Unix()))
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer serv.Close()
+
+	var skewErr *ErrClockSkew
+	_, err := client.Copy(io.NopCloser(&bytes.Buffer{}), "default", time.Hour, config.FileModeReadWrite, false)
+	if !errors.As(err, &skewErr) {
+		t.Fatalf("expected ErrClockSkew, got %#v", err)
+	}
+	test.StrContains(t, err.Error(), "clock skew of -300 seconds")
+}
+
+func TestClient_CopyWithClockSkewSyncsClockFirst(t *testing.T) {
+	_, serverConf := configtest.NewTestConfig(t)
+	serverConf.Key = crypto.DeriveKey([]byte("some password"), []byte("some salt"))
+	srv, err := server.New(serverConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var auths []string
+	conf := config.New()
+	conf.Key = serverConf.Key
+	client, serv := newTestClientAndServer(t, conf, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			auths = append(auths, r.Header.Get("Authorization"))
+		}
+		srv.Handle(w, r)
+	}))
+	defer serv.Close()
+
+	// Local clock is 10 minutes behind the server, so the first signature would be rejected
+	client.timeOffset = -600
+	staleAuth, _ := crypto.GenerateAuthHMACWithTime(time.Now().Add(-10*time.Minute), conf.Key.Bytes, "PUT", "/default", useDefaultAuthTTL)
+
+	if _, err := client.Copy(io.NopCloser(strings.NewReader("skewed upload")), "default", time.Hour, config.FileModeReadWrite, false); err != nil {
+		t.Fatal(err)
+	}
+	test.Int64Equals(t, 1, int64(len(auths)))
+	if auths[0] == staleAuth {
+		t.Fatalf("expected upload to be signed with corrected timestamp, got stale signature %s", auths[0])
+	}
+	var timestamp int64
+	fmt.Sscanf(auths[0], "HMAC %d", &timestamp)
+	if timestamp < time.Now().Add(-time.Minute).Unix() {
+		t.Fatalf("expected corrected HMAC timestamp, got %d", timestamp)
+	}
+	test.Int64Equals(t, 0, atomic.LoadInt64(&client.timeOffset))
+	clipboardtest.Content(t, serverConf, "default", "skewed upload")
+}
+
 func newTestClientAndServer(t *testing.T, conf *config.Config, handler http.Handler) (*Client, *httptest.Server) {
 	serv := httptest.NewTLSServer(handler)
 	conf.ServerAddr = config.ExpandServerAddr(serv.URL)
@@ -8,12 +8,13 @@ import (
 	"fmt"
 	"golang.org/x/sys/unix"
 	"heckel.io/pcopy/config"
+	"heckel.io/pcopy/log"
 	"heckel.io/pcopy/util"
 	"io"
 	"io/fs"
 	"io/ioutil"
-	"log"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"syscall"
@@ -26,6 +27,13 @@ const (
 	FileRegexPart = `(?i)([a-z0-9][-_.a-z0-9]{1,100})`
 
 	metaFileSuffix = ":meta"
+
+	// quarantineDirName is the name of the directory inside the clipboard dir that holds quarantined files,
+	// see Quarantine. Since it starts with a dot, it cannot collide with a valid file ID.
+	quarantineDirName = ".quarantine"
+
+	// quarantineMaxAge is the age after which left-over quarantined files are removed, see Expire
+	quarantineMaxAge = 6 * time.Hour
 )
 
 var (
@@ -36,7 +44,7 @@ var (
 	ErrInvalidFileID = errors.New("invalid file id")
 
 	validIDRegex               = regexp.MustCompile("^" + FileRegexPart + "$")
-	reservedFiles              = []string{"help", "version", "info", "verify", "random", "curl", "nc", "static", "robots.txt", "favicon.ico"}
+	reservedFiles              = []string{"help", "version", "info", "verify", "random", "curl", "nc", "metrics", "healthz", "readyz", "static", "robots.txt", "favicon.ico"}
 	errClipboardDirNotWritable = errors.New("clipboard dir not writable by user")
 )
 
@@ -63,6 +71,17 @@ type File struct {
 	Mode    string    `json:"mode"`
 	Expires int64     `json:"expires"`
 	Secret  string    `json:"secret"`
+	Slot    bool      `json:"slot,omitempty"`    // Upload slot that has not been uploaded to yet, see server.HeaderReserveSlot
+	MaxSize int64     `json:"maxSize,omitempty"` // Per-file size limit, in addition to the configured FileSizeLimit
+	Burn    bool      `json:"burn,omitempty"`    // Deleted after the first download, see config.SecretDetectionBurn
+}
+
+// QuarantinedFile is a file that was written to the quarantine directory, and is not visible in the clipboard
+// until it is published, see Quarantine
+type QuarantinedFile struct {
+	ID       string
+	Path     string // Path of the quarantined file, e.g. to scan it
+	metaPath string
 }
 
 // New creates a new Clipboard using the given config
@@ -96,23 +115,77 @@ func (c *Clipboard) DeleteFile(id string) error {
 	return nil
 }
 
-// Expire will use List to list all clipboard entries and delete the ones that have expired
-func (c *Clipboard) Expire() error {
+// Expire will use List to list all clipboard entries and delete the ones that have expired. It returns the
+// list of deleted entries.
+func (c *Clipboard) Expire() ([]*File, error) {
 	entries, err := c.List()
 	if err != nil {
-		return err
+		return nil, err
 	}
+	expired := make([]*File, 0)
 	for _, entry := range entries {
 		if entry.Expires == 0 || time.Until(time.Unix(entry.Expires, 0)) > 0 {
 			continue
 		}
 		if err := c.DeleteFile(entry.ID); err != nil {
-			log.Printf("failed to remove clipboard entry after expiry: %s", err.Error())
+			c.logger().With("id", entry.ID, "error", err).Error("failed to remove clipboard entry after expiry")
 			continue
 		}
-		log.Printf("removed expired entry: %s (%s)", entry.ID, util.BytesToHuman(entry.Size))
+		c.logger().With("id", entry.ID).Info("removed expired entry (%s)", util.BytesToHuman(entry.Size))
+		expired = append(expired, entry)
 	}
-	return nil
+	c.expireQuarantine()
+	return expired, nil
+}
+
+// expireQuarantine removes quarantined files that were left behind, e.g. because the server was stopped while
+// a file was being scanned
+func (c *Clipboard) expireQuarantine() {
+	dir := filepath.Join(c.config.ClipboardDir, quarantineDirName)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if time.Since(f.ModTime()) > quarantineMaxAge {
+			os.Remove(filepath.Join(dir, f.Name()))
+		}
+	}
+}
+
+// SetExpires updates the expiry time (Unix timestamp) of the file with the given ID in its metadata file.
+// An expiry time of 0 means that the file never expires.
+func (c *Clipboard) SetExpires(id string, expires int64) error {
+	cf, err := c.Stat(id)
+	if err != nil {
+		return err
+	}
+	_, metafile, err := c.getFilenames(id)
+	if err != nil {
+		return err
+	}
+	cf.Expires = expires
+	mf, err := os.OpenFile(metafile, os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer mf.Close()
+	return json.NewEncoder(mf).Encode(cf)
+}
+
+// Writable returns an error if the clipboard directory is not writable, e.g. due to missing permissions
+// or because it is on a read-only file system
+func (c *Clipboard) Writable() error {
+	return unix.Access(c.config.ClipboardDir, unix.W_OK)
+}
+
+// FreeSpace returns the number of bytes available on the file system of the clipboard directory
+func (c *Clipboard) FreeSpace() (int64, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(c.config.ClipboardDir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
 }
 
 // Stats returns statistics about the current clipboard. It also updates the limiters with the current
@@ -139,10 +212,10 @@ func (c *Clipboard) List() ([]*File, error) {
 		return nil, err
 	}
 	for _, f := range files {
-		if !strings.HasSuffix(f.Name(), metaFileSuffix) {
+		if !f.IsDir() && !strings.HasSuffix(f.Name(), metaFileSuffix) {
 			cf, err := c.Stat(f.Name())
 			if err != nil {
-				log.Printf("error reading metadata for %s: %s", f.Name(), err.Error())
+				c.logger().With("id", f.Name(), "error", err).Warn("error reading metadata")
 				continue
 			}
 			entries = append(entries, cf)
@@ -171,7 +244,7 @@ func (c *Clipboard) Stat(id string) (*File, error) {
 
 	var cf File
 	if err := json.NewDecoder(mf).Decode(&cf); err != nil {
-		log.Printf("error reading meta file for %s: %s", id, err.Error())
+		c.logger().With("id", id, "error", err).Warn("error reading meta file")
 		cf.Expires = int64(c.config.FileExpireAfterDefault.Seconds())
 	}
 	cf.ID = id
@@ -189,15 +262,67 @@ func (c *Clipboard) Allow() bool {
 }
 
 // WriteFile writes the entire content of rc to the clipboard entry as well as a metadata file.
-// The method observes the per-file size limit as defined in the config, as well as the total clipboard
-// size limit. If a limit is reached, it will return util.ErrLimitReached. When the target file is a FIFO
+// The method observes the per-file size limit as defined in the config (and in meta.MaxSize, if set), as well
+// as the total clipboard size limit. If a limit is reached, it will return util.ErrLimitReached. When the target file is a FIFO
 // pipe (see MakePipe) and the consumer prematurely interrupts reading, ErrBrokenPipe may be returned.
 func (c *Clipboard) WriteFile(id string, meta *File, rc io.ReadCloser) error {
 	file, metafile, err := c.getFilenames(id)
 	if err != nil {
 		return err
 	}
+	return c.writeFile(file, metafile, meta, rc)
+}
+
+// Quarantine is like WriteFile, but writes the file to the quarantine directory instead of the clipboard, so that
+// it can be checked (e.g. scanned for viruses) before it becomes visible. The quarantined file must then either be
+// published via Publish, or removed via Discard.
+func (c *Clipboard) Quarantine(id string, meta *File, rc io.ReadCloser) (*QuarantinedFile, error) {
+	if !c.isValidID(id) {
+		return nil, ErrInvalidFileID
+	}
+	dir := filepath.Join(c.config.ClipboardDir, quarantineDirName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(dir, id+".*")
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	q := &QuarantinedFile{ID: id, Path: f.Name(), metaPath: f.Name() + metaFileSuffix}
+	if err := c.writeFile(q.Path, q.metaPath, meta, rc); err != nil {
+		c.Discard(q)
+		return nil, err
+	}
+	return q, nil
+}
+
+// Publish moves a quarantined file (see Quarantine) to the clipboard, so that it becomes visible. The metadata file
+// is moved first, since a file without a metadata file is removed by Stat.
+func (c *Clipboard) Publish(q *QuarantinedFile) error {
+	file, metafile, err := c.getFilenames(q.ID)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(q.metaPath, metafile); err != nil {
+		c.Discard(q)
+		return err
+	}
+	if err := os.Rename(q.Path, file); err != nil {
+		os.Remove(metafile)
+		c.Discard(q)
+		return err
+	}
+	return nil
+}
+
+// Discard removes a quarantined file (see Quarantine), including its metadata file
+func (c *Clipboard) Discard(q *QuarantinedFile) error {
+	os.Remove(q.metaPath)
+	return os.Remove(q.Path)
+}
 
+func (c *Clipboard) writeFile(file string, metafile string, meta *File, rc io.ReadCloser) error {
 	// Write metadata file
 	mf, err := os.OpenFile(metafile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
 	if err != nil {
@@ -216,10 +341,12 @@ func (c *Clipboard) WriteFile(id string, meta *File, rc io.ReadCloser) error {
 	defer f.Close()
 
 	fileSizeLimiter := util.NewLimiter(c.config.FileSizeLimit)
-	limitWriter := util.NewLimitWriter(f, fileSizeLimiter, c.sizeLimiter)
+	maxSizeLimiter := util.NewLimiter(meta.MaxSize)
+	limitWriter := util.NewLimitWriter(f, fileSizeLimiter, maxSizeLimiter, c.sizeLimiter)
 
 	if _, err := io.Copy(limitWriter, rc); err != nil {
-		c.DeleteFile(id)
+		os.Remove(metafile)
+		os.Remove(file)
 		if pe, ok := err.(*fs.PathError); ok {
 			err = pe.Err
 		}
@@ -233,7 +360,8 @@ func (c *Clipboard) WriteFile(id string, meta *File, rc io.ReadCloser) error {
 	}
 
 	if err := rc.Close(); err != nil {
-		c.DeleteFile(id)
+		os.Remove(metafile)
+		os.Remove(file)
 		return err
 	}
 
@@ -249,6 +377,20 @@ func (c *Clipboard) MakePipe(id string) error {
 	return unix.Mkfifo(file, 0600)
 }
 
+// ClosePipe unblocks a writer that is waiting for a reader to open the FIFO created by MakePipe, by briefly
+// opening and closing the FIFO for reading. The writer's next write then fails with ErrBrokenPipe.
+func (c *Clipboard) ClosePipe(id string) error {
+	file, _, err := c.getFilenames(id)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
 // ReadFile reads the file content from the clipboard and writes it to w
 func (c *Clipboard) ReadFile(id string, w io.Writer) error {
 	file, _, err := c.getFilenames(id)
@@ -273,6 +415,11 @@ func (c *Clipboard) getFilenames(id string) (string, string, error) {
 	return file, file + metaFileSuffix, nil
 }
 
+// logger returns a log entry with a field identifying the clipboard
+func (c *Clipboard) logger() *log.Entry {
+	return log.With("clipboard", config.CollapseServerAddr(c.config.ServerAddr))
+}
+
 func (c *Clipboard) isValidID(id string) bool {
 	if !validIDRegex.MatchString(id) {
 		return false
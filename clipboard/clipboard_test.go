@@ -38,6 +38,18 @@ func TestClipboard_WriteFile_FileSizeLimitReached(t *testing.T) {
 	test.FileNotExist(t, metafile)
 }
 
+func TestClipboard_WriteFile_MetaMaxSizeReached(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.FileSizeLimit = 100
+	clip, _ := New(conf)
+	meta := &File{Mode: config.FileModeReadWrite, MaxSize: 10}
+	if err := clip.WriteFile("sup", meta, io.NopCloser(strings.NewReader("this is more than 10 bytes"))); err != util.ErrLimitReached {
+		t.Fatalf("expected ErrLimitReached, but that didn't happen")
+	}
+	file, _, _ := clip.getFilenames("sup")
+	test.FileNotExist(t, file)
+}
+
 func TestClipboard_WriteFile_ClipboardSizeLimitReached(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
 	conf.FileSizeLimit = 10
@@ -94,7 +106,9 @@ func TestClipboard_Expire(t *testing.T) {
 	stat, _ := clip.Stat("sup")
 	test.StrEquals(t, "sup", stat.ID)
 
-	clip.Expire()
+	expired, _ := clip.Expire()
+	test.Int64Equals(t, 1, int64(len(expired)))
+	test.StrEquals(t, "sup", expired[0].ID)
 
 	stat, _ = clip.Stat("sup")
 	if stat != nil {
@@ -102,6 +116,52 @@ func TestClipboard_Expire(t *testing.T) {
 	}
 }
 
+func TestClipboard_SetExpiresPinsFile(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	clip, _ := New(conf)
+
+	meta := &File{Mode: config.FileModeReadWrite, Expires: time.Now().Add(-time.Hour).Unix(), Secret: "s3cret"}
+	clip.WriteFile("sup", meta, io.NopCloser(strings.NewReader("7 bytes")))
+
+	if err := clip.SetExpires("sup", 0); err != nil {
+		t.Fatal(err)
+	}
+	expired, _ := clip.Expire()
+	test.Int64Equals(t, 0, int64(len(expired)))
+
+	stat, _ := clip.Stat("sup")
+	test.Int64Equals(t, 0, stat.Expires)
+	test.StrEquals(t, "s3cret", stat.Secret)
+	test.StrEquals(t, config.FileModeReadWrite, stat.Mode)
+}
+
+func TestClipboard_QuarantinePublishDiscard(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	clip, _ := New(conf)
+
+	meta := &File{Mode: config.FileModeReadWrite}
+	q, err := clip.Quarantine("sup", meta, io.NopCloser(strings.NewReader("quarantined")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.FileExist(t, q.Path)
+	clipboardtest.NotExist(t, conf, "sup")
+	entries, _ := clip.List()
+	test.Int64Equals(t, 0, int64(len(entries)))
+
+	if err := clip.Publish(q); err != nil {
+		t.Fatal(err)
+	}
+	test.FileNotExist(t, q.Path)
+	clipboardtest.Content(t, conf, "sup", "quarantined")
+
+	q, _ = clip.Quarantine("other", meta, io.NopCloser(strings.NewReader("rejected")))
+	clip.Discard(q)
+	test.FileNotExist(t, q.Path)
+	test.FileNotExist(t, q.metaPath)
+	clipboardtest.NotExist(t, conf, "other")
+}
+
 func TestClipboard_MakePipe(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
 	clip, _ := New(conf)
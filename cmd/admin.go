@@ -0,0 +1,461 @@
+package cmd
+
+import (
+	"crypto/subtle"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"heckel.io/pcopy/client"
+	"heckel.io/pcopy/config"
+	"heckel.io/pcopy/crypto"
+	"heckel.io/pcopy/server"
+	"heckel.io/pcopy/util"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var cmdAdmin = &cli.Command{
+	Name:     "admin",
+	Usage:    "Manage a running server via its admin API",
+	Category: categoryServer,
+	Subcommands: []*cli.Command{
+		{
+			Name:      "clipboard",
+			Usage:     "Add, remove or list clipboards of a running server",
+			ArgsUsage: "COMMAND",
+			Subcommands: []*cli.Command{
+				{
+					Name:      "add",
+					Usage:     "Add a clipboard to the running server",
+					ArgsUsage: "NAME",
+					Action:    execAdminClipboardAdd,
+					Flags: adminFlags(
+						&cli.BoolFlag{Name: "password", Aliases: []string{"p"}, Usage: "ask for a password to protect the clipboard"},
+						&cli.StringFlag{Name: "dir", Aliases: []string{"d"}, Usage: "clipboard directory, defaults to a sibling of the server's clipboard directory"},
+						&cli.StringFlag{Name: "path", Usage: "base path `PATH` of the clipboard, defaults to /NAME"},
+						&cli.StringFlag{Name: "size-limit", Usage: "total clipboard size limit, e.g. 500M"},
+						&cli.IntFlag{Name: "count-limit", Usage: "maximum number of files in the clipboard"},
+						&cli.StringFlag{Name: "file-size-limit", Usage: "per-file size limit, e.g. 10M"},
+						&cli.StringFlag{Name: "expire-after", Usage: "`DURATION` after which files expire, e.g. 24h"},
+					),
+				},
+				{
+					Name:      "remove",
+					Aliases:   []string{"rm"},
+					Usage:     "Remove a clipboard from the running server",
+					ArgsUsage: "NAME",
+					Action:    execAdminClipboardRemove,
+					Flags: adminFlags(
+						&cli.BoolFlag{Name: "purge", Usage: "also delete the clipboard directory"},
+					),
+				},
+				{
+					Name:    "list",
+					Aliases: []string{"ls"},
+					Usage:   "List the clipboards of the running server",
+					Action:  execAdminClipboardList,
+					Flags:   adminFlags(),
+				},
+			},
+		},
+		{
+			Name:      "entry",
+			Usage:     "List, delete or change the expiry of clipboard entries",
+			ArgsUsage: "COMMAND",
+			Subcommands: []*cli.Command{
+				{
+					Name:    "list",
+					Aliases: []string{"ls"},
+					Usage:   "List the entries of a clipboard",
+					Action:  execAdminEntryList,
+					Flags:   adminClipboardFlags(),
+				},
+				{
+					Name:      "delete",
+					Aliases:   []string{"rm"},
+					Usage:     "Delete an entry, regardless of its mode or file password",
+					ArgsUsage: "ID",
+					Action:    execAdminEntryDelete,
+					Flags:     adminClipboardFlags(),
+				},
+				{
+					Name:      "ttl",
+					Usage:     "Change the time until an entry expires, counting from now",
+					ArgsUsage: "ID DURATION",
+					Action:    execAdminEntryTTL,
+					Flags:     adminClipboardFlags(),
+				},
+				{
+					Name:      "pin",
+					Usage:     "Pin an entry, so that it never expires",
+					ArgsUsage: "ID",
+					Action:    execAdminEntryPin,
+					Flags:     adminClipboardFlags(),
+				},
+			},
+		},
+		{
+			Name:   "stats",
+			Usage:  "Show the usage of a clipboard, and its visitors",
+			Action: execAdminStats,
+			Flags:  adminClipboardFlags(),
+		},
+		{
+			Name:   "expire",
+			Usage:  "Remove expired entries of a clipboard right away",
+			Action: execAdminExpire,
+			Flags:  adminClipboardFlags(),
+		},
+	},
+	Description: `Manages a running server via its admin API, without restarting it.
+
+The admin API must be enabled in the server config via 'AdminListenAddr' and 'AdminKey' (see
+'pcopy keygen'). By default, this command reads both from the server config (default:
+~/.config/pcopy/server.conf or /etc/pcopy/server.conf). To manage a server on another host, pass
+its admin address via --addr, and the admin key via the PCOPY_ADMIN_KEY variable. Note that the
+admin API is served via plain HTTP, so it should only be reachable via a trusted network, unless
+'AdminListenAddr' has the /https suffix. In that case, pass ADDR/https to --addr, and the server
+certificate to pin via --cert (if it is not trusted by the system).
+
+New clipboards inherit the settings of the server config, and are served on the same listen
+addresses under the base path /NAME. Their config files are written to 'AdminConfigDir', so that
+they are loaded again when the server is restarted. Only clipboards added this way can be removed.
+
+The entry, stats and expire commands target the server's own clipboard, unless another clipboard
+is selected via --clipboard, either by name (for clipboards added via 'pcopy admin clipboard add'),
+or by server address (see 'pcopy admin clipboard list').
+
+Examples:
+  pcopy admin clipboard add team1              # Adds an unprotected clipboard at /team1
+  pcopy admin clipboard add -p --expire-after 24h team2  # Adds a protected clipboard at /team2
+  pcopy admin clipboard list                   # Lists all clipboards of the server
+  pcopy admin clipboard remove --purge team1   # Removes the clipboard, and deletes its files
+  pcopy admin entry list -C team1              # Lists the entries of clipboard team1
+  pcopy admin entry ttl report.pdf 7d          # Entry 'report.pdf' expires in 7 days
+  pcopy admin entry pin report.pdf             # Entry 'report.pdf' never expires
+  pcopy admin stats                            # Shows usage and visitors of the server's clipboard
+  PCOPY_ADMIN_KEY=.. pcopy admin stats -a 10.0.0.1:2587  # Talks to a remote admin API
+  PCOPY_ADMIN_KEY=.. pcopy admin stats -a 10.0.0.1:2587/https --cert server.crt  # .. via HTTPS`,
+}
+
+// adminFlags returns the flags that all admin commands share, followed by the given flags
+func adminFlags(flags ...cli.Flag) []cli.Flag {
+	return append([]cli.Flag{
+		&cli.StringFlag{Name: "config", Aliases: []string{"c"}, Usage: "load admin address and key from server config `FILE`"},
+		&cli.StringFlag{Name: "addr", Aliases: []string{"a"}, Usage: "admin API address `ADDR` of a remote server, requires PCOPY_ADMIN_KEY"},
+		&cli.StringFlag{Name: "cert", Usage: "pin server certificate `FILE` if the remote admin API is served via HTTPS"},
+	}, flags...)
+}
+
+// adminClipboardFlags returns the flags of admin commands that target a single clipboard
+func adminClipboardFlags() []cli.Flag {
+	return adminFlags(
+		&cli.StringFlag{Name: "clipboard", Aliases: []string{"C"}, Usage: "target clipboard `NAME` or server address, defaults to the server's own clipboard"},
+	)
+}
+
+func execAdminClipboardAdd(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return cli.Exit("error: clipboard name missing, see 'pcopy admin clipboard add --help'", 1)
+	}
+	adminClient, err := newAdminClient(c)
+	if err != nil {
+		return err
+	}
+	req := &server.AdminClipboardRequest{
+		Name:                c.Args().First(),
+		Dir:                 c.String("dir"),
+		BasePath:            c.String("path"),
+		ClipboardCountLimit: c.Int("count-limit"),
+	}
+	if c.String("size-limit") != "" {
+		if req.ClipboardSizeLimit, err = util.ParseSize(c.String("size-limit")); err != nil {
+			return err
+		}
+	}
+	if c.String("file-size-limit") != "" {
+		if req.FileSizeLimit, err = util.ParseSize(c.String("file-size-limit")); err != nil {
+			return err
+		}
+	}
+	if c.String("expire-after") != "" {
+		expireAfter, err := util.ParseDuration(c.String("expire-after"))
+		if err != nil {
+			return err
+		}
+		req.FileExpireAfter = int64(expireAfter.Seconds())
+	}
+	if c.Bool("password") {
+		key, err := readAndGenerateKey(c)
+		if err != nil {
+			return err
+		}
+		req.Key = crypto.EncodeKey(key)
+	}
+	clipboard, err := adminClient.AddClipboard(req)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.ErrWriter, "Clipboard %s added at %s (dir: %s).\n", clipboard.Name, clipboard.URL, clipboard.Dir)
+	return nil
+}
+
+func execAdminClipboardRemove(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return cli.Exit("error: clipboard name missing, see 'pcopy admin clipboard remove --help'", 1)
+	}
+	adminClient, err := newAdminClient(c)
+	if err != nil {
+		return err
+	}
+	name := c.Args().First()
+	if err := adminClient.RemoveClipboard(name, c.Bool("purge")); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.ErrWriter, "Clipboard %s removed.\n", name)
+	return nil
+}
+
+func execAdminClipboardList(c *cli.Context) error {
+	adminClient, err := newAdminClient(c)
+	if err != nil {
+		return err
+	}
+	clipboards, err := adminClient.Clipboards()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(c.App.Writer, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "Name\tURL\tProtected\tManaged\tExpire after\tDir")
+	for _, clipboard := range clipboards {
+		name := clipboard.Name
+		if name == "" {
+			name = "-"
+		}
+		expireAfter := "never"
+		if clipboard.FileExpireAfter > 0 {
+			expireAfter = util.DurationToHuman(time.Duration(clipboard.FileExpireAfter) * time.Second)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", name, clipboard.URL, yesNo(clipboard.Protected), yesNo(clipboard.Managed), expireAfter, clipboard.Dir)
+	}
+	return w.Flush()
+}
+
+func execAdminEntryList(c *cli.Context) error {
+	adminClient, err := newAdminClient(c)
+	if err != nil {
+		return err
+	}
+	entries, err := adminClient.Entries(c.String("clipboard"))
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(c.App.Writer, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "ID\tSize\tModified\tExpires\tMode\tProtected")
+	for _, entry := range entries {
+		size := util.BytesToHuman(entry.Size)
+		if entry.Pipe {
+			size = "(stream)"
+		} else if entry.Slot {
+			size = "(slot)"
+		}
+		modified := time.Unix(entry.Modified, 0).Format("2006-01-02 15:04:05")
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", entry.ID, size, modified, expiresToHuman(entry.Expires), entry.Mode, yesNo(entry.Protected))
+	}
+	return w.Flush()
+}
+
+func execAdminEntryDelete(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return cli.Exit("error: entry ID missing, see 'pcopy admin entry delete --help'", 1)
+	}
+	adminClient, err := newAdminClient(c)
+	if err != nil {
+		return err
+	}
+	id := c.Args().First()
+	if err := adminClient.DeleteEntry(c.String("clipboard"), id); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.ErrWriter, "Entry %s deleted.\n", id)
+	return nil
+}
+
+func execAdminEntryTTL(c *cli.Context) error {
+	if c.NArg() != 2 {
+		return cli.Exit("error: entry ID or duration missing, see 'pcopy admin entry ttl --help'", 1)
+	}
+	ttl, err := util.ParseDuration(c.Args().Get(1))
+	if err != nil {
+		return err
+	} else if ttl < time.Second {
+		return cli.Exit("error: duration must be at least 1s; to keep an entry forever, use 'pcopy admin entry pin'", 1)
+	}
+	return updateAdminEntry(c, &server.AdminEntryRequest{TTL: int64(ttl.Seconds())})
+}
+
+func execAdminEntryPin(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return cli.Exit("error: entry ID missing, see 'pcopy admin entry pin --help'", 1)
+	}
+	return updateAdminEntry(c, &server.AdminEntryRequest{Pin: true})
+}
+
+func updateAdminEntry(c *cli.Context, req *server.AdminEntryRequest) error {
+	adminClient, err := newAdminClient(c)
+	if err != nil {
+		return err
+	}
+	entry, err := adminClient.UpdateEntry(c.String("clipboard"), c.Args().First(), req)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.ErrWriter, "Entry %s expires: %s.\n", entry.ID, expiresToHuman(entry.Expires))
+	return nil
+}
+
+func execAdminStats(c *cli.Context) error {
+	adminClient, err := newAdminClient(c)
+	if err != nil {
+		return err
+	}
+	stats, err := adminClient.Stats(c.String("clipboard"))
+	if err != nil {
+		return err
+	}
+	countLimit, sizeLimit := "no limit", "no limit"
+	if stats.ClipboardCountLimit > 0 {
+		countLimit = fmt.Sprintf("max %d", stats.ClipboardCountLimit)
+	}
+	if stats.ClipboardSizeLimit > 0 {
+		sizeLimit = fmt.Sprintf("max %s", util.BytesToHuman(stats.ClipboardSizeLimit))
+	}
+	fmt.Fprintf(c.App.Writer, "Clipboard:  %s\n", stats.URL)
+	fmt.Fprintf(c.App.Writer, "Files:      %d (%s)\n", stats.Count, countLimit)
+	fmt.Fprintf(c.App.Writer, "Size:       %s (%s)\n", util.BytesToHuman(stats.Size), sizeLimit)
+	fmt.Fprintf(c.App.Writer, "Free space: %s\n", util.BytesToHuman(stats.FreeSpace))
+	if len(stats.LockedIDs) > 0 {
+		fmt.Fprintf(c.App.Writer, "Locked IDs: %s\n", strings.Join(stats.LockedIDs, ", "))
+	}
+	fmt.Fprintf(c.App.Writer, "Visitors:   %d (last 30 minutes)\n", len(stats.Visitors))
+	if len(stats.Visitors) == 0 {
+		return nil
+	}
+	fmt.Fprintln(c.App.Writer)
+	w := tabwriter.NewWriter(c.App.Writer, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "IP\tLast seen\tRate limited\tAuth failures\tLocked until")
+	for _, v := range stats.Visitors {
+		rateLimited := make([]string, 0)
+		if v.RateLimitedGET {
+			rateLimited = append(rateLimited, "GET")
+		}
+		if v.RateLimitedPUT {
+			rateLimited = append(rateLimited, "PUT")
+		}
+		if len(rateLimited) == 0 {
+			rateLimited = append(rateLimited, "no")
+		}
+		lockedUntil := "-"
+		if v.LockedUntil > 0 {
+			lockedUntil = time.Unix(v.LockedUntil, 0).Format("2006-01-02 15:04:05")
+		}
+		lastSeen := time.Unix(v.LastSeen, 0).Format("2006-01-02 15:04:05")
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", v.IP, lastSeen, strings.Join(rateLimited, ", "), v.AuthFailures, lockedUntil)
+	}
+	return w.Flush()
+}
+
+func execAdminExpire(c *cli.Context) error {
+	adminClient, err := newAdminClient(c)
+	if err != nil {
+		return err
+	}
+	expired, err := adminClient.Expire(c.String("clipboard"))
+	if err != nil {
+		return err
+	}
+	for _, entry := range expired {
+		fmt.Fprintf(c.App.ErrWriter, "Removed expired entry %s (%s).\n", entry.ID, util.BytesToHuman(entry.Size))
+	}
+	fmt.Fprintf(c.App.ErrWriter, "%d expired entries removed.\n", len(expired))
+	return nil
+}
+
+// newAdminClient creates an admin client from the --addr and --cert flags and the PCOPY_ADMIN_KEY variable, or if
+// --addr is not given, from the admin settings of the server config. If the admin API of the server config is
+// served via HTTPS, the server certificate (see CertFile) is pinned.
+func newAdminClient(c *cli.Context) (*client.AdminClient, error) {
+	if addr := c.String("addr"); addr != "" {
+		if os.Getenv(config.EnvAdminKey) == "" {
+			return nil, cli.Exit(fmt.Sprintf("error: --addr requires the admin key to be passed via %s", config.EnvAdminKey), 1)
+		}
+		key, err := crypto.DecodeKey(os.Getenv(config.EnvAdminKey))
+		if err != nil {
+			return nil, err
+		}
+		var cert *x509.Certificate
+		if c.String("cert") != "" {
+			if cert, err = crypto.LoadCertFromFile(c.String("cert")); err != nil {
+				return nil, err
+			}
+		}
+		return client.NewAdminClientWithCert(addr, key, cert)
+	}
+	configFile := c.String("config")
+	if configFile == "" {
+		configFile = config.NewStore().FileFromName(defaultServerClipboardName)
+	}
+	if _, err := os.Stat(configFile); err != nil {
+		return nil, cli.Exit(fmt.Sprintf("error: server config file %s does not exist", configFile), 1)
+	}
+	conf, err := config.LoadFromFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	if conf.AdminListenAddr == "" || conf.AdminKey == nil {
+		return nil, cli.Exit(fmt.Sprintf("error: admin API not enabled in %s, see 'AdminListenAddr' and 'AdminKey'", configFile), 1)
+	}
+	if !conf.AdminListenHTTPS {
+		return client.NewAdminClient(conf.AdminListenAddr, conf.AdminKey)
+	}
+	cert, err := crypto.LoadCertFromFile(conf.CertFile)
+	if err != nil {
+		return nil, err
+	}
+	return client.NewAdminClientWithCert(conf.AdminListenAddr+"/https", conf.AdminKey, cert)
+}
+
+func readAndGenerateKey(c *cli.Context) (*crypto.Key, error) {
+	fmt.Fprint(c.App.ErrWriter, "Enter Password: ")
+	password, err := util.ReadPassword(c.App.Reader)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(c.App.ErrWriter, "\r%s\rConfirm: ", strings.Repeat(" ", 25))
+	confirm, err := util.ReadPassword(c.App.Reader)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(c.App.ErrWriter, "\r%s\r", strings.Repeat(" ", 25))
+	if subtle.ConstantTimeCompare(confirm, password) != 1 {
+		return nil, errors.New("passwords do not match: try it again, but this time type slooowwwlly")
+	}
+	return crypto.GenerateKey(password)
+}
+
+func expiresToHuman(expires int64) string {
+	if expires == 0 {
+		return "never"
+	}
+	return time.Unix(expires, 0).Format("2006-01-02 15:04:05")
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"heckel.io/pcopy/config"
+	"heckel.io/pcopy/config/configtest"
+	"heckel.io/pcopy/crypto"
+	"heckel.io/pcopy/test"
+	"os"
+	"testing"
+)
+
+func TestCLI_AdminClipboardAddListRemove(t *testing.T) {
+	filename, conf := configtest.NewTestConfig(t)
+	conf.AdminListenAddr = "127.0.0.1:12587"
+	conf.AdminKey = &crypto.Key{Salt: make([]byte, 10), Bytes: make([]byte, 32)}
+	conf.AdminConfigDir = t.TempDir()
+	if err := conf.WriteFile(filename); err != nil {
+		t.Fatal(err)
+	}
+	serverRouter := startTestServerRouter(t, conf)
+	defer serverRouter.Stop()
+	test.WaitForPortUp(t, "12587")
+
+	addApp, _, _, addStderr := newTestApp()
+	if err := Run(addApp, "pcopy", "admin", "clipboard", "add", "-c", filename, "--expire-after", "2h", "team1"); err != nil {
+		t.Fatal(err)
+	}
+	test.StrContains(t, addStderr.String(), "Clipboard team1 added at https://localhost:12345/team1")
+
+	listApp, _, listStdout, _ := newTestApp()
+	if err := Run(listApp, "pcopy", "admin", "clipboard", "list", "-c", filename); err != nil {
+		t.Fatal(err)
+	}
+	test.StrContains(t, listStdout.String(), "https://localhost:12345/team1")
+	test.StrContains(t, listStdout.String(), "2h")
+
+	removeApp, _, _, removeStderr := newTestApp()
+	if err := Run(removeApp, "pcopy", "admin", "clipboard", "remove", "-c", filename, "team1"); err != nil {
+		t.Fatal(err)
+	}
+	test.StrContains(t, removeStderr.String(), "Clipboard team1 removed")
+
+	removeAgainApp, _, _, _ := newTestApp()
+	err := Run(removeAgainApp, "pcopy", "admin", "clipboard", "remove", "-c", filename, "team1")
+	if err == nil {
+		t.Fatal("expected error when removing clipboard twice")
+	}
+	test.StrContains(t, err.Error(), "clipboard team1 does not exist")
+}
+
+func TestCLI_AdminEntriesAndStatsWithRemoteAddr(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.AdminListenAddr = "127.0.0.1:12587"
+	conf.AdminKey = &crypto.Key{Salt: make([]byte, 10), Bytes: make([]byte, 32)}
+	conf.AdminConfigDir = t.TempDir()
+	serverRouter := startTestServerRouter(t, conf)
+	defer serverRouter.Stop()
+	test.WaitForPortUp(t, "12345")
+	test.WaitForPortUp(t, "12587")
+
+	os.Setenv(config.EnvConfigDir, t.TempDir())
+	os.Setenv(config.EnvAdminKey, crypto.EncodeKey(conf.AdminKey))
+	defer os.Unsetenv(config.EnvAdminKey)
+	joinApp, _, _, _ := newTestApp()
+	if err := Run(joinApp, "pcopy", "join", "localhost:12345"); err != nil {
+		t.Fatal(err)
+	}
+	copyApp, copyStdin, _, _ := newTestApp()
+	copyStdin.WriteString("keep me")
+	if err := Run(copyApp, "pcp", "report"); err != nil {
+		t.Fatal(err)
+	}
+
+	pinApp, _, _, pinStderr := newTestApp()
+	if err := Run(pinApp, "pcopy", "admin", "entry", "pin", "-a", "127.0.0.1:12587", "report"); err != nil {
+		t.Fatal(err)
+	}
+	test.StrContains(t, pinStderr.String(), "Entry report expires: never")
+
+	listApp, _, listStdout, _ := newTestApp()
+	if err := Run(listApp, "pcopy", "admin", "entry", "list", "-a", "127.0.0.1:12587"); err != nil {
+		t.Fatal(err)
+	}
+	test.StrContains(t, listStdout.String(), "report")
+	test.StrContains(t, listStdout.String(), "never")
+
+	statsApp, _, statsStdout, _ := newTestApp()
+	if err := Run(statsApp, "pcopy", "admin", "stats", "-a", "127.0.0.1:12587"); err != nil {
+		t.Fatal(err)
+	}
+	test.StrContains(t, statsStdout.String(), "Files:      1 (no limit)")
+	test.StrContains(t, statsStdout.String(), "Visitors:   1")
+
+	deleteApp, _, _, deleteStderr := newTestApp()
+	if err := Run(deleteApp, "pcopy", "admin", "entry", "delete", "-a", "127.0.0.1:12587", "report"); err != nil {
+		t.Fatal(err)
+	}
+	test.StrContains(t, deleteStderr.String(), "Entry report deleted")
+}
+
+func TestCLI_AdminViaHTTPS(t *testing.T) {
+	filename, conf := configtest.NewTestConfig(t)
+	conf.AdminListenAddr = "127.0.0.1:12587"
+	conf.AdminListenHTTPS = true
+	conf.AdminKey = &crypto.Key{Salt: make([]byte, 10), Bytes: make([]byte, 32)}
+	conf.AdminConfigDir = t.TempDir()
+	if err := conf.WriteFile(filename); err != nil {
+		t.Fatal(err)
+	}
+	serverRouter := startTestServerRouter(t, conf)
+	defer serverRouter.Stop()
+	test.WaitForPortUp(t, "12587")
+
+	listApp, _, listStdout, _ := newTestApp()
+	if err := Run(listApp, "pcopy", "admin", "clipboard", "list", "-c", filename); err != nil {
+		t.Fatal(err)
+	}
+	test.StrContains(t, listStdout.String(), "https://localhost:12345")
+
+	os.Setenv(config.EnvAdminKey, crypto.EncodeKey(conf.AdminKey))
+	defer os.Unsetenv(config.EnvAdminKey)
+	statsApp, _, statsStdout, _ := newTestApp()
+	if err := Run(statsApp, "pcopy", "admin", "stats", "-a", "127.0.0.1:12587/https", "--cert", conf.CertFile); err != nil {
+		t.Fatal(err)
+	}
+	test.StrContains(t, statsStdout.String(), "Files:      0")
+
+	plainApp, _, _, _ := newTestApp()
+	if err := Run(plainApp, "pcopy", "admin", "stats", "-a", "127.0.0.1:12587"); err == nil {
+		t.Fatal("expected error when talking plain HTTP to the HTTPS admin API")
+	}
+}
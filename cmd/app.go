@@ -32,11 +32,17 @@ func New() *cli.App {
 			cmdLeave,
 			cmdList,
 			cmdLink,
+			cmdRequest,
+			cmdRepin,
+			cmdHealth,
 
 			// Server commands
 			cmdServe,
 			cmdSetup,
 			cmdKeygen,
+			cmdCert,
+			cmdEvents,
+			cmdAdmin,
 		},
 	}
 }
@@ -4,9 +4,9 @@ import (
 	"bytes"
 	"github.com/urfave/cli/v2"
 	"heckel.io/pcopy/config"
+	"heckel.io/pcopy/log"
 	"heckel.io/pcopy/server"
 	"io"
-	"log"
 	"net/http"
 	"os"
 	"testing"
@@ -0,0 +1,143 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"heckel.io/pcopy/config"
+	"heckel.io/pcopy/crypto"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+var cmdCert = &cli.Command{
+	Name:     "cert",
+	Usage:    "Manage the TLS certificate of the server",
+	Category: categoryServer,
+	Subcommands: []*cli.Command{
+		{
+			Name:   "renew",
+			Usage:  "Renew the server certificate, keeping the private key",
+			Action: execCertRenew,
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "config", Aliases: []string{"c"}, Usage: "load server config from `FILE`"},
+				&cli.StringSliceFlag{Name: "san", Usage: "additional DNS name or IP address `NAME` for the server certificate (repeatable)"},
+			},
+			Description: `Renews the TLS certificate of the server, using the existing private key.
+
+The certificate is re-issued for the same DNS names and IP addresses as the current certificate,
+plus any additional names given via --san. If the server has a local CA (see 'CAFile' and
+'CAKeyFile'), the certificate is issued by the CA; otherwise it is self-signed.
+
+Since the private key does not change, clients that pinned the current certificate continue to
+work, and do not need to re-join. A running server picks up the new certificate automatically.
+
+Examples:
+  pcopy cert renew                     # Renews the cert of the default server config
+  pcopy cert renew -c work.conf        # Renews the cert of the given server config
+  pcopy cert renew --san 10.0.0.1      # Renews the cert, and adds an IP address to it`,
+		},
+		{
+			Name:   "fingerprint",
+			Usage:  "Show the fingerprint of the certificate that clients pin",
+			Action: execCertFingerprint,
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "config", Aliases: []string{"c"}, Usage: "load server config from `FILE`"},
+			},
+			Description: `Shows the fingerprint of the certificate that clients pin when joining the clipboard, i.e.
+the server certificate, or the local CA certificate if the server has one (see 'CAFile').
+
+Clients can verify the fingerprint out of band when joining or re-pinning, see 'pcopy join
+--fingerprint' and 'pcopy repin --fingerprint'.
+
+Examples:
+  pcopy cert fingerprint               # Shows the fingerprint for the default server config
+  pcopy cert fingerprint -c work.conf  # Shows the fingerprint for the given server config`,
+		},
+	},
+}
+
+func execCertRenew(c *cli.Context) error {
+	configFile, conf, err := loadCertServerConfig(c)
+	if err != nil {
+		return err
+	}
+	if conf.KeyFile == "" || conf.CertFile == "" {
+		return cli.Exit(fmt.Sprintf("error: no private key or certificate found for %s, see 'KeyFile' and 'CertFile'", configFile), 1)
+	}
+	key, err := crypto.LoadPrivateKeyFromFile(conf.KeyFile)
+	if err != nil {
+		return err
+	}
+	cert, err := crypto.LoadCertFromFile(conf.CertFile)
+	if err != nil {
+		return err
+	}
+	hosts := crypto.CertHosts(cert)
+	for _, san := range c.StringSlice("san") {
+		if !containsString(hosts, san) {
+			hosts = append(hosts, san)
+		}
+	}
+
+	_, pemCert, err := generateServerCert(conf.CAKeyFile, conf.CAFile, key, hosts)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(conf.CertFile, []byte(pemCert), 0644); err != nil {
+		return err
+	}
+	renewed, err := crypto.LoadCertFromFile(conf.CertFile)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.ErrWriter, "Renewed certificate %s for %s, expires %s.\n", conf.CertFile, strings.Join(hosts, ", "),
+		renewed.NotAfter.Format("2006-01-02"))
+	fmt.Fprintln(c.App.ErrWriter, "A running server picks up the new certificate automatically. Since the private key did")
+	fmt.Fprintln(c.App.ErrWriter, "not change, joined clients continue to work.")
+	return nil
+}
+
+func execCertFingerprint(c *cli.Context) error {
+	configFile, conf, err := loadCertServerConfig(c)
+	if err != nil {
+		return err
+	}
+	certFile := conf.CAFile
+	if certFile == "" {
+		certFile = conf.CertFile
+	}
+	if certFile == "" {
+		return cli.Exit(fmt.Sprintf("error: no certificate found for %s, see 'CertFile'", configFile), 1)
+	}
+	cert, err := crypto.LoadCertFromFile(certFile)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(c.App.Writer, crypto.CertFingerprint(cert))
+	return nil
+}
+
+func loadCertServerConfig(c *cli.Context) (string, *config.Config, error) {
+	configFile := c.String("config")
+	if configFile == "" {
+		configFile = config.NewStore().FileFromName(defaultServerClipboardName)
+	}
+	if _, err := os.Stat(configFile); err != nil {
+		return "", nil, cli.Exit(fmt.Sprintf("error: server config file %s does not exist", configFile), 1)
+	}
+	conf, err := config.LoadFromFile(configFile)
+	if err != nil {
+		return "", nil, err
+	}
+	return configFile, conf, nil
+}
+
+func containsString(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
+}
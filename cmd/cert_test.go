@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"heckel.io/pcopy/config"
+	"heckel.io/pcopy/config/configtest"
+	"heckel.io/pcopy/crypto"
+	"heckel.io/pcopy/test"
+	"os"
+	"testing"
+)
+
+func TestCLI_CertRenewWithoutRestartOrRejoin(t *testing.T) {
+	filename, conf := configtest.NewTestConfig(t)
+	serverRouter := startTestServerRouter(t, conf)
+	defer serverRouter.Stop()
+	test.WaitForPortUp(t, "12345")
+
+	configDir := t.TempDir()
+	os.Setenv(config.EnvConfigDir, configDir)
+	joinApp, _, _, _ := newTestApp()
+	if err := Run(joinApp, "pcopy", "join", "localhost:12345"); err != nil {
+		t.Fatal(err)
+	}
+	copyApp, copyStdin, _, _ := newTestApp()
+	copyStdin.WriteString("renewed cert")
+	if err := Run(copyApp, "pcp", "somefile"); err != nil {
+		t.Fatal(err)
+	}
+
+	oldCert, _ := crypto.LoadCertFromFile(conf.CertFile)
+	renewApp, _, _, renewStderr := newTestApp()
+	if err := Run(renewApp, "pcopy", "cert", "renew", "--san", "127.0.0.1", "-c", filename); err != nil {
+		t.Fatal(err)
+	}
+	test.StrContains(t, renewStderr.String(), "Renewed certificate")
+	test.StrContains(t, renewStderr.String(), "localhost, 127.0.0.1")
+	renewedCert, _ := crypto.LoadCertFromFile(conf.CertFile)
+	test.BoolEquals(t, false, oldCert.SerialNumber.Cmp(renewedCert.SerialNumber) == 0)
+	test.BytesEquals(t, oldCert.RawSubjectPublicKeyInfo, renewedCert.RawSubjectPublicKeyInfo)
+
+	pasteApp, _, pasteStdout, _ := newTestApp()
+	if err := Run(pasteApp, "ppaste", "somefile"); err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, "renewed cert", pasteStdout.String())
+}
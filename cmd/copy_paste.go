@@ -11,6 +11,8 @@ import (
 	"heckel.io/pcopy/server"
 	"heckel.io/pcopy/util"
 	"io"
+	"net/http"
+	"net/url"
 	"os"
 	"regexp"
 	"strings"
@@ -37,6 +39,7 @@ var cmdCopy = &cli.Command{
 		&cli.BoolFlag{Name: "read-only", Aliases: []string{"ro"}, Usage: "make remote file read-only (if supported by the server)"},
 		&cli.BoolFlag{Name: "read-write", Aliases: []string{"rw"}, Usage: "allow file to be overwritten (if supported by the server)"},
 		&cli.StringFlag{Name: "ttl", Aliases: []string{"t"}, DefaultText: "server default", Usage: "set duration the link is valid for to `TTL`"},
+		&cli.BoolFlag{Name: "allow-secrets", Usage: "upload even if the server detects secrets (keys, tokens, passwords)"},
 	},
 	Description: `Without FILE arguments, this command reads STDIN and copies it to the remote clipboard. ID is
 the remote file name, and CLIPBOARD is the name of the clipboard (both default to 'default').
@@ -54,6 +57,7 @@ Examples:
   echo ho | pcp work:bla   # Copies 'ho' to the 'work' clipboard as 'bla'
   pcp : img1/ img2/        # Creates ZIP from two folders and copies it to the default clipboard
   yes | pcp --stream       # Stream contents to the other end via FIFO device
+  pcp 'https://..' < f.pdf # Uploads f.pdf to an upload link, see 'pcopy request'
 
 To override or specify the remote server key, you may pass the PCOPY_KEY variable.`,
 }
@@ -92,6 +96,9 @@ To override or specify the remote server key, you may pass the PCOPY_KEY variabl
 }
 
 func execCopy(c *cli.Context) error {
+	if c.NArg() > 0 && isSlotURL(c.Args().First()) {
+		return execCopyToSlot(c)
+	}
 	conf, id, files, err := parseClientArgs(c)
 	if err != nil {
 		return err
@@ -100,6 +107,7 @@ func execCopy(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
+	pclient.SetAllowSecrets(c.Bool("allow-secrets"))
 
 	stream := c.Bool("stream")
 	link := !c.Bool("nolink")
@@ -158,38 +166,101 @@ func execCopy(c *cli.Context) error {
 			return handleCopyError(c.App.ErrWriter, err)
 		}
 	} else {
-		mode := os.FileMode(0)
-		if stdin, ok := c.App.Reader.(*os.File); ok {
-			stat, err := stdin.Stat()
-			if err != nil {
-				return err
-			}
-			mode = stat.Mode()
-		}
-
-		var reader io.ReadCloser
-		if (mode & os.ModeCharDevice) == 0 {
-			var ok bool
-			reader, ok = c.App.Reader.(io.ReadCloser)
-			if !ok {
-				reader = io.NopCloser(c.App.Reader)
-			}
-		} else {
-			reader = createInteractiveReader(c.App.Reader, c.App.ErrWriter)
+		reader, err := createStdinReader(c)
+		if err != nil {
+			return err
 		}
-
 		fileInfo, err = pclient.Copy(reader, id, ttl, fileMode, stream)
 		if err != nil {
 			return handleCopyError(c.App.ErrWriter, err)
 		}
 	}
 
+	fmt.Fprint(c.App.ErrWriter, server.SecretsWarning(fileInfo))
 	if link && !stream {
 		fmt.Fprint(c.App.ErrWriter, server.FileInfoInstructions(fileInfo))
 	}
+	warnIfKeyRotated(c.App.ErrWriter, pclient)
 	return nil
 }
 
+// execCopyToSlot uploads STDIN or the given files to an upload slot URL, as created by 'pcopy request'. This does
+// not require a clipboard config, since the URL contains everything that is needed to upload.
+func execCopyToSlot(c *cli.Context) error {
+	for _, flag := range []string{"config", "server", "stream", "random", "read-only", "read-write", "ttl", "allow-secrets"} {
+		if c.IsSet(flag) {
+			return cli.Exit(fmt.Sprintf("error: --%s cannot be used with upload links", flag), 1)
+		}
+	}
+	slotURL := c.Args().First()
+	u, err := url.Parse(slotURL)
+	if err != nil {
+		return err
+	}
+	conf := &config.Config{
+		ServerAddr: fmt.Sprintf("%s://%s", u.Scheme, u.Host),
+		CertFile:   c.String("cert"),
+	}
+	if !c.Bool("quiet") {
+		conf.ProgressFunc = func(processed int64, total int64, done bool) {
+			progressOutput(c.App.ErrWriter, processed, total, done)
+		}
+	}
+	pclient, err := client.NewClient(conf)
+	if err != nil {
+		return err
+	}
+	if c.NArg() > 1 {
+		_, err = pclient.CopyFilesToSlot(c.Args().Slice()[1:], slotURL)
+	} else {
+		var reader io.ReadCloser
+		if reader, err = createStdinReader(c); err != nil {
+			return err
+		}
+		_, err = pclient.CopyToSlot(reader, slotURL)
+	}
+	var httpErr *server.ErrHTTP
+	if errors.As(err, &httpErr) && (httpErr.Code == http.StatusUnauthorized || httpErr.Code == http.StatusConflict) {
+		return errors.New("upload link is invalid, expired or has already been used")
+	} else if err != nil {
+		return handleCopyError(c.App.ErrWriter, err)
+	}
+	fmt.Fprintln(c.App.ErrWriter, "Upload successful. The upload link cannot be used again.")
+	return nil
+}
+
+func isSlotURL(arg string) bool {
+	return strings.HasPrefix(arg, "https://") || strings.HasPrefix(arg, "http://")
+}
+
+// createStdinReader returns a reader for STDIN, or an interactive reader if STDIN is a terminal
+func createStdinReader(c *cli.Context) (io.ReadCloser, error) {
+	mode := os.FileMode(0)
+	if stdin, ok := c.App.Reader.(*os.File); ok {
+		stat, err := stdin.Stat()
+		if err != nil {
+			return nil, err
+		}
+		mode = stat.Mode()
+	}
+	if (mode & os.ModeCharDevice) == 0 {
+		reader, ok := c.App.Reader.(io.ReadCloser)
+		if !ok {
+			reader = io.NopCloser(c.App.Reader)
+		}
+		return reader, nil
+	}
+	return createInteractiveReader(c.App.Reader, c.App.ErrWriter), nil
+}
+
+// warnIfKeyRotated prints a warning if the server reported that the clipboard key has been rotated
+func warnIfKeyRotated(errWriter io.Writer, pclient *client.Client) {
+	if pclient.KeyRotated() {
+		fmt.Fprintln(errWriter, "warning: the clipboard password has been changed and the old one will stop working soon.")
+		fmt.Fprintln(errWriter, "         please re-join the clipboard using 'pcopy join' to continue using it.")
+	}
+}
+
 func handleCopyError(errWriter io.Writer, err error) error {
 	if err == server.ErrHTTPPartialContent {
 		fmt.Fprintln(errWriter, " (interrupted by client)")
@@ -237,6 +308,7 @@ func execPaste(c *cli.Context) error {
 			return err
 		}
 	}
+	warnIfKeyRotated(c.App.ErrWriter, pclient)
 	return nil
 }
 
@@ -284,10 +356,33 @@ func parseClientArgs(c *cli.Context) (*config.Config, string, []string, error) {
 			return nil, "", nil, err
 		}
 	}
+	conf.KeyPassphraseFunc = func() ([]byte, error) {
+		return readKeyPassphrase(c)
+	}
 
 	return conf, id, files, nil
 }
 
+// readKeyPassphrase returns the passphrase to decrypt the KeyEncryptedFile, either from the PCOPY_KEY_PASSPHRASE
+// environment variable, or by asking the user on the terminal. STDIN is not used, since it may be piped into pcopy.
+func readKeyPassphrase(c *cli.Context) ([]byte, error) {
+	if passphrase := os.Getenv(config.EnvKeyPassphrase); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+	tty, err := os.Open("/dev/tty")
+	if err != nil {
+		return nil, fmt.Errorf("cannot ask for key passphrase, set %s instead: %w", config.EnvKeyPassphrase, err)
+	}
+	defer tty.Close()
+	fmt.Fprint(c.App.ErrWriter, "\rEnter passphrase to decrypt key: ")
+	passphrase, err := util.ReadPassword(tty)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprint(c.App.ErrWriter, "\r")
+	return passphrase, nil
+}
+
 func parseClipboardIDAndFiles(args cli.Args, configFileOverride string) (string, string, []string, error) {
 	clipboard, id := config.DefaultClipboard, "" // special handling of Config.DefaultID
 	files := make([]string, 0)
@@ -0,0 +1,202 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"heckel.io/pcopy/config"
+	"heckel.io/pcopy/server"
+	"heckel.io/pcopy/util"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const eventsFollowInterval = 500 * time.Millisecond
+
+var cmdEvents = &cli.Command{
+	Name:     "events",
+	Usage:    "Show events from the server audit log",
+	Action:   execEvents,
+	Category: categoryServer,
+	Flags: []cli.Flag{
+		&cli.StringFlag{Name: "config", Aliases: []string{"c"}, Usage: "load server config from `FILE`"},
+		&cli.BoolFlag{Name: "follow", Aliases: []string{"f"}, Usage: "wait for and show new events as they are written"},
+		&cli.IntFlag{Name: "lines", Aliases: []string{"n"}, Value: 20, Usage: "show the last `N` events (0 shows all)"},
+		&cli.StringFlag{Name: "action", Aliases: []string{"a"}, Usage: "only show events with `ACTION` (upload, download, delete, auth-failure)"},
+		&cli.StringFlag{Name: "id", Aliases: []string{"i"}, Usage: "only show events for file `ID`"},
+		&cli.StringFlag{Name: "remote-addr", Aliases: []string{"r"}, Usage: "only show events from IP address `ADDR`"},
+		&cli.StringFlag{Name: "user", Aliases: []string{"u"}, Usage: "only show events by `USER`"},
+		&cli.BoolFlag{Name: "json", Aliases: []string{"j"}, Usage: "print events as JSON lines, as they appear in the log"},
+	},
+	Description: `Shows events from the audit log of a clipboard, see 'AuditLog' in the server config.
+
+The command reads the audit log file configured in the server config (default: ~/.config/pcopy/server.conf
+or /etc/pcopy/server.conf) and prints the last events, optionally filtered by action, file ID,
+remote address or user. Only the current log file is read, not the rotated files.
+
+Examples:
+  pcopy events                       # Shows the last 20 events
+  pcopy events -f                    # Shows the last 20 events, and waits for new events
+  pcopy events -a auth-failure -n 0  # Shows all failed authentication attempts
+  pcopy events -c work.conf -i abc   # Shows events for file 'abc' in the given clipboard`,
+}
+
+type eventFilter struct {
+	action     string
+	id         string
+	remoteAddr string
+	user       string
+}
+
+func execEvents(c *cli.Context) error {
+	configFile := c.String("config")
+	follow := c.Bool("follow")
+	lines := c.Int("lines")
+	asJSON := c.Bool("json")
+	filter := &eventFilter{
+		action:     c.String("action"),
+		id:         c.String("id"),
+		remoteAddr: c.String("remote-addr"),
+		user:       c.String("user"),
+	}
+	if lines < 0 {
+		return cli.Exit("error: --lines must be 0 or larger", 1)
+	}
+
+	// Load config
+	if configFile == "" {
+		configFile = config.NewStore().FileFromName(defaultServerClipboardName)
+	}
+	conf, err := config.LoadFromFile(configFile)
+	if err != nil {
+		return err
+	}
+	if conf.AuditLogFile == "" {
+		return cli.Exit(fmt.Sprintf("error: no audit log configured in %s, see 'AuditLog'", configFile), 1)
+	}
+
+	// Print last events, then follow (if requested)
+	file, err := os.Open(conf.AuditLogFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	events := make([]string, 0)
+	partial := ""
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			partial = line // Incomplete last line, may be completed while following
+			break
+		} else if err != nil {
+			return err
+		}
+		if event, ok := formatEvent(line, filter, asJSON); ok {
+			events = append(events, event)
+			if lines > 0 && len(events) > lines {
+				events = events[1:]
+			}
+		}
+	}
+	for _, event := range events {
+		fmt.Fprintln(c.App.Writer, event)
+	}
+	if !follow {
+		return nil
+	}
+	return followEvents(c, conf.AuditLogFile, file, reader, partial, filter, asJSON)
+}
+
+// followEvents waits for new events in the audit log and prints them. If the log file is rotated, the
+// new file is opened. This function does not return unless there is an error.
+func followEvents(c *cli.Context, filename string, file *os.File, reader *bufio.Reader, partial string, filter *eventFilter, asJSON bool) error {
+	defer func() { file.Close() }() // Closes the re-opened file, if any
+	for {
+		line, err := reader.ReadString('\n')
+		if err == nil {
+			if event, ok := formatEvent(partial+line, filter, asJSON); ok {
+				fmt.Fprintln(c.App.Writer, event)
+			}
+			partial = ""
+			continue
+		} else if err != io.EOF {
+			return err
+		}
+		partial += line
+		time.Sleep(eventsFollowInterval)
+
+		// Re-open file if it was rotated
+		current, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		if latest, err := os.Stat(filename); err == nil && !os.SameFile(current, latest) {
+			file.Close()
+			file, err = os.Open(filename)
+			if err != nil {
+				return err
+			}
+			reader.Reset(file)
+			partial = ""
+		}
+	}
+}
+
+// formatEvent parses the given JSON line and formats it (unless asJSON is set), if the event matches the
+// filter. If the line cannot be parsed or the event does not match, false is returned.
+func formatEvent(line string, filter *eventFilter, asJSON bool) (string, bool) {
+	var event server.Event
+	if err := json.Unmarshal([]byte(line), &event); err != nil {
+		return "", false
+	}
+	if !filter.matches(&event) {
+		return "", false
+	}
+	if asJSON {
+		return strings.TrimSpace(line), true
+	}
+	details := []string{
+		fmt.Sprintf("size=%s", util.BytesToHuman(event.Size)),
+	}
+	if event.ID != "" {
+		details = append([]string{fmt.Sprintf("id=%s", event.ID)}, details...)
+	}
+	if event.Status != 0 {
+		details = append(details, fmt.Sprintf("status=%d", event.Status))
+	}
+	if event.User != "" {
+		details = append(details, fmt.Sprintf("user=%s", event.User))
+	}
+	if event.UserAgent != "" {
+		details = append(details, fmt.Sprintf("agent=%q", event.UserAgent))
+	}
+	remoteAddr := event.RemoteAddr
+	if remoteAddr == "" {
+		remoteAddr = "-"
+	}
+	return fmt.Sprintf("%s  %-12s  %-21s  %s", event.Time.Local().Format("2006-01-02 15:04:05"), event.Action,
+		remoteAddr, strings.Join(details, " ")), true
+}
+
+func (f *eventFilter) matches(event *server.Event) bool {
+	if f.action != "" && f.action != event.Action {
+		return false
+	}
+	if f.id != "" && f.id != event.ID {
+		return false
+	}
+	if f.user != "" && f.user != event.User {
+		return false
+	}
+	if f.remoteAddr != "" {
+		ip := util.RemoteIP(event.RemoteAddr)
+		if ip == nil || ip.String() != util.RemoteIP(f.remoteAddr).String() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"heckel.io/pcopy/config"
+	"heckel.io/pcopy/test"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCLI_EventsFiltered(t *testing.T) {
+	dir := t.TempDir()
+	auditLogFile := filepath.Join(dir, "audit.log")
+	configFile := filepath.Join(dir, "server.conf")
+	conf := config.New()
+	conf.AuditLogFile = auditLogFile
+	if err := conf.WriteFile(configFile); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(auditLogFile, []byte(`{"time":"2021-01-01T10:00:00Z","remoteAddr":"1.2.3.4:1234","action":"upload","id":"abc","size":1024,"status":201}
+{"time":"2021-01-01T10:01:00Z","remoteAddr":"5.6.7.8:1234","action":"auth-failure","id":"abc","size":0,"status":401}
+{"time":"2021-01-01T10:02:00Z","remoteAddr":"1.2.3.4:1234","action":"download","id":"abc","size":1024,"status":200}
+{"time":"2021-01-01T10:03:00Z","action":"delete","id":"abc","size":1024}
+`), 0600)
+
+	app, _, stdout, _ := newTestApp()
+	if err := Run(app, "pcopy", "events", "-c", configFile, "-r", "1.2.3.4"); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	test.Int64Equals(t, 2, int64(len(lines)))
+	test.StrContains(t, lines[0], "upload")
+	test.StrContains(t, lines[0], "id=abc size=1.0 kB status=201")
+	test.StrContains(t, lines[1], "download")
+
+	app, _, stdout, _ = newTestApp()
+	if err := Run(app, "pcopy", "events", "-c", configFile, "--json", "-n", "1"); err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, `{"time":"2021-01-01T10:03:00Z","action":"delete","id":"abc","size":1024}`+"\n", stdout.String())
+
+	app, _, stdout, _ = newTestApp()
+	if err := Run(app, "pcopy", "events", "-c", configFile, "-a", "auth-failure"); err != nil {
+		t.Fatal(err)
+	}
+	test.StrContains(t, stdout.String(), "5.6.7.8:1234")
+	test.StrContains(t, stdout.String(), "status=401")
+}
@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"heckel.io/pcopy/client"
+	"heckel.io/pcopy/config"
+	"sort"
+)
+
+var cmdHealth = &cli.Command{
+	Name:      "health",
+	Usage:     "Check whether a clipboard server is ready (e.g. for Docker HEALTHCHECK)",
+	UsageText: "pcopy health [OPTIONS..] [CLIPBOARD]",
+	Action:    execHealth,
+	Category:  categoryClient,
+	Flags: []cli.Flag{
+		&cli.StringFlag{Name: "config", Aliases: []string{"c"}, Usage: "load config file from `FILE`"},
+		&cli.StringFlag{Name: "server", Aliases: []string{"S"}, Usage: "connect to server `ADDR[:PORT]` (default port: 2586)"},
+		&cli.StringFlag{Name: "cert", Aliases: []string{"C"}, Usage: "load server cert `FILE` for TLS connections"},
+		&cli.BoolFlag{Name: "live", Aliases: []string{"l"}, Usage: "only check whether the server process is alive (/healthz)"},
+		&cli.BoolFlag{Name: "quiet", Aliases: []string{"q"}, Usage: "do not print the result of the individual checks"},
+	},
+	Description: `Queries the readiness endpoint (/readyz) of the clipboard server and prints the result of the
+individual checks: whether the clipboard directory is writable, whether there is enough free disk
+space, whether the certificate is valid and whether the background manager is running. If the server
+is not ready or cannot be reached, the command exits with a non-zero exit code.
+
+The command works with client configs (see 'pcopy join'), and with server configs. Since the advertised
+server address may not be reachable from the server itself, you may pass --server to connect to the
+local address instead. The server certificate in the config is pinned, so the hostname does not need
+to match.
+
+Examples:
+  pcopy health                       # Checks whether the default clipboard's server is ready
+  pcopy health work                  # Checks whether the 'work' clipboard's server is ready
+  pcopy health --live                # Only checks whether the server is alive
+  pcopy health -q -c /etc/pcopy/server.conf -S localhost:2586
+                                     # Checks the local server, e.g. in a Docker HEALTHCHECK`,
+}
+
+func execHealth(c *cli.Context) error {
+	conf, err := parseHealthArgs(c)
+	if err != nil {
+		return err
+	}
+	pclient, err := client.NewClient(conf)
+	if err != nil {
+		return err
+	}
+	health, err := pclient.Health(c.Bool("live"))
+	if err != nil {
+		return err
+	}
+	if !c.Bool("quiet") {
+		names := make([]string, 0, len(health.Checks))
+		for name := range health.Checks {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			check := health.Checks[name]
+			status := "ok"
+			if !check.OK {
+				status = "failed"
+			}
+			fmt.Fprintf(c.App.Writer, "%-14s %-7s %s\n", name, status, check.Message)
+		}
+	}
+	if !health.OK {
+		return errors.New("server is not ready")
+	} else if !c.Bool("quiet") {
+		fmt.Fprintln(c.App.Writer, "Server is healthy.")
+	}
+	return nil
+}
+
+func parseHealthArgs(c *cli.Context) (*config.Config, error) {
+	configFileOverride := c.String("config")
+	clipboard := config.DefaultClipboard
+	if c.NArg() > 0 {
+		clipboard = c.Args().First()
+	}
+	configFile, conf, err := parseAndLoadConfig(configFileOverride, clipboard)
+	if err != nil {
+		return nil, err
+	}
+	if conf.CertFile == "" {
+		conf.CertFile = config.DefaultCertFile(configFile, true)
+	}
+	if c.String("server") != "" {
+		conf.ServerAddr = config.ExpandServerAddr(c.String("server"))
+	}
+	if c.String("cert") != "" {
+		conf.CertFile = c.String("cert")
+	}
+	return conf, nil
+}
@@ -0,0 +1,23 @@
+package cmd
+
+import (
+	"heckel.io/pcopy/config/configtest"
+	"heckel.io/pcopy/test"
+	"testing"
+)
+
+func TestCLI_Health(t *testing.T) {
+	filename, conf := configtest.NewTestConfig(t)
+	serverRouter := startTestServerRouter(t, conf)
+	defer serverRouter.Stop()
+
+	test.WaitForPortUp(t, "12345")
+
+	app, _, stdout, _ := newTestApp()
+	if err := Run(app, "pcopy", "health", "-c", filename); err != nil {
+		t.Fatal(err)
+	}
+	test.StrContains(t, stdout.String(), "clipboardDir   ok")
+	test.StrContains(t, stdout.String(), "manager        ok")
+	test.StrContains(t, stdout.String(), "Server is healthy.")
+}
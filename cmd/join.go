@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,8 +11,10 @@ import (
 	"heckel.io/pcopy/crypto"
 	"heckel.io/pcopy/server"
 	"heckel.io/pcopy/util"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 )
 
@@ -26,6 +29,11 @@ var cmdJoin = &cli.Command{
 		&cli.BoolFlag{Name: "force", Aliases: []string{"f"}, Usage: "overwrite config if it already exists"},
 		&cli.BoolFlag{Name: "auto", Aliases: []string{"a"}, Usage: "automatically choose clipboard alias"},
 		&cli.BoolFlag{Name: "quiet", Aliases: []string{"q"}, Usage: "do not print instructions"},
+		&cli.StringFlag{Name: "client-cert", Usage: "authenticate with TLS client certificate `CERT`"},
+		&cli.StringFlag{Name: "client-key", Usage: "load private key for the TLS client certificate from `KEY`"},
+		&cli.StringFlag{Name: "key-command", Usage: "fetch the key by running `CMD` instead of storing it in the config"},
+		&cli.BoolFlag{Name: "encrypt-key", Usage: "store the key in a passphrase-encrypted file instead of the config"},
+		&cli.StringFlag{Name: "fingerprint", Usage: "verify that the server certificate has fingerprint `SHA256:...`"},
 	},
 	Description: `Connects to a remote clipboard with the server address SERVER. CLIPBOARD is the local alias
 that can be used to identify it (default is 'default'). This command is interactive and
@@ -36,22 +44,53 @@ environment variable is passed.
 
 If the remote server's certificate is self-signed, its certificate will be downloaded to
 ~/.config/pcopy/$CLIPBOARD.crt (or /etc/pcopy/$CLIPBOARD.crt) and pinned for future connections.
+If the server certificate was issued by a local CA (see 'pcopy setup --ca'), the CA certificate
+is pinned instead, so that the server certificate can be renewed without having to re-join.
+
+Since the certificate cannot be verified by the system in that case, its fingerprint is shown and
+must be confirmed when joining interactively. To verify it out of band (e.g. in scripts), pass the
+fingerprint shown by 'pcopy cert fingerprint' on the server via --fingerprint.
+
+If the remote clipboard accepts TLS client certificates, --client-cert and --client-key can be
+used to authenticate with a certificate instead of a password. The paths are stored in the config.
+
+By default, the key derived from the password is stored in the config file. To avoid storing it
+in the clear, --key-command can be used to fetch the key from a command (e.g. a password manager)
+whenever it is needed, or --encrypt-key can be used to store the key in a passphrase-encrypted file
+~/.config/pcopy/$CLIPBOARD.key.enc. The passphrase is asked for, unless PCOPY_KEY_PASSPHRASE is set.
 
 Examples:
   pcopy join pcopy.example.com     # Joins remote clipboard as local alias 'default'
-  pcopy join pcopy.work.com work   # Joins remote clipboard with local alias 'work'`,
+  pcopy join pcopy.work.com work   # Joins remote clipboard with local alias 'work'
+  pcopy join --client-cert me.crt --client-key me.key pcopy.work.com
+                                   # Joins remote clipboard using a client certificate
+  pcopy join --key-command 'pass show pcopy/work' pcopy.work.com work
+                                   # Joins remote clipboard, fetches key from password manager
+  pcopy join --encrypt-key pcopy.work.com work
+                                   # Joins remote clipboard, stores key in encrypted file
+  pcopy join --fingerprint SHA256:2Fq8..Yw pcopy.work.com
+                                   # Joins remote clipboard, verifies the certificate fingerprint`,
 }
 
 func execJoin(c *cli.Context) error {
 	force := c.Bool("force")
 	auto := c.Bool("auto")
 	quiet := c.Bool("quiet")
+	keyCommand := c.String("key-command")
+	encryptKey := c.Bool("encrypt-key")
+	clientCertFile, clientKeyFile, err := absClientCertFiles(c.String("client-cert"), c.String("client-key"))
+	if err != nil {
+		return err
+	}
 	if c.NArg() < 1 {
 		return errors.New("missing server address, see --help for usage details")
 	}
 	if force && auto {
 		return errors.New("cannot use both --auto and --force")
 	}
+	if keyCommand != "" && encryptKey {
+		return errors.New("cannot use both --key-command and --encrypt-key")
+	}
 
 	clipboard := config.DefaultClipboard
 	rawServerAddr := c.Args().Get(0)
@@ -71,17 +110,42 @@ func execJoin(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
-	pclient, err := client.NewClient(&config.Config{ServerAddr: info.ServerAddr})
+	pclient, err := client.NewClient(&config.Config{
+		ServerAddr:     info.ServerAddr,
+		ClientCertFile: clientCertFile,
+		ClientKeyFile:  clientKeyFile,
+	})
 	if err != nil {
 		return err
 	}
+	if err := verifyFingerprint(c, pclient, info, c.String("fingerprint")); err != nil {
+		return err
+	}
+
+	// Verify that the client certificate is accepted (if any); no password is needed in that case
+	certAccepted := false
+	if clientCertFile != "" {
+		if err := pclient.Verify(info.Cert, nil); err != nil && info.Salt == nil {
+			return fmt.Errorf("failed to join clipboard: %s", err.Error())
+		} else if err == nil {
+			certAccepted = true
+		}
+	}
 
 	// Read and verify that password was correct (if server is secured with key)
 	var key *crypto.Key
 
-	if info.Salt != nil {
+	if info.Salt != nil && !certAccepted {
 		envKey := os.Getenv(config.EnvKey)
-		if envKey != "" {
+		if keyCommand != "" {
+			keyClient, err := client.NewClient(&config.Config{ServerAddr: info.ServerAddr, KeyCommand: keyCommand})
+			if err != nil {
+				return err
+			}
+			if err := keyClient.Verify(info.Cert, nil); err != nil {
+				return fmt.Errorf("failed to join clipboard: %s", err.Error())
+			}
+		} else if envKey != "" {
 			key, err = crypto.DecodeKey(envKey)
 			if err != nil {
 				return err
@@ -104,6 +168,16 @@ func execJoin(c *cli.Context) error {
 	conf.ServerAddr = config.CollapseServerAddr(info.ServerAddr)
 	conf.DefaultID = info.DefaultID
 	conf.Key = key // May be nil, but that's ok
+	conf.KeyCommand = keyCommand
+	conf.ClientCertFile = clientCertFile
+	conf.ClientKeyFile = clientKeyFile
+	if encryptKey && key != nil {
+		conf.Key = nil
+		conf.KeyEncryptedFile = config.DefaultKeyEncryptedFile(configFile, false)
+		if err := writeEncryptedKey(c, conf.KeyEncryptedFile, key); err != nil {
+			return err
+		}
+	}
 	if err := conf.WriteFile(configFile); err != nil {
 		return err
 	}
@@ -127,6 +201,32 @@ func execJoin(c *cli.Context) error {
 	return nil
 }
 
+// absClientCertFiles checks that the given client cert/key files exist and turns them into absolute paths,
+// so that they can be stored in the config file
+func absClientCertFiles(certFile, keyFile string) (string, string, error) {
+	if certFile == "" {
+		if keyFile != "" {
+			return "", "", errors.New("--client-key requires --client-cert")
+		}
+		return "", "", nil
+	}
+	files := []string{certFile, keyFile}
+	for i, file := range files {
+		if file == "" {
+			continue
+		}
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return "", "", err
+		}
+		if _, err := os.Stat(abs); err != nil {
+			return "", "", err
+		}
+		files[i] = abs
+	}
+	return files[0], files[1], nil
+}
+
 type serverInfoResult struct {
 	addr string
 	info *server.Info
@@ -192,6 +292,36 @@ func toHumanReadable(err error) string {
 	return err.Error()
 }
 
+// writeEncryptedKey encrypts the key with a passphrase and writes it to the given file. The passphrase is taken
+// from the PCOPY_KEY_PASSPHRASE environment variable, or asked for interactively (with confirmation).
+func writeEncryptedKey(c *cli.Context, filename string, key *crypto.Key) error {
+	passphrase := []byte(os.Getenv(config.EnvKeyPassphrase))
+	if len(passphrase) == 0 {
+		var err error
+		fmt.Fprintf(c.App.ErrWriter, "\r%s\rEnter passphrase to encrypt key: ", strings.Repeat(" ", 50))
+		passphrase, err = util.ReadPassword(c.App.Reader)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.App.ErrWriter, "\r%s\rConfirm: ", strings.Repeat(" ", 50))
+		confirm, err := util.ReadPassword(c.App.Reader)
+		if err != nil {
+			return err
+		}
+		fmt.Fprint(c.App.ErrWriter, "\r")
+		if subtle.ConstantTimeCompare(confirm, passphrase) != 1 {
+			return errors.New("passphrases do not match")
+		} else if len(passphrase) == 0 {
+			return errors.New("passphrase must not be empty")
+		}
+	}
+	encrypted, err := crypto.EncryptKey(key, passphrase)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, encrypted, 0600)
+}
+
 func readPassword(c *cli.Context) ([]byte, error) {
 	fmt.Fprintf(c.App.ErrWriter, "\r%s\rEnter password to join clipboard: ", strings.Repeat(" ", 50)) // a hack ..
 	password, err := util.ReadPassword(c.App.Reader)
@@ -202,6 +332,73 @@ func readPassword(c *cli.Context) ([]byte, error) {
 	return password, nil
 }
 
+// verifyFingerprint verifies the server certificate against the expected fingerprint (if given). If no fingerprint
+// is given and the certificate is about to be pinned, the user is asked to confirm its fingerprint (if interactive).
+func verifyFingerprint(c *cli.Context, pclient *client.Client, info *server.Info, expected string) error {
+	cert := info.Cert
+	if expected != "" {
+		if cert == nil { // Trusted by the system, but we check anyway
+			var err error
+			cert, err = pclient.RetrieveCert()
+			if err != nil {
+				return err
+			}
+		}
+		if fingerprint := crypto.CertFingerprint(cert); fingerprint != strings.TrimSpace(expected) {
+			return fmt.Errorf("failed.\nServer certificate fingerprint %s does not match expected fingerprint %s", fingerprint, expected)
+		}
+		return nil
+	} else if cert == nil || !isInteractive(c) {
+		return nil
+	}
+	fmt.Fprintln(c.App.ErrWriter)
+	fmt.Fprintln(c.App.ErrWriter, "The server certificate is not trusted by the system, and will be pinned. Please verify")
+	fmt.Fprintln(c.App.ErrWriter, "its fingerprint, e.g. by comparing it with 'pcopy cert fingerprint' on the server:")
+	fmt.Fprintln(c.App.ErrWriter)
+	fmt.Fprintf(c.App.ErrWriter, "  %s\n", crypto.CertFingerprint(cert))
+	fmt.Fprintln(c.App.ErrWriter)
+	ok, err := confirm(c, "Trust this certificate? [y/N] ")
+	if err != nil {
+		return err
+	} else if !ok {
+		return errors.New("certificate not trusted, user aborted")
+	}
+	return nil
+}
+
+// isInteractive returns true if the app reads from a terminal, i.e. if the user can be asked questions
+func isInteractive(c *cli.Context) bool {
+	f, ok := c.App.Reader.(*os.File)
+	if !ok {
+		return false
+	}
+	stat, err := f.Stat()
+	return err == nil && (stat.Mode()&os.ModeCharDevice) == os.ModeCharDevice
+}
+
+// confirm prints the prompt and reads a line from the app's reader. It returns true if the answer is "y" or "yes".
+// The input is read byte by byte, so that no input beyond the line is consumed (e.g. a password).
+func confirm(c *cli.Context, prompt string) (bool, error) {
+	fmt.Fprint(c.App.ErrWriter, prompt)
+	answer := make([]byte, 0)
+	buf := make([]byte, 1)
+	for {
+		n, err := c.App.Reader.Read(buf)
+		if err == io.EOF || (n == 1 && buf[0] == '\n') {
+			break
+		} else if err != nil {
+			return false, err
+		}
+		answer = append(answer, buf[:n]...)
+	}
+	switch strings.ToLower(strings.TrimSpace(string(answer))) {
+	case "y", "yes":
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
 func printInstructions(c *cli.Context, configFile string, clipboard string, info *server.Info) {
 	clipboardPrefix := ""
 	if clipboard != config.DefaultClipboard {
@@ -216,7 +413,12 @@ func printInstructions(c *cli.Context, configFile string, clipboard string, info
 
 	if info.Cert != nil {
 		fmt.Fprintln(c.App.ErrWriter)
-		fmt.Fprintln(c.App.ErrWriter, "Warning: The TLS certificate was self-signed and has been pinned.")
+		if crypto.IsCA(info.Cert) {
+			fmt.Fprintln(c.App.ErrWriter, "Warning: The TLS certificate was issued by a local CA, and the CA has been pinned.")
+		} else {
+			fmt.Fprintln(c.App.ErrWriter, "Warning: The TLS certificate was self-signed and has been pinned.")
+		}
+		fmt.Fprintf(c.App.ErrWriter, "Fingerprint: %s\n", crypto.CertFingerprint(info.Cert))
 		fmt.Fprintln(c.App.ErrWriter, "Future communication will be secure, but joining could have been intercepted.")
 	}
 
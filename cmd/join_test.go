@@ -9,6 +9,7 @@ import (
 	"heckel.io/pcopy/util"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -79,3 +80,74 @@ func TestCLI_JoinWithPasswordAndCopyAndPaste(t *testing.T) {
 	test.StrContains(t, string(content), saltBase64)
 	test.FileExist(t, filepath.Join(configDir, "default.conf"))
 }
+
+func TestCLI_JoinWithEncryptedKeyAndCopyAndPaste(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.Key, _ = crypto.GenerateKey([]byte("some password"))
+	serverRouter := startTestServerRouter(t, conf)
+	defer serverRouter.Stop()
+
+	test.WaitForPortUp(t, "12345")
+
+	configDir := t.TempDir()
+	os.Setenv(config.EnvConfigDir, configDir)
+	os.Setenv(config.EnvKeyPassphrase, "some passphrase")
+	defer os.Unsetenv(config.EnvKeyPassphrase)
+
+	app, stdin, _, _ := newTestApp()
+	stdin.WriteString("some password")
+	if err := Run(app, "pcopy", "join", "--encrypt-key", "localhost:12345"); err != nil {
+		t.Fatal(err)
+	}
+
+	content, _ := os.ReadFile(filepath.Join(configDir, "default.conf"))
+	test.StrContains(t, string(content), "KeyEncryptedFile "+filepath.Join(configDir, "default.key.enc"))
+	if strings.Contains(string(content), crypto.EncodeKey(conf.Key)) {
+		t.Fatalf("expected key not to be stored in config file")
+	}
+	test.FileExist(t, filepath.Join(configDir, "default.key.enc"))
+
+	copyApp, copyStdin, _, _ := newTestApp()
+	copyStdin.WriteString("encrypted key works")
+	if err := Run(copyApp, "pcp", "somefile"); err != nil {
+		t.Fatal(err)
+	}
+	pasteApp, _, pasteStdout, _ := newTestApp()
+	if err := Run(pasteApp, "ppaste", "somefile"); err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, "encrypted key works", pasteStdout.String())
+}
+
+func TestCLI_JoinWithKeyCommandAndPaste(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.Key, _ = crypto.GenerateKey([]byte("some password"))
+	serverRouter := startTestServerRouter(t, conf)
+	defer serverRouter.Stop()
+
+	test.WaitForPortUp(t, "12345")
+
+	configDir := t.TempDir()
+	os.Setenv(config.EnvConfigDir, configDir)
+
+	keyCommand := "echo " + crypto.EncodeKey(conf.Key)
+	app, _, _, _ := newTestApp()
+	if err := Run(app, "pcopy", "join", "--key-command", keyCommand, "localhost:12345"); err != nil {
+		t.Fatal(err)
+	}
+
+	content, _ := os.ReadFile(filepath.Join(configDir, "default.conf"))
+	test.StrContains(t, string(content), "KeyCommand "+keyCommand)
+	test.StrContains(t, string(content), "# Key\n")
+
+	copyApp, copyStdin, _, _ := newTestApp()
+	copyStdin.WriteString("key command works")
+	if err := Run(copyApp, "pcp", "somefile"); err != nil {
+		t.Fatal(err)
+	}
+	pasteApp, _, pasteStdout, _ := newTestApp()
+	if err := Run(pasteApp, "ppaste", "somefile"); err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, "key command works", pasteStdout.String())
+}
@@ -1,13 +1,19 @@
 package cmd
 
 import (
+	"crypto/ecdsa"
 	"crypto/subtle"
 	"errors"
 	"fmt"
 	"github.com/urfave/cli/v2"
+	"heckel.io/pcopy/config"
 	"heckel.io/pcopy/crypto"
 	"heckel.io/pcopy/util"
+	"io/ioutil"
+	"net/url"
+	"os"
 	"strings"
+	"time"
 )
 
 var cmdKeygen = &cli.Command{
@@ -15,16 +21,74 @@ var cmdKeygen = &cli.Command{
 	Usage:    "Generate key for the server config",
 	Action:   execKeygen,
 	Category: categoryServer,
+	Flags: []cli.Flag{
+		&cli.BoolFlag{Name: "rotate", Aliases: []string{"r"}, Usage: "rotate the key in the server config, and keep accepting the current key"},
+		&cli.StringFlag{Name: "config", Aliases: []string{"c"}, Usage: "server config file to update when rotating the key"},
+		&cli.DurationFlag{Name: "retire", Usage: "stop accepting the current key after `DURATION` when rotating the key"},
+		&cli.BoolFlag{Name: "cert", Usage: "generate a new server private key and certificate instead of a key"},
+		&cli.BoolFlag{Name: "ca", Usage: "create a local CA (if it does not exist) and issue the server certificate from it"},
+		&cli.StringSliceFlag{Name: "san", Usage: "additional DNS name or IP address `NAME` for the server certificate (repeatable)"},
+	},
 	Description: `Generate key for the server config. This command is interactive and will ask for a password.
 
 The output of the command can be pasted into the 'server.conf' file to secure a server, or
 passed via the PCOPY_KEY environment variables to commands that support it.
 
+With --rotate, the key in the server config (default: ~/.config/pcopy/server.conf or
+/etc/pcopy/server.conf) is replaced with the new key, and the current key is added to the
+'PreviousKeys' option, so that joined clients continue to work. Clients using the previous
+key are asked to re-join. If --retire is given, the previous key stops working after the given
+duration. Previous keys that are already retired are removed from the config. Only the 'Key' and
+'PreviousKeys' lines of the config are changed, and the change is applied when the server is
+reloaded (SIGHUP, e.g. via 'systemctl reload pcopy'), without a restart.
+
+With --cert, a new TLS private key and certificate are generated for the server config instead.
+The certificate is issued for the hostname of 'ServerAddr', and any additional DNS names or IP
+addresses given via --san. If the server has a local CA (see 'CAFile' and 'CAKeyFile'), the
+certificate is issued by the CA, and clients do not need to re-join. With --ca, a local CA is
+created first, if it does not exist yet. Otherwise, a new self-signed certificate is generated.
+
 Examples:
-  pcopy keygen    # Asks for password and generates key`,
+  pcopy keygen                      # Asks for password and generates key
+  pcopy keygen --rotate             # Rotates the key in the default server config
+  pcopy keygen -r --retire 168h     # Rotates the key, old key stops working after 7 days
+  pcopy keygen -r -c /etc/pcopy/work.conf  # Rotates the key in the given server config
+  pcopy keygen --cert --ca --san 10.0.0.1  # Creates a local CA, and issues a new server cert from it`,
 }
 
 func execKeygen(c *cli.Context) error {
+	rotate := c.Bool("rotate")
+	configFile := c.String("config")
+	retire := c.Duration("retire")
+	if c.Bool("cert") {
+		if rotate || retire != 0 {
+			return cli.Exit("error: --cert cannot be used with --rotate or --retire", 1)
+		}
+		return execKeygenCert(c, configFile)
+	} else if c.Bool("ca") || len(c.StringSlice("san")) > 0 {
+		return cli.Exit("error: --ca and --san can only be used with --cert", 1)
+	} else if !rotate && (configFile != "" || retire != 0) {
+		return cli.Exit("error: --config and --retire can only be used with --rotate or --cert", 1)
+	}
+
+	var conf *config.Config
+	if rotate {
+		if configFile == "" {
+			configFile = config.NewStore().FileFromName(defaultServerClipboardName)
+		}
+		if _, err := os.Stat(configFile); err != nil {
+			return cli.Exit(fmt.Sprintf("error: server config file %s does not exist", configFile), 1)
+		}
+		var err error
+		conf, err = config.LoadFromFile(configFile)
+		if err != nil {
+			return err
+		}
+		if conf.Key == nil {
+			return cli.Exit(fmt.Sprintf("error: server config file %s has no key to rotate, use 'pcopy keygen' instead", configFile), 1)
+		}
+	}
+
 	fmt.Fprint(c.App.ErrWriter, "Enter Password: ")
 	password, err := util.ReadPassword(c.App.Reader)
 	if err != nil {
@@ -45,6 +109,150 @@ func execKeygen(c *cli.Context) error {
 		return err
 	}
 
+	if rotate {
+		return rotateKey(c, configFile, conf, key, retire)
+	}
 	fmt.Fprintf(c.App.Writer, "\rKey %s\n", crypto.EncodeKey(key))
 	return nil
 }
+
+func rotateKey(c *cli.Context, configFile string, conf *config.Config, key *crypto.Key, retire time.Duration) error {
+	previousKey := &config.PreviousKey{Key: conf.Key}
+	if retire > 0 {
+		previousKey.Retires = time.Now().Add(retire).Truncate(time.Second)
+	}
+	previousKeys := []*config.PreviousKey{previousKey}
+	for _, k := range conf.PreviousKeys {
+		if !k.Retired() {
+			previousKeys = append(previousKeys, k)
+		}
+	}
+	conf.Key = key
+	conf.PreviousKeys = previousKeys
+	if err := conf.WriteKeysToFile(configFile); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.App.ErrWriter, "\r%s\r", strings.Repeat(" ", 25))
+	fmt.Fprintf(c.App.ErrWriter, "Key rotated in %s.\n", configFile)
+	if previousKey.Retires.IsZero() {
+		fmt.Fprintln(c.App.ErrWriter, "The previous key will continue to be accepted until it is removed from 'PreviousKeys'.")
+	} else {
+		fmt.Fprintf(c.App.ErrWriter, "The previous key will stop being accepted at %s.\n", previousKey.Retires.Format(time.RFC1123))
+	}
+	fmt.Fprintln(c.App.ErrWriter)
+	fmt.Fprintln(c.App.ErrWriter, "Reload the server to apply the change, e.g. via 'systemctl reload pcopy' or 'kill -HUP'.")
+	fmt.Fprintln(c.App.ErrWriter, "Clients using the previous key will be asked to re-join the clipboard using 'pcopy join'")
+	fmt.Fprintln(c.App.ErrWriter, "with the new password.")
+	return nil
+}
+
+func execKeygenCert(c *cli.Context, configFile string) error {
+	if configFile == "" {
+		configFile = config.NewStore().FileFromName(defaultServerClipboardName)
+	}
+	if _, err := os.Stat(configFile); err != nil {
+		return cli.Exit(fmt.Sprintf("error: server config file %s does not exist", configFile), 1)
+	}
+	conf, err := config.LoadFromFile(configFile)
+	if err != nil {
+		return err
+	}
+	hosts, err := serverCertHosts(conf.ServerAddr, c.StringSlice("san"))
+	if err != nil {
+		return err
+	}
+
+	// Create CA (if requested and it does not exist)
+	caFile, caKeyFile := conf.CAFile, conf.CAKeyFile
+	createdCA := false
+	if c.Bool("ca") && caFile == "" {
+		caFile, caKeyFile = config.DefaultCAFile(configFile, false), config.DefaultCAKeyFile(configFile, false)
+		pemCAKey, pemCACert, err := crypto.GenerateCA(fmt.Sprintf("pcopy CA (%s)", hosts[0]))
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(caKeyFile, []byte(pemCAKey), 0600); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(caFile, []byte(pemCACert), 0644); err != nil {
+			return err
+		}
+		fmt.Fprintf(c.App.ErrWriter, "Created local CA %s (key: %s).\n", caFile, caKeyFile)
+		createdCA = true
+	}
+
+	// Issue server key and certificate
+	pemKey, pemCert, err := generateServerCert(caKeyFile, caFile, nil, hosts)
+	if err != nil {
+		return err
+	}
+	keyFile, certFile := conf.KeyFile, conf.CertFile
+	if keyFile == "" {
+		keyFile = config.DefaultKeyFile(configFile, false)
+	}
+	if certFile == "" {
+		certFile = config.DefaultCertFile(configFile, false)
+	}
+	if err := ioutil.WriteFile(keyFile, []byte(pemKey), 0600); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(certFile, []byte(pemCert), 0644); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.ErrWriter, "Wrote server certificate %s (key: %s) for %s.\n", certFile, keyFile, strings.Join(hosts, ", "))
+	fmt.Fprintln(c.App.ErrWriter)
+	fmt.Fprintln(c.App.ErrWriter, "Restart the server to apply the change.")
+	if caFile == "" || createdCA {
+		fmt.Fprintln(c.App.ErrWriter, "Clients pinning the previous certificate must re-join the clipboard using 'pcopy join'.")
+	} else {
+		fmt.Fprintln(c.App.ErrWriter, "Clients pinning the local CA do not need to re-join the clipboard.")
+	}
+	return nil
+}
+
+// serverCertHosts returns the hostnames and IP addresses the server certificate is issued for, i.e. the
+// host of the server address, followed by the additional names given (e.g. via --san)
+func serverCertHosts(serverAddr string, sans []string) ([]string, error) {
+	serverURL, err := url.ParseRequestURI(config.ExpandServerAddr(serverAddr))
+	if err != nil {
+		return nil, err
+	}
+	hosts := []string{serverURL.Hostname()}
+	for _, san := range sans {
+		if san != "" && san != serverURL.Hostname() {
+			hosts = append(hosts, san)
+		}
+	}
+	return hosts, nil
+}
+
+// generateServerCert issues a server certificate for the given hosts, and returns the PEM-encoded key and
+// certificate. If key is nil, a new key is generated; otherwise the given key is used (e.g. to renew a
+// certificate), and the returned key is empty. If caFile is set, the certificate is issued by that CA
+// (see caKeyFile). Otherwise, it is self-signed.
+func generateServerCert(caKeyFile string, caFile string, key *ecdsa.PrivateKey, hosts []string) (string, string, error) {
+	if caFile == "" {
+		if key == nil {
+			return crypto.GenerateKeyAndCert(hosts...)
+		}
+		pemCert, err := crypto.GenerateCert(key, hosts...)
+		return "", pemCert, err
+	}
+	if caKeyFile == "" {
+		return "", "", cli.Exit(fmt.Sprintf("error: CA certificate %s found, but no CA key; see 'CAKeyFile'", caFile), 1)
+	}
+	caKey, err := crypto.LoadPrivateKeyFromFile(caKeyFile)
+	if err != nil {
+		return "", "", err
+	}
+	caCert, err := crypto.LoadCertFromFile(caFile)
+	if err != nil {
+		return "", "", err
+	}
+	if key == nil {
+		return crypto.GenerateKeyAndCertWithCA(caKey, caCert, hosts...)
+	}
+	pemCert, err := crypto.GenerateCertWithCA(key, caKey, caCert, hosts...)
+	return "", pemCert, err
+}
@@ -1,10 +1,16 @@
 package cmd
 
 import (
+	"heckel.io/pcopy/config"
+	"heckel.io/pcopy/config/configtest"
 	"heckel.io/pcopy/crypto"
 	"heckel.io/pcopy/test"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestCLI_Keygen(t *testing.T) {
@@ -26,3 +32,111 @@ func TestCLI_Keygen(t *testing.T) {
 	test.BytesEquals(t, key.Salt, derivedKey.Salt)
 	test.BytesEquals(t, key.Bytes, derivedKey.Bytes)
 }
+
+func TestCLI_KeygenRotate(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "server.conf")
+	oldKey, _ := crypto.GenerateKey([]byte("old password"))
+	conf := config.New()
+	conf.Key = oldKey
+	if err := conf.WriteFile(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	app, stdin, _, stderr := newTestApp()
+	stdin.WriteString("new password\nnew password")
+	if err := Run(app, "pcopy", "keygen", "--rotate", "--retire", "48h", "-c", filename); err != nil {
+		t.Fatal(err)
+	}
+	test.StrContains(t, stderr.String(), "Key rotated")
+
+	rotated, err := config.LoadFromFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	derivedKey := crypto.DeriveKey([]byte("new password"), rotated.Key.Salt)
+	test.BytesEquals(t, derivedKey.Bytes, rotated.Key.Bytes)
+	test.Int64Equals(t, 1, int64(len(rotated.PreviousKeys)))
+	test.BytesEquals(t, oldKey.Bytes, rotated.PreviousKeys[0].Key.Bytes)
+	test.BoolEquals(t, false, rotated.PreviousKeys[0].Retires.IsZero())
+	test.BoolEquals(t, true, rotated.PreviousKeys[0].Retires.After(time.Now().Add(47*time.Hour)))
+}
+
+func TestCLI_KeygenRotateKeepsOtherLines(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "server.conf")
+	oldKey, _ := crypto.GenerateKey([]byte("old password"))
+	contents := "# Our team clipboard, managed by ops\nServerAddr https://pcopy.example.com\n\n  Key " + crypto.EncodeKey(oldKey) + "\n# Keep small\nFileSizeLimit 10M\n"
+	if err := ioutil.WriteFile(filename, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		app, stdin, _, stderr := newTestApp()
+		stdin.WriteString("new password\nnew password")
+		if err := Run(app, "pcopy", "keygen", "--rotate", "-c", filename); err != nil {
+			t.Fatal(err)
+		}
+		test.StrContains(t, stderr.String(), "kill -HUP")
+	}
+
+	b, _ := ioutil.ReadFile(filename)
+	test.StrContains(t, string(b), "# Our team clipboard, managed by ops\nServerAddr https://pcopy.example.com\n\nKey ")
+	test.StrContains(t, string(b), "\n# Keep small\nFileSizeLimit 10M\nPreviousKeys ")
+	rotated, err := config.LoadFromFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.Int64Equals(t, 2, int64(len(rotated.PreviousKeys)))
+	test.BytesEquals(t, oldKey.Bytes, rotated.PreviousKeys[1].Key.Bytes)
+}
+
+func TestCLI_KeygenCertWithCAAndJoinAndRenew(t *testing.T) {
+	filename, conf := configtest.NewTestConfig(t)
+	app, _, _, stderr := newTestApp()
+	if err := Run(app, "pcopy", "keygen", "--cert", "--ca", "--san", "127.0.0.1", "-c", filename); err != nil {
+		t.Fatal(err)
+	}
+	test.StrContains(t, stderr.String(), "Created local CA")
+	test.FileExist(t, config.DefaultCAFile(filename, false))
+	test.FileExist(t, config.DefaultCAKeyFile(filename, false))
+
+	conf, _ = config.LoadFromFile(filename)
+	serverRouter := startTestServerRouter(t, conf)
+	test.WaitForPortUp(t, "12345")
+
+	configDir := t.TempDir()
+	os.Setenv(config.EnvConfigDir, configDir)
+	joinApp, _, _, joinStderr := newTestApp()
+	if err := Run(joinApp, "pcopy", "join", "localhost:12345"); err != nil {
+		t.Fatal(err)
+	}
+	test.StrContains(t, joinStderr.String(), "the CA has been pinned")
+	pinned, _ := crypto.LoadCertFromFile(filepath.Join(configDir, "default.crt"))
+	test.BoolEquals(t, true, crypto.IsCA(pinned))
+
+	copyApp, copyStdin, _, copyStderr := newTestApp()
+	copyStdin.WriteString("pinned the CA")
+	if err := Run(copyApp, "pcp", "somefile"); err != nil {
+		t.Fatal(err)
+	}
+	test.StrContains(t, copyStderr.String(), "curl -sSL --cacert '"+filepath.Join(configDir, "default.crt")+"'")
+	serverRouter.Stop()
+	test.WaitForPortDown(t, "12345")
+
+	// Renew server cert; client must still be able to connect
+	renewApp, _, _, renewStderr := newTestApp()
+	if err := Run(renewApp, "pcopy", "keygen", "--cert", "-c", filename); err != nil {
+		t.Fatal(err)
+	}
+	test.StrContains(t, renewStderr.String(), "do not need to re-join")
+
+	conf, _ = config.LoadFromFile(filename)
+	serverRouter = startTestServerRouter(t, conf)
+	defer serverRouter.Stop()
+	test.WaitForPortUp(t, "12345")
+
+	pasteApp, _, pasteStdout, _ := newTestApp()
+	if err := Run(pasteApp, "ppaste", "somefile"); err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, "pinned the CA", pasteStdout.String())
+}
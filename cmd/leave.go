@@ -57,6 +57,12 @@ func execLeave(c *cli.Context) error {
 			}
 		}
 	}
+	if conf.KeyEncryptedFile != "" && conf.KeyEncryptedFile == config.DefaultKeyEncryptedFile(filename, false) {
+		// Only remove the encrypted key file if it was written by 'pcopy join'
+		if err := os.Remove(conf.KeyEncryptedFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
 	fmt.Fprintf(c.App.Writer, "Successfully left clipboard '%s'. To rejoin, run 'pcopy join %s'.\n", clipboard, config.CollapseServerAddr(conf.ServerAddr))
 	return nil
 }
@@ -40,6 +40,7 @@ func execLink(c *cli.Context) error {
 		return err
 	}
 	fmt.Fprint(c.App.ErrWriter, server.FileInfoInstructions(info))
+	warnIfKeyRotated(c.App.ErrWriter, pclient)
 	return nil
 }
 
@@ -69,6 +70,9 @@ func parseLinkArgs(c *cli.Context) (*config.Config, string, error) {
 	if conf.CertFile == "" {
 		conf.CertFile = config.DefaultCertFile(configFile, true)
 	}
+	conf.KeyPassphraseFunc = func() ([]byte, error) {
+		return readKeyPassphrase(c)
+	}
 
 	return conf, id, nil
 }
@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"heckel.io/pcopy/client"
+	"heckel.io/pcopy/config"
+	"heckel.io/pcopy/crypto"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+var cmdRepin = &cli.Command{
+	Name:      "repin",
+	Usage:     "Pin the new certificate of a remote clipboard",
+	UsageText: "pcopy repin [OPTIONS..] [CLIPBOARD]",
+	Action:    execRepin,
+	Category:  categoryClient,
+	Flags: []cli.Flag{
+		&cli.StringFlag{Name: "fingerprint", Usage: "only pin the new certificate if it has fingerprint `SHA256:...`"},
+	},
+	Description: `Replaces the pinned certificate of a clipboard with the server's current certificate.
+
+If a clipboard was joined with a self-signed certificate (or a local CA), the certificate is pinned
+in ~/.config/pcopy/$CLIPBOARD.crt (or /etc/pcopy/$CLIPBOARD.crt). If the server certificate is replaced
+with a new key, all commands fail until the new certificate is pinned.
+
+The command shows the fingerprints of the old and the new certificate, and asks for confirmation before
+pinning the new certificate. Compare the new fingerprint with 'pcopy cert fingerprint' on the server. To
+verify it out of band (e.g. in scripts), pass the expected fingerprint via --fingerprint.
+
+Examples:
+  pcopy repin                       # Pins the new certificate of the default clipboard
+  pcopy repin work                  # Pins the new certificate of the clipboard called 'work'
+  pcopy repin --fingerprint SHA256:2Fq8..Yw work
+                                    # Pins the new certificate, if the fingerprint matches`,
+}
+
+func execRepin(c *cli.Context) error {
+	clipboard := config.DefaultClipboard
+	if c.NArg() > 0 {
+		clipboard = c.Args().First()
+	}
+	expected := strings.TrimSpace(c.String("fingerprint"))
+	store := config.NewStore()
+	filename := store.FileFromName(clipboard)
+	if _, err := os.Stat(filename); err != nil {
+		return fmt.Errorf("clipboard '%s' does not exist", clipboard)
+	}
+	conf, err := config.LoadFromFile(filename)
+	if err != nil {
+		return fmt.Errorf("cannot load config for %s: %w", clipboard, err)
+	}
+	if conf.CertFile == "" {
+		return fmt.Errorf("clipboard '%s' has no pinned certificate, nothing to do", clipboard)
+	}
+	oldCert, err := crypto.LoadCertFromFile(conf.CertFile)
+	if err != nil {
+		return err
+	}
+	pclient, err := client.NewClient(&config.Config{ServerAddr: conf.ServerAddr})
+	if err != nil {
+		return err
+	}
+	newCert, err := pclient.RetrieveCert()
+	if err != nil {
+		return err
+	}
+
+	oldFingerprint, newFingerprint := crypto.CertFingerprint(oldCert), crypto.CertFingerprint(newCert)
+	fmt.Fprintf(c.App.ErrWriter, "Pinned certificate: %s\n", oldFingerprint)
+	fmt.Fprintf(c.App.ErrWriter, "Server certificate: %s\n", newFingerprint)
+	if oldFingerprint == newFingerprint {
+		fmt.Fprintln(c.App.ErrWriter, "The server certificate matches the pinned certificate, nothing to do.")
+		return nil
+	}
+	if expected != "" {
+		if newFingerprint != expected {
+			return fmt.Errorf("server certificate fingerprint %s does not match expected fingerprint %s", newFingerprint, expected)
+		}
+	} else if isInteractive(c) {
+		fmt.Fprintln(c.App.ErrWriter)
+		fmt.Fprintln(c.App.ErrWriter, "Please verify the new fingerprint, e.g. by comparing it with 'pcopy cert fingerprint' on the server.")
+		ok, err := confirm(c, "Pin the new certificate? [y/N] ")
+		if err != nil {
+			return err
+		} else if !ok {
+			return errors.New("certificate not pinned, user aborted")
+		}
+	} else {
+		return errors.New("cannot confirm new certificate; use --fingerprint to pin it non-interactively")
+	}
+
+	pemCert, err := crypto.EncodeCert(newCert)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(conf.CertFile, pemCert, 0644); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.ErrWriter, "Successfully pinned new certificate for clipboard '%s' in %s.\n", clipboard, conf.CertFile)
+	return nil
+}
@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"heckel.io/pcopy/config"
+	"heckel.io/pcopy/config/configtest"
+	"heckel.io/pcopy/test"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCLI_JoinWithFingerprint(t *testing.T) {
+	filename, conf := configtest.NewTestConfig(t)
+	serverRouter := startTestServerRouter(t, conf)
+	defer serverRouter.Stop()
+	test.WaitForPortUp(t, "12345")
+
+	fingerprintApp, _, fingerprintStdout, _ := newTestApp()
+	if err := Run(fingerprintApp, "pcopy", "cert", "fingerprint", "-c", filename); err != nil {
+		t.Fatal(err)
+	}
+	fingerprint := strings.TrimSpace(fingerprintStdout.String())
+	test.StrContains(t, fingerprint, "SHA256:")
+
+	configDir := t.TempDir()
+	os.Setenv(config.EnvConfigDir, configDir)
+	app, _, _, _ := newTestApp()
+	err := Run(app, "pcopy", "join", "--fingerprint", "SHA256:wrong", "localhost:12345")
+	if err == nil {
+		t.Fatalf("expected join to fail due to wrong fingerprint, but it succeeded")
+	}
+	test.StrContains(t, err.Error(), "does not match expected fingerprint SHA256:wrong")
+
+	app, _, _, stderr := newTestApp()
+	if err := Run(app, "pcopy", "join", "--fingerprint", fingerprint, "localhost:12345"); err != nil {
+		t.Fatal(err)
+	}
+	test.StrContains(t, stderr.String(), "Fingerprint: "+fingerprint)
+}
+
+func TestCLI_RepinAfterCertChange(t *testing.T) {
+	filename, conf := configtest.NewTestConfig(t)
+	conf.ManagerInterval = 50 * time.Millisecond
+	serverRouter := startTestServerRouter(t, conf)
+	defer serverRouter.Stop()
+	test.WaitForPortUp(t, "12345")
+
+	configDir := t.TempDir()
+	os.Setenv(config.EnvConfigDir, configDir)
+	joinApp, _, _, _ := newTestApp()
+	if err := Run(joinApp, "pcopy", "join", "localhost:12345"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace server key and cert; the server reloads it automatically
+	keygenApp, _, _, _ := newTestApp()
+	if err := Run(keygenApp, "pcopy", "keygen", "--cert", "-c", filename); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond) // Wait for the manager to reload the cert
+	copyApp, copyStdin, _, _ := newTestApp()
+	copyStdin.WriteString("repinned")
+	err := Run(copyApp, "pcp", "somefile")
+	if err == nil {
+		t.Fatalf("expected copy to fail due to cert change, but it succeeded")
+	}
+	test.StrContains(t, err.Error(), "does not match pinned certificate")
+	test.StrContains(t, err.Error(), "pcopy repin")
+
+	// Repin without confirmation fails, with fingerprint succeeds
+	fingerprintApp, _, fingerprintStdout, _ := newTestApp()
+	if err := Run(fingerprintApp, "pcopy", "cert", "fingerprint", "-c", filename); err != nil {
+		t.Fatal(err)
+	}
+	fingerprint := strings.TrimSpace(fingerprintStdout.String())
+	repinApp, _, _, _ := newTestApp()
+	if err := Run(repinApp, "pcopy", "repin"); err == nil {
+		t.Fatalf("expected repin to fail without confirmation, but it succeeded")
+	}
+	repinApp, _, _, repinStderr := newTestApp()
+	if err := Run(repinApp, "pcopy", "repin", "--fingerprint", fingerprint); err != nil {
+		t.Fatal(err)
+	}
+	test.StrContains(t, repinStderr.String(), "Server certificate: "+fingerprint)
+	test.StrContains(t, repinStderr.String(), "Successfully pinned new certificate")
+
+	copyApp, copyStdin, _, _ = newTestApp()
+	copyStdin.WriteString("repinned")
+	if err := Run(copyApp, "pcp", "somefile"); err != nil {
+		t.Fatal(err)
+	}
+}
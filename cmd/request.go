@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"heckel.io/pcopy/client"
+	"heckel.io/pcopy/config"
+	"heckel.io/pcopy/server"
+	"heckel.io/pcopy/util"
+	"time"
+)
+
+var cmdRequest = &cli.Command{
+	Name:      "request",
+	Usage:     "Create an upload link that allows others to send you a file",
+	UsageText: "pcopy request [OPTIONS..] [[CLIPBOARD]:[ID]]",
+	Action:    execRequest,
+	Category:  categoryClient,
+	Flags: []cli.Flag{
+		&cli.StringFlag{Name: "config", Aliases: []string{"c"}, Usage: "load config file from `FILE`"},
+		&cli.StringFlag{Name: "ttl", Aliases: []string{"t"}, DefaultText: "server default", Usage: "set duration the upload link is valid for to `TTL`"},
+		&cli.StringFlag{Name: "max-size", Aliases: []string{"m"}, DefaultText: "server limit", Usage: "limit the size of the uploaded file to `SIZE` (e.g. 100M, 1G)"},
+	},
+	Description: `Creates an upload slot in the clipboard and prints a link to it. Anyone holding the link can upload
+exactly one file to the slot, without knowing the clipboard password, e.g. via curl, the web UI or
+'pcp URL'. After the upload, the file is a normal clipboard entry, which can only be read with the
+clipboard password, e.g. via 'ppaste ID'.
+
+If no ID is given, a random file name is chosen. The upload link expires after TTL, unless it has
+been used by then.
+
+Examples:
+  pcopy request                      # Creates an upload link for a random file name
+  pcopy request --ttl 1d --max-size 1G
+                                     # Creates an upload link that is valid for a day, for files up to 1 GB
+  pcopy request work:invoice         # Creates an upload link for file 'invoice' in the 'work' clipboard`,
+}
+
+func execRequest(c *cli.Context) error {
+	conf, id, err := parseRequestArgs(c)
+	if err != nil {
+		return err
+	}
+	ttl := time.Duration(0)
+	if c.String("ttl") != "" {
+		ttl, err = util.ParseDuration(c.String("ttl"))
+		if err != nil {
+			return err
+		}
+	}
+	maxSize := int64(0)
+	if c.String("max-size") != "" {
+		maxSize, err = util.ParseSize(c.String("max-size"))
+		if err != nil {
+			return err
+		}
+	}
+	pclient, err := client.NewClient(conf)
+	if err != nil {
+		return err
+	}
+	info, err := pclient.Request(id, ttl, maxSize)
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(c.App.ErrWriter, server.FileInfoInstructions(info))
+	fmt.Fprintln(c.App.ErrWriter)
+	fmt.Fprintf(c.App.ErrWriter, "# After the upload, paste via pcopy (you may need a prefix)\nppaste %s\n", info.File)
+	warnIfKeyRotated(c.App.ErrWriter, pclient)
+	return nil
+}
+
+func parseRequestArgs(c *cli.Context) (*config.Config, string, error) {
+	configFileOverride := c.String("config")
+
+	// Parse clipboard and file; unlike other commands, the ID does not default to the DefaultID
+	clipboard, id := config.DefaultClipboard, ""
+	if c.NArg() > 0 {
+		var err error
+		clipboard, id, err = parseClipboardAndID(c.Args().First(), configFileOverride)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	// Load config
+	configFile, conf, err := parseAndLoadConfig(configFileOverride, clipboard)
+	if err != nil {
+		return nil, "", cli.Exit("clipboard does not exist", 1)
+	}
+	if conf.CertFile == "" {
+		conf.CertFile = config.DefaultCertFile(configFile, true)
+	}
+	conf.KeyPassphraseFunc = func() ([]byte, error) {
+		return readKeyPassphrase(c)
+	}
+
+	return conf, id, nil
+}
@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"heckel.io/pcopy/clipboard/clipboardtest"
+	"heckel.io/pcopy/config/configtest"
+	"heckel.io/pcopy/crypto"
+	"heckel.io/pcopy/test"
+	"regexp"
+	"testing"
+)
+
+func TestCLI_RequestAndCopyToSlot(t *testing.T) {
+	filename, conf := configtest.NewTestConfig(t)
+	conf.Key, _ = crypto.GenerateKey([]byte("some password"))
+	if err := conf.WriteFile(filename); err != nil {
+		t.Fatal(err)
+	}
+	serverRouter := startTestServerRouter(t, conf)
+	defer serverRouter.Stop()
+
+	test.WaitForPortUp(t, "12345")
+
+	// Create upload slot
+	requestApp, _, _, requestStderr := newTestApp()
+	if err := Run(requestApp, "pcopy", "request", "-c", filename, "--ttl", "1d", "--max-size", "1k", "invoice"); err != nil {
+		t.Fatal(err)
+	}
+	test.StrContains(t, requestStderr.String(), "# Upload link (valid for 1d")
+	test.StrContains(t, requestStderr.String(), "ppaste invoice")
+	slotURL := regexp.MustCompile(`https://localhost:12345/invoice\?a=\w+`).FindString(requestStderr.String())
+	if slotURL == "" {
+		t.Fatalf("expected upload link in output, got: %s", requestStderr.String())
+	}
+
+	// Upload without clipboard config, only with the pinned cert
+	copyApp, copyStdin, _, copyStderr := newTestApp()
+	copyStdin.WriteString("the invoice")
+	if err := Run(copyApp, "pcp", "--cert", conf.CertFile, slotURL); err != nil {
+		t.Fatal(err)
+	}
+	test.StrContains(t, copyStderr.String(), "Upload successful")
+	clipboardtest.Content(t, conf, "invoice", "the invoice")
+
+	// Upload link cannot be used twice
+	copyApp, copyStdin, _, _ = newTestApp()
+	copyStdin.WriteString("overwritten")
+	err := Run(copyApp, "pcp", "--cert", conf.CertFile, slotURL)
+	if err == nil {
+		t.Fatalf("expected error, got none")
+	}
+	test.StrContains(t, err.Error(), "already been used")
+	clipboardtest.Content(t, conf, "invoice", "the invoice")
+
+	// Readable with the key
+	pasteApp, _, pasteStdout, _ := newTestApp()
+	if err := Run(pasteApp, "ppaste", "-c", filename, "invoice"); err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, "the invoice", pasteStdout.String())
+}
@@ -1,12 +1,16 @@
 package cmd
 
 import (
+	"errors"
 	"github.com/urfave/cli/v2"
 	"heckel.io/pcopy/config"
 	"heckel.io/pcopy/crypto"
+	"heckel.io/pcopy/log"
 	"heckel.io/pcopy/server"
-	"log"
 	"os"
+	"os/signal"
+	"sort"
+	"syscall"
 )
 
 const defaultServerClipboardName = "server"
@@ -32,6 +36,8 @@ The command will load a the clipboard config from ~/.config/pcopy/server.conf or
 
 To generate a new config file, you may want to use the 'pcopy setup' command.
 
+The server shuts down gracefully on SIGTERM or SIGINT, and reloads the config files on SIGHUP.
+
 Examples:
   pcopy serve                      # Starts server in the foreground
   pcopy serve --listen-https :9999 # Starts server with alternate port
@@ -49,20 +55,117 @@ func execServe(c *cli.Context) error {
 	certFile := c.String("cert")
 	clipboardDir := c.String("dir")
 
-	var err error
-	var configs []*config.Config
-	if len(files) == 0 {
-		configs, err = loadDefaultServerConfigWithOverrides(listenHTTPS, listenHTTP, serverAddr, keyFile, certFile, clipboardDir)
-	} else {
-		configs, err = loadServerConfigsFromFilesWithOverrides(files, listenHTTPS, listenHTTP, serverAddr, keyFile, certFile, clipboardDir)
+	loadConfigs := func() ([]*config.Config, error) {
+		var configs []*config.Config
+		var err error
+		if len(files) == 0 {
+			configs, err = loadDefaultServerConfigWithOverrides(listenHTTPS, listenHTTP, serverAddr, keyFile, certFile, clipboardDir)
+		} else {
+			configs, err = loadServerConfigsFromFilesWithOverrides(files, listenHTTPS, listenHTTP, serverAddr, keyFile, certFile, clipboardDir)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return appendManagedConfigs(configs), nil
 	}
+	configs, err := loadConfigs()
 	if err != nil {
 		return err
 	}
 	if len(configs) == 0 {
 		return cli.Exit("No valid config files found. Exiting", 1)
 	}
-	return server.Serve(configs...)
+	if err := configureLogging(configs); err != nil {
+		return err
+	}
+	router, err := server.NewRouter(configs...)
+	if err != nil {
+		return err
+	}
+	go handleShutdownSignals(router)
+	go handleReloadSignals(router, loadConfigs, configs[0])
+	return router.Start()
+}
+
+// handleReloadSignals reloads the config files on SIGHUP, and applies them to the running router. If the
+// new configs cannot be loaded or are invalid, the error is logged and the running configs are kept.
+func handleReloadSignals(router *server.Router, loadConfigs func() ([]*config.Config, error), current *config.Config) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	for range sigs {
+		log.Info("Received SIGHUP signal, reloading config")
+		configs, err := loadConfigs()
+		if err == nil && len(configs) == 0 {
+			err = errors.New("no valid config files found")
+		}
+		if err == nil {
+			err = checkLogging(configs)
+		}
+		if err == nil {
+			err = router.Reload(configs...)
+		}
+		if err != nil {
+			log.With("error", err).Error("Cannot reload config, continuing with the running config")
+			continue
+		}
+		if logSettingsChanged(current, configs[0]) {
+			if err := configureLogging(configs); err != nil {
+				log.With("error", err).Error("Cannot apply new log settings")
+			}
+		}
+		current = configs[0]
+	}
+}
+
+// handleShutdownSignals gracefully shuts down the router on SIGINT or SIGTERM. If a second signal
+// arrives while waiting for in-flight requests, the router is stopped immediately.
+func handleShutdownSignals(router *server.Router) {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigs
+	log.Info("Received %s signal", sig)
+	go func() {
+		<-sigs
+		log.Warn("Received second signal, stopping immediately")
+		router.Stop()
+	}()
+	router.Shutdown()
+}
+
+// configureLogging sets the log level, format and output from the given configs. Since all clipboards
+// share the same process-wide log, the log settings of all configs must be identical.
+func configureLogging(configs []*config.Config) error {
+	if err := checkLogging(configs); err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+	conf := configs[0]
+	log.SetLevel(conf.LogLevel)
+	if err := log.SetFormat(conf.LogFormat); err != nil {
+		return err
+	}
+	if conf.LogFile != log.OutputStderr {
+		output, err := log.NewOutput(conf.LogFile, conf.LogFileMaxSize, conf.LogFileMaxFiles)
+		if err != nil {
+			return err
+		}
+		log.SetOutput(output)
+	}
+	return nil
+}
+
+func checkLogging(configs []*config.Config) error {
+	conf := configs[0]
+	for _, c := range configs[1:] {
+		if c.LogLevel != conf.LogLevel || c.LogFormat != conf.LogFormat || c.LogFile != conf.LogFile {
+			return errors.New("LogLevel, LogFormat and LogFile must be identical in all config files")
+		}
+	}
+	return nil
+}
+
+func logSettingsChanged(a, b *config.Config) bool {
+	return a.LogLevel != b.LogLevel || a.LogFormat != b.LogFormat || a.LogFile != b.LogFile ||
+		a.LogFileMaxSize != b.LogFileMaxSize || a.LogFileMaxFiles != b.LogFileMaxFiles
 }
 
 func loadDefaultServerConfigWithOverrides(listenHTTPS, listenHTTP, serverAddr, keyFile, certFile, clipboardDir string) ([]*config.Config, error) {
@@ -72,13 +175,13 @@ func loadDefaultServerConfigWithOverrides(listenHTTPS, listenHTTP, serverAddr, k
 	var err error
 	var conf *config.Config
 	if stat, _ := os.Stat(filename); stat != nil {
-		log.Printf("Loading config from %s", filename)
+		log.Info("Loading config from %s", filename)
 		conf, err = config.LoadFromFile(filename)
 		if err != nil {
 			return nil, err
 		}
 	} else {
-		log.Printf("No server config file found, using command line arguments")
+		log.Info("No server config file found, using command line arguments")
 		conf = config.New()
 	}
 	conf, err = maybeOverrideOptions(conf, listenHTTPS, listenHTTP, serverAddr, keyFile, certFile, clipboardDir)
@@ -94,7 +197,7 @@ func loadServerConfigsFromFilesWithOverrides(files []string, listenHTTPS, listen
 		if _, err := os.Stat(filename); err != nil {
 			return nil, err
 		}
-		log.Printf("Loading config from %s", filename)
+		log.Info("Loading config from %s", filename)
 		conf, err := config.LoadFromFile(filename)
 		if err != nil {
 			return nil, err
@@ -108,12 +211,33 @@ func loadServerConfigsFromFilesWithOverrides(files []string, listenHTTPS, listen
 	return configs, nil
 }
 
+// appendManagedConfigs appends the configs of the clipboards that were added via the admin API (see AdminConfigDir)
+func appendManagedConfigs(configs []*config.Config) []*config.Config {
+	for _, conf := range configs {
+		if conf.AdminListenAddr == "" || conf.AdminConfigDir == "" {
+			continue
+		}
+		managed := config.NewStoreWithDir(conf.AdminConfigDir).All()
+		filenames := make([]string, 0)
+		for filename := range managed {
+			filenames = append(filenames, filename)
+		}
+		sort.Strings(filenames)
+		for _, filename := range filenames {
+			log.Info("Loading config from %s", filename)
+			configs = append(configs, managed[filename])
+		}
+		break
+	}
+	return configs
+}
+
 func maybeOverrideOptions(conf *config.Config, listenHTTPS, listenHTTP, serverAddr, keyFile, certFile, clipboardDir string) (*config.Config, error) {
 	if listenHTTPS != "" {
-		conf.ListenHTTPS = listenHTTPS
+		conf.ListenHTTPS = []string{listenHTTPS}
 	}
 	if listenHTTP != "" {
-		conf.ListenHTTP = listenHTTP
+		conf.ListenHTTP = []string{listenHTTP}
 	}
 	if serverAddr != "" {
 		conf.ServerAddr = config.ExpandServerAddr(serverAddr)
@@ -12,7 +12,7 @@ import (
 func TestCLI_ServeAndJoin(t *testing.T) {
 	go func() {
 		filename, config := configtest.NewTestConfig(t)
-		config.ListenHTTPS = ":18818"
+		config.ListenHTTPS = []string{":18818"}
 		config.ServerAddr = "https://localhost:18818"
 		config.WriteFile(filename)
 		app, _, _, _ := newTestApp()
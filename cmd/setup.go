@@ -9,7 +9,6 @@ import (
 	"heckel.io/pcopy/crypto"
 	"heckel.io/pcopy/util"
 	"io/ioutil"
-	"net/url"
 	"os"
 	"os/exec"
 	"os/user"
@@ -20,6 +19,7 @@ import (
 
 const (
 	serviceFile        = "/lib/systemd/system/pcopy.service"
+	socketFile         = "/lib/systemd/system/pcopy.socket"
 	defaultServiceUser = "pcopy"
 )
 
@@ -28,13 +28,23 @@ var cmdSetup = &cli.Command{
 	Usage:    "Initial setup wizard for a new pcopy server",
 	Action:   execSetup,
 	Category: categoryServer,
+	Flags: []cli.Flag{
+		&cli.BoolFlag{Name: "ca", Usage: "create a local CA and issue the server certificate from it"},
+		&cli.StringSliceFlag{Name: "san", Usage: "additional DNS name or IP address `NAME` for the server certificate (repeatable)"},
+	},
 	Description: `Starts an interactive wizard to generate server config, private key and certificate.
 This command must be run as root, since it (potentially) creates users and installs a
 systemd service.
 
+By default, a self-signed certificate is generated for the server hostname, which clients
+pin when joining. With --ca, a local certificate authority (CA) is created instead, and the
+server certificate is issued by it. Clients then pin the CA, so that the server certificate
+can be renewed (see 'pcopy keygen --cert') without clients having to re-join.
+
 Examples:
-  sudo pcopy setup   # Install pcopy server to /etc/pcopy with 'pcopy' user
-  pcopy setup        # Install pcopy server to ~/.config/pcopy for current user`,
+  sudo pcopy setup                   # Install pcopy server to /etc/pcopy with 'pcopy' user
+  pcopy setup                        # Install pcopy server to ~/.config/pcopy for current user
+  pcopy setup --ca --san 10.0.0.1    # Create a local CA, and add an IP address to the server cert`,
 }
 
 type wizard struct {
@@ -44,6 +54,8 @@ type wizard struct {
 
 	configFile     string
 	clipboardDir   string
+	createCA       bool
+	certSANs       []string
 	installService bool
 	hasService     bool
 	serviceUser    string
@@ -53,9 +65,11 @@ type wizard struct {
 
 func execSetup(c *cli.Context) error {
 	setup := &wizard{
-		config:  config.New(),
-		reader:  bufio.NewReader(c.App.Reader),
-		context: c,
+		config:   config.New(),
+		reader:   bufio.NewReader(c.App.Reader),
+		context:  c,
+		createCA: c.Bool("ca"),
+		certSANs: c.StringSlice("san"),
 	}
 
 	fmt.Fprintln(c.App.ErrWriter, "pcopy server setup")
@@ -159,7 +173,9 @@ func (w *wizard) askClipboardDir() {
 func (w *wizard) askListenAddr() {
 	fmt.Fprintln(w.context.App.ErrWriter, "The listen address is used to bind the local server for HTTPS connections.")
 	fmt.Fprintf(w.context.App.ErrWriter, "Listen address (default: :%d): ", config.DefaultPort)
-	w.config.ListenHTTPS = w.readLine()
+	if listenAddr := w.readLine(); listenAddr != "" {
+		w.config.ListenHTTPS = []string{listenAddr}
+	}
 	fmt.Fprintln(w.context.App.ErrWriter)
 }
 
@@ -234,8 +250,13 @@ func (w *wizard) askConfirm() {
 	fmt.Fprintf(w.context.App.ErrWriter, "- Config file:       %s\n", util.CollapseHome(w.configFile))
 	fmt.Fprintf(w.context.App.ErrWriter, "- Private key file:  %s\n", util.CollapseHome(config.DefaultKeyFile(w.configFile, false)))
 	fmt.Fprintf(w.context.App.ErrWriter, "- Certificate file:  %s\n", util.CollapseHome(config.DefaultCertFile(w.configFile, false)))
+	if w.createCA {
+		fmt.Fprintf(w.context.App.ErrWriter, "- CA key file:       %s\n", util.CollapseHome(config.DefaultCAKeyFile(w.configFile, false)))
+		fmt.Fprintf(w.context.App.ErrWriter, "- CA cert file:      %s\n", util.CollapseHome(config.DefaultCAFile(w.configFile, false)))
+	}
 	if w.installService {
 		fmt.Fprintf(w.context.App.ErrWriter, "- Systemd unit file: %s\n", serviceFile)
+		fmt.Fprintf(w.context.App.ErrWriter, "- Systemd socket:    %s (optional, for socket activation)\n", socketFile)
 	}
 	fmt.Fprintln(w.context.App.ErrWriter)
 
@@ -273,31 +294,34 @@ func (w *wizard) writeConfigFile() {
 }
 
 func (w *wizard) writeKeyAndCert() {
-	serverURL, err := url.ParseRequestURI(config.ExpandServerAddr(w.config.ServerAddr))
+	hosts, err := serverCertHosts(w.config.ServerAddr, w.certSANs)
 	if err != nil {
 		w.fail(err)
 	}
-	pemKey, pemCert, err := crypto.GenerateKeyAndCert(serverURL.Hostname())
-	if err != nil {
-		w.fail(err)
-	}
-
-	keyFile := config.DefaultKeyFile(w.configFile, false)
-	fmt.Fprintf(w.context.App.ErrWriter, "Writing private key file %s ... ", util.CollapseHome(keyFile))
-	if err := ioutil.WriteFile(keyFile, []byte(pemKey), 0600); err != nil {
-		w.fail(err)
+	var caKeyFile, caFile string
+	if w.createCA {
+		caKeyFile, caFile = config.DefaultCAKeyFile(w.configFile, false), config.DefaultCAFile(w.configFile, false)
+		pemCAKey, pemCACert, err := crypto.GenerateCA(fmt.Sprintf("pcopy CA (%s)", hosts[0]))
+		if err != nil {
+			w.fail(err)
+		}
+		w.writeFile("CA private key file", caKeyFile, pemCAKey, 0600)
+		w.writeFile("CA certificate", caFile, pemCACert, 0644)
 	}
-	if err := os.Chown(keyFile, w.uid, w.gid); err != nil {
+	pemKey, pemCert, err := generateServerCert(caKeyFile, caFile, nil, hosts)
+	if err != nil {
 		w.fail(err)
 	}
-	fmt.Fprintln(w.context.App.ErrWriter, "ok")
+	w.writeFile("private key file", config.DefaultKeyFile(w.configFile, false), pemKey, 0600)
+	w.writeFile("certificate", config.DefaultCertFile(w.configFile, false), pemCert, 0644)
+}
 
-	certFile := config.DefaultCertFile(w.configFile, false)
-	fmt.Fprintf(w.context.App.ErrWriter, "Writing certificate %s ... ", util.CollapseHome(certFile))
-	if err := ioutil.WriteFile(certFile, []byte(pemCert), 0644); err != nil {
+func (w *wizard) writeFile(description string, filename string, contents string, mode os.FileMode) {
+	fmt.Fprintf(w.context.App.ErrWriter, "Writing %s %s ... ", description, util.CollapseHome(filename))
+	if err := ioutil.WriteFile(filename, []byte(contents), mode); err != nil {
 		w.fail(err)
 	}
-	if err := os.Chown(certFile, w.uid, w.gid); err != nil {
+	if err := os.Chown(filename, w.uid, w.gid); err != nil {
 		w.fail(err)
 	}
 	fmt.Fprintln(w.context.App.ErrWriter, "ok")
@@ -309,6 +333,11 @@ func (w *wizard) writeSystemdUnit() {
 		w.fail(err)
 	}
 	fmt.Fprintln(w.context.App.ErrWriter, "ok")
+	fmt.Fprintf(w.context.App.ErrWriter, "Writing systemd socket unit file %s ... ", socketFile)
+	if err := ioutil.WriteFile(socketFile, []byte(config.SystemdSocketUnit), 0644); err != nil {
+		w.fail(err)
+	}
+	fmt.Fprintln(w.context.App.ErrWriter, "ok")
 }
 
 func (w *wizard) createUserAndGroup() {
@@ -7,11 +7,16 @@ import (
 	"fmt"
 	"golang.org/x/time/rate"
 	"heckel.io/pcopy/crypto"
+	"heckel.io/pcopy/log"
 	"heckel.io/pcopy/util"
 	"io"
+	"net"
+	"net/url"
 	"os"
 	"os/user"
+	"path"
 	"path/filepath"
+	"reflect"
 	"regexp"
 	"strconv"
 	"strings"
@@ -65,9 +70,49 @@ const (
 	// FileModeReadOnly ensures that files cannot be overwritten
 	FileModeReadOnly = "ro"
 
+	// MetricsOff disables the /metrics endpoint
+	MetricsOff = "off"
+
+	// MetricsOn exposes the /metrics endpoint without authentication
+	MetricsOn = "on"
+
+	// MetricsAuth exposes the /metrics endpoint, but requires authentication (like any other request)
+	MetricsAuth = "auth"
+
+	// SecretDetectionOff disables the detection of secrets in uploads, see SecretDetection
+	SecretDetectionOff = "off"
+
+	// SecretDetectionWarn accepts uploads that contain secrets, but warns the uploader
+	SecretDetectionWarn = "warn"
+
+	// SecretDetectionReject rejects uploads that contain secrets
+	SecretDetectionReject = "reject"
+
+	// SecretDetectionBurn accepts uploads that contain secrets, but deletes them after the first download, and
+	// limits their TTL (see SecretDetectionTTL)
+	SecretDetectionBurn = "burn"
+
+	// WebhookEventUpload is the webhook event for a completed upload, see Webhook
+	WebhookEventUpload = "upload"
+
+	// WebhookEventDownload is the webhook event for a completed download, see Webhook
+	WebhookEventDownload = "download"
+
+	// WebhookEventDelete is the webhook event for a file that was deleted by an operator, see Webhook
+	WebhookEventDelete = "delete"
+
+	// WebhookEventExpire is the webhook event for a file that was deleted because it expired, see Webhook
+	WebhookEventExpire = "expire"
+
 	// EnvKey provides the ability to provide a key for certain CLI commands
 	EnvKey = "PCOPY_KEY"
 
+	// EnvKeyPassphrase provides the passphrase to decrypt the KeyEncryptedFile for certain CLI commands
+	EnvKeyPassphrase = "PCOPY_KEY_PASSPHRASE"
+
+	// EnvAdminKey provides the admin key to 'pcopy admin' when talking to a remote admin API, see AdminKey
+	EnvAdminKey = "PCOPY_ADMIN_KEY"
+
 	// EnvConfigDir allows overriding the user-specific config dir
 	EnvConfigDir = "PCOPY_CONFIG_DIR"
 
@@ -75,8 +120,15 @@ const (
 	userConfigDir          = "~/.config/pcopy"
 	suffixConf             = ".conf"
 	suffixKey              = ".key"
+	suffixKeyEncrypted     = ".key.enc"
 	suffixCert             = ".crt"
+	suffixCA               = ".ca.crt"
+	suffixCAKey            = ".ca.key"
+	adminConfigDirName     = "clipboards.d"
 	defaultManagerInterval = 30 * time.Second
+
+	previousKeyRetiresFormat     = time.RFC3339
+	previousKeyRetiresDateFormat = "2006-01-02"
 )
 
 var (
@@ -84,34 +136,94 @@ var (
 	//go:embed "pcopy.service"
 	SystemdUnit string
 
+	// SystemdSocketUnit contains the systemd socket unit file content, used for socket activation.
+	//go:embed "pcopy.socket"
+	SystemdSocketUnit string
+
 	//go:embed "config.conf.tmpl"
 	configTemplateSource string
 	configTemplate       = template.Must(template.New("config").Funcs(templateFnMap).Parse(configTemplateSource))
 
+	// listenAddrRegex matches a single address of the ListenAddr option: A TCP address ([ADDR]:PORT, IPv6
+	// addresses in brackets), a Unix socket (unix:PATH) or a socket passed by systemd (systemd:NAME),
+	// each optionally followed by the protocol
+	listenAddrRegex = regexp.MustCompile(`^(?i)(unix:/.+?|systemd:[^/\s]+|(?:\[[0-9a-f:.]+\]|[^:/\[\]\s]*):\d+)(?:/(https|http|tcp))?$`)
+
+	// basePathRegex matches the BasePath option: One or more path segments, each starting with a slash
+	basePathRegex = regexp.MustCompile(`^(/[-_.~a-zA-Z0-9]+)*/?$`)
+
+	// contentPolicyTypeRegex matches the type of a ContentPolicies entry: A MIME type (image/png), a wildcard
+	// for all subtypes (image/*), or a wildcard for all types (*/*)
+	contentPolicyTypeRegex = regexp.MustCompile(`^(\*/\*|[a-z0-9][-a-z0-9.+]*/(\*|[a-z0-9][-a-z0-9.+]*))$`)
+
 	templateFnMap = template.FuncMap{
-		"encodeKey":       crypto.EncodeKey,
-		"durationToHuman": util.DurationToHuman,
-		"stringsJoin":     strings.Join,
+		"encodeKey":             crypto.EncodeKey,
+		"encodePreviousKey":     encodePreviousKey,
+		"durationToHuman":       util.DurationToHuman,
+		"stringsJoin":           strings.Join,
+		"ipNetsToString":        util.IPNetsToString,
+		"encodeListenAddrs":     encodeListenAddrs,
+		"encodeWebhooks":        encodeWebhooks,
+		"encodeContentPolicies": encodeContentPolicies,
 	}
 
 	defaultLimitGET      = rate.Every(time.Second)
 	defaultLimitGETBurst = 200
 	defaultLimitPUT      = rate.Every(time.Minute)
 	defaultLimitPUTBurst = 50
+
+	defaultAuthLockoutThreshold   = 10
+	defaultAuthLockoutDuration    = time.Minute
+	defaultAuthLockoutMaxDuration = time.Hour
+
+	defaultCertExpiryWarning = 30 * 24 * time.Hour
+
+	defaultAuditLogMaxSize  = int64(10 * 1024 * 1024)
+	defaultAuditLogMaxFiles = 5
+
+	defaultSecretDetectionTTL = 10 * time.Minute
+
+	defaultUploadScanError   = "upload rejected by content scan"
+	defaultUploadHookTimeout = time.Minute
+
+	defaultLogFileMaxSize  = int64(10 * 1024 * 1024)
+	defaultLogFileMaxFiles = 5
+
+	defaultReadyMinFreeSpace = int64(10 * 1024 * 1024)
+
+	defaultShutdownTimeout = 30 * time.Second
 )
 
 // Config is the configuration struct used to configure the client and the server. Some settings only apply to
 // the client, others only to the server. Some apply to both. Many (but not all) of these settings can be set either
 // via the config file, or via command line parameters.
 type Config struct {
-	ListenHTTPS               string
-	ListenHTTP                string
-	ListenTCP                 string
+	ListenHTTPS               []string
+	ListenHTTP                []string
+	ListenTCP                 []string
 	ServerAddr                string
+	BasePath                  string
 	DefaultID                 string
 	Key                       *crypto.Key
+	PreviousKeys              []*PreviousKey
+	KeyCommand                string
+	KeyEncryptedFile          string
+	KeyPassphraseFunc         func() ([]byte, error)
 	KeyFile                   string
 	CertFile                  string
+	CAFile                    string
+	CAKeyFile                 string
+	CertExpiryWarning         time.Duration
+	ClientCAFile              string
+	ClientCertAllow           []string
+	ClientCertFile            string
+	ClientKeyFile             string
+	TrustedProxies            []*net.IPNet
+	RedirectHTTPS             bool
+	AllowRead                 []*net.IPNet
+	DenyRead                  []*net.IPNet
+	AllowWrite                []*net.IPNet
+	DenyWrite                 []*net.IPNet
 	ClipboardName             string
 	ClipboardDir              string
 	ClipboardSizeLimit        int64
@@ -127,18 +239,153 @@ type Config struct {
 	LimitGETBurst             int
 	LimitPUT                  rate.Limit
 	LimitPUTBurst             int
+	AuthLockoutThreshold      int
+	AuthLockoutDuration       time.Duration
+	AuthLockoutMaxDuration    time.Duration
+	AuditLogFile              string
+	AuditLogMaxSize           int64
+	AuditLogMaxFiles          int
+	Webhooks                  []*Webhook
+	ContentPolicies           []*ContentPolicy
+	SecretDetection           string
+	SecretDetectionTTL        time.Duration
+	UploadScan                string
+	UploadScanError           string
+	UploadHook                string
+	UploadHookTimeout         time.Duration
+	Metrics                   string
+	MetricsListenAddr         string
+	AdminListenAddr           string
+	AdminListenHTTPS          bool
+	AdminKey                  *crypto.Key
+	AdminConfigDir            string
+	LogLevel                  log.Level
+	LogFormat                 string
+	LogFile                   string
+	LogFileMaxSize            int64
+	LogFileMaxFiles           int
+	ReadyMinFreeSpace         int64
+	ShutdownTimeout           time.Duration
+}
+
+// PreviousKey is a former clipboard key that is still accepted by the server after the key has been rotated.
+// If Retires is set, the key is no longer accepted after that time.
+type PreviousKey struct {
+	Key     *crypto.Key
+	Retires time.Time
+}
+
+// Retired returns true if the previous key has passed its retirement date
+func (k *PreviousKey) Retired() bool {
+	return !k.Retires.IsZero() && time.Now().After(k.Retires)
+}
+
+// Webhook is a URL that is notified via HTTP POST about clipboard events. If Events is empty, the webhook is
+// notified about all events. If Prefix is set, only events for file IDs with that prefix are sent. If Secret
+// is set, the request body is signed with it (HMAC-SHA256).
+type Webhook struct {
+	URL    string
+	Events []string
+	Prefix string
+	Secret string
+}
+
+// Matches returns true if the webhook should be notified about the given event and file ID
+func (w *Webhook) Matches(event string, id string) bool {
+	if w.Prefix != "" && !strings.HasPrefix(id, w.Prefix) {
+		return false
+	}
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, e := range w.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// ContentPolicy is a rule for uploaded files of a certain content type, as detected by sniffing the first bytes
+// of the file (see util.DetectContentType). Type is a MIME type (e.g. "image/png"), a wildcard for all subtypes
+// (e.g. "image/*"), or "*/*" for all types. If Deny is set, files of this type are rejected. MaxSize and MaxTTL
+// limit the size and the expiry of files of this type, if set. If Download is set, files of this type are always
+// sent as attachment, instead of being displayed in the browser.
+type ContentPolicy struct {
+	Type     string
+	Deny     bool
+	MaxSize  int64
+	MaxTTL   time.Duration
+	Download bool
+}
+
+// Matches returns true if the policy applies to the given content type. Parameters (e.g. "; charset=utf-8")
+// are ignored.
+func (p *ContentPolicy) Matches(contentType string) bool {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	if p.Type == "*/*" || p.Type == mediaType {
+		return true
+	} else if strings.HasSuffix(p.Type, "/*") {
+		return strings.HasPrefix(mediaType, strings.TrimSuffix(p.Type, "*"))
+	}
+	return false
+}
+
+// String returns the policy in the format of a ContentPolicies entry, see encodeContentPolicies
+func (p *ContentPolicy) String() string {
+	policy := p.Type
+	if p.Deny {
+		policy += "|deny"
+	}
+	if p.MaxSize > 0 {
+		policy += "|max-size=" + strconv.FormatInt(p.MaxSize, 10)
+	}
+	if p.MaxTTL > 0 {
+		policy += "|max-ttl=" + util.DurationToHuman(p.MaxTTL)
+	}
+	if p.Download {
+		policy += "|download"
+	}
+	return policy
+}
+
+// ContentPolicy returns the first content policy that matches the given content type, or nil if there is none
+func (c *Config) ContentPolicy(contentType string) *ContentPolicy {
+	for _, policy := range c.ContentPolicies {
+		if policy.Matches(contentType) {
+			return policy
+		}
+	}
+	return nil
 }
 
 // New returns the default config
 func New() *Config {
 	return &Config{
-		ListenHTTPS:               fmt.Sprintf(":%d", DefaultPort),
-		ListenHTTP:                "",
-		ListenTCP:                 "",
+		ListenHTTPS:               []string{fmt.Sprintf(":%d", DefaultPort)},
+		ListenHTTP:                nil,
+		ListenTCP:                 nil,
 		ServerAddr:                "",
 		Key:                       nil,
+		PreviousKeys:              nil,
+		KeyCommand:                "",
+		KeyEncryptedFile:          "",
+		KeyPassphraseFunc:         nil,
 		KeyFile:                   "",
 		CertFile:                  "",
+		CAFile:                    "",
+		CAKeyFile:                 "",
+		CertExpiryWarning:         defaultCertExpiryWarning,
+		ClientCAFile:              "",
+		ClientCertAllow:           nil,
+		ClientCertFile:            "",
+		ClientKeyFile:             "",
+		TrustedProxies:            nil,
+		RedirectHTTPS:             true,
+		AllowRead:                 nil,
+		DenyRead:                  nil,
+		AllowWrite:                nil,
+		DenyWrite:                 nil,
 		DefaultID:                 DefaultID,
 		ClipboardName:             DefaultClipboardName,
 		ClipboardDir:              DefaultClipboardDir,
@@ -155,6 +402,28 @@ func New() *Config {
 		LimitGETBurst:             defaultLimitGETBurst,
 		LimitPUT:                  defaultLimitPUT,
 		LimitPUTBurst:             defaultLimitPUTBurst,
+		AuthLockoutThreshold:      defaultAuthLockoutThreshold,
+		AuthLockoutDuration:       defaultAuthLockoutDuration,
+		AuthLockoutMaxDuration:    defaultAuthLockoutMaxDuration,
+		AuditLogFile:              "",
+		AuditLogMaxSize:           defaultAuditLogMaxSize,
+		AuditLogMaxFiles:          defaultAuditLogMaxFiles,
+		ContentPolicies:           nil,
+		SecretDetection:           SecretDetectionOff,
+		SecretDetectionTTL:        defaultSecretDetectionTTL,
+		UploadScan:                "",
+		UploadScanError:           defaultUploadScanError,
+		UploadHook:                "",
+		UploadHookTimeout:         defaultUploadHookTimeout,
+		Metrics:                   MetricsOff,
+		MetricsListenAddr:         "",
+		LogLevel:                  log.InfoLevel,
+		LogFormat:                 log.FormatText,
+		LogFile:                   log.OutputStderr,
+		LogFileMaxSize:            defaultLogFileMaxSize,
+		LogFileMaxFiles:           defaultLogFileMaxFiles,
+		ReadyMinFreeSpace:         defaultReadyMinFreeSpace,
+		ShutdownTimeout:           defaultShutdownTimeout,
 	}
 }
 
@@ -178,6 +447,87 @@ func (c *Config) WriteFile(filename string) error {
 	return nil
 }
 
+// WriteKeysToFile writes the Key and PreviousKeys options of the config to an existing config file, e.g. after
+// the key was rotated. Unlike WriteFile, all other lines of the file (including comments and formatting) are
+// left untouched.
+func (c *Config) WriteKeysToFile(filename string) error {
+	previousKeys := make([]string, 0)
+	for _, k := range c.PreviousKeys {
+		previousKeys = append(previousKeys, encodePreviousKey(k))
+	}
+	options := [][2]string{{"Key", ""}, {"PreviousKeys", strings.Join(previousKeys, " ")}}
+	if c.Key != nil {
+		options[0][1] = crypto.EncodeKey(c.Key)
+	}
+	return updateFile(filename, options)
+}
+
+// updateFile sets the given options (name and value) in an existing config file. All active lines of an option
+// are replaced; if there are none, the commented-out placeholder of the option (e.g. "# Key") is replaced, or the
+// option is appended to the file. Options with an empty value are commented out.
+func updateFile(filename string, options [][2]string) error {
+	stat, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	contents, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(string(contents), "\n")
+	for _, option := range options {
+		name, value := option[0], option[1]
+		line := fmt.Sprintf("%s %s", name, value)
+		if value == "" {
+			line = fmt.Sprintf("# %s", name)
+		}
+		active := regexp.MustCompile(`^\s*` + regexp.QuoteMeta(name) + `(\s|$)`)
+		placeholder := regexp.MustCompile(`^\s*#\s*` + regexp.QuoteMeta(name) + `\s*$`)
+		replaced := false
+		for i := range lines {
+			if active.MatchString(lines[i]) {
+				lines[i] = line
+				replaced = true
+			}
+		}
+		for i := 0; i < len(lines) && !replaced; i++ {
+			if placeholder.MatchString(lines[i]) {
+				lines[i] = line
+				replaced = true
+			}
+		}
+		if !replaced && len(lines) > 0 && lines[len(lines)-1] == "" {
+			lines = append(lines[:len(lines)-1], line, "")
+		} else if !replaced {
+			lines = append(lines, line)
+		}
+	}
+	return os.WriteFile(filename, []byte(strings.Join(lines, "\n")), stat.Mode().Perm())
+}
+
+// Diff returns a list of the settings that differ between the two configs, e.g. "FileSizeLimit: 10485760 -> 20971520".
+// The values of secret settings (the keys) are not included. Func-typed settings are ignored.
+func Diff(a, b *Config) []string {
+	changes := make([]string, 0)
+	va, vb := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+	for i := 0; i < va.NumField(); i++ {
+		field := va.Type().Field(i)
+		if field.Type.Kind() == reflect.Func {
+			continue
+		}
+		fa, fb := va.Field(i).Interface(), vb.Field(i).Interface()
+		if reflect.DeepEqual(fa, fb) {
+			continue
+		}
+		if field.Name == "Key" || field.Name == "PreviousKeys" || field.Name == "AdminKey" || field.Name == "Webhooks" {
+			changes = append(changes, fmt.Sprintf("%s changed", field.Name))
+		} else {
+			changes = append(changes, fmt.Sprintf("%s: %v -> %v", field.Name, fa, fb))
+		}
+	}
+	return changes
+}
+
 // LoadFromFile loads the configuration from a file
 func LoadFromFile(filename string) (*Config, error) {
 	file, err := os.Open(filename)
@@ -195,6 +545,15 @@ func LoadFromFile(filename string) (*Config, error) {
 	if config.CertFile == "" {
 		config.CertFile = DefaultCertFile(filename, true)
 	}
+	if config.CAFile == "" {
+		config.CAFile = DefaultCAFile(filename, true)
+	}
+	if config.CAKeyFile == "" {
+		config.CAKeyFile = DefaultCAKeyFile(filename, true)
+	}
+	if config.AdminListenAddr != "" && config.AdminConfigDir == "" {
+		config.AdminConfigDir = DefaultAdminConfigDir(filename)
+	}
 	return config, nil
 }
 
@@ -219,35 +578,25 @@ func loadConfig(reader io.Reader) (*Config, error) {
 
 	listenAddr, ok := raw["ListenAddr"]
 	if ok {
-		config.ListenHTTP = ""
-		config.ListenHTTPS = ""
-		config.ListenTCP = ""
-		re := regexp.MustCompile(`^(?i)([^:]*:\d+)?(?:/(https|http|tcp))?`)
-		addrs := strings.Split(listenAddr, " ")
-		for _, addr := range addrs {
-			matches := re.FindStringSubmatch(addr)
+		config.ListenHTTP = nil
+		config.ListenHTTPS = nil
+		config.ListenTCP = nil
+		seen := make(map[string]bool)
+		for _, addr := range strings.Fields(listenAddr) {
+			matches := listenAddrRegex.FindStringSubmatch(addr)
 			if matches == nil {
 				return nil, fmt.Errorf("invalid config value for 'ListenAddr', for address %s", addr)
+			} else if seen[matches[1]] {
+				return nil, fmt.Errorf("invalid config value for 'ListenAddr': address %s defined more than once", matches[1])
 			}
-			proto := "https"
-			if len(matches) == 3 {
-				proto = strings.ToLower(matches[2])
-			}
+			seen[matches[1]] = true
+			proto := strings.ToLower(matches[2])
 			if proto == "tcp" {
-				if config.ListenTCP != "" {
-					return nil, fmt.Errorf("invalid config value for 'ListenAddr': TCP address defined more than once")
-				}
-				config.ListenTCP = matches[1]
+				config.ListenTCP = append(config.ListenTCP, matches[1])
 			} else if proto == "http" {
-				if config.ListenHTTP != "" {
-					return nil, fmt.Errorf("invalid config value for 'ListenAddr': HTTP address defined more than once")
-				}
-				config.ListenHTTP = matches[1]
+				config.ListenHTTP = append(config.ListenHTTP, matches[1])
 			} else {
-				if config.ListenHTTPS != "" {
-					return nil, fmt.Errorf("invalid config value for 'ListenAddr': HTTPS address defined more than once")
-				}
-				config.ListenHTTPS = matches[1]
+				config.ListenHTTPS = append(config.ListenHTTPS, matches[1])
 			}
 		}
 	}
@@ -257,6 +606,14 @@ func loadConfig(reader io.Reader) (*Config, error) {
 		config.ServerAddr = ExpandServerAddr(serverAddr)
 	}
 
+	basePath, ok := raw["BasePath"]
+	if ok {
+		if basePath != "" && !basePathRegex.MatchString(basePath) {
+			return nil, fmt.Errorf("invalid config value for 'BasePath': %s", basePath)
+		}
+		config.BasePath = strings.TrimSuffix(basePath, "/")
+	}
+
 	defaultID, ok := raw["DefaultID"]
 	if ok {
 		re := regexp.MustCompile(`^[a-z0-9][-_.a-z0-9]*$`)
@@ -274,6 +631,31 @@ func loadConfig(reader io.Reader) (*Config, error) {
 		}
 	}
 
+	previousKeys, ok := raw["PreviousKeys"]
+	if ok && previousKeys != "" {
+		config.PreviousKeys = make([]*PreviousKey, 0)
+		for _, previousKey := range strings.Split(previousKeys, " ") {
+			k, err := decodePreviousKey(previousKey)
+			if err != nil {
+				return nil, fmt.Errorf("invalid config value for 'PreviousKeys': %w", err)
+			}
+			config.PreviousKeys = append(config.PreviousKeys, k)
+		}
+	}
+
+	keyCommand, ok := raw["KeyCommand"]
+	if ok {
+		config.KeyCommand = keyCommand
+	}
+
+	keyEncryptedFile, ok := raw["KeyEncryptedFile"]
+	if ok {
+		if _, err := os.Stat(keyEncryptedFile); err != nil {
+			return nil, err
+		}
+		config.KeyEncryptedFile = keyEncryptedFile
+	}
+
 	keyFile, ok := raw["KeyFile"]
 	if ok {
 		if _, err := os.Stat(keyFile); err != nil {
@@ -290,6 +672,99 @@ func loadConfig(reader io.Reader) (*Config, error) {
 		config.CertFile = certFile
 	}
 
+	caFile, ok := raw["CAFile"]
+	if ok {
+		if _, err := os.Stat(caFile); err != nil {
+			return nil, err
+		}
+		config.CAFile = caFile
+	}
+
+	caKeyFile, ok := raw["CAKeyFile"]
+	if ok {
+		if _, err := os.Stat(caKeyFile); err != nil {
+			return nil, err
+		}
+		config.CAKeyFile = caKeyFile
+	}
+
+	shutdownTimeout, ok := raw["ShutdownTimeout"]
+	if ok {
+		config.ShutdownTimeout, err = util.ParseDuration(shutdownTimeout)
+		if err != nil || config.ShutdownTimeout < 0 {
+			return nil, fmt.Errorf("invalid config value for 'ShutdownTimeout': %s", shutdownTimeout)
+		}
+	}
+
+	certExpiryWarning, ok := raw["CertExpiryWarning"]
+	if ok {
+		config.CertExpiryWarning, err = util.ParseDuration(certExpiryWarning)
+		if err != nil || config.CertExpiryWarning < 0 {
+			return nil, fmt.Errorf("invalid config value for 'CertExpiryWarning': %s", certExpiryWarning)
+		}
+	}
+
+	clientCAFile, ok := raw["ClientCAFile"]
+	if ok {
+		if _, err := os.Stat(clientCAFile); err != nil {
+			return nil, err
+		}
+		config.ClientCAFile = clientCAFile
+	}
+
+	clientCertAllow, ok := raw["ClientCertAllow"]
+	if ok && clientCertAllow != "" {
+		config.ClientCertAllow = strings.Split(clientCertAllow, " ")
+		for _, pattern := range config.ClientCertAllow {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid config value for 'ClientCertAllow': %s", pattern)
+			}
+		}
+	}
+
+	redirectHTTPS, ok := raw["RedirectHTTPS"]
+	if ok && redirectHTTPS != "" {
+		if redirectHTTPS != "on" && redirectHTTPS != "off" {
+			return nil, fmt.Errorf("invalid config value for 'RedirectHTTPS': %s, must be on or off", redirectHTTPS)
+		}
+		config.RedirectHTTPS = redirectHTTPS == "on"
+	}
+
+	for _, option := range []struct {
+		name  string
+		value *[]*net.IPNet
+	}{
+		{"TrustedProxies", &config.TrustedProxies},
+		{"AllowRead", &config.AllowRead},
+		{"DenyRead", &config.DenyRead},
+		{"AllowWrite", &config.AllowWrite},
+		{"DenyWrite", &config.DenyWrite},
+	} {
+		value, ok := raw[option.name]
+		if ok && value != "" {
+			*option.value, err = util.ParseIPNets(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid config value for '%s': %w", option.name, err)
+			}
+		}
+	}
+
+	clientCertFile, ok := raw["ClientCertFile"]
+	if ok {
+		if _, err := os.Stat(clientCertFile); err != nil {
+			return nil, err
+		}
+		config.ClientCertFile = clientCertFile
+	}
+
+	clientKeyFile, ok := raw["ClientKeyFile"]
+	if ok {
+		if _, err := os.Stat(clientKeyFile); err != nil {
+			return nil, err
+		}
+		config.ClientKeyFile = clientKeyFile
+	}
+
 	clipboardName, ok := raw["ClipboardName"]
 	if ok {
 		config.ClipboardName = clipboardName
@@ -308,6 +783,14 @@ func loadConfig(reader io.Reader) (*Config, error) {
 		}
 	}
 
+	readyMinFreeSpace, ok := raw["ReadyMinFreeSpace"]
+	if ok {
+		config.ReadyMinFreeSpace, err = util.ParseSize(readyMinFreeSpace)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config value for 'ReadyMinFreeSpace': %w", err)
+		}
+	}
+
 	clipboardCountLimit, ok := raw["ClipboardCountLimit"]
 	if ok {
 		config.ClipboardCountLimit, err = strconv.Atoi(clipboardCountLimit)
@@ -369,9 +852,332 @@ func loadConfig(reader io.Reader) (*Config, error) {
 		config.FileModesAllowed = modes
 	}
 
+	authLockout, ok := raw["AuthLockout"]
+	if ok {
+		parts := strings.Split(authLockout, " ")
+		config.AuthLockoutThreshold, err = strconv.Atoi(parts[0])
+		if err != nil || config.AuthLockoutThreshold < 0 {
+			return nil, fmt.Errorf("invalid config value for 'AuthLockout': invalid threshold %s", parts[0])
+		}
+		if len(parts) > 1 {
+			config.AuthLockoutDuration, err = util.ParseDuration(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid config value for 'AuthLockout': %w", err)
+			}
+		}
+		if len(parts) > 2 {
+			config.AuthLockoutMaxDuration, err = util.ParseDuration(parts[2])
+			if err != nil {
+				return nil, fmt.Errorf("invalid config value for 'AuthLockout': %w", err)
+			}
+		}
+		if config.AuthLockoutMaxDuration < config.AuthLockoutDuration {
+			return nil, fmt.Errorf("invalid config value for 'AuthLockout': duration cannot be larger than max-duration")
+		}
+	}
+
+	auditLog, ok := raw["AuditLog"]
+	if ok && auditLog != "" {
+		parts := strings.Split(auditLog, " ")
+		config.AuditLogFile = parts[0]
+		if len(parts) > 1 {
+			config.AuditLogMaxSize, err = util.ParseSize(parts[1])
+			if err != nil || config.AuditLogMaxSize <= 0 {
+				return nil, fmt.Errorf("invalid config value for 'AuditLog': invalid max size %s", parts[1])
+			}
+		}
+		if len(parts) > 2 {
+			config.AuditLogMaxFiles, err = strconv.Atoi(parts[2])
+			if err != nil || config.AuditLogMaxFiles < 0 {
+				return nil, fmt.Errorf("invalid config value for 'AuditLog': invalid max files %s", parts[2])
+			}
+		}
+	}
+
+	webhooks, ok := raw["Webhooks"]
+	if ok && webhooks != "" {
+		config.Webhooks = make([]*Webhook, 0)
+		for _, webhook := range strings.Fields(webhooks) {
+			w, err := decodeWebhook(webhook)
+			if err != nil {
+				return nil, fmt.Errorf("invalid config value for 'Webhooks': %w", err)
+			}
+			config.Webhooks = append(config.Webhooks, w)
+		}
+	}
+
+	contentPolicies, ok := raw["ContentPolicies"]
+	if ok && contentPolicies != "" {
+		config.ContentPolicies = make([]*ContentPolicy, 0)
+		for _, policy := range strings.Fields(contentPolicies) {
+			p, err := decodeContentPolicy(policy)
+			if err != nil {
+				return nil, fmt.Errorf("invalid config value for 'ContentPolicies': %w", err)
+			}
+			config.ContentPolicies = append(config.ContentPolicies, p)
+		}
+	}
+
+	secretDetection, ok := raw["SecretDetection"]
+	if ok && secretDetection != "" {
+		parts := strings.Split(secretDetection, " ")
+		mode := parts[0]
+		if mode != SecretDetectionOff && mode != SecretDetectionWarn && mode != SecretDetectionReject && mode != SecretDetectionBurn {
+			return nil, fmt.Errorf("invalid config value for 'SecretDetection': %s, must be off, warn, reject or burn", mode)
+		}
+		config.SecretDetection = mode
+		if len(parts) > 1 {
+			config.SecretDetectionTTL, err = util.ParseDuration(parts[1])
+			if err != nil || config.SecretDetectionTTL <= 0 {
+				return nil, fmt.Errorf("invalid config value for 'SecretDetection': invalid TTL %s", parts[1])
+			}
+		}
+	}
+
+	uploadScan, ok := raw["UploadScan"]
+	if ok {
+		config.UploadScan = uploadScan
+	}
+
+	uploadScanError, ok := raw["UploadScanError"]
+	if ok && uploadScanError != "" {
+		config.UploadScanError = uploadScanError
+	}
+
+	uploadHook, ok := raw["UploadHook"]
+	if ok {
+		config.UploadHook = uploadHook
+	}
+
+	uploadHookTimeout, ok := raw["UploadHookTimeout"]
+	if ok {
+		config.UploadHookTimeout, err = util.ParseDuration(uploadHookTimeout)
+		if err != nil || config.UploadHookTimeout <= 0 {
+			return nil, fmt.Errorf("invalid config value for 'UploadHookTimeout': %s", uploadHookTimeout)
+		}
+	}
+
+	metrics, ok := raw["Metrics"]
+	if ok && metrics != "" {
+		parts := strings.Split(metrics, " ")
+		if parts[0] != MetricsOff && parts[0] != MetricsOn && parts[0] != MetricsAuth {
+			return nil, fmt.Errorf("invalid config value for 'Metrics': %s, must be off, on or auth", parts[0])
+		}
+		config.Metrics = parts[0]
+		if len(parts) > 1 {
+			if _, _, err := net.SplitHostPort(parts[1]); err != nil {
+				return nil, fmt.Errorf("invalid config value for 'Metrics': invalid listen address %s", parts[1])
+			}
+			config.MetricsListenAddr = parts[1]
+		}
+	}
+
+	adminListenAddr, ok := raw["AdminListenAddr"]
+	if ok && adminListenAddr != "" {
+		matches := listenAddrRegex.FindStringSubmatch(adminListenAddr)
+		if matches == nil || strings.HasPrefix(adminListenAddr, "systemd:") {
+			return nil, fmt.Errorf("invalid config value for 'AdminListenAddr': %s", adminListenAddr)
+		}
+		proto := strings.ToLower(matches[2])
+		if (proto != "" && proto != "https") || (proto == "https" && strings.HasPrefix(adminListenAddr, "unix:")) {
+			return nil, fmt.Errorf("invalid config value for 'AdminListenAddr': %s", adminListenAddr)
+		}
+		config.AdminListenAddr = matches[1]
+		config.AdminListenHTTPS = proto == "https"
+	}
+
+	adminKey, ok := raw["AdminKey"]
+	if ok && adminKey != "" {
+		config.AdminKey, err = crypto.DecodeKey(adminKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config value for 'AdminKey': %w", err)
+		}
+	}
+
+	adminConfigDir, ok := raw["AdminConfigDir"]
+	if ok {
+		config.AdminConfigDir = adminConfigDir
+	}
+
+	logLevel, ok := raw["LogLevel"]
+	if ok && logLevel != "" {
+		config.LogLevel, err = log.ToLevel(logLevel)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config value for 'LogLevel': %w", err)
+		}
+	}
+
+	logFormat, ok := raw["LogFormat"]
+	if ok && logFormat != "" {
+		if err := log.CheckFormat(logFormat); err != nil {
+			return nil, fmt.Errorf("invalid config value for 'LogFormat': %w", err)
+		}
+		config.LogFormat = logFormat
+	}
+
+	logFile, ok := raw["LogFile"]
+	if ok && logFile != "" {
+		parts := strings.Split(logFile, " ")
+		config.LogFile = parts[0]
+		if len(parts) > 1 {
+			config.LogFileMaxSize, err = util.ParseSize(parts[1])
+			if err != nil || config.LogFileMaxSize <= 0 {
+				return nil, fmt.Errorf("invalid config value for 'LogFile': invalid max size %s", parts[1])
+			}
+		}
+		if len(parts) > 2 {
+			config.LogFileMaxFiles, err = strconv.Atoi(parts[2])
+			if err != nil || config.LogFileMaxFiles < 0 {
+				return nil, fmt.Errorf("invalid config value for 'LogFile': invalid max files %s", parts[2])
+			}
+		}
+	}
+
 	return config, nil
 }
 
+// encodePreviousKey encodes a previous key in the format SALT:KEY[@RETIRE-DATE]
+// encodeListenAddrs returns the listen addresses of the config in the format of the ListenAddr option
+func encodeListenAddrs(c *Config) string {
+	addrs := make([]string, 0)
+	for _, addr := range c.ListenHTTPS {
+		addrs = append(addrs, addr+"/https")
+	}
+	for _, addr := range c.ListenHTTP {
+		addrs = append(addrs, addr+"/http")
+	}
+	for _, addr := range c.ListenTCP {
+		addrs = append(addrs, addr+"/tcp")
+	}
+	return strings.Join(addrs, " ")
+}
+
+func encodePreviousKey(k *PreviousKey) string {
+	if k.Retires.IsZero() {
+		return crypto.EncodeKey(k.Key)
+	}
+	return fmt.Sprintf("%s@%s", crypto.EncodeKey(k.Key), k.Retires.Format(previousKeyRetiresFormat))
+}
+
+// decodePreviousKey decodes a previous key in the format SALT:KEY[@RETIRE-TIME], where RETIRE-TIME is either
+// an RFC3339 timestamp, or a date (YYYY-MM-DD), meaning the start of that day in local time
+func decodePreviousKey(s string) (*PreviousKey, error) {
+	parts := strings.SplitN(s, "@", 2)
+	key, err := crypto.DecodeKey(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	previousKey := &PreviousKey{Key: key}
+	if len(parts) > 1 {
+		previousKey.Retires, err = time.Parse(previousKeyRetiresFormat, parts[1])
+		if err != nil {
+			previousKey.Retires, err = time.ParseInLocation(previousKeyRetiresDateFormat, parts[1], time.Local)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return previousKey, nil
+}
+
+// encodeWebhooks encodes the webhooks in the format of the Webhooks option, i.e. space-separated entries in the
+// format URL[|events=EVENT,..][|prefix=PREFIX][|secret=SECRET]
+func encodeWebhooks(webhooks []*Webhook) string {
+	encoded := make([]string, 0)
+	for _, w := range webhooks {
+		webhook := w.URL
+		if len(w.Events) > 0 {
+			webhook += "|events=" + strings.Join(w.Events, ",")
+		}
+		if w.Prefix != "" {
+			webhook += "|prefix=" + w.Prefix
+		}
+		if w.Secret != "" {
+			webhook += "|secret=" + w.Secret
+		}
+		encoded = append(encoded, webhook)
+	}
+	return strings.Join(encoded, " ")
+}
+
+// decodeWebhook decodes a single webhook in the format URL[|events=EVENT,..][|prefix=PREFIX][|secret=SECRET]
+func decodeWebhook(s string) (*Webhook, error) {
+	parts := strings.Split(s, "|")
+	u, err := url.Parse(parts[0])
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid URL %s", parts[0])
+	}
+	webhook := &Webhook{URL: parts[0]}
+	for _, option := range parts[1:] {
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("invalid option %s for webhook %s", option, parts[0])
+		}
+		switch kv[0] {
+		case "events":
+			for _, event := range strings.Split(kv[1], ",") {
+				if event != WebhookEventUpload && event != WebhookEventDownload && event != WebhookEventDelete && event != WebhookEventExpire {
+					return nil, fmt.Errorf("invalid event %s for webhook %s, must be upload, download, delete or expire", event, parts[0])
+				}
+				webhook.Events = append(webhook.Events, event)
+			}
+		case "prefix":
+			webhook.Prefix = kv[1]
+		case "secret":
+			webhook.Secret = kv[1]
+		default:
+			return nil, fmt.Errorf("invalid option %s for webhook %s", option, parts[0])
+		}
+	}
+	return webhook, nil
+}
+
+// encodeContentPolicies encodes the policies in the format of the ContentPolicies option, i.e. space-separated
+// entries in the format TYPE[|deny][|max-size=SIZE][|max-ttl=DURATION][|download]
+func encodeContentPolicies(policies []*ContentPolicy) string {
+	encoded := make([]string, 0)
+	for _, p := range policies {
+		encoded = append(encoded, p.String())
+	}
+	return strings.Join(encoded, " ")
+}
+
+// decodeContentPolicy decodes a single policy in the format TYPE[|deny][|max-size=SIZE][|max-ttl=DURATION][|download]
+func decodeContentPolicy(s string) (*ContentPolicy, error) {
+	parts := strings.Split(s, "|")
+	contentType := strings.ToLower(parts[0])
+	if !contentPolicyTypeRegex.MatchString(contentType) {
+		return nil, fmt.Errorf("invalid content type %s", parts[0])
+	}
+	policy := &ContentPolicy{Type: contentType}
+	for _, option := range parts[1:] {
+		kv := strings.SplitN(option, "=", 2)
+		var err error
+		switch {
+		case option == "deny":
+			policy.Deny = true
+		case option == "download":
+			policy.Download = true
+		case kv[0] == "max-size" && len(kv) == 2:
+			policy.MaxSize, err = util.ParseSize(kv[1])
+			if err == nil && policy.MaxSize <= 0 {
+				err = fmt.Errorf("max size must be positive")
+			}
+		case kv[0] == "max-ttl" && len(kv) == 2:
+			policy.MaxTTL, err = util.ParseDuration(kv[1])
+			if err == nil && policy.MaxTTL <= 0 {
+				err = fmt.Errorf("max TTL must be positive")
+			}
+		default:
+			err = fmt.Errorf("unknown option")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid option %s for content type %s: %w", option, parts[0], err)
+		}
+	}
+	return policy, nil
+}
+
 func loadRawConfig(reader io.Reader) (map[string]string, error) {
 	config := make(map[string]string)
 	scanner := bufio.NewScanner(reader)
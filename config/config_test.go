@@ -72,8 +72,8 @@ func TestLoadConfig_EmptyFileSuccess(t *testing.T) {
 	if config.ClipboardDir != DefaultClipboardDir {
 		t.Fatalf("expected %s, got %s", DefaultClipboardDir, config.ClipboardDir)
 	}
-	if config.ListenHTTPS != fmt.Sprintf(":%d", DefaultPort) {
-		t.Fatalf("expected %s, got %s", fmt.Sprintf(":%d", DefaultPort), config.ListenHTTPS)
+	if len(config.ListenHTTPS) != 1 || config.ListenHTTPS[0] != fmt.Sprintf(":%d", DefaultPort) {
+		t.Fatalf("expected %s, got %v", fmt.Sprintf(":%d", DefaultPort), config.ListenHTTPS)
 	}
 }
 
@@ -119,7 +119,7 @@ FileModesAllowed ro rw
 	if err != nil {
 		t.Fatal(err)
 	}
-	test.StrEquals(t, ":1234", config.ListenHTTPS)
+	test.StrEquals(t, ":1234", strings.Join(config.ListenHTTPS, " "))
 	test.StrEquals(t, "https://hi.com:2586", config.ServerAddr)
 	test.BytesEquals(t, test.FromBase64(t, "Osz6osE1fRRirA=="), config.Key.Salt)
 	test.BytesEquals(t, test.FromBase64(t, "XEBZJjB/7w4eCugzQSkwGMe8QW4nbsPvPMlle1wvW4I="), config.Key.Bytes)
@@ -141,8 +141,9 @@ FileModesAllowed ro rw
 func TestConfig_WriteFileAllTheThings(t *testing.T) {
 	config := New()
 	config.ServerAddr = "some-host.com"
-	config.ListenHTTPS = ":8888"
-	config.ListenHTTP = ":8889"
+	config.ListenHTTPS = []string{":8888"}
+	config.ListenHTTP = []string{":8889", "unix:/run/pcopy.sock"}
+	config.ListenTCP = []string{":9999"}
 	config.DefaultID = "some-id"
 	config.Key = &crypto.Key{Salt: []byte("some salt"), Bytes: []byte("16 bytes exactly")}
 	config.CertFile = "some cert file"
@@ -168,7 +169,7 @@ func TestConfig_WriteFileAllTheThings(t *testing.T) {
 	}
 	contents := string(b)
 	test.StrContains(t, contents, "ServerAddr some-host.com")
-	test.StrContains(t, contents, "ListenAddr :8888/https :8889/http")
+	test.StrContains(t, contents, "ListenAddr :8888/https :8889/http unix:/run/pcopy.sock/http :9999/tcp")
 	test.StrContains(t, contents, "DefaultID some-id")
 	test.StrContains(t, contents, "Key c29tZSBzYWx0:MTYgYnl0ZXMgZXhhY3RseQ==")
 	test.StrContains(t, contents, "CertFile some cert file")
@@ -196,6 +197,7 @@ func TestConfig_WriteFileNoneOfTheThings(t *testing.T) {
 	}
 	contents := string(b)
 	test.StrContains(t, contents, "# ServerAddr")
+	test.StrContains(t, contents, "# BasePath")
 	test.StrContains(t, contents, "# ListenAddr :2586")
 	test.StrContains(t, contents, "# DefaultID default")
 	test.StrContains(t, contents, "# Key")
@@ -208,6 +210,35 @@ func TestConfig_WriteFileNoneOfTheThings(t *testing.T) {
 	test.StrContains(t, contents, "# FileSizeLimit")
 	test.StrContains(t, contents, "# FileExpireAfter 7d")
 	test.StrContains(t, contents, "# FileModesAllowed rw ro")
+	test.StrContains(t, contents, "# ClientCAFile")
+	test.StrContains(t, contents, "# ClientCertFile")
+	test.StrContains(t, contents, "# AuthLockout 10 1m 1h")
+	test.StrContains(t, contents, "# PreviousKeys")
+	test.StrContains(t, contents, "# KeyCommand")
+	test.StrContains(t, contents, "# KeyEncryptedFile")
+	test.StrContains(t, contents, "# TrustedProxies")
+	test.StrContains(t, contents, "# RedirectHTTPS on")
+	test.StrContains(t, contents, "# AllowRead")
+	test.StrContains(t, contents, "# AuditLog")
+	test.StrContains(t, contents, "# Webhooks")
+	test.StrContains(t, contents, "# ContentPolicies")
+	test.StrContains(t, contents, "# SecretDetection off")
+	test.StrContains(t, contents, "# UploadScan")
+	test.StrContains(t, contents, "# UploadScanError upload rejected by content scan")
+	test.StrContains(t, contents, "# UploadHook")
+	test.StrContains(t, contents, "# UploadHookTimeout 1m")
+	test.StrContains(t, contents, "# CAFile")
+	test.StrContains(t, contents, "# CAKeyFile")
+	test.StrContains(t, contents, "# CertExpiryWarning 30d")
+	test.StrContains(t, contents, "# Metrics off")
+	test.StrContains(t, contents, "# LogLevel info")
+	test.StrContains(t, contents, "# LogFormat text")
+	test.StrContains(t, contents, "# LogFile stderr")
+	test.StrContains(t, contents, "# ReadyMinFreeSpace 10M")
+	test.StrContains(t, contents, "# ShutdownTimeout 30s")
+	test.StrContains(t, contents, "# AdminListenAddr")
+	test.StrContains(t, contents, "# AdminKey")
+	test.StrContains(t, contents, "# AdminConfigDir")
 }
 
 func TestConfig_LoadConfigFileExpireAfterNoValue(t *testing.T) {
@@ -260,6 +291,259 @@ func TestConfig_LoadConfigFileExpireAfterThreeValuesInfiniteText(t *testing.T) {
 	test.DurationEquals(t, 0, config.FileExpireAfterTextMax)
 }
 
+func TestConfig_LoadConfigAuthLockout(t *testing.T) {
+	config, err := loadConfig(strings.NewReader(`AuthLockout 5 30s 2h`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.Int64Equals(t, 5, int64(config.AuthLockoutThreshold))
+	test.DurationEquals(t, 30*time.Second, config.AuthLockoutDuration)
+	test.DurationEquals(t, 2*time.Hour, config.AuthLockoutMaxDuration)
+}
+
+func TestConfig_LoadConfigAuthLockoutInvalid(t *testing.T) {
+	_, err := loadConfig(strings.NewReader(`AuthLockout 5 2h 1h`))
+	if err == nil {
+		t.Fatalf("expected error, got none")
+	}
+}
+
+func TestConfig_LoadConfigClientCertAllow(t *testing.T) {
+	config, err := loadConfig(strings.NewReader(`ClientCertAllow *.fleet.example.com admin@example.com`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.Int64Equals(t, 2, int64(len(config.ClientCertAllow)))
+	test.StrEquals(t, "*.fleet.example.com", config.ClientCertAllow[0])
+	test.StrEquals(t, "admin@example.com", config.ClientCertAllow[1])
+}
+
+func TestConfig_LoadConfigPreviousKeys(t *testing.T) {
+	config, err := loadConfig(strings.NewReader(`PreviousKeys c29tZSBzYWx0IQ==:MzIgYnl0ZXMgZXhhY3RseSwgb3Igc28gaXQgc2VlbXM= b3RoZXIgc2FsdA==:MzIgYnl0ZXMgZXhhY3RseSwgb3Igc28gaXQgc2VlbXM=@2030-01-02`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.Int64Equals(t, 2, int64(len(config.PreviousKeys)))
+	test.BytesEquals(t, []byte("some salt!"), config.PreviousKeys[0].Key.Salt)
+	test.BoolEquals(t, true, config.PreviousKeys[0].Retires.IsZero())
+	test.BytesEquals(t, []byte("other salt"), config.PreviousKeys[1].Key.Salt)
+	test.StrEquals(t, "2030-01-02", config.PreviousKeys[1].Retires.Format("2006-01-02"))
+}
+
+func TestConfig_LoadConfigPreviousKeysExactTime(t *testing.T) {
+	config, err := loadConfig(strings.NewReader(`PreviousKeys b3RoZXIgc2FsdA==:MzIgYnl0ZXMgZXhhY3RseSwgb3Igc28gaXQgc2VlbXM=@2030-01-02T15:04:05Z`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.Int64Equals(t, 1, int64(len(config.PreviousKeys)))
+	test.Int64Equals(t, time.Date(2030, 1, 2, 15, 4, 5, 0, time.UTC).Unix(), config.PreviousKeys[0].Retires.Unix())
+	test.StrEquals(t, "b3RoZXIgc2FsdA==:MzIgYnl0ZXMgZXhhY3RseSwgb3Igc28gaXQgc2VlbXM=@2030-01-02T15:04:05Z", encodePreviousKey(config.PreviousKeys[0]))
+}
+
+func TestConfig_LoadConfigPreviousKeysInvalid(t *testing.T) {
+	_, err := loadConfig(strings.NewReader(`PreviousKeys c29tZSBzYWx0IQ==:MzIgYnl0ZXMgZXhhY3RseSwgb3Igc28gaXQgc2VlbXM=@tomorrow`))
+	if err == nil {
+		t.Fatalf("expected error, got none")
+	}
+}
+
+func TestConfig_LoadConfigKeyCommand(t *testing.T) {
+	config, err := loadConfig(strings.NewReader(`KeyCommand pass show pcopy/work`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, "pass show pcopy/work", config.KeyCommand)
+}
+
+func TestConfig_LoadConfigTrustedProxiesAndAccessLists(t *testing.T) {
+	config, err := loadConfig(strings.NewReader(`TrustedProxies 127.0.0.1 10.0.0.0/8
+AllowWrite 192.168.0.0/16
+DenyRead 1.2.3.4`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.Int64Equals(t, 2, int64(len(config.TrustedProxies)))
+	test.StrEquals(t, "127.0.0.1/32", config.TrustedProxies[0].String())
+	test.StrEquals(t, "192.168.0.0/16", config.AllowWrite[0].String())
+	test.StrEquals(t, "1.2.3.4/32", config.DenyRead[0].String())
+	test.Int64Equals(t, 0, int64(len(config.AllowRead)))
+}
+
+func TestConfig_LoadConfigAccessListInvalid(t *testing.T) {
+	_, err := loadConfig(strings.NewReader(`DenyWrite 10.0.0.0/40`))
+	if err == nil {
+		t.Fatalf("expected error, got none")
+	}
+}
+
+func TestConfig_LoadConfigAuditLog(t *testing.T) {
+	config, err := loadConfig(strings.NewReader(`AuditLog /var/log/pcopy/audit.log 1M 3`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, "/var/log/pcopy/audit.log", config.AuditLogFile)
+	test.Int64Equals(t, 1024*1024, config.AuditLogMaxSize)
+	test.Int64Equals(t, 3, int64(config.AuditLogMaxFiles))
+}
+
+func TestConfig_LoadConfigAuditLogDefaults(t *testing.T) {
+	config, err := loadConfig(strings.NewReader(`AuditLog /var/log/pcopy/audit.log`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.Int64Equals(t, 10*1024*1024, config.AuditLogMaxSize)
+	test.Int64Equals(t, 5, int64(config.AuditLogMaxFiles))
+}
+
+func TestConfig_LoadConfigWebhooks(t *testing.T) {
+	config, err := loadConfig(strings.NewReader(`Webhooks https://chat.example.com/hook|events=upload,expire http://10.0.0.1:8080/ci|prefix=build-|secret=s3cr3t`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.Int64Equals(t, 2, int64(len(config.Webhooks)))
+	test.StrEquals(t, "https://chat.example.com/hook", config.Webhooks[0].URL)
+	test.StrEquals(t, "upload,expire", strings.Join(config.Webhooks[0].Events, ","))
+	test.BoolEquals(t, true, config.Webhooks[0].Matches(WebhookEventUpload, "any"))
+	test.BoolEquals(t, false, config.Webhooks[0].Matches(WebhookEventDownload, "any"))
+	test.StrEquals(t, "http://10.0.0.1:8080/ci", config.Webhooks[1].URL)
+	test.StrEquals(t, "build-", config.Webhooks[1].Prefix)
+	test.StrEquals(t, "s3cr3t", config.Webhooks[1].Secret)
+	test.BoolEquals(t, true, config.Webhooks[1].Matches(WebhookEventDownload, "build-123"))
+	test.BoolEquals(t, false, config.Webhooks[1].Matches(WebhookEventDownload, "other"))
+	test.StrEquals(t, "https://chat.example.com/hook|events=upload,expire http://10.0.0.1:8080/ci|prefix=build-|secret=s3cr3t", encodeWebhooks(config.Webhooks))
+}
+
+func TestConfig_LoadConfigWebhooksInvalid(t *testing.T) {
+	for _, webhooks := range []string{"ftp://example.com", "https://example.com|events=upload,rename", "https://example.com|prefix=", "https://example.com|color=red"} {
+		if _, err := loadConfig(strings.NewReader("Webhooks " + webhooks)); err == nil {
+			t.Fatalf("expected error for %s", webhooks)
+		}
+	}
+}
+
+func TestConfig_LoadConfigContentPolicies(t *testing.T) {
+	config, err := loadConfig(strings.NewReader(`ContentPolicies application/x-executable|deny image/*|max-size=20M|max-ttl=30d application/pdf|download */*|max-ttl=1d`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.Int64Equals(t, 4, int64(len(config.ContentPolicies)))
+	test.BoolEquals(t, true, config.ContentPolicy("application/x-executable").Deny)
+	test.Int64Equals(t, 20*1024*1024, config.ContentPolicy("image/png").MaxSize)
+	test.DurationEquals(t, 30*24*time.Hour, config.ContentPolicy("image/png").MaxTTL)
+	test.BoolEquals(t, true, config.ContentPolicy("application/pdf").Download)
+	test.StrEquals(t, "*/*", config.ContentPolicy("text/plain; charset=utf-8").Type)
+	test.StrEquals(t, "application/x-executable|deny image/*|max-size=20971520|max-ttl=30d application/pdf|download */*|max-ttl=1d", encodeContentPolicies(config.ContentPolicies))
+
+	config, _ = loadConfig(strings.NewReader(`ContentPolicies image/png|deny`))
+	if config.ContentPolicy("image/jpeg") != nil {
+		t.Fatal("expected no policy for image/jpeg")
+	}
+}
+
+func TestConfig_LoadConfigContentPoliciesInvalid(t *testing.T) {
+	for _, policy := range []string{"image", "image/*|max-size=0", "*/png", "text/plain|max-ttl=abc", "text/plain|inline"} {
+		if _, err := loadConfig(strings.NewReader("ContentPolicies " + policy)); err == nil {
+			t.Fatalf("expected error for %s", policy)
+		}
+	}
+}
+
+func TestConfig_LoadConfigSecretDetection(t *testing.T) {
+	config, err := loadConfig(strings.NewReader(`SecretDetection burn 5m`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, SecretDetectionBurn, config.SecretDetection)
+	test.DurationEquals(t, 5*time.Minute, config.SecretDetectionTTL)
+
+	config, _ = loadConfig(strings.NewReader(`SecretDetection reject`))
+	test.StrEquals(t, SecretDetectionReject, config.SecretDetection)
+	test.DurationEquals(t, 10*time.Minute, config.SecretDetectionTTL)
+
+	for _, value := range []string{"block", "burn 0", "burn abc"} {
+		if _, err := loadConfig(strings.NewReader("SecretDetection " + value)); err == nil {
+			t.Fatalf("expected error for %s", value)
+		}
+	}
+}
+
+func TestConfig_LoadConfigUploadScanAndHook(t *testing.T) {
+	config, err := loadConfig(strings.NewReader(`UploadScan clamdscan --no-summary "$1"
+UploadScanError file contains a virus
+UploadHook https://index.example.com/upload
+UploadHookTimeout 10s`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, `clamdscan --no-summary "$1"`, config.UploadScan)
+	test.StrEquals(t, "file contains a virus", config.UploadScanError)
+	test.StrEquals(t, "https://index.example.com/upload", config.UploadHook)
+	test.DurationEquals(t, 10*time.Second, config.UploadHookTimeout)
+
+	if _, err := loadConfig(strings.NewReader("UploadHookTimeout 0")); err == nil {
+		t.Fatal("expected error for zero timeout")
+	}
+}
+
+func TestConfig_LoadConfigCertExpiryWarning(t *testing.T) {
+	config, err := loadConfig(strings.NewReader(`CertExpiryWarning 2w`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.DurationEquals(t, 14*24*time.Hour, config.CertExpiryWarning)
+
+	config, _ = loadConfig(strings.NewReader(``))
+	test.DurationEquals(t, 30*24*time.Hour, config.CertExpiryWarning)
+}
+
+func TestConfig_LoadConfigMetrics(t *testing.T) {
+	config, err := loadConfig(strings.NewReader(`Metrics auth 127.0.0.1:9090`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, "auth", config.Metrics)
+	test.StrEquals(t, "127.0.0.1:9090", config.MetricsListenAddr)
+
+	config, _ = loadConfig(strings.NewReader(``))
+	test.StrEquals(t, "off", config.Metrics)
+	test.StrEquals(t, "", config.MetricsListenAddr)
+}
+
+func TestConfig_LoadConfigMetricsInvalid(t *testing.T) {
+	_, err := loadConfig(strings.NewReader(`Metrics yes`))
+	if err == nil {
+		t.Fatalf("expected error, got none")
+	}
+}
+
+func TestConfig_LoadConfigLog(t *testing.T) {
+	config, err := loadConfig(strings.NewReader(`LogLevel debug
+LogFormat json
+LogFile /var/log/pcopy/pcopy.log 1M 3`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, "debug", config.LogLevel.String())
+	test.StrEquals(t, "json", config.LogFormat)
+	test.StrEquals(t, "/var/log/pcopy/pcopy.log", config.LogFile)
+	test.Int64Equals(t, 1024*1024, config.LogFileMaxSize)
+	test.Int64Equals(t, 3, int64(config.LogFileMaxFiles))
+
+	config, _ = loadConfig(strings.NewReader(``))
+	test.StrEquals(t, "info", config.LogLevel.String())
+	test.StrEquals(t, "text", config.LogFormat)
+	test.StrEquals(t, "stderr", config.LogFile)
+}
+
+func TestConfig_LoadConfigLogInvalid(t *testing.T) {
+	if _, err := loadConfig(strings.NewReader(`LogLevel verbose`)); err == nil {
+		t.Fatalf("expected error for LogLevel, got none")
+	}
+	if _, err := loadConfig(strings.NewReader(`LogFormat xml`)); err == nil {
+		t.Fatalf("expected error for LogFormat, got none")
+	}
+}
+
 func TestConfig_LoadConfigFromFileFailedDueToMissingCert(t *testing.T) {
 	filename := filepath.Join(t.TempDir(), "some.conf")
 	contents := "CertFile some.crt"
@@ -326,9 +610,93 @@ func TestConfig_LoadConfigFromFileFailedDueToInvalidFileMode2(t *testing.T) {
 	}
 }
 
+func TestConfig_LoadListenAddrMultipleUnixAndSystemd(t *testing.T) {
+	config, err := loadConfig(strings.NewReader(`ListenAddr 0.0.0.0:2586 [::]:2586/HTTPS unix:/run/pcopy/pcopy.sock/http systemd:pcopy-tcp/tcp`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, "0.0.0.0:2586 [::]:2586", strings.Join(config.ListenHTTPS, " "))
+	test.StrEquals(t, "unix:/run/pcopy/pcopy.sock", strings.Join(config.ListenHTTP, " "))
+	test.StrEquals(t, "systemd:pcopy-tcp", strings.Join(config.ListenTCP, " "))
+}
+
+func TestConfig_LoadListenAddrInvalid(t *testing.T) {
+	for _, listenAddr := range []string{":2586 :2586/https", "unix:relative.sock/http", "localhost", ":2586/udp"} {
+		if _, err := loadConfig(strings.NewReader("ListenAddr " + listenAddr)); err == nil {
+			t.Fatalf("expected error for %s, got none", listenAddr)
+		}
+	}
+}
+
+func TestConfig_LoadBasePath(t *testing.T) {
+	config, err := loadConfig(strings.NewReader("ServerAddr example.com\nBasePath /work/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, "/work", config.BasePath)
+	for _, basePath := range []string{"work", "/work space", "/work?x=1"} {
+		if _, err := loadConfig(strings.NewReader("BasePath " + basePath)); err == nil {
+			t.Fatalf("expected error for %s, got none", basePath)
+		}
+	}
+}
+
+func TestConfig_LoadFromFileAdmin(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "server.conf")
+	contents := "AdminListenAddr unix:/run/pcopy/admin.sock\nAdminKey Osz6osE1fRRirA==:XEBZJjB/7w4eCugzQSkwGMe8QW4nbsPvPMlle1wvW4I="
+	if err := ioutil.WriteFile(filename, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config, err := LoadFromFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, "unix:/run/pcopy/admin.sock", config.AdminListenAddr)
+	test.StrEquals(t, filepath.Join(dir, "clipboards.d"), config.AdminConfigDir)
+	if config.AdminKey == nil {
+		t.Fatalf("expected admin key, got none")
+	}
+	for _, addr := range []string{":2587/tcp", ":2587/http", "unix:/run/pcopy/admin.sock/https", "systemd:admin", "localhost"} {
+		if _, err := loadConfig(strings.NewReader("AdminListenAddr " + addr)); err == nil {
+			t.Fatalf("expected error for %s, got none", addr)
+		}
+	}
+}
+
+func TestConfig_LoadConfigAdminListenHTTPS(t *testing.T) {
+	config, err := loadConfig(strings.NewReader("AdminListenAddr 10.0.0.1:2587/https"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, "10.0.0.1:2587", config.AdminListenAddr)
+	test.BoolEquals(t, true, config.AdminListenHTTPS)
+}
+
+func TestDiff(t *testing.T) {
+	a, err := loadConfig(strings.NewReader(`Key Osz6osE1fRRirA==:XEBZJjB/7w4eCugzQSkwGMe8QW4nbsPvPMlle1wvW4I=
+FileSizeLimit 10M
+TrustedProxies 10.0.0.0/8`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := loadConfig(strings.NewReader(`Key AQIDBAUGBwgJCg==:AQIDBAUGBwgJCgsMDQ4PEBESExQVFhcYGRobHB0eHyA=
+FileSizeLimit 20M
+TrustedProxies 10.0.0.0/8 192.168.0.0/16`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes := Diff(a, b)
+	test.Int64Equals(t, 3, int64(len(changes)))
+	test.StrEquals(t, "Key changed", changes[0])
+	test.StrEquals(t, "TrustedProxies: [10.0.0.0/8] -> [10.0.0.0/8 192.168.0.0/16]", changes[1])
+	test.StrEquals(t, "FileSizeLimit: 10485760 -> 20971520", changes[2])
+	test.Int64Equals(t, 0, int64(len(Diff(a, a))))
+}
+
 func TestConfigStore_FileFromName(t *testing.T) {
 	dir := t.TempDir()
-	store := newStoreWithDir(dir)
+	store := NewStoreWithDir(dir)
 	file := store.FileFromName("work")
 	test.StrEquals(t, dir+"/work.conf", file)
 }
@@ -339,7 +707,7 @@ func TestConfigStore_All(t *testing.T) {
 	f1.Close()
 	f2, _ := os.Create(dir + "/default.conf")
 	f2.Close()
-	store := newStoreWithDir(dir)
+	store := NewStoreWithDir(dir)
 	configs := store.All()
 	if len(configs) != 2 {
 		t.Fatalf("expected two configs, got %d", len(configs))
@@ -40,7 +40,7 @@ func NewTestConfigWithHostname(t *testing.T, hostname string) (string, *config.C
 	}
 
 	conf.ServerAddr = config.ExpandServerAddr(fmt.Sprintf("%s:12345", hostname))
-	conf.ListenHTTPS = ":12345"
+	conf.ListenHTTPS = []string{":12345"}
 	conf.ClipboardDir = clipboardDir
 	conf.KeyFile = keyFile
 	conf.CertFile = certFile
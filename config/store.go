@@ -13,11 +13,11 @@ type Store struct {
 
 // NewStore creates a new config store using the user-specific config dir
 func NewStore() *Store {
-	return newStoreWithDir(getConfigDir())
+	return NewStoreWithDir(getConfigDir())
 }
 
-// newStoreWithDir creates a config store using the given directory as root
-func newStoreWithDir(dir string) *Store {
+// NewStoreWithDir creates a config store using the given directory as root, e.g. the AdminConfigDir
+func NewStoreWithDir(dir string) *Store {
 	return &Store{
 		dir: dir,
 	}
@@ -16,15 +16,17 @@ func ExtractClipboard(filename string) string {
 
 // ExpandServerAddr expands the server address with the default port if no port is provided to a full URL, including
 // protocol prefix. For instance: "myhost" will become "https://myhost:2586", and "myhost:443" will become "https://myhost",
-// but "http://myhost:1234" will remain unchanged.
+// but "http://myhost:1234" will remain unchanged. A path is kept (without trailing slash), e.g. "myhost/work" will
+// become "https://myhost:2586/work".
 func ExpandServerAddr(serverAddr string) string {
 	if strings.HasPrefix(serverAddr, "http://") || strings.HasPrefix(serverAddr, "https://") {
-		return serverAddr
+		return strings.TrimSuffix(serverAddr, "/")
 	}
-	if !strings.Contains(serverAddr, ":") {
-		serverAddr = fmt.Sprintf("%s:%d", serverAddr, DefaultPort)
+	host, path := splitServerAddrPath(serverAddr)
+	if !strings.Contains(host, ":") {
+		host = fmt.Sprintf("%s:%d", host, DefaultPort)
 	}
-	return fmt.Sprintf("https://%s", strings.ReplaceAll(serverAddr, ":443", ""))
+	return fmt.Sprintf("https://%s%s", strings.ReplaceAll(host, ":443", ""), path)
 }
 
 // ExpandServerAddrsGuess expands the server address (similar to ExpandServerAddr), except that it will return
@@ -32,14 +34,15 @@ func ExpandServerAddr(serverAddr string) string {
 // able to do "pcopy join example.com" and have it work unless it's not the default or not 443.
 func ExpandServerAddrsGuess(serverAddr string) []string {
 	if strings.HasPrefix(serverAddr, "http://") || strings.HasPrefix(serverAddr, "https://") {
-		return []string{serverAddr}
+		return []string{strings.TrimSuffix(serverAddr, "/")}
 	}
-	if strings.Contains(serverAddr, ":") {
-		return []string{fmt.Sprintf("https://%s", serverAddr)}
+	host, path := splitServerAddrPath(serverAddr)
+	if strings.Contains(host, ":") {
+		return []string{fmt.Sprintf("https://%s%s", host, path)}
 	}
 	return []string{
-		fmt.Sprintf("https://%s", serverAddr),
-		fmt.Sprintf("https://%s:%d", serverAddr, DefaultPort),
+		fmt.Sprintf("https://%s%s", host, path),
+		fmt.Sprintf("https://%s:%d%s", host, DefaultPort, path),
 	}
 }
 
@@ -47,19 +50,30 @@ func ExpandServerAddrsGuess(serverAddr string) []string {
 // the default port, but leaves the address unchanged if it doesn't contain it.
 func CollapseServerAddr(serverAddr string) string {
 	if strings.HasPrefix(serverAddr, "http://") {
-		return serverAddr
+		return strings.TrimSuffix(serverAddr, "/")
 	}
 	if strings.HasPrefix(serverAddr, "https://") {
 		u, err := url.Parse(serverAddr)
 		if err != nil {
 			return serverAddr
 		}
+		path := strings.TrimSuffix(u.Path, "/")
 		if u.Port() == "" || u.Port() == "443" {
-			return fmt.Sprintf("%s:443", u.Host)
+			return fmt.Sprintf("%s:443%s", u.Host, path)
 		}
-		return strings.TrimSuffix(u.Host, fmt.Sprintf(":%d", DefaultPort))
+		return strings.TrimSuffix(u.Host, fmt.Sprintf(":%d", DefaultPort)) + path
 	}
-	return strings.TrimSuffix(serverAddr, fmt.Sprintf(":%d", DefaultPort))
+	host, path := splitServerAddrPath(serverAddr)
+	return strings.TrimSuffix(host, fmt.Sprintf(":%d", DefaultPort)) + path
+}
+
+// splitServerAddrPath splits a server address without protocol prefix into host (incl. port) and path,
+// e.g. "myhost:1234/work/" is split into "myhost:1234" and "/work". The path is empty if there is none.
+func splitServerAddrPath(serverAddr string) (host string, path string) {
+	if i := strings.Index(serverAddr, "/"); i >= 0 {
+		return serverAddr[:i], strings.TrimSuffix(serverAddr[i:], "/")
+	}
+	return serverAddr, ""
 }
 
 // DefaultCertFile returns the default path to the certificate file, relative to the config file. If mustExist is
@@ -68,12 +82,36 @@ func DefaultCertFile(configFile string, mustExist bool) string {
 	return defaultFileWithNewExt(suffixCert, configFile, mustExist)
 }
 
+// DefaultCAFile returns the default path to the local CA certificate file, relative to the config file. If
+// mustExist is true, the function returns an empty string if the file does not exist.
+func DefaultCAFile(configFile string, mustExist bool) string {
+	return defaultFileWithNewExt(suffixCA, configFile, mustExist)
+}
+
+// DefaultCAKeyFile returns the default path to the local CA private key file, relative to the config file. If
+// mustExist is true, the function returns an empty string if the file does not exist.
+func DefaultCAKeyFile(configFile string, mustExist bool) string {
+	return defaultFileWithNewExt(suffixCAKey, configFile, mustExist)
+}
+
 // DefaultKeyFile returns the default path to the key file, relative to the config file. If mustExist is
 // true, the function returns an empty string.
 func DefaultKeyFile(configFile string, mustExist bool) string {
 	return defaultFileWithNewExt(suffixKey, configFile, mustExist)
 }
 
+// DefaultKeyEncryptedFile returns the default path to the passphrase-encrypted clipboard key file, relative to the
+// config file. If mustExist is true, the function returns an empty string if the file does not exist.
+func DefaultKeyEncryptedFile(configFile string, mustExist bool) string {
+	return defaultFileWithNewExt(suffixKeyEncrypted, configFile, mustExist)
+}
+
+// DefaultAdminConfigDir returns the default directory for the configs of clipboards that are added via the
+// admin API, relative to the config file, e.g. /etc/pcopy/clipboards.d for /etc/pcopy/server.conf.
+func DefaultAdminConfigDir(configFile string) string {
+	return filepath.Join(filepath.Dir(configFile), adminConfigDirName)
+}
+
 func defaultFileWithNewExt(newExtension string, configFile string, mustExist bool) string {
 	file := strings.TrimSuffix(configFile, suffixConf) + newExtension
 	if mustExist {
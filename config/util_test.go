@@ -48,3 +48,22 @@ func TestCollapseServerAddr_FullHTTPSURL(t *testing.T) {
 func TestCollapseServerAddr_FullHTTPSURL443(t *testing.T) {
 	test.StrEquals(t, "myhost:443", CollapseServerAddr("https://myhost"))
 }
+
+func TestExpandServerAddr_WithPath(t *testing.T) {
+	test.StrEquals(t, "https://myhost:2586/work", ExpandServerAddr("myhost/work/"))
+	test.StrEquals(t, "https://myhost/work", ExpandServerAddr("myhost:443/work"))
+	test.StrEquals(t, "https://myhost/work", ExpandServerAddr("https://myhost/work/"))
+}
+
+func TestExpandServerAddrsGuess_WithPath(t *testing.T) {
+	actual := ExpandServerAddrsGuess("myhost/work")
+	test.Int64Equals(t, 2, int64(len(actual)))
+	test.StrEquals(t, "https://myhost/work", actual[0])
+	test.StrEquals(t, "https://myhost:2586/work", actual[1])
+}
+
+func TestCollapseServerAddr_WithPath(t *testing.T) {
+	test.StrEquals(t, "myhost/work", CollapseServerAddr("https://myhost:2586/work"))
+	test.StrEquals(t, "myhost:443/work", CollapseServerAddr("https://myhost/work"))
+	test.StrEquals(t, "myhost/work", CollapseServerAddr("myhost:2586/work"))
+}
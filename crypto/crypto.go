@@ -4,6 +4,8 @@ package crypto
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/hmac"
@@ -18,6 +20,7 @@ import (
 	"golang.org/x/crypto/pbkdf2"
 	"io/ioutil"
 	"math/big"
+	"net"
 	"regexp"
 	"time"
 )
@@ -30,8 +33,13 @@ const (
 	KeyDerivIter = 10000
 
 	keySaltLenBytes  = 10
-	certNotBeforeAge = -time.Hour * 24 * 7      // ~ 1 week
-	certNotAfterAge  = time.Hour * 24 * 365 * 3 // ~ 3 years
+	encKeySaltLen    = 16
+	encKeyPemType    = "PCOPY ENCRYPTED KEY"
+	certNotBeforeAge = -time.Hour * 24 * 7       // ~ 1 week
+	certNotAfterAge  = time.Hour * 24 * 365 * 3  // ~ 3 years
+	caNotAfterAge    = time.Hour * 24 * 365 * 10 // ~ 10 years
+
+	certFingerprintPrefix = "SHA256:"
 
 	// TODO move hmac validation in this package as well
 	authHmacFormat = "HMAC %d %d %s" // timestamp ttl b64-hmac
@@ -101,6 +109,60 @@ func DecodeKey(s string) (*Key, error) {
 	}, nil
 }
 
+// EncryptKey encrypts the given key with a key derived from the passphrase (PBKDF2, AES-256-GCM), and returns
+// it PEM encoded. The result can be decrypted with DecryptKey.
+func EncryptKey(key *Key, passphrase []byte) ([]byte, error) {
+	salt := make([]byte, encKeySaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	gcm, err := newKeyCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	ciphertext := gcm.Seal(nil, nonce, []byte(EncodeKey(key)), nil)
+	var b bytes.Buffer
+	block := &pem.Block{Type: encKeyPemType, Bytes: append(append(salt, nonce...), ciphertext...)}
+	if err := pem.Encode(&b, block); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// DecryptKey decrypts a key that was previously encrypted with EncryptKey using the given passphrase.
+func DecryptKey(encrypted []byte, passphrase []byte) (*Key, error) {
+	block, _ := pem.Decode(encrypted)
+	if block == nil || block.Type != encKeyPemType || len(block.Bytes) < encKeySaltLen {
+		return nil, errInvalidKeyFormat
+	}
+	salt := block.Bytes[:encKeySaltLen]
+	gcm, err := newKeyCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(block.Bytes) < encKeySaltLen+gcm.NonceSize() {
+		return nil, errInvalidKeyFormat
+	}
+	nonce := block.Bytes[encKeySaltLen : encKeySaltLen+gcm.NonceSize()]
+	plaintext, err := gcm.Open(nil, nonce, block.Bytes[encKeySaltLen+gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, errInvalidPassphrase
+	}
+	return DecodeKey(string(plaintext))
+}
+
+func newKeyCipher(passphrase []byte, salt []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(pbkdf2.Key(passphrase, salt, KeyDerivIter, KeyLenBytes, sha256.New))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
 // EncodeCert encodes a X.509 certificates as PEM.
 func EncodeCert(cert *x509.Certificate) ([]byte, error) {
 	var b bytes.Buffer
@@ -137,6 +199,33 @@ func LoadCertFromFile(filename string) (*x509.Certificate, error) {
 	return nil, errNoCertFound
 }
 
+// LoadCertsFromFile loads all PEM-encoded certificates from the given filename, e.g. from a CA bundle
+func LoadCertsFromFile(filename string) ([]*x509.Certificate, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	certs := make([]*x509.Certificate, 0)
+	for {
+		block, rest := pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			certs = append(certs, cert)
+		}
+		b = rest
+	}
+	if len(certs) == 0 {
+		return nil, errNoCertFound
+	}
+	return certs, nil
+}
+
 // CalculatePublicKeyHash calculates the SHA-256 hash of the DER PKIX representation of the public
 // key contained in the given certificate. This is useful to use with the --pinnedpubkey option in curl.
 func CalculatePublicKeyHash(cert *x509.Certificate) ([]byte, error) {
@@ -154,6 +243,14 @@ func EncodeCurlPinnedPublicKeyHash(hash []byte) string {
 	return fmt.Sprintf("sha256//%s", base64.StdEncoding.EncodeToString(hash))
 }
 
+// CertFingerprint returns the fingerprint of the public key of the given certificate, in the format
+// SHA256:<base64-hash>. Since only the public key is hashed, the fingerprint does not change if the
+// certificate is renewed with the same key.
+func CertFingerprint(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return fmt.Sprintf("%s%s", certFingerprintPrefix, base64.RawStdEncoding.EncodeToString(hash[:]))
+}
+
 // ReadCurlPinnedPublicKeyFromFile reads a cert from the given filename and calculates the public key for curl
 func ReadCurlPinnedPublicKeyFromFile(filename string) (string, error) {
 	cert, err := LoadCertFromFile(filename)
@@ -177,9 +274,33 @@ func GenerateAuthHMAC(key []byte, method string, path string, ttl time.Duration)
 	return generateAuthHMAC(time.Now().Unix(), key, method, path, ttl)
 }
 
+// GenerateAuthHMACWithTime is like GenerateAuthHMAC, but uses the given time instead of the current time as
+// the HMAC timestamp. This is useful for clients that need to correct for clock skew.
+func GenerateAuthHMACWithTime(timestamp time.Time, key []byte, method string, path string, ttl time.Duration) (string, error) {
+	return generateAuthHMAC(timestamp.Unix(), key, method, path, ttl)
+}
+
+// GenerateAdminAuthHMAC is like GenerateAuthHMAC, but the HMAC additionally covers the raw query string and
+// the body of the request (see AdminAuthData), so that a captured header cannot be replayed with a different
+// query or body. It is used to authenticate requests to the admin API.
+func GenerateAdminAuthHMAC(key []byte, method string, path string, rawQuery string, body []byte, ttl time.Duration) (string, error) {
+	timestamp := time.Now().Unix()
+	ttlSecs := int(ttl.Seconds())
+	return signAuthHMAC(timestamp, ttlSecs, key, AdminAuthData(timestamp, ttlSecs, method, path, rawQuery, body))
+}
+
+// AdminAuthData returns the data that is signed by GenerateAdminAuthHMAC: the timestamp, TTL, method, path
+// and raw query of the request, and the hex-encoded SHA-256 hash of the request body.
+func AdminAuthData(timestamp int64, ttlSecs int, method string, path string, rawQuery string, body []byte) []byte {
+	return []byte(fmt.Sprintf("%d:%d:%s:%s:%s:%x", timestamp, ttlSecs, method, path, rawQuery, sha256.Sum256(body)))
+}
+
 func generateAuthHMAC(timestamp int64, key []byte, method string, path string, ttl time.Duration) (string, error) {
 	ttlSecs := int(ttl.Seconds())
-	data := []byte(fmt.Sprintf("%d:%d:%s:%s", timestamp, ttlSecs, method, path))
+	return signAuthHMAC(timestamp, ttlSecs, key, []byte(fmt.Sprintf("%d:%d:%s:%s", timestamp, ttlSecs, method, path)))
+}
+
+func signAuthHMAC(timestamp int64, ttlSecs int, key []byte, data []byte) (string, error) {
 	hash := hmac.New(sha256.New, key)
 	if _, err := hash.Write(data); err != nil {
 		return "", err
@@ -189,51 +310,201 @@ func generateAuthHMAC(timestamp int64, key []byte, method string, path string, t
 	return fmt.Sprintf(authHmacFormat, timestamp, ttlSecs, hashBase64), nil
 }
 
-// GenerateKeyAndCert generates a ECDSA P-256 key, and a self-signed certificate.
+// GenerateKeyAndCert generates a ECDSA P-256 key, and a self-signed certificate for the given hosts. Hosts
+// may be hostnames or IP addresses; the first host is used as the common name of the certificate.
 // It returns both as PEM-encoded values.
-func GenerateKeyAndCert(hostname string) (string, string, error) {
-	key, cert, err := generateKeyAndCertRaw(hostname)
+func GenerateKeyAndCert(hosts ...string) (string, string, error) {
+	key, cert, err := generateKeyAndCertRaw(hosts, nil, nil)
 	if err != nil {
 		return "", "", err
 	}
-	pemKey, err := encodeKey(key)
+	return encodeKeyAndCerts(key, cert)
+}
+
+// GenerateKeyAndCertWithCA generates a ECDSA P-256 key, and a certificate for the given hosts that is issued
+// by the given CA (see GenerateCA). It returns both as PEM-encoded values. The returned certificate PEM contains
+// the certificate chain, i.e. the server certificate followed by the CA certificate.
+func GenerateKeyAndCertWithCA(caKey *ecdsa.PrivateKey, caCert *x509.Certificate, hosts ...string) (string, string, error) {
+	key, cert, err := generateKeyAndCertRaw(hosts, caKey, caCert)
+	if err != nil {
+		return "", "", err
+	}
+	return encodeKeyAndCerts(key, cert, caCert)
+}
+
+// GenerateCA generates a ECDSA P-256 key, and a self-signed CA certificate with the given name, which can be
+// used to issue server certificates. It returns both as PEM-encoded values.
+func GenerateCA(name string) (string, string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	serial, err := generateSerial()
 	if err != nil {
 		return "", "", err
 	}
-	pemCert, err := EncodeCert(cert)
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(certNotBeforeAge),
+		NotAfter:              time.Now().Add(caNotAfterAge),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	derCert, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
 	if err != nil {
 		return "", "", err
 	}
-	return string(pemKey), string(pemCert), nil
+	cert, err := x509.ParseCertificate(derCert)
+	if err != nil {
+		return "", "", err
+	}
+	return encodeKeyAndCerts(key, cert)
+}
+
+// IsCA returns true if the given certificate is a self-signed CA certificate, i.e. a certificate that can be
+// pinned by clients to trust all certificates issued by it
+func IsCA(cert *x509.Certificate) bool {
+	return cert.IsCA && bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil
+}
+
+// LoadPrivateKeyFromFile loads a PEM-encoded ECDSA private key from the given filename, e.g. a CA key
+func LoadPrivateKeyFromFile(filename string) (*ecdsa.PrivateKey, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		block, rest := pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type == "EC PRIVATE KEY" {
+			return x509.ParseECPrivateKey(block.Bytes)
+		} else if block.Type == "PRIVATE KEY" {
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			ecKey, ok := key.(*ecdsa.PrivateKey)
+			if !ok {
+				return nil, errUnsupportedPrivateKey
+			}
+			return ecKey, nil
+		}
+		b = rest
+	}
+	return nil, errNoPrivateKeyFound
+}
+
+// GenerateCert generates a new self-signed certificate for the given hosts, using an existing key. Since the public
+// key does not change, clients that pinned the previous certificate continue to work. It returns the certificate
+// as PEM-encoded value.
+func GenerateCert(key *ecdsa.PrivateKey, hosts ...string) (string, error) {
+	cert, err := generateCertRaw(key, hosts, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	_, pemCert, err := encodeKeyAndCerts(key, cert)
+	return pemCert, err
+}
+
+// GenerateCertWithCA generates a new certificate for the given hosts that is issued by the given CA, using an
+// existing key. Like GenerateKeyAndCertWithCA, the returned PEM value contains the certificate chain.
+func GenerateCertWithCA(key *ecdsa.PrivateKey, caKey *ecdsa.PrivateKey, caCert *x509.Certificate, hosts ...string) (string, error) {
+	cert, err := generateCertRaw(key, hosts, caKey, caCert)
+	if err != nil {
+		return "", err
+	}
+	_, pemCert, err := encodeKeyAndCerts(key, cert, caCert)
+	return pemCert, err
 }
 
-func generateKeyAndCertRaw(hostname string) (*ecdsa.PrivateKey, *x509.Certificate, error) {
+// CertHosts returns the DNS names and IP addresses the given certificate is valid for. If the certificate has
+// no subject alternative names, the common name is returned.
+func CertHosts(cert *x509.Certificate) []string {
+	hosts := make([]string, 0)
+	hosts = append(hosts, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		hosts = append(hosts, ip.String())
+	}
+	if len(hosts) == 0 && cert.Subject.CommonName != "" {
+		hosts = append(hosts, cert.Subject.CommonName)
+	}
+	return hosts
+}
+
+func generateKeyAndCertRaw(hosts []string, caKey *ecdsa.PrivateKey, caCert *x509.Certificate) (*ecdsa.PrivateKey, *x509.Certificate, error) {
 	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
 		return nil, nil, err
 	}
-	max := new(big.Int)
-	max.Exp(big.NewInt(2), big.NewInt(130), nil).Sub(max, big.NewInt(1))
-	serial, err := rand.Int(rand.Reader, max)
+	cert, err := generateCertRaw(key, hosts, caKey, caCert)
 	if err != nil {
 		return nil, nil, err
 	}
+	return key, cert, nil
+}
+
+func generateCertRaw(key *ecdsa.PrivateKey, hosts []string, caKey *ecdsa.PrivateKey, caCert *x509.Certificate) (*x509.Certificate, error) {
+	if len(hosts) == 0 {
+		return nil, errNoHosts
+	}
+	serial, err := generateSerial()
+	if err != nil {
+		return nil, err
+	}
 	template := x509.Certificate{
 		SerialNumber: serial,
-		Subject:      pkix.Name{CommonName: hostname},
-		DNSNames:     []string{hostname},
+		Subject:      pkix.Name{CommonName: hosts[0]},
 		NotBefore:    time.Now().Add(certNotBeforeAge),
 		NotAfter:     time.Now().Add(certNotAfterAge),
 	}
-	derCert, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	parent, signer := &template, key
+	if caCert != nil {
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		if template.NotAfter.After(caCert.NotAfter) {
+			template.NotAfter = caCert.NotAfter
+		}
+		parent, signer = caCert, caKey
+	}
+	derCert, err := x509.CreateCertificate(rand.Reader, &template, parent, &key.PublicKey, signer)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	cert, err := x509.ParseCertificate(derCert)
+	return x509.ParseCertificate(derCert)
+}
+
+func generateSerial() (*big.Int, error) {
+	max := new(big.Int)
+	max.Exp(big.NewInt(2), big.NewInt(130), nil).Sub(max, big.NewInt(1))
+	return rand.Int(rand.Reader, max)
+}
+
+func encodeKeyAndCerts(key *ecdsa.PrivateKey, certs ...*x509.Certificate) (string, string, error) {
+	pemKey, err := encodeKey(key)
 	if err != nil {
-		return nil, nil, err
+		return "", "", err
 	}
-	return key, cert, nil
+	var pemCerts bytes.Buffer
+	for _, cert := range certs {
+		pemCert, err := EncodeCert(cert)
+		if err != nil {
+			return "", "", err
+		}
+		pemCerts.Write(pemCert)
+	}
+	return string(pemKey), pemCerts.String(), nil
 }
 
 func encodeKey(key *ecdsa.PrivateKey) ([]byte, error) {
@@ -249,4 +520,8 @@ func encodeKey(key *ecdsa.PrivateKey) ([]byte, error) {
 }
 
 var errInvalidKeyFormat = errors.New("invalid key format")
+var errInvalidPassphrase = errors.New("invalid passphrase")
 var errNoCertFound = errors.New("no cert found in file")
+var errNoPrivateKeyFound = errors.New("no private key found in file")
+var errUnsupportedPrivateKey = errors.New("unsupported private key, only ECDSA keys are supported")
+var errNoHosts = errors.New("at least one hostname or IP address is required")
@@ -2,12 +2,14 @@ package crypto
 
 import (
 	"bytes"
+	"crypto/x509"
 	"heckel.io/pcopy/test"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -121,6 +123,28 @@ func TestDecodeKey_FailureInvalidBase64(t *testing.T) {
 	}
 }
 
+func TestEncryptDecryptKey_Success(t *testing.T) {
+	key := DeriveKey([]byte("some password"), []byte("some salt!"))
+	encrypted, err := EncryptKey(key, []byte("some passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := DecryptKey(encrypted, []byte("some passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.BytesEquals(t, key.Salt, decrypted.Salt)
+	test.BytesEquals(t, key.Bytes, decrypted.Bytes)
+}
+
+func TestDecryptKey_FailureWrongPassphrase(t *testing.T) {
+	key := DeriveKey([]byte("some password"), []byte("some salt!"))
+	encrypted, _ := EncryptKey(key, []byte("some passphrase"))
+	if _, err := DecryptKey(encrypted, []byte("wrong passphrase")); err != errInvalidPassphrase {
+		t.Fatalf("expected errInvalidPassphrase, got %#v", err)
+	}
+}
+
 func TestDecodeKey_FailureKeyInvalidBase64(t *testing.T) {
 	keyEncoded := "Osz6osE1fRRirA==:this is invalid"
 	_, err := DecodeKey(keyEncoded)
@@ -198,6 +222,70 @@ func TestGenerateKeyAndCert(t *testing.T) {
 	test.StrEquals(t, "thiscert.com", crt.DNSNames[0])
 }
 
+func TestGenerateKeyAndCertWithCA(t *testing.T) {
+	dir := t.TempDir()
+	caKeyPEM, caCertPEM, err := GenerateCA("my CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	caKeyFile, caCertFile := filepath.Join(dir, "ca.key"), filepath.Join(dir, "ca.crt")
+	ioutil.WriteFile(caKeyFile, []byte(caKeyPEM), 0600)
+	ioutil.WriteFile(caCertFile, []byte(caCertPEM), 0600)
+	caKey, err := LoadPrivateKeyFromFile(caKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, _ := LoadCertFromFile(caCertFile)
+	test.BoolEquals(t, true, IsCA(caCert))
+
+	_, cert, err := GenerateKeyAndCertWithCA(caKey, caCert, "thiscert.com", "other.thiscert.com", "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, "cert")
+	ioutil.WriteFile(certFile, []byte(cert), 0600)
+
+	certs, _ := LoadCertsFromFile(certFile)
+	test.Int64Equals(t, 2, int64(len(certs)))
+	test.BoolEquals(t, false, IsCA(certs[0]))
+	test.BytesEquals(t, caCert.Raw, certs[1].Raw)
+	test.StrEquals(t, "thiscert.com", certs[0].Subject.CommonName)
+	test.StrEquals(t, "thiscert.com other.thiscert.com", strings.Join(certs[0].DNSNames, " "))
+	test.StrEquals(t, "10.0.0.1", certs[0].IPAddresses[0].String())
+
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+	for _, host := range []string{"other.thiscert.com", "10.0.0.1"} {
+		if _, err := certs[0].Verify(x509.VerifyOptions{DNSName: host, Roots: roots}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGenerateKeyAndCert_FailureNoHosts(t *testing.T) {
+	if _, _, err := GenerateKeyAndCert(); err != errNoHosts {
+		t.Fatalf("expected errNoHosts, got %v", err)
+	}
+}
+
+func TestCertFingerprint_SameAfterRenew(t *testing.T) {
+	dir := t.TempDir()
+	pemKey, pemCert, _ := GenerateKeyAndCert("thiscert.com")
+	keyFile, certFile := filepath.Join(dir, "key"), filepath.Join(dir, "cert")
+	ioutil.WriteFile(keyFile, []byte(pemKey), 0600)
+	ioutil.WriteFile(certFile, []byte(pemCert), 0600)
+	key, _ := LoadPrivateKeyFromFile(keyFile)
+	cert, _ := LoadCertFromFile(certFile)
+
+	renewedPemCert, _ := GenerateCert(key, "thiscert.com", "10.0.0.1")
+	ioutil.WriteFile(certFile, []byte(renewedPemCert), 0600)
+	renewed, _ := LoadCertFromFile(certFile)
+
+	test.StrContains(t, CertFingerprint(cert), "SHA256:")
+	test.StrEquals(t, CertFingerprint(cert), CertFingerprint(renewed))
+	test.BoolEquals(t, false, bytes.Equal(cert.Raw, renewed.Raw))
+}
+
 func TestEncodeCertAndReadCurlPinnedPublicKeyFromFileSuccess(t *testing.T) {
 	dir := t.TempDir()
 	serv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -282,3 +370,8 @@ func TestGenerateAuthHMAC(t *testing.T) {
 	hmacAuth, _ := generateAuthHMAC(timestamp, key, "GET", "/abcdef", time.Hour)
 	test.StrEquals(t, "HMAC 1626482338 3600 Z4Z5hOFyX2i+GHBUEV5Ft8CVnuQuts+3lC0yz8uDj8U=", hmacAuth)
 }
+
+func TestAdminAuthData(t *testing.T) {
+	data := AdminAuthData(1626482338, 3600, "DELETE", "/clipboards/team1", "purge=1", []byte("{}"))
+	test.StrEquals(t, "1626482338:3600:DELETE:/clipboards/team1:purge=1:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a", string(data))
+}
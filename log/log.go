@@ -0,0 +1,286 @@
+// Package log implements leveled, structured logging for the pcopy server. Log entries consist of a message
+// and optional key-value fields, and can be written as human-readable text, logfmt or JSON lines.
+package log
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"heckel.io/pcopy/util"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log entry
+type Level int
+
+// Log levels, in increasing severity
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+const (
+	// FormatText writes log entries as human-readable text lines, e.g. "2021/01/30 12:00:00 INFO message key=value"
+	FormatText = "text"
+
+	// FormatLogfmt writes log entries in logfmt, e.g. "time=... level=info msg=message key=value"
+	FormatLogfmt = "logfmt"
+
+	// FormatJSON writes log entries as JSON objects, one per line
+	FormatJSON = "json"
+
+	// OutputStderr is the output name for standard error, see NewOutput
+	OutputStderr = "stderr"
+
+	// OutputSyslog is the output name (prefix) for syslog, see NewOutput
+	OutputSyslog = "syslog"
+
+	textTimeFormat = "2006/01/02 15:04:05"
+)
+
+var (
+	errInvalidLevel  = errors.New("invalid log level, must be debug, info, warn or error")
+	errInvalidFormat = errors.New("invalid log format, must be text, logfmt or json")
+
+	levelNames = map[Level]string{
+		DebugLevel: "debug",
+		InfoLevel:  "info",
+		WarnLevel:  "warn",
+		ErrorLevel: "error",
+	}
+
+	level            = InfoLevel
+	format           = FormatText
+	output io.Writer = os.Stderr
+	mu     sync.Mutex
+)
+
+// levelWriter is implemented by outputs that keep track of the severity themselves, e.g. syslog
+type levelWriter interface {
+	WriteLevel(l Level, line []byte) error
+}
+
+// Entry is a log entry with a set of fields (key-value pairs). Entries are immutable; With returns a copy.
+type Entry struct {
+	fields []interface{}
+}
+
+// String returns the name of the level, e.g. "info"
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// ToLevel converts a level name (debug, info, warn, error) to a Level
+func ToLevel(s string) (Level, error) {
+	for l, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return l, nil
+		}
+	}
+	return InfoLevel, errInvalidLevel
+}
+
+// CheckFormat returns an error if the given format is not one of FormatText, FormatLogfmt or FormatJSON
+func CheckFormat(f string) error {
+	if f != FormatText && f != FormatLogfmt && f != FormatJSON {
+		return errInvalidFormat
+	}
+	return nil
+}
+
+// SetLevel sets the minimum level of entries that are written
+func SetLevel(l Level) {
+	mu.Lock()
+	defer mu.Unlock()
+	level = l
+}
+
+// SetFormat sets the output format, see FormatText, FormatLogfmt and FormatJSON
+func SetFormat(f string) error {
+	if err := CheckFormat(f); err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	format = f
+	return nil
+}
+
+// SetOutput sets the destination of all log entries, see NewOutput
+func SetOutput(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+	output = w
+}
+
+// NewOutput creates a log destination from its name: "stderr" writes to standard error, "syslog" writes
+// to the local syslog daemon, "syslog:ADDR" writes to a syslog socket (e.g. syslog:/dev/log or
+// syslog:udp://host:514), and anything else is treated as a filename. Files are rotated when they reach
+// maxSize, and maxFiles rotated files are kept (see util.RotatingFile).
+func NewOutput(name string, maxSize int64, maxFiles int) (io.Writer, error) {
+	if name == "" || name == OutputStderr {
+		return os.Stderr, nil
+	} else if name == OutputSyslog || strings.HasPrefix(name, OutputSyslog+":") {
+		return newSyslogOutput(strings.TrimPrefix(strings.TrimPrefix(name, OutputSyslog), ":"))
+	}
+	return util.NewRotatingFile(name, maxSize, maxFiles)
+}
+
+// With returns a new entry with the given fields (key-value pairs), e.g. log.With("id", id).Info("uploaded")
+func With(fields ...interface{}) *Entry {
+	return (&Entry{}).With(fields...)
+}
+
+// Debug writes a debug message without any fields
+func Debug(message string, v ...interface{}) {
+	(&Entry{}).Debug(message, v...)
+}
+
+// Info writes an info message without any fields
+func Info(message string, v ...interface{}) {
+	(&Entry{}).Info(message, v...)
+}
+
+// Warn writes a warning message without any fields
+func Warn(message string, v ...interface{}) {
+	(&Entry{}).Warn(message, v...)
+}
+
+// Error writes an error message without any fields
+func Error(message string, v ...interface{}) {
+	(&Entry{}).Error(message, v...)
+}
+
+// With returns a copy of the entry with the given fields (key-value pairs) appended
+func (e *Entry) With(fields ...interface{}) *Entry {
+	merged := make([]interface{}, 0, len(e.fields)+len(fields))
+	merged = append(merged, e.fields...)
+	merged = append(merged, fields...)
+	return &Entry{fields: merged}
+}
+
+// Debug writes a debug message with the entry's fields; the message is formatted like fmt.Sprintf
+func (e *Entry) Debug(message string, v ...interface{}) {
+	e.write(DebugLevel, message, v...)
+}
+
+// Info writes an info message with the entry's fields; the message is formatted like fmt.Sprintf
+func (e *Entry) Info(message string, v ...interface{}) {
+	e.write(InfoLevel, message, v...)
+}
+
+// Warn writes a warning message with the entry's fields; the message is formatted like fmt.Sprintf
+func (e *Entry) Warn(message string, v ...interface{}) {
+	e.write(WarnLevel, message, v...)
+}
+
+// Error writes an error message with the entry's fields; the message is formatted like fmt.Sprintf
+func (e *Entry) Error(message string, v ...interface{}) {
+	e.write(ErrorLevel, message, v...)
+}
+
+func (e *Entry) write(l Level, message string, v ...interface{}) {
+	mu.Lock()
+	defer mu.Unlock()
+	if l < level {
+		return
+	}
+	if len(v) > 0 {
+		message = fmt.Sprintf(message, v...)
+	}
+	var line string
+	switch format {
+	case FormatLogfmt:
+		line = e.logfmt(l, message)
+	case FormatJSON:
+		line = e.json(l, message)
+	default:
+		line = e.text(l, message)
+	}
+	if w, ok := output.(levelWriter); ok {
+		w.WriteLevel(l, []byte(line))
+	} else {
+		io.WriteString(output, line+"\n") // Nowhere to report errors to
+	}
+}
+
+func (e *Entry) text(l Level, message string) string {
+	var sb strings.Builder
+	sb.WriteString(time.Now().Format(textTimeFormat))
+	sb.WriteString(" ")
+	sb.WriteString(strings.ToUpper(l.String()))
+	sb.WriteString(" ")
+	sb.WriteString(message)
+	e.eachField(func(key string, value string) {
+		sb.WriteString(fmt.Sprintf(" %s=%s", key, quoteIfNeeded(value)))
+	})
+	return sb.String()
+}
+
+func (e *Entry) logfmt(l Level, message string) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("time=%s level=%s msg=%s", time.Now().Format(time.RFC3339), l.String(), quoteIfNeeded(message)))
+	e.eachField(func(key string, value string) {
+		sb.WriteString(fmt.Sprintf(" %s=%s", key, quoteIfNeeded(value)))
+	})
+	return sb.String()
+}
+
+func (e *Entry) json(l Level, message string) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf(`{"time":%s,"level":%s,"msg":%s`, jsonValue(time.Now().Format(time.RFC3339)), jsonValue(l.String()), jsonValue(message)))
+	for i := 0; i+1 < len(e.fields); i += 2 {
+		if value, ok := e.fields[i+1].(string); ok && value == "" {
+			continue
+		}
+		sb.WriteString(fmt.Sprintf(",%s:%s", jsonValue(fmt.Sprint(e.fields[i])), jsonValue(e.fields[i+1])))
+	}
+	sb.WriteString("}")
+	return sb.String()
+}
+
+// eachField calls fn for each key-value pair, with the value converted to a string. Empty values are skipped.
+func (e *Entry) eachField(fn func(key string, value string)) {
+	for i := 0; i+1 < len(e.fields); i += 2 {
+		var value string
+		switch v := e.fields[i+1].(type) {
+		case error:
+			value = v.Error()
+		default:
+			value = fmt.Sprint(v)
+		}
+		if value != "" {
+			fn(fmt.Sprint(e.fields[i]), value)
+		}
+	}
+}
+
+// quoteIfNeeded quotes s if it is empty or contains spaces, quotes or equal signs
+func quoteIfNeeded(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return fmt.Sprintf("%q", s)
+	}
+	return s
+}
+
+func jsonValue(v interface{}) string {
+	switch t := v.(type) {
+	case error:
+		v = t.Error()
+	case time.Duration:
+		v = t.String()
+	case fmt.Stringer:
+		v = t.String()
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	return string(b)
+}
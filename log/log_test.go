@@ -0,0 +1,76 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"heckel.io/pcopy/test"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLog_TextFormatAndLevel(t *testing.T) {
+	var buf bytes.Buffer
+	setTestOutput(t, &buf, InfoLevel, FormatText)
+
+	With("clipboard", "localhost:2586", "id", "some file").Info("uploaded %d bytes", 10)
+	Debug("this is hidden")
+	With("empty", "").Warn("careful")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	test.Int64Equals(t, 2, int64(len(lines)))
+	test.StrContains(t, lines[0], ` INFO uploaded 10 bytes clipboard=localhost:2586 id="some file"`)
+	test.StrContains(t, lines[1], ` WARN careful`)
+	test.BoolEquals(t, false, strings.Contains(lines[1], "empty="))
+}
+
+func TestLog_LogfmtFormat(t *testing.T) {
+	var buf bytes.Buffer
+	setTestOutput(t, &buf, DebugLevel, FormatLogfmt)
+
+	With("status", 404, "duration", 1500*time.Millisecond).Debug("request handled")
+	test.StrContains(t, buf.String(), ` level=debug msg="request handled" status=404 duration=1.5s`)
+}
+
+func TestLog_JSONFormat(t *testing.T) {
+	var buf bytes.Buffer
+	setTestOutput(t, &buf, InfoLevel, FormatJSON)
+
+	With("status", 201, "error", os.ErrNotExist, "id", "a \"quoted\" id").Error("request failed")
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, "error", entry["level"].(string))
+	test.StrEquals(t, "request failed", entry["msg"].(string))
+	test.Int64Equals(t, 201, int64(entry["status"].(float64)))
+	test.StrEquals(t, "file does not exist", entry["error"].(string))
+	test.StrEquals(t, `a "quoted" id`, entry["id"].(string))
+}
+
+func TestLog_ToLevelAndCheckFormat(t *testing.T) {
+	l, err := ToLevel("WARN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, "warn", l.String())
+	if _, err := ToLevel("verbose"); err == nil {
+		t.Fatalf("expected error, got none")
+	}
+	if err := CheckFormat("xml"); err == nil {
+		t.Fatalf("expected error, got none")
+	}
+}
+
+func setTestOutput(t *testing.T, buf *bytes.Buffer, l Level, f string) {
+	SetOutput(buf)
+	SetLevel(l)
+	SetFormat(f)
+	t.Cleanup(func() {
+		SetOutput(os.Stderr)
+		SetLevel(InfoLevel)
+		SetFormat(FormatText)
+	})
+}
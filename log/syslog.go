@@ -0,0 +1,61 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package log
+
+import (
+	"io"
+	"log/syslog"
+	"net/url"
+	"strings"
+)
+
+const syslogTag = "pcopy"
+
+// syslogOutput writes log entries to syslog, mapping the log level to the syslog severity
+type syslogOutput struct {
+	writer *syslog.Writer
+}
+
+// newSyslogOutput connects to the syslog daemon at addr, which may be empty (local syslog), a socket path
+// (e.g. /dev/log) or a URL (e.g. udp://host:514)
+func newSyslogOutput(addr string) (io.Writer, error) {
+	var writer *syslog.Writer
+	var err error
+	if addr == "" {
+		writer, err = syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, syslogTag)
+	} else if strings.HasPrefix(addr, "/") {
+		writer, err = syslog.Dial("unixgram", addr, syslog.LOG_INFO|syslog.LOG_DAEMON, syslogTag)
+		if err != nil {
+			writer, err = syslog.Dial("unix", addr, syslog.LOG_INFO|syslog.LOG_DAEMON, syslogTag)
+		}
+	} else {
+		var u *url.URL
+		u, err = url.Parse(addr)
+		if err != nil {
+			return nil, err
+		}
+		writer, err = syslog.Dial(u.Scheme, u.Host, syslog.LOG_INFO|syslog.LOG_DAEMON, syslogTag)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &syslogOutput{writer: writer}, nil
+}
+
+func (s *syslogOutput) Write(p []byte) (int, error) {
+	return s.writer.Write(p)
+}
+
+func (s *syslogOutput) WriteLevel(l Level, line []byte) error {
+	switch l {
+	case DebugLevel:
+		return s.writer.Debug(string(line))
+	case WarnLevel:
+		return s.writer.Warning(string(line))
+	case ErrorLevel:
+		return s.writer.Err(string(line))
+	default:
+		return s.writer.Info(string(line))
+	}
+}
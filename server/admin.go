@@ -0,0 +1,585 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/time/rate"
+	"heckel.io/pcopy/clipboard"
+	"heckel.io/pcopy/config"
+	"heckel.io/pcopy/crypto"
+	"heckel.io/pcopy/log"
+	"heckel.io/pcopy/util"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	adminClipboardsPath = "/clipboards"
+	adminEntriesPath    = "/entries"
+	adminStatsPath      = "/stats"
+	adminExpirePath     = "/expire"
+
+	// adminMaxRequestBodySize limits the size of JSON request bodies of the admin API
+	adminMaxRequestBodySize = 64 * 1024
+)
+
+var (
+	adminClipboardPathRegex = regexp.MustCompile(`^/clipboards/([^/]+)$`)
+	adminEntryPathRegex     = regexp.MustCompile(`^/entries/([^/]+)$`)
+	adminClipboardNameRegex = regexp.MustCompile(`^[a-z0-9][-_a-z0-9]{0,63}$`)
+)
+
+// AdminClipboard describes a clipboard in the admin API. Managed clipboards were added via the admin API
+// (see AdminConfigDir), and can be removed via it.
+type AdminClipboard struct {
+	Name                string `json:"name,omitempty"`
+	URL                 string `json:"url"`
+	Dir                 string `json:"dir"`
+	Protected           bool   `json:"protected"`
+	Managed             bool   `json:"managed"`
+	ClipboardSizeLimit  int64  `json:"clipboardSizeLimit"`
+	ClipboardCountLimit int    `json:"clipboardCountLimit"`
+	FileSizeLimit       int64  `json:"fileSizeLimit"`
+	FileExpireAfter     int64  `json:"fileExpireAfter"` // In seconds
+}
+
+// AdminClipboardRequest is the request body to add a clipboard via the admin API. The new clipboard inherits
+// all other settings (listen addresses, certificate, rate limits, ...) from the clipboard that enables the
+// admin API. Unset limits are inherited as well.
+type AdminClipboardRequest struct {
+	Name                string `json:"name"`
+	Key                 string `json:"key,omitempty"`      // Encoded clipboard key (see crypto.EncodeKey); unprotected if empty
+	Dir                 string `json:"dir,omitempty"`      // Defaults to a sibling of the admin clipboard's dir, e.g. /var/cache/pcopy-NAME
+	BasePath            string `json:"basePath,omitempty"` // Defaults to /NAME
+	ClipboardSizeLimit  int64  `json:"clipboardSizeLimit,omitempty"`
+	ClipboardCountLimit int    `json:"clipboardCountLimit,omitempty"`
+	FileSizeLimit       int64  `json:"fileSizeLimit,omitempty"`
+	FileExpireAfter     int64  `json:"fileExpireAfter,omitempty"` // In seconds
+}
+
+// AdminEntry describes a clipboard entry in the admin API. Times are Unix timestamps; an Expires value of 0
+// means that the entry never expires.
+type AdminEntry struct {
+	ID        string `json:"id"`
+	Size      int64  `json:"size"`
+	Modified  int64  `json:"modified"`
+	Expires   int64  `json:"expires"`
+	Mode      string `json:"mode"`
+	Protected bool   `json:"protected"` // Entry is protected by a file password, see HeaderFileSecret
+	Pipe      bool   `json:"pipe,omitempty"`
+	Slot      bool   `json:"slot,omitempty"`
+}
+
+// AdminEntryRequest is the request body to change the expiry of a clipboard entry via the admin API. If Pin is
+// set, the entry never expires. Otherwise, the entry expires TTL seconds from now. Unlike for regular uploads,
+// the TTL is not capped by the FileExpireAfter* settings.
+type AdminEntryRequest struct {
+	TTL int64 `json:"ttl,omitempty"` // In seconds
+	Pin bool  `json:"pin,omitempty"`
+}
+
+// AdminStats describes the current usage of a clipboard, and the state of its visitors
+type AdminStats struct {
+	URL                 string          `json:"url"`
+	Count               int             `json:"count"`
+	Size                int64           `json:"size"`
+	ClipboardCountLimit int             `json:"clipboardCountLimit"`
+	ClipboardSizeLimit  int64           `json:"clipboardSizeLimit"`
+	FreeSpace           int64           `json:"freeSpace"`
+	Visitors            []*AdminVisitor `json:"visitors"`
+	LockedIDs           []string        `json:"lockedIDs"` // File IDs that are locked due to failed auth attempts
+}
+
+// AdminVisitor describes a visitor of a clipboard (see visitorExpungeAfter), and its rate limiting and
+// lockout state. Times are Unix timestamps.
+type AdminVisitor struct {
+	IP             string `json:"ip"`
+	LastSeen       int64  `json:"lastSeen"`
+	RateLimitedGET bool   `json:"rateLimitedGET"`
+	RateLimitedPUT bool   `json:"rateLimitedPUT"`
+	AuthFailures   int    `json:"authFailures"`
+	LockedUntil    int64  `json:"lockedUntil,omitempty"`
+}
+
+// adminConfig returns the config that enables the admin API, or nil if the admin API is disabled. Since the admin
+// API is shared by all clipboards, only one config may enable it.
+func adminConfig(servers []*Server) (*config.Config, error) {
+	var conf *config.Config
+	for _, s := range servers {
+		if s.config.AdminListenAddr == "" {
+			continue
+		} else if conf != nil {
+			return nil, errAdminListenAddrNotUnique
+		} else if s.config.AdminKey == nil {
+			return nil, errAdminKeyMissing
+		}
+		conf = s.config
+	}
+	return conf, nil
+}
+
+// adminHandler returns the handler for the admin API listener, see AdminListenAddr. All requests must be
+// authenticated with the admin key.
+func (r *Router) adminHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		r.mu.Lock()
+		conf, _ := adminConfig(r.servers)
+		r.mu.Unlock()
+		logger := log.With("admin", true, "remote_addr", req.RemoteAddr, "method", req.Method, "uri", req.RequestURI)
+		var err error = ErrHTTPNotFound
+		if conf != nil {
+			if err = authorizeAdmin(req, conf.AdminKey); err == nil {
+				err = r.handleAdmin(w, req, conf)
+			}
+		}
+		status := http.StatusOK
+		if err != nil {
+			e, ok := err.(*ErrHTTP)
+			if !ok {
+				logger.With("error", err).Error("admin request failed")
+				e = &ErrHTTP{Code: http.StatusInternalServerError, Status: err.Error()}
+			}
+			status = e.Code
+			w.WriteHeader(e.Code)
+			io.WriteString(w, fmt.Sprintf("%s\n", e.Status))
+		}
+		logger.With("status", status, "duration", time.Since(start)).Info("admin request handled")
+	}
+}
+
+func (r *Router) handleAdmin(w http.ResponseWriter, req *http.Request, conf *config.Config) error {
+	if req.URL.Path == adminClipboardsPath && req.Method == http.MethodGet {
+		return r.handleAdminClipboardsList(w, conf)
+	} else if req.URL.Path == adminClipboardsPath && req.Method == http.MethodPost {
+		return r.handleAdminClipboardAdd(w, req, conf)
+	} else if m := adminClipboardPathRegex.FindStringSubmatch(req.URL.Path); m != nil && req.Method == http.MethodDelete {
+		return r.handleAdminClipboardRemove(w, req, conf, m[1])
+	}
+	isEntries := req.URL.Path == adminEntriesPath && req.Method == http.MethodGet
+	isStats := req.URL.Path == adminStatsPath && req.Method == http.MethodGet
+	isExpire := req.URL.Path == adminExpirePath && req.Method == http.MethodPost
+	entry := adminEntryPathRegex.FindStringSubmatch(req.URL.Path)
+	if !isEntries && !isStats && !isExpire && entry == nil {
+		return ErrHTTPNotFound
+	}
+	s, err := r.adminServer(req, conf)
+	if err != nil {
+		return err
+	}
+	if isEntries {
+		return s.handleAdminEntriesList(w)
+	} else if isStats {
+		return s.handleAdminStats(w)
+	} else if isExpire {
+		return s.handleAdminExpire(w)
+	} else if req.Method == http.MethodPatch {
+		return s.handleAdminEntryUpdate(w, req, entry[1])
+	} else if req.Method == http.MethodDelete {
+		return s.handleAdminEntryDelete(w, entry[1])
+	}
+	return ErrHTTPNotFound
+}
+
+// adminServer returns the server targeted by the "clipboard" query parameter, which may be the name of a managed
+// clipboard, or a server URL (see serverURL). If the parameter is not set, the clipboard that enables the admin
+// API is returned.
+func (r *Router) adminServer(req *http.Request, conf *config.Config) (*Server, error) {
+	url := serverURL(conf)
+	name := req.URL.Query().Get("clipboard")
+	if name != "" {
+		url = config.ExpandServerAddr(name)
+		if adminClipboardNameRegex.MatchString(name) {
+			if managed, err := config.LoadFromFile(config.NewStoreWithDir(conf.AdminConfigDir).FileFromName(name)); err == nil {
+				url = serverURL(managed)
+			}
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s := r.server(url); s != nil {
+		return s, nil
+	}
+	return nil, &ErrHTTP{Code: http.StatusNotFound, Status: fmt.Sprintf("clipboard %s not found", name)}
+}
+
+func (r *Router) handleAdminClipboardsList(w http.ResponseWriter, conf *config.Config) error {
+	managed := make(map[string]string) // Server URL -> name
+	for filename, c := range config.NewStoreWithDir(conf.AdminConfigDir).All() {
+		managed[serverURL(c)] = config.ExtractClipboard(filename)
+	}
+	r.mu.Lock()
+	clipboards := make([]*AdminClipboard, 0)
+	for _, s := range r.servers {
+		clipboard := newAdminClipboard(s.config)
+		clipboard.Name, clipboard.Managed = managed[clipboard.URL]
+		clipboards = append(clipboards, clipboard)
+	}
+	r.mu.Unlock()
+	return writeAdminJSON(w, http.StatusOK, clipboards)
+}
+
+// handleAdminClipboardAdd adds a clipboard: The config file is written to the AdminConfigDir first, so that the
+// clipboard survives a restart, and is then loaded from that file and applied via Reload. If the config is invalid
+// or the reload fails, the config file is removed again.
+func (r *Router) handleAdminClipboardAdd(w http.ResponseWriter, req *http.Request, conf *config.Config) error {
+	var clipboardReq AdminClipboardRequest
+	if err := json.NewDecoder(io.LimitReader(req.Body, adminMaxRequestBodySize)).Decode(&clipboardReq); err != nil {
+		return &ErrHTTP{Code: http.StatusBadRequest, Status: fmt.Sprintf("invalid request: %s", err.Error())}
+	}
+	newConf, err := newManagedConfig(conf, &clipboardReq)
+	if err != nil {
+		return &ErrHTTP{Code: http.StatusBadRequest, Status: err.Error()}
+	}
+	r.adminMu.Lock()
+	defer r.adminMu.Unlock()
+	filename := config.NewStoreWithDir(conf.AdminConfigDir).FileFromName(clipboardReq.Name)
+	if _, err := os.Stat(filename); err == nil {
+		return &ErrHTTP{Code: http.StatusConflict, Status: fmt.Sprintf("clipboard %s already exists", clipboardReq.Name)}
+	}
+	r.mu.Lock()
+	existing := r.server(serverURL(newConf))
+	configs := r.configs()
+	r.mu.Unlock()
+	if existing != nil {
+		return &ErrHTTP{Code: http.StatusConflict, Status: fmt.Sprintf("a clipboard with URL %s already exists", serverURL(newConf))}
+	}
+	if err := newConf.WriteFile(filename); err != nil {
+		return err
+	}
+	newConf, err = config.LoadFromFile(filename)
+	if err == nil {
+		err = r.Reload(append(configs, newConf)...)
+	}
+	if err != nil {
+		os.Remove(filename)
+		return &ErrHTTP{Code: http.StatusBadRequest, Status: fmt.Sprintf("cannot add clipboard: %s", err.Error())}
+	}
+	clipboard := newAdminClipboard(newConf)
+	clipboard.Name, clipboard.Managed = clipboardReq.Name, true
+	return writeAdminJSON(w, http.StatusCreated, clipboard)
+}
+
+// handleAdminClipboardRemove removes a managed clipboard: The config file is removed first (so that a concurrent
+// SIGHUP does not bring it back), and the clipboard is then removed via Reload. With ?purge=1, the clipboard
+// directory is removed as well, but only if it is a managed clipboard directory (see managedClipboardDir) that
+// no other clipboard uses.
+func (r *Router) handleAdminClipboardRemove(w http.ResponseWriter, req *http.Request, conf *config.Config, name string) error {
+	r.adminMu.Lock()
+	defer r.adminMu.Unlock()
+	filename := config.NewStoreWithDir(conf.AdminConfigDir).FileFromName(name)
+	if !adminClipboardNameRegex.MatchString(name) {
+		return ErrHTTPNotFound
+	} else if _, err := os.Stat(filename); err != nil {
+		return &ErrHTTP{Code: http.StatusNotFound, Status: fmt.Sprintf("clipboard %s does not exist or was not added via the admin API", name)}
+	}
+	removed, err := config.LoadFromFile(filename)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	target := r.server(serverURL(removed))
+	configs := make([]*config.Config, 0)
+	for _, s := range r.servers {
+		if s != target {
+			configs = append(configs, s.config)
+		}
+	}
+	r.mu.Unlock()
+	purge := req.URL.Query().Get("purge") == "1"
+	if purge {
+		if err := checkPurgeClipboardDir(conf, removed.ClipboardDir, configs); err != nil {
+			return &ErrHTTP{Code: http.StatusBadRequest, Status: fmt.Sprintf("cannot purge clipboard: %s", err.Error())}
+		}
+	}
+	contents, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filename); err != nil {
+		return err
+	}
+	if err := r.Reload(configs...); err != nil {
+		os.WriteFile(filename, contents, 0600)
+		return &ErrHTTP{Code: http.StatusBadRequest, Status: fmt.Sprintf("cannot remove clipboard: %s", err.Error())}
+	}
+	if purge {
+		if err := os.RemoveAll(removed.ClipboardDir); err != nil {
+			return err
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// managedClipboardDir returns the default clipboard directory of a managed clipboard, which is next to the
+// clipboard directory of the base config, e.g. /var/cache/pcopy-team1 for /var/cache/pcopy
+func managedClipboardDir(base *config.Config, name string) string {
+	return filepath.Join(filepath.Dir(base.ClipboardDir), fmt.Sprintf("%s-%s", filepath.Base(base.ClipboardDir), name))
+}
+
+// checkPurgeClipboardDir returns an error if the given clipboard directory may not be removed, because it is
+// not a managed clipboard directory (see managedClipboardDir), or because one of the other configs uses it
+func checkPurgeClipboardDir(base *config.Config, dir string, others []*config.Config) error {
+	dir = filepath.Clean(dir)
+	prefix := filepath.Base(base.ClipboardDir) + "-"
+	if filepath.Dir(dir) != filepath.Clean(filepath.Dir(base.ClipboardDir)) || !strings.HasPrefix(filepath.Base(dir), prefix) {
+		return fmt.Errorf("directory %s is not a managed clipboard directory", dir)
+	}
+	for _, c := range others {
+		if filepath.Clean(c.ClipboardDir) == dir {
+			return fmt.Errorf("directory %s is used by another clipboard", dir)
+		}
+	}
+	return nil
+}
+
+// newManagedConfig creates the config of a new clipboard from the config of the clipboard that enables the admin
+// API. Settings that cannot be shared between clipboards (TCP forwarder, audit log, admin API) are not inherited.
+func newManagedConfig(base *config.Config, req *AdminClipboardRequest) (*config.Config, error) {
+	if !adminClipboardNameRegex.MatchString(req.Name) {
+		return nil, fmt.Errorf("invalid clipboard name %s, must match %s", req.Name, adminClipboardNameRegex.String())
+	}
+	conf := *base
+	conf.ClipboardName = req.Name
+	conf.BasePath = "/" + req.Name
+	if req.BasePath != "" {
+		conf.BasePath = req.BasePath
+	}
+	conf.ClipboardDir = managedClipboardDir(base, req.Name)
+	if req.Dir != "" {
+		conf.ClipboardDir = req.Dir
+	}
+	conf.Key, conf.PreviousKeys = nil, nil
+	if req.Key != "" {
+		key, err := crypto.DecodeKey(req.Key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key: %w", err)
+		}
+		conf.Key = key
+	}
+	if req.ClipboardSizeLimit > 0 {
+		conf.ClipboardSizeLimit = req.ClipboardSizeLimit
+	}
+	if req.ClipboardCountLimit > 0 {
+		conf.ClipboardCountLimit = req.ClipboardCountLimit
+	}
+	if req.FileSizeLimit > 0 {
+		conf.FileSizeLimit = req.FileSizeLimit
+	}
+	if req.FileExpireAfter > 0 {
+		expireAfter := time.Duration(req.FileExpireAfter) * time.Second
+		conf.FileExpireAfterDefault, conf.FileExpireAfterNonTextMax, conf.FileExpireAfterTextMax = expireAfter, expireAfter, expireAfter
+	}
+	conf.ListenTCP = nil
+	conf.AuditLogFile = ""
+	conf.AdminListenAddr, conf.AdminListenHTTPS, conf.AdminKey, conf.AdminConfigDir = "", false, nil, ""
+	return &conf, nil
+}
+
+func (s *Server) handleAdminEntriesList(w http.ResponseWriter) error {
+	files, err := s.clipboard.List()
+	if err != nil {
+		return err
+	}
+	entries := make([]*AdminEntry, 0)
+	for _, f := range files {
+		entries = append(entries, newAdminEntry(f))
+	}
+	return writeAdminJSON(w, http.StatusOK, entries)
+}
+
+func (s *Server) handleAdminEntryUpdate(w http.ResponseWriter, req *http.Request, id string) error {
+	var entryReq AdminEntryRequest
+	if err := json.NewDecoder(io.LimitReader(req.Body, adminMaxRequestBodySize)).Decode(&entryReq); err != nil {
+		return &ErrHTTP{Code: http.StatusBadRequest, Status: fmt.Sprintf("invalid request: %s", err.Error())}
+	} else if !entryReq.Pin && entryReq.TTL <= 0 {
+		return &ErrHTTP{Code: http.StatusBadRequest, Status: "invalid request: either ttl or pin must be set"}
+	}
+	expires := int64(0)
+	if !entryReq.Pin {
+		expires = time.Now().Add(time.Duration(entryReq.TTL) * time.Second).Unix()
+	}
+	if err := s.clipboard.SetExpires(id, expires); err != nil {
+		return adminEntryError(id, err)
+	}
+	f, err := s.clipboard.Stat(id)
+	if err != nil {
+		return adminEntryError(id, err)
+	}
+	s.logger(nil).With("id", id, "expires", expires).Info("entry expiry changed via admin API")
+	return writeAdminJSON(w, http.StatusOK, newAdminEntry(f))
+}
+
+func (s *Server) handleAdminEntryDelete(w http.ResponseWriter, id string) error {
+	f, err := s.clipboard.Stat(id)
+	if err != nil {
+		return adminEntryError(id, err)
+	}
+	if f.Pipe {
+		s.clipboard.ClosePipe(id) // Unblock a waiting stream, if any
+	}
+	if err := s.clipboard.DeleteFile(id); err != nil {
+		return adminEntryError(id, err)
+	}
+	s.writeEvent(nil, EventDelete, id, f.Size, 0)
+	s.notify(config.WebhookEventDelete, id, f.Size)
+	s.logger(nil).With("id", id).Info("entry deleted via admin API (%s)", util.BytesToHuman(f.Size))
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (s *Server) handleAdminExpire(w http.ResponseWriter) error {
+	entries := make([]*AdminEntry, 0)
+	for _, f := range s.updateStatsAndExpire() {
+		entries = append(entries, newAdminEntry(f))
+	}
+	return writeAdminJSON(w, http.StatusOK, entries)
+}
+
+func (s *Server) handleAdminStats(w http.ResponseWriter) error {
+	clipboardStats, err := s.clipboard.Stats()
+	if err != nil {
+		return err
+	}
+	freeSpace, err := s.clipboard.FreeSpace()
+	if err != nil {
+		return err
+	}
+	stats := &AdminStats{
+		URL:                 serverURL(s.config),
+		Count:               clipboardStats.Count,
+		Size:                clipboardStats.Size,
+		ClipboardCountLimit: s.config.ClipboardCountLimit,
+		ClipboardSizeLimit:  s.config.ClipboardSizeLimit,
+		FreeSpace:           freeSpace,
+		Visitors:            make([]*AdminVisitor, 0),
+		LockedIDs:           make([]string, 0),
+	}
+	now := time.Now()
+	s.mu.Lock()
+	for ip, v := range s.visitors {
+		visitor := &AdminVisitor{
+			IP:             ip,
+			LastSeen:       v.lastSeen.Unix(),
+			RateLimitedGET: rateLimited(v.limiterGET, now),
+			RateLimitedPUT: rateLimited(v.limiterPUT, now),
+			AuthFailures:   v.failures.count,
+		}
+		if now.Before(v.failures.lockedUntil) {
+			visitor.LockedUntil = v.failures.lockedUntil.Unix()
+		}
+		stats.Visitors = append(stats.Visitors, visitor)
+	}
+	for id, f := range s.idFailures {
+		if now.Before(f.lockedUntil) {
+			stats.LockedIDs = append(stats.LockedIDs, id)
+		}
+	}
+	s.mu.Unlock()
+	sort.Slice(stats.Visitors, func(i, j int) bool { return stats.Visitors[i].IP < stats.Visitors[j].IP })
+	sort.Strings(stats.LockedIDs)
+	return writeAdminJSON(w, http.StatusOK, stats)
+}
+
+// rateLimited returns true if the limiter would currently reject a request. The reservation is cancelled
+// right away, so that checking does not consume a token.
+func rateLimited(limiter *rate.Limiter, now time.Time) bool {
+	reservation := limiter.ReserveN(now, 1)
+	defer reservation.CancelAt(now)
+	return !reservation.OK() || reservation.DelayFrom(now) > 0
+}
+
+func adminEntryError(id string, err error) error {
+	if err == clipboard.ErrInvalidFileID || os.IsNotExist(err) {
+		return &ErrHTTP{Code: http.StatusNotFound, Status: fmt.Sprintf("entry %s not found", id)}
+	}
+	return err
+}
+
+func newAdminEntry(f *clipboard.File) *AdminEntry {
+	return &AdminEntry{
+		ID:        f.ID,
+		Size:      f.Size,
+		Modified:  f.ModTime.Unix(),
+		Expires:   f.Expires,
+		Mode:      f.Mode,
+		Protected: f.Secret != "",
+		Pipe:      f.Pipe,
+		Slot:      f.Slot,
+	}
+}
+
+func newAdminClipboard(conf *config.Config) *AdminClipboard {
+	return &AdminClipboard{
+		URL:                 serverURL(conf),
+		Dir:                 conf.ClipboardDir,
+		Protected:           conf.Key != nil,
+		ClipboardSizeLimit:  conf.ClipboardSizeLimit,
+		ClipboardCountLimit: conf.ClipboardCountLimit,
+		FileSizeLimit:       conf.FileSizeLimit,
+		FileExpireAfter:     int64(conf.FileExpireAfterDefault.Seconds()),
+	}
+}
+
+// authorizeAdmin verifies the HMAC "Authorization" header of an admin request against the admin key. The header
+// has the same format as for clipboard requests, but the HMAC also covers the query and body of the request (see
+// crypto.GenerateAdminAuthHMAC). Other auth methods are not supported. The body is read and replaced, so that the
+// handlers can read it again.
+func authorizeAdmin(r *http.Request, key *crypto.Key) error {
+	m := authHmacRegex.FindStringSubmatch(r.Header.Get("Authorization"))
+	if m == nil {
+		return ErrHTTPUnauthorized
+	}
+	timestamp, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return ErrHTTPUnauthorized
+	}
+	ttlSecs, err := strconv.Atoi(m[2])
+	if err != nil {
+		return ErrHTTPUnauthorized
+	}
+	hash, err := base64.StdEncoding.DecodeString(m[3])
+	if err != nil {
+		return ErrHTTPUnauthorized
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, adminMaxRequestBodySize+1))
+	if err != nil {
+		return ErrHTTPBadRequest
+	} else if len(body) > adminMaxRequestBodySize {
+		return ErrHTTPPayloadTooLarge
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	hm := hmac.New(sha256.New, key.Bytes)
+	hm.Write(crypto.AdminAuthData(timestamp, ttlSecs, r.Method, r.URL.Path, r.URL.RawQuery, body))
+	if subtle.ConstantTimeCompare(hash, hm.Sum(nil)) != 1 {
+		return ErrHTTPUnauthorized
+	}
+	maxAge := defaultMaxAuthAge
+	if ttlSecs > 0 {
+		maxAge = time.Second * time.Duration(ttlSecs)
+	}
+	if time.Since(time.Unix(timestamp, 0)) > maxAge {
+		return ErrHTTPUnauthorized
+	}
+	return nil
+}
+
+func writeAdminJSON(w http.ResponseWriter, code int, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	return json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,305 @@
+package server
+
+import (
+	"encoding/json"
+	"heckel.io/pcopy/clipboard/clipboardtest"
+	"heckel.io/pcopy/config"
+	"heckel.io/pcopy/config/configtest"
+	"heckel.io/pcopy/crypto"
+	"heckel.io/pcopy/test"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerRouter_AdminAddListRemoveClipboard(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.ServerAddr = "http://localhost:11080"
+	conf.ListenHTTPS = nil
+	conf.ListenHTTP = []string{":11080"}
+	conf.AdminListenAddr = "127.0.0.1:11587"
+	conf.AdminKey = &crypto.Key{Salt: make([]byte, 10), Bytes: make([]byte, 32)}
+	conf.AdminConfigDir = t.TempDir()
+	serverRouter := startTestServerRouter(t, conf)
+	defer serverRouter.Stop()
+
+	test.WaitForPortUp(t, "11080")
+	test.WaitForPortUp(t, "11587")
+
+	// Add clipboard
+	resp := doAdminRequest(t, conf.AdminKey, "POST", "/clipboards", `{"name":"team1","fileExpireAfter":3600}`)
+	test.Int64Equals(t, http.StatusCreated, int64(resp.StatusCode))
+	var added AdminClipboard
+	if err := json.NewDecoder(resp.Body).Decode(&added); err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, "team1", added.Name)
+	test.StrEquals(t, "http://localhost:11080/team1", added.URL)
+	test.Int64Equals(t, 3600, added.FileExpireAfter)
+	test.FileExist(t, config.NewStoreWithDir(conf.AdminConfigDir).FileFromName("team1"))
+
+	// New clipboard is served, existing clipboard still works
+	test.Int64Equals(t, http.StatusCreated, int64(putTestFile(t, "http://localhost:11080/team1/file1", "team file")))
+	test.Int64Equals(t, http.StatusCreated, int64(putTestFile(t, "http://localhost:11080/file1", "main file")))
+	clipboardtest.Content(t, conf, "file1", "main file")
+	teamConf := &config.Config{ClipboardDir: added.Dir}
+	clipboardtest.Content(t, teamConf, "file1", "team file")
+
+	// Add again fails
+	resp = doAdminRequest(t, conf.AdminKey, "POST", "/clipboards", `{"name":"team1"}`)
+	test.Int64Equals(t, http.StatusConflict, int64(resp.StatusCode))
+
+	// List
+	resp = doAdminRequest(t, conf.AdminKey, "GET", "/clipboards", "")
+	test.Int64Equals(t, http.StatusOK, int64(resp.StatusCode))
+	var clipboards []*AdminClipboard
+	if err := json.NewDecoder(resp.Body).Decode(&clipboards); err != nil {
+		t.Fatal(err)
+	}
+	test.Int64Equals(t, 2, int64(len(clipboards)))
+	test.StrEquals(t, "http://localhost:11080", clipboards[0].URL)
+	test.BoolEquals(t, false, clipboards[0].Managed)
+	test.StrEquals(t, "team1", clipboards[1].Name)
+	test.BoolEquals(t, true, clipboards[1].Managed)
+
+	// Remove
+	resp = doAdminRequest(t, conf.AdminKey, "DELETE", "/clipboards/team1?purge=1", "")
+	test.Int64Equals(t, http.StatusNoContent, int64(resp.StatusCode))
+	test.FileNotExist(t, config.NewStoreWithDir(conf.AdminConfigDir).FileFromName("team1"))
+	test.FileNotExist(t, added.Dir)
+	test.Int64Equals(t, http.StatusBadRequest, int64(putTestFile(t, "http://localhost:11080/team1/file2", "gone"))) // Falls through to main clipboard, invalid ID
+
+	// Unmanaged clipboards cannot be removed
+	resp = doAdminRequest(t, conf.AdminKey, "DELETE", "/clipboards/server", "")
+	test.Int64Equals(t, http.StatusNotFound, int64(resp.StatusCode))
+}
+
+func TestServerRouter_AdminPurgeOnlyUnusedManagedDirs(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.ServerAddr = "http://localhost:11080"
+	conf.ListenHTTPS = nil
+	conf.ListenHTTP = []string{":11080"}
+	conf.AdminListenAddr = "127.0.0.1:11587"
+	conf.AdminKey = &crypto.Key{Salt: make([]byte, 10), Bytes: make([]byte, 32)}
+	conf.AdminConfigDir = t.TempDir()
+	serverRouter := startTestServerRouter(t, conf)
+	defer serverRouter.Stop()
+
+	test.WaitForPortUp(t, "11587")
+
+	// Directory outside of the managed clipboard root is not purged
+	outsideDir := t.TempDir()
+	resp := doAdminRequest(t, conf.AdminKey, "POST", "/clipboards", `{"name":"outside","dir":"`+outsideDir+`"}`)
+	test.Int64Equals(t, http.StatusCreated, int64(resp.StatusCode))
+	resp = doAdminRequest(t, conf.AdminKey, "DELETE", "/clipboards/outside?purge=1", "")
+	test.Int64Equals(t, http.StatusBadRequest, int64(resp.StatusCode))
+	test.FileExist(t, outsideDir)
+	test.FileExist(t, config.NewStoreWithDir(conf.AdminConfigDir).FileFromName("outside"))
+
+	// Directory that is still used by another clipboard is not purged
+	resp = doAdminRequest(t, conf.AdminKey, "POST", "/clipboards", `{"name":"shared1"}`)
+	test.Int64Equals(t, http.StatusCreated, int64(resp.StatusCode))
+	var shared1 AdminClipboard
+	if err := json.NewDecoder(resp.Body).Decode(&shared1); err != nil {
+		t.Fatal(err)
+	}
+	resp = doAdminRequest(t, conf.AdminKey, "POST", "/clipboards", `{"name":"shared2","dir":"`+shared1.Dir+`"}`)
+	test.Int64Equals(t, http.StatusCreated, int64(resp.StatusCode))
+	resp = doAdminRequest(t, conf.AdminKey, "DELETE", "/clipboards/shared2?purge=1", "")
+	test.Int64Equals(t, http.StatusBadRequest, int64(resp.StatusCode))
+	test.FileExist(t, shared1.Dir)
+
+	// Once unused, it is purged
+	resp = doAdminRequest(t, conf.AdminKey, "DELETE", "/clipboards/shared2", "")
+	test.Int64Equals(t, http.StatusNoContent, int64(resp.StatusCode))
+	resp = doAdminRequest(t, conf.AdminKey, "DELETE", "/clipboards/shared1?purge=1", "")
+	test.Int64Equals(t, http.StatusNoContent, int64(resp.StatusCode))
+	test.FileNotExist(t, shared1.Dir)
+}
+
+func TestServerRouter_AdminEntriesStatsExpire(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.ServerAddr = "http://localhost:11080"
+	conf.ListenHTTPS = nil
+	conf.ListenHTTP = []string{":11080"}
+	conf.AdminListenAddr = "127.0.0.1:11587"
+	conf.AdminKey = &crypto.Key{Salt: make([]byte, 10), Bytes: make([]byte, 32)}
+	conf.AdminConfigDir = t.TempDir()
+	serverRouter := startTestServerRouter(t, conf)
+	defer serverRouter.Stop()
+
+	test.WaitForPortUp(t, "11080")
+	test.WaitForPortUp(t, "11587")
+
+	test.Int64Equals(t, http.StatusCreated, int64(putTestFile(t, "http://localhost:11080/file1", "file one")))
+	test.Int64Equals(t, http.StatusCreated, int64(putTestFile(t, "http://localhost:11080/file2", "file two")))
+
+	// List entries
+	resp := doAdminRequest(t, conf.AdminKey, "GET", "/entries", "")
+	test.Int64Equals(t, http.StatusOK, int64(resp.StatusCode))
+	var entries []*AdminEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		t.Fatal(err)
+	}
+	test.Int64Equals(t, 2, int64(len(entries)))
+	test.StrEquals(t, "file1", entries[0].ID)
+	test.Int64Equals(t, 8, entries[0].Size)
+	test.BoolEquals(t, true, entries[0].Expires > time.Now().Unix())
+
+	// Pin entry, and make the other one expire right away
+	resp = doAdminRequest(t, conf.AdminKey, "PATCH", "/entries/file1", `{"pin":true}`)
+	test.Int64Equals(t, http.StatusOK, int64(resp.StatusCode))
+	var entry AdminEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entry); err != nil {
+		t.Fatal(err)
+	}
+	test.Int64Equals(t, 0, entry.Expires)
+	resp = doAdminRequest(t, conf.AdminKey, "PATCH", "/entries/file2", `{"ttl":1}`)
+	test.Int64Equals(t, http.StatusOK, int64(resp.StatusCode))
+	resp = doAdminRequest(t, conf.AdminKey, "PATCH", "/entries/file2", `{}`)
+	test.Int64Equals(t, http.StatusBadRequest, int64(resp.StatusCode))
+	resp = doAdminRequest(t, conf.AdminKey, "PATCH", "/entries/does-not-exist", `{"pin":true}`)
+	test.Int64Equals(t, http.StatusNotFound, int64(resp.StatusCode))
+
+	// Trigger expiry
+	time.Sleep(1100 * time.Millisecond)
+	resp = doAdminRequest(t, conf.AdminKey, "POST", "/expire", "")
+	test.Int64Equals(t, http.StatusOK, int64(resp.StatusCode))
+	var expired []*AdminEntry
+	if err := json.NewDecoder(resp.Body).Decode(&expired); err != nil {
+		t.Fatal(err)
+	}
+	test.Int64Equals(t, 1, int64(len(expired)))
+	test.StrEquals(t, "file2", expired[0].ID)
+	clipboardtest.NotExist(t, conf, "file2")
+	clipboardtest.Content(t, conf, "file1", "file one")
+
+	// Stats
+	resp = doAdminRequest(t, conf.AdminKey, "GET", "/stats", "")
+	test.Int64Equals(t, http.StatusOK, int64(resp.StatusCode))
+	var stats AdminStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, "http://localhost:11080", stats.URL)
+	test.Int64Equals(t, 1, int64(stats.Count))
+	test.Int64Equals(t, 8, stats.Size)
+	test.Int64Equals(t, 1, int64(len(stats.Visitors)))
+	test.BoolEquals(t, false, stats.Visitors[0].RateLimitedGET)
+
+	// Force-delete entry
+	resp = doAdminRequest(t, conf.AdminKey, "DELETE", "/entries/file1", "")
+	test.Int64Equals(t, http.StatusNoContent, int64(resp.StatusCode))
+	clipboardtest.NotExist(t, conf, "file1")
+
+	// Unknown clipboard
+	resp = doAdminRequest(t, conf.AdminKey, "GET", "/entries?clipboard=unknown", "")
+	test.Int64Equals(t, http.StatusNotFound, int64(resp.StatusCode))
+}
+
+func TestServerRouter_AdminEntriesOfManagedClipboard(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.ServerAddr = "http://localhost:11080"
+	conf.ListenHTTPS = nil
+	conf.ListenHTTP = []string{":11080"}
+	conf.AdminListenAddr = "127.0.0.1:11587"
+	conf.AdminKey = &crypto.Key{Salt: make([]byte, 10), Bytes: make([]byte, 32)}
+	conf.AdminConfigDir = t.TempDir()
+	serverRouter := startTestServerRouter(t, conf)
+	defer serverRouter.Stop()
+
+	test.WaitForPortUp(t, "11080")
+	test.WaitForPortUp(t, "11587")
+
+	resp := doAdminRequest(t, conf.AdminKey, "POST", "/clipboards", `{"name":"team1"}`)
+	test.Int64Equals(t, http.StatusCreated, int64(resp.StatusCode))
+	test.Int64Equals(t, http.StatusCreated, int64(putTestFile(t, "http://localhost:11080/team1/teamfile", "team file")))
+
+	for _, clipboard := range []string{"team1", "http://localhost:11080/team1"} {
+		resp = doAdminRequest(t, conf.AdminKey, "GET", "/entries?clipboard="+url.QueryEscape(clipboard), "")
+		test.Int64Equals(t, http.StatusOK, int64(resp.StatusCode))
+		var entries []*AdminEntry
+		if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+			t.Fatal(err)
+		}
+		test.Int64Equals(t, 1, int64(len(entries)))
+		test.StrEquals(t, "teamfile", entries[0].ID)
+	}
+}
+
+func TestServerRouter_AdminUnauthorized(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.ListenHTTPS = nil
+	conf.ListenHTTP = []string{":11080"}
+	conf.AdminListenAddr = "127.0.0.1:11587"
+	conf.AdminKey = &crypto.Key{Salt: make([]byte, 10), Bytes: make([]byte, 32)}
+	conf.AdminConfigDir = t.TempDir()
+	serverRouter := startTestServerRouter(t, conf)
+	defer serverRouter.Stop()
+
+	test.WaitForPortUp(t, "11587")
+
+	resp, err := http.Get("http://127.0.0.1:11587/clipboards")
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.Int64Equals(t, http.StatusUnauthorized, int64(resp.StatusCode))
+
+	wrongKey := &crypto.Key{Salt: make([]byte, 10), Bytes: []byte(strings.Repeat("x", 32))}
+	resp = doAdminRequest(t, wrongKey, "GET", "/clipboards", "")
+	test.Int64Equals(t, http.StatusUnauthorized, int64(resp.StatusCode))
+
+	// Header of a signed request cannot be replayed with a different body or query
+	auth, _ := crypto.GenerateAdminAuthHMAC(conf.AdminKey.Bytes, "POST", "/clipboards", "", []byte(`{"name":"team1"}`), 0)
+	req, _ := http.NewRequest("POST", "http://127.0.0.1:11587/clipboards", strings.NewReader(`{"name":"evil"}`))
+	req.Header.Set("Authorization", auth)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.Int64Equals(t, http.StatusUnauthorized, int64(resp.StatusCode))
+
+	auth, _ = crypto.GenerateAdminAuthHMAC(conf.AdminKey.Bytes, "DELETE", "/clipboards/team1", "", nil, 0)
+	req, _ = http.NewRequest("DELETE", "http://127.0.0.1:11587/clipboards/team1?purge=1", nil)
+	req.Header.Set("Authorization", auth)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.Int64Equals(t, http.StatusUnauthorized, int64(resp.StatusCode))
+}
+
+func TestServerRouter_AdminKeyMissing(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.AdminListenAddr = "127.0.0.1:11587"
+	serverRouter, err := NewRouter(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := serverRouter.Start(); err != errAdminKeyMissing {
+		t.Fatalf("expected errAdminKeyMissing, got %v", err)
+	}
+}
+
+func doAdminRequest(t *testing.T, key *crypto.Key, method string, path string, body string) *http.Response {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req, _ := http.NewRequest(method, "http://127.0.0.1:11587"+path, reader)
+	u, _ := url.Parse(path)
+	auth, err := crypto.GenerateAdminAuthHMAC(key.Bytes, method, u.Path, u.RawQuery, []byte(body), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", auth)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
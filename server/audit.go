@@ -0,0 +1,107 @@
+package server
+
+import (
+	"encoding/json"
+	"heckel.io/pcopy/util"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	// EventUpload is the audit log action for a file upload (PUT/POST)
+	EventUpload = "upload"
+
+	// EventDownload is the audit log action for a file download (GET/HEAD)
+	EventDownload = "download"
+
+	// EventDelete is the audit log action for a file that was deleted, e.g. because it expired
+	EventDelete = "delete"
+
+	// EventAuthFailure is the audit log action for a failed authentication attempt
+	EventAuthFailure = "auth-failure"
+)
+
+// Event is a single entry in the audit log. It is written to the log file as one JSON object per line.
+type Event struct {
+	Time       time.Time `json:"time"`
+	RemoteAddr string    `json:"remoteAddr,omitempty"`
+	User       string    `json:"user,omitempty"`
+	Action     string    `json:"action"`
+	ID         string    `json:"id,omitempty"`
+	Size       int64     `json:"size"`
+	Status     int       `json:"status,omitempty"`
+	UserAgent  string    `json:"userAgent,omitempty"`
+}
+
+// auditLog is an append-only JSON lines log file that is rotated when it reaches maxSize. Rotated files
+// are renamed to filename.1, filename.2, and so on; only maxFiles rotated files are kept.
+type auditLog struct {
+	file *util.RotatingFile
+}
+
+func newAuditLog(filename string, maxSize int64, maxFiles int) (*auditLog, error) {
+	file, err := util.NewRotatingFile(filename, maxSize, maxFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{file: file}, nil
+}
+
+// Write appends the event to the log file, and rotates the file if it would exceed the max size
+func (a *auditLog) Write(e *Event) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = a.file.Write(append(line, '\n'))
+	return err
+}
+
+// Close closes the underlying log file
+func (a *auditLog) Close() error {
+	return a.file.Close()
+}
+
+// auditResponseWriter is a http.ResponseWriter that records the status code and the number of bytes written,
+// so that they can be written to the audit log
+type auditResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (w *auditResponseWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *auditResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *auditResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// auditReadCloser is an io.ReadCloser that counts the number of bytes read, so that the upload size
+// can be written to the audit log (and sent to webhooks)
+type auditReadCloser struct {
+	io.ReadCloser
+	read int64
+}
+
+func (r *auditReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.read += int64(n)
+	return n, err
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"heckel.io/pcopy/test"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAuditLog_WriteAndRotate(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := newAuditLog(filename, 300, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := audit.Write(&Event{Time: time.Now(), Action: EventUpload, ID: "some-file", Size: int64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	test.FileExist(t, filename)
+	test.FileExist(t, filename+".1")
+	test.FileExist(t, filename+".2")
+	test.FileNotExist(t, filename+".3")
+	for _, f := range []string{filename, filename + ".1", filename + ".2"} {
+		stat, _ := os.Stat(f)
+		if stat.Size() > 300 {
+			t.Fatalf("expected %s to be smaller than max size, but it is %d bytes", f, stat.Size())
+		}
+	}
+
+	// Last event is in the current file
+	events := readTestEvents(t, filename)
+	test.Int64Equals(t, 9, events[len(events)-1].Size)
+}
+
+func readTestEvents(t *testing.T, filename string) []*Event {
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	events := make([]*Event, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, &event)
+	}
+	return events
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"heckel.io/pcopy/config"
+	"heckel.io/pcopy/log"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader holds the TLS certificate for a clipboard, and reloads it from disk whenever the certificate
+// or key file changes. This allows replacing the certificate (e.g. via 'pcopy cert renew') without a restart.
+// The files are checked for changes by the manager (see reload), not on every TLS handshake.
+type certReloader struct {
+	serverAddr  string
+	certFile    string
+	keyFile     string
+	cert        *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+	mu          sync.Mutex
+}
+
+func newCertReloader(serverAddr string, certFile string, keyFile string) (*certReloader, error) {
+	c := &certReloader{
+		serverAddr: serverAddr,
+		certFile:   certFile,
+		keyFile:    keyFile,
+	}
+	var err error
+	c.certModTime, c.keyModTime, err = c.modTimes()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Certificate returns the current certificate
+func (c *certReloader) Certificate() *tls.Certificate {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cert
+}
+
+// reload reloads the certificate if the certificate or key file have changed. If the files cannot be loaded,
+// the previous certificate is kept.
+func (c *certReloader) reload() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	certModTime, keyModTime, err := c.modTimes()
+	if err == nil && (!certModTime.Equal(c.certModTime) || !keyModTime.Equal(c.keyModTime)) {
+		c.certModTime, c.keyModTime = certModTime, keyModTime // Only attempt to reload once per change
+		if err := c.load(); err != nil {
+			log.With("clipboard", config.CollapseServerAddr(c.serverAddr), "error", err).
+				Error("cannot reload TLS certificate %s, continuing to use previous certificate", c.certFile)
+		} else {
+			log.With("clipboard", config.CollapseServerAddr(c.serverAddr)).
+				Info("reloaded TLS certificate %s, expires %s", c.certFile, c.cert.Leaf.NotAfter.Format(time.RFC3339))
+		}
+	}
+}
+
+// Expires returns the expiry date of the current certificate
+func (c *certReloader) Expires() time.Time {
+	return c.Certificate().Leaf.NotAfter
+}
+
+func (c *certReloader) modTimes() (time.Time, time.Time, error) {
+	certStat, err := os.Stat(c.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	keyStat, err := os.Stat(c.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return certStat.ModTime(), keyStat.ModTime(), nil
+}
+
+// load loads the certificate and key file. It must be called with c.mu held (or before the reloader is shared).
+func (c *certReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	c.cert = &cert
+	return nil
+}
+
+// getCertificateFunc returns a function to be used in tls.Config's GetCertificate. It selects the first
+// certificate that supports the client hello (e.g. because it matches the requested server name), or the first
+// certificate if none match.
+func getCertificateFunc(reloaders []*certReloader) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		certs := make([]*tls.Certificate, len(reloaders))
+		for i, reloader := range reloaders {
+			certs[i] = reloader.Certificate()
+			if len(reloaders) == 1 || hello.SupportsCertificate(certs[i]) == nil {
+				return certs[i], nil
+			}
+		}
+		return certs[0], nil
+	}
+}
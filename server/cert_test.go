@@ -0,0 +1,42 @@
+package server
+
+import (
+	"heckel.io/pcopy/crypto"
+	"heckel.io/pcopy/test"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCertReloader_ReloadOnChange(t *testing.T) {
+	dir := t.TempDir()
+	keyFile, certFile := filepath.Join(dir, "server.key"), filepath.Join(dir, "server.crt")
+	pemKey, pemCert, _ := crypto.GenerateKeyAndCert("first.example.com")
+	ioutil.WriteFile(keyFile, []byte(pemKey), 0600)
+	ioutil.WriteFile(certFile, []byte(pemCert), 0644)
+
+	reloader, err := newCertReloader("localhost", certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, "first.example.com", reloader.Certificate().Leaf.Subject.CommonName)
+
+	// Renew cert with same key
+	key, _ := crypto.LoadPrivateKeyFromFile(keyFile)
+	renewedCert, _ := crypto.GenerateCert(key, "second.example.com")
+	ioutil.WriteFile(certFile, []byte(renewedCert), 0644)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	test.StrEquals(t, "first.example.com", reloader.Certificate().Leaf.Subject.CommonName)
+	reloader.reload()
+	test.StrEquals(t, "second.example.com", reloader.Certificate().Leaf.Subject.CommonName)
+
+	// Broken cert: previous cert is kept
+	ioutil.WriteFile(certFile, []byte("invalid"), 0644)
+	future = future.Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	reloader.reload()
+	test.StrEquals(t, "second.example.com", reloader.Certificate().Leaf.Subject.CommonName)
+}
@@ -28,6 +28,9 @@ var ErrHTTPMethodNotAllowed = &ErrHTTP{http.StatusMethodNotAllowed, http.StatusT
 // ErrHTTPNotFound is returned when a resource is not found on the server
 var ErrHTTPNotFound = &ErrHTTP{http.StatusNotFound, http.StatusText(http.StatusNotFound)}
 
+// ErrHTTPConflict is returned when an upload slot is already being uploaded to, or has already been used
+var ErrHTTPConflict = &ErrHTTP{http.StatusConflict, http.StatusText(http.StatusConflict)}
+
 // ErrHTTPTooManyRequests is returned when a server-side rate limit has been reached
 var ErrHTTPTooManyRequests = &ErrHTTP{http.StatusTooManyRequests, http.StatusText(http.StatusTooManyRequests)}
 
@@ -37,8 +40,18 @@ var ErrHTTPPayloadTooLarge = &ErrHTTP{http.StatusRequestEntityTooLarge, http.Sta
 // ErrHTTPUnauthorized is returned when the client has not sent proper credentials
 var ErrHTTPUnauthorized = &ErrHTTP{http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized)}
 
+// ErrHTTPForbidden is returned when the client's address is not allowed to access the clipboard
+var ErrHTTPForbidden = &ErrHTTP{http.StatusForbidden, http.StatusText(http.StatusForbidden)}
+
+// errHTTPStreamNotScannable is returned for streaming uploads if uploads are scanned (see UploadScan), since a stream
+// cannot be scanned before it is read
+var errHTTPStreamNotScannable = &ErrHTTP{http.StatusUnprocessableEntity, "streaming is not allowed, since uploads are scanned"}
+
 var errListenAddrMissing = errors.New("listen address missing, add 'ListenHTTPS' or 'ListenHTTP' to config or pass --listen-http(s)")
 var errKeyFileMissing = errors.New("private key file missing, add 'KeyFile' to config or pass --keyfile")
 var errCertFileMissing = errors.New("certificate file missing, add 'CertFile' to config or pass --certfile")
 var errInvalidStreamMode = errors.New("invalid stream mode")
 var errNoMatchingRoute = errors.New("no matching route")
+var errNoSystemdSockets = errors.New("no sockets passed by systemd, make sure pcopy is started via a systemd socket unit")
+var errAdminListenAddrNotUnique = errors.New("admin API can only be enabled in one config file, remove 'AdminListenAddr' from all others")
+var errAdminKeyMissing = errors.New("admin key missing, add 'AdminKey' to config (see 'pcopy keygen')")
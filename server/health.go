@@ -0,0 +1,142 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"heckel.io/pcopy/util"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+
+	healthCheckClipboardDir = "clipboardDir"
+	healthCheckDiskSpace    = "diskSpace"
+	healthCheckCert         = "cert"
+	healthCheckManager      = "manager"
+
+	// managerMaxMissedRuns is the number of manager intervals after which the manager is considered stuck
+	managerMaxMissedRuns = 3
+)
+
+// Health is the response of the /healthz and /readyz endpoints. For /readyz, it contains the result of
+// each individual check; the server is only ready if all checks pass.
+type Health struct {
+	OK     bool                    `json:"ok"`
+	Checks map[string]*HealthCheck `json:"checks,omitempty"`
+}
+
+// HealthCheck is the result of a single readiness check
+type HealthCheck struct {
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+// handleHealthz reports that the process is alive. It does not check anything else, so that a liveness
+// probe does not restart the server because of problems that a restart cannot fix (e.g. a full disk).
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) error {
+	return writeHealth(w, &Health{OK: true})
+}
+
+// handleReadyz reports whether the server is ready to handle requests, i.e. whether the clipboard directory
+// is writable and has enough free space, the certificate is valid and the manager goroutine is running.
+//
+// Since the check messages reveal details about the server (e.g. the clipboard directory), they are only
+// returned to local requests (e.g. 'pcopy health' in a Docker health check) and to authorized requests.
+// Requests with credentials are rate limited and count towards the auth lockout like any other request.
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) error {
+	if isLoopbackRequest(r) {
+		return writeHealth(w, s.readiness(true))
+	} else if s.isProtected() && hasCredentials(r) {
+		return s.limit(s.auth(func(w http.ResponseWriter, r *http.Request) error {
+			return writeHealth(w, s.readiness(true))
+		}))(w, r)
+	}
+	return writeHealth(w, s.readiness(false))
+}
+
+// readiness runs all readiness checks. If details is false, the check messages are omitted.
+func (s *Server) readiness(details bool) *Health {
+	health := &Health{
+		OK: true,
+		Checks: map[string]*HealthCheck{
+			healthCheckClipboardDir: s.checkClipboardDir(),
+			healthCheckDiskSpace:    s.checkDiskSpace(),
+			healthCheckManager:      s.checkManager(),
+		},
+	}
+	if s.cert != nil {
+		health.Checks[healthCheckCert] = s.checkCert()
+	}
+	for _, check := range health.Checks {
+		health.OK = health.OK && check.OK
+		if !details {
+			check.Message = ""
+		}
+	}
+	return health
+}
+
+// isLoopbackRequest returns true if the request comes from the local host
+func isLoopbackRequest(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr // Forwarded requests have no port, see withClientAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// hasCredentials returns true if the request contains a key (header or query parameter) or a client certificate
+func hasCredentials(r *http.Request) bool {
+	return r.Header.Get("Authorization") != "" || r.URL.Query().Get(queryParamAuth) != "" ||
+		(r.TLS != nil && len(r.TLS.PeerCertificates) > 0)
+}
+
+func (s *Server) checkClipboardDir() *HealthCheck {
+	if err := s.clipboard.Writable(); err != nil {
+		return &HealthCheck{Message: fmt.Sprintf("clipboard dir %s not writable: %s", s.config.ClipboardDir, err.Error())}
+	}
+	return &HealthCheck{OK: true}
+}
+
+func (s *Server) checkDiskSpace() *HealthCheck {
+	free, err := s.clipboard.FreeSpace()
+	if err != nil {
+		return &HealthCheck{Message: fmt.Sprintf("cannot determine free space: %s", err.Error())}
+	}
+	message := fmt.Sprintf("%s free, min %s", util.BytesToHuman(free), util.BytesToHuman(s.config.ReadyMinFreeSpace))
+	return &HealthCheck{OK: free >= s.config.ReadyMinFreeSpace, Message: message}
+}
+
+func (s *Server) checkCert() *HealthCheck {
+	expires := s.cert.Expires()
+	if time.Now().After(expires) {
+		return &HealthCheck{Message: fmt.Sprintf("certificate expired %s", expires.Format(time.RFC3339))}
+	}
+	return &HealthCheck{OK: true, Message: fmt.Sprintf("certificate expires %s", expires.Format(time.RFC3339))}
+}
+
+func (s *Server) checkManager() *HealthCheck {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.managerChan == nil {
+		return &HealthCheck{Message: "manager not running"}
+	}
+	lastRun := time.Since(s.managerLast)
+	message := fmt.Sprintf("last run %s ago", lastRun.Round(time.Second))
+	return &HealthCheck{OK: lastRun < managerMaxMissedRuns*s.config.ManagerInterval, Message: message}
+}
+
+func writeHealth(w http.ResponseWriter, health *Health) error {
+	w.Header().Set("Content-Type", "application/json")
+	if health.OK {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	return json.NewEncoder(w).Encode(health)
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"golang.org/x/time/rate"
+	"heckel.io/pcopy/config/configtest"
+	"heckel.io/pcopy/crypto"
+	"heckel.io/pcopy/test"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestServer_HandleHealthzNotRateLimited(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.LimitGETBurst = 1
+	conf.LimitGET = rate.Every(time.Hour)
+	server := newTestServer(t, conf)
+
+	for i := 0; i < 3; i++ {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/healthz", nil)
+		server.Handle(rr, req)
+		test.Status(t, rr, http.StatusOK)
+		test.StrEquals(t, "{\"ok\":true}\n", rr.Body.String())
+	}
+}
+
+func TestServer_HandleReadyz(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	// Manager is not running
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/readyz", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusServiceUnavailable)
+	health := readTestHealth(t, rr)
+	test.BoolEquals(t, false, health.OK)
+	test.BoolEquals(t, true, health.Checks["clipboardDir"].OK)
+	test.BoolEquals(t, true, health.Checks["diskSpace"].OK)
+	test.BoolEquals(t, false, health.Checks["manager"].OK)
+	test.StrEquals(t, "manager not running", health.Checks["manager"].Message)
+
+	// Ready once the manager is running
+	server.startManager()
+	defer server.stopManager()
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/readyz", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	test.BoolEquals(t, true, readTestHealth(t, rr).OK)
+}
+
+func TestServer_HandleReadyzNotEnoughDiskSpace(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.ReadyMinFreeSpace = 1 << 62
+	server := newTestServer(t, conf)
+	server.startManager()
+	defer server.stopManager()
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/readyz", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusServiceUnavailable)
+	health := readTestHealth(t, rr)
+	test.BoolEquals(t, false, health.Checks["diskSpace"].OK)
+	test.StrContains(t, health.Checks["diskSpace"].Message, "free, min")
+}
+
+func TestServer_HandleReadyzDetailsOnlyForLocalOrAuthorized(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.Key = crypto.DeriveKey([]byte("some password"), []byte("some salt"))
+	server := newTestServer(t, conf)
+	server.startManager()
+	defer server.stopManager()
+
+	// Remote, unauthenticated: only the results
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/readyz", nil)
+	req.RemoteAddr = "1.2.3.4:1234"
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	health := readTestHealth(t, rr)
+	test.BoolEquals(t, true, health.Checks["diskSpace"].OK)
+	test.StrEquals(t, "", health.Checks["diskSpace"].Message)
+	test.StrEquals(t, "", health.Checks["manager"].Message)
+
+	// Remote, wrong password
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/readyz", nil)
+	req.RemoteAddr = "1.2.3.4:1234"
+	req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("x:wrong password")))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusUnauthorized)
+
+	// Remote, authorized
+	hmac, _ := crypto.GenerateAuthHMAC(conf.Key.Bytes, "GET", "/readyz", time.Minute)
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/readyz", nil)
+	req.RemoteAddr = "1.2.3.4:1234"
+	req.Header.Set("Authorization", hmac)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	test.StrContains(t, readTestHealth(t, rr).Checks["diskSpace"].Message, "free, min")
+
+	// Local
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/readyz", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	test.StrContains(t, readTestHealth(t, rr).Checks["diskSpace"].Message, "free, min")
+}
+
+func readTestHealth(t *testing.T, rr *httptest.ResponseRecorder) *Health {
+	var health Health
+	if err := json.NewDecoder(rr.Body).Decode(&health); err != nil {
+		t.Fatal(err)
+	}
+	return &health
+}
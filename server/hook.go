@@ -0,0 +1,110 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const (
+	// HeaderHookID is the header that contains the file ID in upload hook requests, see config.UploadScan
+	HeaderHookID = "X-Pcopy-ID"
+
+	// HeaderHookClipboard is the header that contains the clipboard URL in upload hook requests
+	HeaderHookClipboard = "X-Pcopy-Clipboard"
+
+	// HeaderHookRemoteAddr is the header that contains the address of the uploading client in upload hook requests
+	HeaderHookRemoteAddr = "X-Pcopy-Remote-Addr"
+
+	hookOutputMaxBytes = 1024
+)
+
+// uploadHookInfo is the file and metadata that is passed to an upload hook, see runUploadHook
+type uploadHookInfo struct {
+	Clipboard  string
+	ID         string
+	Path       string
+	Size       int64
+	RemoteAddr string
+}
+
+// runUploadHook runs the given upload hook (see config.UploadScan and config.UploadHook) for the given file.
+// If the hook is a http(s) URL, the file is POSTed to it, and any 2xx response is a success. Otherwise, the hook
+// is run as a shell command with the file path as first argument, and exit code 0 is a success.
+func runUploadHook(ctx context.Context, hook string, info *uploadHookInfo) error {
+	if strings.HasPrefix(hook, "http://") || strings.HasPrefix(hook, "https://") {
+		return runUploadHookURL(ctx, hook, info)
+	}
+	return runUploadHookCommand(ctx, hook, info)
+}
+
+func runUploadHookCommand(ctx context.Context, command string, info *uploadHookInfo) error {
+	cmd := exec.CommandContext(ctx, "sh", "-c", command, "sh", info.Path)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("PCOPY_FILE=%s", info.Path),
+		fmt.Sprintf("PCOPY_ID=%s", info.ID),
+		fmt.Sprintf("PCOPY_SIZE=%d", info.Size),
+		fmt.Sprintf("PCOPY_CLIPBOARD=%s", info.Clipboard),
+		fmt.Sprintf("PCOPY_REMOTE_ADDR=%s", info.RemoteAddr),
+	)
+
+	// Output goes to a file rather than a pipe, since a pipe that is held open by a child process of the
+	// command would make Run wait for that child, even after the timeout has passed
+	out, err := ioutil.TempFile("", "pcopy-hook-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if err := cmd.Run(); ctx.Err() != nil {
+		return ctx.Err()
+	} else if err != nil {
+		output, _ := ioutil.ReadFile(out.Name())
+		return fmt.Errorf("%s: %s", err.Error(), hookOutput(output))
+	}
+	return nil
+}
+
+func runUploadHookURL(ctx context.Context, url string, info *uploadHookInfo) error {
+	f, err := os.Open(info.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("User-Agent", "pcopy")
+	req.Header.Set(HeaderHookID, info.ID)
+	req.Header.Set(HeaderHookClipboard, info.Clipboard)
+	req.Header.Set(HeaderHookRemoteAddr, info.RemoteAddr)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	output, _ := ioutil.ReadAll(io.LimitReader(resp.Body, hookOutputMaxBytes))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response status %d: %s", resp.StatusCode, hookOutput(output))
+	}
+	return nil
+}
+
+// hookOutput returns the trimmed output of a hook, so that it can be logged
+func hookOutput(output []byte) string {
+	if len(output) > hookOutputMaxBytes {
+		output = output[:hookOutputMaxBytes]
+	}
+	return string(bytes.TrimSpace(output))
+}
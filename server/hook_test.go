@@ -0,0 +1,116 @@
+package server
+
+import (
+	"heckel.io/pcopy/clipboard/clipboardtest"
+	"heckel.io/pcopy/config/configtest"
+	"heckel.io/pcopy/test"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_UploadScanCommand(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.UploadScan = `grep -q EICAR "$1" && exit 1; test "$PCOPY_ID" != "forbidden-id"`
+	conf.UploadScanError = "file contains a virus"
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/clean", strings.NewReader("clean file"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	clipboardtest.Content(t, conf, "clean", "clean file")
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/infected", strings.NewReader("X5O!P%@AP EICAR test file"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusUnprocessableEntity)
+	test.StrEquals(t, "file contains a virus\n", rr.Body.String())
+	clipboardtest.NotExist(t, conf, "infected")
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/forbidden-id", strings.NewReader("clean file"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusUnprocessableEntity)
+	clipboardtest.NotExist(t, conf, "forbidden-id")
+
+	// Nothing is left behind in the quarantine
+	files, _ := os.ReadDir(filepath.Join(conf.ClipboardDir, ".quarantine"))
+	test.Int64Equals(t, 0, int64(len(files)))
+
+	// Streams cannot be scanned
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/stream?s=1", strings.NewReader("streamed"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusUnprocessableEntity)
+}
+
+func TestServer_UploadScanURL(t *testing.T) {
+	scanner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get(HeaderHookID) == "" || strings.Contains(string(body), "secret") {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer scanner.Close()
+
+	_, conf := configtest.NewTestConfig(t)
+	conf.UploadScan = scanner.URL
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/public", strings.NewReader("public info"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	clipboardtest.Content(t, conf, "public", "public info")
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/private", strings.NewReader("top secret info"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusUnprocessableEntity)
+	test.StrEquals(t, "upload rejected by content scan\n", rr.Body.String())
+	clipboardtest.NotExist(t, conf, "private")
+}
+
+func TestServer_UploadScanTimeout(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.UploadScan = "sleep 5"
+	conf.UploadHookTimeout = 100 * time.Millisecond
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/slow", strings.NewReader("slow scan"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusUnprocessableEntity)
+	clipboardtest.NotExist(t, conf, "slow")
+}
+
+func TestServer_UploadHook(t *testing.T) {
+	ids := make(chan string, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		ids <- r.Header.Get(HeaderHookID) + ":" + string(body)
+	}))
+	defer receiver.Close()
+
+	_, conf := configtest.NewTestConfig(t)
+	conf.UploadHook = receiver.URL
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/indexed", strings.NewReader("index me"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	select {
+	case id := <-ids:
+		test.StrEquals(t, "indexed:index me", id)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for upload hook")
+	}
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	listenUnixPrefix    = "unix:"
+	listenSystemdPrefix = "systemd:"
+
+	// systemdListenFDsStart is the first file descriptor passed by systemd socket activation, see sd_listen_fds(3)
+	systemdListenFDsStart = 3
+)
+
+var (
+	systemdListeners     map[string][]net.Listener // Sockets passed by systemd, keyed by FileDescriptorName=
+	systemdListenersErr  error
+	systemdListenersOnce sync.Once
+	systemdListenersMu   sync.Mutex
+)
+
+// listen binds the given address and returns its listeners. The address may be a TCP address ([ADDR]:PORT),
+// a Unix socket (unix:PATH), or the name of sockets passed by systemd socket activation (systemd:NAME). Since
+// systemd may pass more than one socket with the same name, more than one listener may be returned.
+func listen(addr string) ([]net.Listener, error) {
+	if strings.HasPrefix(addr, listenUnixPrefix) {
+		listener, err := listenUnix(strings.TrimPrefix(addr, listenUnixPrefix))
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{listener}, nil
+	} else if strings.HasPrefix(addr, listenSystemdPrefix) {
+		return listenSystemd(strings.TrimPrefix(addr, listenSystemdPrefix))
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return []net.Listener{listener}, nil
+}
+
+// listenUnix binds a Unix socket. A stale socket file from a previous run is removed first; the socket
+// file is removed again when the listener is closed.
+func listenUnix(path string) (net.Listener, error) {
+	if stat, err := os.Stat(path); err == nil && stat.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("unix socket %s is already in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// listenSystemd returns the listeners for the sockets with the given name that were passed by systemd. Each
+// socket can only be used once, since it is closed when the listener is shut down.
+func listenSystemd(name string) ([]net.Listener, error) {
+	systemdListenersOnce.Do(func() {
+		systemdListeners, systemdListenersErr = systemdListenersFromEnv()
+	})
+	if systemdListenersErr != nil {
+		return nil, systemdListenersErr
+	}
+	systemdListenersMu.Lock()
+	defer systemdListenersMu.Unlock()
+	listeners, ok := systemdListeners[name]
+	if !ok {
+		return nil, fmt.Errorf("no socket with name %s passed by systemd, or socket already in use", name)
+	}
+	delete(systemdListeners, name)
+	return listeners, nil
+}
+
+// systemdListenersFromEnv creates listeners for the sockets passed by systemd socket activation, as described
+// by the LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES environment variables (see sd_listen_fds(3)).
+func systemdListenersFromEnv() (map[string][]net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, errNoSystemdSockets
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, errNoSystemdSockets
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	listeners := make(map[string][]net.Listener)
+	for i := 0; i < count; i++ {
+		name := "unknown" // Default name used by systemd if FileDescriptorName= is not set and LISTEN_FDNAMES is missing
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		file := os.NewFile(uintptr(systemdListenFDsStart+i), name)
+		listener, err := net.FileListener(file)
+		file.Close() // FileListener dups the file descriptor
+		if err != nil {
+			return nil, fmt.Errorf("cannot use socket %s passed by systemd: %w", name, err)
+		}
+		listeners[name] = append(listeners[name], listener)
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	return listeners, nil
+}
+
+// listenPort returns the port of the first TCP address in addrs, or an empty string if there is none
+func listenPort(addrs []string) string {
+	for _, addr := range addrs {
+		if strings.HasPrefix(addr, listenUnixPrefix) || strings.HasPrefix(addr, listenSystemdPrefix) {
+			continue
+		}
+		if _, port, err := net.SplitHostPort(addr); err == nil {
+			return port
+		}
+	}
+	return ""
+}
+
+func containsAddr(addrs []string, addr string) bool {
+	for _, a := range addrs {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
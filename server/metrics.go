@@ -0,0 +1,321 @@
+package server
+
+import (
+	"fmt"
+	"heckel.io/pcopy/config"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	metricsPath = "/metrics"
+	routeFileID = "/{id}"
+)
+
+var (
+	// durationBuckets are the histogram buckets (in seconds) for upload and download durations. Since files
+	// can be large, the buckets go up to 10 minutes.
+	durationBuckets = []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300, 600}
+)
+
+// metrics collects Prometheus metrics for a clipboard. To avoid a dependency on the Prometheus client library,
+// the metrics are kept in simple counters, and written in the Prometheus text exposition format, see writeMetrics.
+type metrics struct {
+	requests         map[requestKey]int64
+	bytesIn          int64
+	bytesOut         int64
+	uploadDuration   *histogram
+	downloadDuration *histogram
+	activeStreams    int64
+	authFailures     int64
+	rateLimited      int64
+	expired          int64
+	mu               sync.Mutex
+}
+
+// requestKey identifies the labels of the requests counter
+type requestKey struct {
+	route  string
+	method string
+	status int
+}
+
+// histogram is a cumulative Prometheus-style histogram
+type histogram struct {
+	buckets []float64
+	counts  []int64
+	count   int64
+	sum     float64
+}
+
+// metricFamily is a metric with all its samples, as written to the /metrics endpoint
+type metricFamily struct {
+	name    string
+	help    string
+	typ     string
+	samples []*metricSample
+}
+
+// metricSample is a single line in a metric family. The suffix is appended to the family name (e.g. _bucket).
+type metricSample struct {
+	suffix string
+	labels []string // Key-value pairs
+	value  float64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests:         make(map[requestKey]int64),
+		uploadDuration:   newHistogram(durationBuckets),
+		downloadDuration: newHistogram(durationBuckets),
+	}
+}
+
+// observeRequest counts a handled request, and records the upload/download duration for file transfers
+func (m *metrics) observeRequest(route string, method string, status int, bytesIn int64, bytesOut int64, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[requestKey{route: route, method: method, status: status}]++
+	m.bytesIn += bytesIn
+	m.bytesOut += bytesOut
+	if status >= 200 && status < 300 {
+		if (route == routeFileID || route == "/(random)?") && (method == http.MethodPut || method == http.MethodPost) {
+			m.uploadDuration.observe(duration.Seconds())
+		} else if route == routeFileID && method == http.MethodGet {
+			m.downloadDuration.observe(duration.Seconds())
+		}
+	}
+}
+
+func (m *metrics) addStream(n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.activeStreams += n
+}
+
+func (m *metrics) addAuthFailure() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.authFailures++
+}
+
+func (m *metrics) addRateLimited() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rateLimited++
+}
+
+func (m *metrics) addExpired(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expired += int64(n)
+}
+
+// metricFamilies returns all metric families of the given server, labeled with the clipboard's server address
+func (s *Server) metricFamilies() []*metricFamily {
+	clipboard := config.CollapseServerAddr(serverURL(s.config))
+	m := s.metrics
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	requests := &metricFamily{name: "pcopy_requests_total", help: "Number of handled HTTP requests by route, method and status code", typ: "counter"}
+	keys := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		} else if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].status < keys[j].status
+	})
+	for _, key := range keys {
+		requests.add("", float64(m.requests[key]), "clipboard", clipboard, "route", key.route, "method", key.method, "status", fmt.Sprintf("%d", key.status))
+	}
+	families := []*metricFamily{
+		requests,
+		newMetricFamily("pcopy_received_bytes_total", "Number of bytes received in request bodies", "counter", clipboard, float64(m.bytesIn)),
+		newMetricFamily("pcopy_sent_bytes_total", "Number of bytes sent in response bodies", "counter", clipboard, float64(m.bytesOut)),
+		m.uploadDuration.family("pcopy_upload_duration_seconds", "Duration of successful uploads", clipboard),
+		m.downloadDuration.family("pcopy_download_duration_seconds", "Duration of successful downloads", clipboard),
+		newMetricFamily("pcopy_active_streams", "Number of streams (see pcp --stream) that are currently in progress", "gauge", clipboard, float64(m.activeStreams)),
+		newMetricFamily("pcopy_auth_failures_total", "Number of failed authentication attempts", "counter", clipboard, float64(m.authFailures)),
+		newMetricFamily("pcopy_rate_limited_total", "Number of requests rejected due to rate limiting", "counter", clipboard, float64(m.rateLimited)),
+		newMetricFamily("pcopy_expired_total", "Number of clipboard entries deleted because they expired", "counter", clipboard, float64(m.expired)),
+	}
+	if stats, err := s.clipboard.Stats(); err == nil {
+		families = append(families,
+			newMetricFamily("pcopy_clipboard_size_bytes", "Total size of all clipboard entries", "gauge", clipboard, float64(stats.Size)),
+			newMetricFamily("pcopy_clipboard_size_limit_bytes", "Total clipboard size limit (0 if unlimited), see ClipboardSizeLimit", "gauge", clipboard, float64(s.config.ClipboardSizeLimit)),
+			newMetricFamily("pcopy_clipboard_files", "Number of clipboard entries", "gauge", clipboard, float64(stats.Count)),
+			newMetricFamily("pcopy_clipboard_files_limit", "Clipboard entry count limit (0 if unlimited), see ClipboardCountLimit", "gauge", clipboard, float64(s.config.ClipboardCountLimit)),
+		)
+	}
+	return families
+}
+
+// handleMetrics writes the metrics of this clipboard in the Prometheus text exposition format
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) error {
+	return writeMetrics(w, []*Server{s})
+}
+
+// metricsHandler returns a handler for a separate metrics listener (see MetricsListenAddr), which may be
+// shared by multiple clipboards. Clipboards that require authentication for metrics are only included
+// if the request is authorized for them (see authorizeMetrics).
+//
+// Since a request is typically only meant for one of the clipboards, failed attempts are only counted
+// if the request is not authorized for any of them.
+func metricsHandler(servers []*Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != metricsPath || r.Method != http.MethodGet {
+			http.NotFound(w, r)
+			return
+		}
+		authorized, failed := make([]*Server, 0), make([]*Server, 0)
+		limited := false
+		for _, s := range servers {
+			if s.config.Metrics == config.MetricsOn {
+				authorized = append(authorized, s)
+			} else if err := s.authorizeMetrics(w, r); err == nil {
+				authorized = append(authorized, s)
+			} else if err == ErrHTTPTooManyRequests {
+				limited = true
+			} else {
+				failed = append(failed, s)
+			}
+		}
+		if len(authorized) == 0 {
+			for _, s := range failed {
+				s.addMetricsAuthFailure(r)
+			}
+			if limited {
+				http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			} else {
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			}
+			return
+		}
+		writeMetrics(w, authorized)
+	}
+}
+
+// authorizeMetrics authorizes a request to the separate metrics listener. Like on the main listener, the
+// request is rate limited, and rejected if the visitor is locked out. Failed attempts are not counted here,
+// see addMetricsAuthFailure.
+func (s *Server) authorizeMetrics(w http.ResponseWriter, r *http.Request) error {
+	v := s.getVisitor(r.RemoteAddr)
+	if !v.limiterGET.Allow() {
+		s.metrics.addRateLimited()
+		return ErrHTTPTooManyRequests
+	}
+	if s.config.AuthLockoutThreshold > 0 {
+		if retryAfter := s.visitorLockedOutFor(v); retryAfter > 0 {
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(retryAfter.Seconds()))))
+			return ErrHTTPTooManyRequests
+		}
+	}
+	if err := s.authorize(r); err != nil {
+		return err
+	}
+	s.resetAuthFailures(v)
+	return nil
+}
+
+// addMetricsAuthFailure records a failed authentication attempt to the separate metrics listener in the
+// audit log and the metrics, and counts it towards the lockout of the visitor (see AuthLockoutThreshold)
+func (s *Server) addMetricsAuthFailure(r *http.Request) {
+	s.writeEvent(r, EventAuthFailure, "", 0, http.StatusUnauthorized)
+	s.metrics.addAuthFailure()
+	if s.config.AuthLockoutThreshold > 0 {
+		s.addAuthFailure(r, s.getVisitor(r.RemoteAddr), "")
+	}
+}
+
+// writeMetrics writes the metrics of all given servers to w. Samples of the same metric family are grouped,
+// since the exposition format requires each family to appear only once.
+func writeMetrics(w http.ResponseWriter, servers []*Server) error {
+	families := make([]*metricFamily, 0)
+	byName := make(map[string]*metricFamily)
+	for _, s := range servers {
+		for _, family := range s.metricFamilies() {
+			if existing, ok := byName[family.name]; ok {
+				existing.samples = append(existing.samples, family.samples...)
+			} else {
+				byName[family.name] = family
+				families = append(families, family)
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, family := range families {
+		if err := family.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newMetricFamily(name string, help string, typ string, clipboard string, value float64) *metricFamily {
+	family := &metricFamily{name: name, help: help, typ: typ}
+	family.add("", value, "clipboard", clipboard)
+	return family
+}
+
+func (f *metricFamily) add(suffix string, value float64, labels ...string) {
+	f.samples = append(f.samples, &metricSample{suffix: suffix, labels: labels, value: value})
+}
+
+func (f *metricFamily) write(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.typ); err != nil {
+		return err
+	}
+	for _, sample := range f.samples {
+		labels := make([]string, 0, len(sample.labels)/2)
+		for i := 0; i+1 < len(sample.labels); i += 2 {
+			labels = append(labels, fmt.Sprintf(`%s="%s"`, sample.labels[i], escapeLabelValue(sample.labels[i+1])))
+		}
+		if _, err := fmt.Fprintf(w, "%s%s{%s} %g\n", f.name, sample.suffix, strings.Join(labels, ","), sample.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{
+		buckets: buckets,
+		counts:  make([]int64, len(buckets)),
+	}
+}
+
+func (h *histogram) observe(value float64) {
+	for i, bucket := range h.buckets {
+		if value <= bucket {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+func (h *histogram) family(name string, help string, clipboard string) *metricFamily {
+	family := &metricFamily{name: name, help: help, typ: "histogram"}
+	for i, bucket := range h.buckets {
+		family.add("_bucket", float64(h.counts[i]), "clipboard", clipboard, "le", fmt.Sprintf("%g", bucket))
+	}
+	family.add("_bucket", float64(h.count), "clipboard", clipboard, "le", "+Inf")
+	family.add("_sum", h.sum, "clipboard", clipboard)
+	family.add("_count", float64(h.count), "clipboard", clipboard)
+	return family
+}
+
+func escapeLabelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
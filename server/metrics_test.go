@@ -0,0 +1,135 @@
+package server
+
+import (
+	"encoding/base64"
+	"heckel.io/pcopy/config"
+	"heckel.io/pcopy/config/configtest"
+	"heckel.io/pcopy/crypto"
+	"heckel.io/pcopy/test"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_HandleMetrics(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.Metrics = config.MetricsOn
+	conf.ClipboardCountLimit = 5
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/hi", strings.NewReader("hi there"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/metrics", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	test.StrContains(t, rr.Header().Get("Content-Type"), "text/plain; version=0.0.4")
+
+	body := rr.Body.String()
+	test.StrContains(t, body, "# TYPE pcopy_requests_total counter\n")
+	test.StrContains(t, body, `pcopy_requests_total{clipboard="localhost:12345",route="/{id}",method="PUT",status="201"} 1`)
+	test.StrContains(t, body, `pcopy_received_bytes_total{clipboard="localhost:12345"} 8`)
+	test.StrContains(t, body, `pcopy_upload_duration_seconds_count{clipboard="localhost:12345"} 1`)
+	test.StrContains(t, body, `pcopy_upload_duration_seconds_bucket{clipboard="localhost:12345",le="+Inf"} 1`)
+	test.StrContains(t, body, `pcopy_clipboard_files{clipboard="localhost:12345"} 1`)
+	test.StrContains(t, body, `pcopy_clipboard_files_limit{clipboard="localhost:12345"} 5`)
+}
+
+func TestServer_HandleMetricsAuth(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.Key = crypto.DeriveKey([]byte("some password"), []byte("some salt"))
+	conf.Metrics = config.MetricsAuth
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusUnauthorized)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/metrics", nil)
+	hmac, _ := crypto.GenerateAuthHMAC(conf.Key.Bytes, "GET", "/metrics", time.Minute)
+	req.Header.Set("Authorization", hmac)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	test.StrContains(t, rr.Body.String(), `pcopy_auth_failures_total{clipboard="localhost:12345"} 1`)
+	test.StrContains(t, rr.Body.String(), `pcopy_requests_total{clipboard="localhost:12345",route="/metrics",method="GET",status="401"} 1`)
+}
+
+func TestServer_HandleMetricsOff(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusNotFound)
+}
+
+func TestServerRouter_MetricsListenAddr(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.ServerAddr = "https://localhost:11443"
+	conf.ListenHTTPS = []string{":11443"}
+	conf.ListenHTTP = nil
+	conf.Metrics = config.MetricsOn
+	conf.MetricsListenAddr = "127.0.0.1:11090"
+	serverRouter := startTestServerRouter(t, conf)
+	defer serverRouter.Stop()
+
+	test.WaitForPortUp(t, "11443")
+	test.WaitForPortUp(t, "11090")
+
+	resp, err := http.Get("http://127.0.0.1:11090/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	test.Int64Equals(t, http.StatusOK, int64(resp.StatusCode))
+	test.StrContains(t, string(body), `pcopy_clipboard_files{clipboard="localhost:11443"} 0`)
+}
+
+func TestServer_MetricsHandlerLockout(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.Key = crypto.DeriveKey([]byte("some password"), []byte("some salt"))
+	conf.Metrics = config.MetricsAuth
+	conf.MetricsListenAddr = "127.0.0.1:11090"
+	conf.AuthLockoutThreshold = 2
+	server := newTestServer(t, conf)
+	handler := metricsHandler([]*Server{server})
+
+	for i := 0; i < 2; i++ {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/metrics", nil)
+		req.RemoteAddr = "1.2.3.4:1234"
+		req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("x:wrong password")))
+		handler(rr, req)
+		test.Status(t, rr, http.StatusUnauthorized)
+	}
+
+	// Locked out, even with the correct password
+	hmac, _ := crypto.GenerateAuthHMAC(conf.Key.Bytes, "GET", "/metrics", time.Minute)
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	req.RemoteAddr = "1.2.3.4:1234"
+	req.Header.Set("Authorization", hmac)
+	handler(rr, req)
+	test.Status(t, rr, http.StatusTooManyRequests)
+	if rr.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected Retry-After header, got none")
+	}
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/metrics", nil)
+	req.RemoteAddr = "5.6.7.8:1234"
+	req.Header.Set("Authorization", hmac)
+	handler(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	test.StrContains(t, rr.Body.String(), `pcopy_auth_failures_total{clipboard="localhost:12345"} 2`)
+}
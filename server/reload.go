@@ -0,0 +1,263 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"golang.org/x/time/rate"
+	"heckel.io/pcopy/config"
+	"heckel.io/pcopy/log"
+)
+
+// Reload replaces the configs of a running router. Clipboards are matched by their server address: Changed
+// settings of existing clipboards are applied in place (keeping rate limiters, lockouts and active streams),
+// clipboards that are no longer configured are removed, and new ones are added. Listeners for new addresses are
+// started, and listeners for addresses that are no longer used are shut down gracefully. All changes are logged.
+//
+// If any of the new configs is invalid, or a new listen address cannot be bound, an error is returned and the
+// running configs are left untouched.
+func (r *Router) Reload(configs ...*config.Config) error {
+	if len(configs) == 0 {
+		return errInvalidNumberOfConfigs
+	}
+	candidates, err := createServers(configs)
+	if err != nil {
+		return err
+	}
+	for _, c := range candidates {
+		if err := c.loadCert(); err != nil {
+			closeServers(candidates)
+			return err
+		}
+	}
+	r.mu.Lock()
+	plan, err := r.planReload(candidates)
+	if err != nil {
+		r.mu.Unlock()
+		closeServers(candidates)
+		return err
+	}
+	reloaded := r.applyReload(plan)
+	r.mu.Unlock()
+
+	// The size and count limiters of reloaded clipboards are only updated by the manager. Since this walks the
+	// clipboard directory, it is done after releasing r.mu, so that incoming requests are not blocked by it.
+	for _, s := range reloaded {
+		current, release := s.acquire()
+		current.updateStatsAndExpire()
+		release()
+	}
+	return nil
+}
+
+// reloadPlan holds everything that is needed to apply a reload. It is created by planReload, which does not
+// modify the running router.
+type reloadPlan struct {
+	servers          []*Server // Servers after the reload; existing servers are kept, new ones are taken from candidates
+	candidates       []*Server // Servers created from the new configs, see Reload
+	listeners        map[string]*listener
+	tcpForwarders    map[string]*tcpForwarder
+	newListeners     map[string]*listener
+	newTCPForwarders map[string]*tcpForwarder
+	tlsConfigs       map[string]*tls.Config
+}
+
+func (r *Router) planReload(candidates []*Server) (*reloadPlan, error) {
+	listeners, err := createListeners(candidates)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfigs, err := createTLSConfigs(candidates)
+	if err != nil {
+		return nil, err
+	}
+	plan := &reloadPlan{
+		servers:          make([]*Server, len(candidates)),
+		candidates:       candidates,
+		listeners:        make(map[string]*listener),
+		tcpForwarders:    make(map[string]*tcpForwarder),
+		newListeners:     make(map[string]*listener),
+		newTCPForwarders: make(map[string]*tcpForwarder),
+		tlsConfigs:       tlsConfigs,
+	}
+	for i, c := range candidates {
+		if s := r.server(serverURL(c.config)); s != nil {
+			plan.servers[i] = s
+		} else {
+			plan.servers[i] = c
+		}
+	}
+	for addr, l := range listeners {
+		if existing, ok := r.listeners[addr]; ok && existing.kind != l.kind {
+			return nil, fmt.Errorf("cannot change listen address %s from %s to %s without a restart", addr, existing.kind, l.kind)
+		} else if ok {
+			plan.listeners[addr] = existing
+		} else {
+			plan.listeners[addr] = l
+			plan.newListeners[addr] = l
+		}
+	}
+	for addr, f := range createTCPForwarders(plan.servers) {
+		if existing, ok := r.tcpForwarders[addr]; ok {
+			plan.tcpForwarders[addr] = existing
+		} else {
+			plan.tcpForwarders[addr] = f
+			plan.newTCPForwarders[addr] = f
+		}
+	}
+	if err := r.listen(plan.newListeners, plan.newTCPForwarders); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// applyReload applies a reload plan. It must be called with r.mu held, and it cannot fail. It returns the servers
+// whose config was changed in place (see Server.reload), so that the caller can update their stats.
+func (r *Router) applyReload(plan *reloadPlan) []*Server {
+	changed := false
+	reloaded := make([]*Server, 0)
+	for i, s := range plan.servers {
+		c := plan.candidates[i]
+		if s == c {
+			s.logger(nil).Info("Added clipboard")
+			s.startManager()
+			changed = true
+			continue
+		}
+		changes := config.Diff(s.config, c.config)
+		for _, change := range changes {
+			s.logger(nil).Info("Config changed: %s", change)
+		}
+		if len(changes) > 0 {
+			s.reload(c)
+			plan.servers[i] = c
+			reloaded = append(reloaded, c)
+			changed = true
+		} else {
+			closeServers([]*Server{c})
+		}
+	}
+	for _, s := range r.servers {
+		if !containsServer(plan.servers, s) {
+			s.logger(nil).Info("Removed clipboard")
+			s.stopManager()
+			s.retire()
+			changed = true
+		}
+	}
+	for addr, f := range plan.tcpForwarders {
+		s := r.serverForTCP(plan.servers, addr)
+		f.setUpstream(config.ExpandServerAddr(s.config.ServerAddr), s.Handle, s.config.TrustedProxies)
+	}
+	for addr, l := range r.listeners {
+		if _, ok := plan.listeners[addr]; !ok {
+			log.Info("Stopped listening on %s/%s", addr, l.kind)
+			go r.shutdownListener(l)
+			changed = true
+		}
+	}
+	for addr, f := range r.tcpForwarders {
+		if _, ok := plan.tcpForwarders[addr]; !ok {
+			log.Info("Stopped listening on %s/tcp", addr)
+			go r.drainTCPForwarder(f)
+			changed = true
+		}
+	}
+	for addr, l := range plan.newListeners {
+		log.Info("Listening on %s/%s", addr, l.kind)
+		changed = true
+	}
+	for addr := range plan.newTCPForwarders {
+		log.Info("Listening on %s/tcp", addr)
+		changed = true
+	}
+	r.servers = plan.servers
+	r.listeners = plan.listeners
+	r.tcpForwarders = plan.tcpForwarders
+	r.tlsConfigs = plan.tlsConfigs
+	r.serve(plan.newListeners, plan.newTCPForwarders)
+	if changed {
+		log.Info("Config reloaded (%d clipboard(s))", len(r.servers))
+	} else {
+		log.Info("Config reloaded, nothing changed")
+	}
+	return reloaded
+}
+
+// server returns the running server with the given server URL (see serverURL), or nil if there is none
+func (r *Router) server(url string) *Server {
+	for _, s := range r.servers {
+		if serverURL(s.config) == url {
+			return s
+		}
+	}
+	return nil
+}
+
+// configs returns the configs of the running servers. It must be called with r.mu held.
+func (r *Router) configs() []*config.Config {
+	configs := make([]*config.Config, len(r.servers))
+	for i, s := range r.servers {
+		configs[i] = s.config
+	}
+	return configs
+}
+
+func (r *Router) serverForTCP(servers []*Server, addr string) *Server {
+	var server *Server
+	for _, s := range servers {
+		if containsAddr(s.config.ListenTCP, addr) {
+			server = s // Like createTCPForwarders, the last one wins
+		}
+	}
+	return server
+}
+
+func (r *Router) shutdownListener(l *listener) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.shutdownTimeout())
+	defer cancel()
+	if err := l.server.Shutdown(ctx); err != nil {
+		l.server.Close()
+	}
+}
+
+func (r *Router) drainTCPForwarder(f *tcpForwarder) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.shutdownTimeout())
+	defer cancel()
+	f.drain(ctx)
+}
+
+// reload replaces the running server s with c, a server created from the new config (see Router.Reload). c takes
+// over the state of s: Visitors, auth failures, metrics and active streams are kept; rate limiters are only reset
+// if the limits changed. Requests that are still handled by s are finished by s, and its resources are closed
+// afterwards, see retire. The stats of c are not updated here, see Router.Reload.
+func (s *Server) reload(c *Server) {
+	c.serverState = s.serverState
+	s.mu.Lock()
+	old := s.config
+	if old.LimitGET != c.config.LimitGET || old.LimitGETBurst != c.config.LimitGETBurst ||
+		old.LimitPUT != c.config.LimitPUT || old.LimitPUTBurst != c.config.LimitPUTBurst {
+		for _, v := range s.visitors {
+			v.limiterGET = rate.NewLimiter(c.config.LimitGET, c.config.LimitGETBurst)
+			v.limiterPUT = rate.NewLimiter(c.config.LimitPUT, c.config.LimitPUTBurst)
+		}
+	}
+	restartManager := s.managerChan != nil && old.ManagerInterval != c.config.ManagerInterval
+	s.current.Store(c)
+	s.mu.Unlock()
+	s.retire()
+	if restartManager {
+		c.stopManager()
+		c.startManager()
+	}
+}
+
+// containsServer returns true if servers contains server, or the server that replaced it (see reload)
+func containsServer(servers []*Server, server *Server) bool {
+	for _, s := range servers {
+		if s.serverState == server.serverState {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"fmt"
+	"golang.org/x/time/rate"
+	"heckel.io/pcopy/clipboard/clipboardtest"
+	"heckel.io/pcopy/config"
+	"heckel.io/pcopy/config/configtest"
+	"heckel.io/pcopy/test"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestServerRouter_ReloadChangesLimitsAndListeners(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.ServerAddr = "http://localhost:11080"
+	conf.ListenHTTPS = nil
+	conf.ListenHTTP = []string{":11080"}
+	conf.FileSizeLimit = 10
+	serverRouter := startTestServerRouter(t, conf)
+	defer serverRouter.Stop()
+
+	test.WaitForPortUp(t, "11080")
+	test.Int64Equals(t, http.StatusRequestEntityTooLarge, int64(putTestFileToRouter(serverRouter, ":11080", "/file1", "more than 10 bytes")))
+
+	// Raise file size limit, and add a second clipboard on a new port
+	newConf := *conf
+	newConf.FileSizeLimit = 100
+	_, conf2 := configtest.NewTestConfig(t)
+	conf2.ServerAddr = "http://localhost:12080"
+	conf2.ListenHTTPS = nil
+	conf2.ListenHTTP = []string{":12080"}
+	if err := serverRouter.Reload(&newConf, conf2); err != nil {
+		t.Fatal(err)
+	}
+	test.WaitForPortUp(t, "12080")
+	test.Int64Equals(t, http.StatusCreated, int64(putTestFile(t, "http://localhost:11080/file1", "more than 10 bytes")))
+	test.Int64Equals(t, http.StatusCreated, int64(putTestFile(t, "http://localhost:12080/file2", "clipboard 2")))
+	clipboardtest.Content(t, conf, "file1", "more than 10 bytes")
+	clipboardtest.Content(t, conf2, "file2", "clipboard 2")
+
+	// Remove the second clipboard again
+	if err := serverRouter.Reload(&newConf); err != nil {
+		t.Fatal(err)
+	}
+	test.WaitForPortDown(t, "12080")
+	test.WaitForPortUp(t, "11080")
+}
+
+func TestServerRouter_ReloadInvalidConfigKeepsRunningConfig(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.ServerAddr = "http://localhost:11080"
+	conf.ListenHTTPS = nil
+	conf.ListenHTTP = []string{":11080"}
+	conf.FileSizeLimit = 10
+	serverRouter := startTestServerRouter(t, conf)
+	defer serverRouter.Stop()
+
+	test.WaitForPortUp(t, "11080")
+
+	newConf := *conf
+	newConf.FileSizeLimit = 100
+	newConf.Metrics = config.MetricsOn
+	newConf.MetricsListenAddr = ":11080" // Conflicts with ListenHTTP
+	if err := serverRouter.Reload(&newConf); err == nil {
+		t.Fatalf("expected error, got none")
+	}
+	test.Int64Equals(t, http.StatusRequestEntityTooLarge, int64(putTestFileToRouter(serverRouter, ":11080", "/file1", "more than 10 bytes")))
+	test.Int64Equals(t, http.StatusCreated, int64(putTestFile(t, "http://localhost:11080/file1", "short")))
+}
+
+func putTestFile(t *testing.T, url string, content string) int {
+	req, _ := http.NewRequest("PUT", url, strings.NewReader(content))
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}} // Pooled connections may be to a stopped server on the same port
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// putTestFileToRouter is like putTestFile, but calls the handler of the listener directly. Over a real socket,
+// the server may close the connection before a body that is too large was fully sent, which makes the client
+// fail before it reads the 413 response.
+func putTestFileToRouter(serverRouter *Router, addr string, path string, content string) int {
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("PUT", path, strings.NewReader(content))
+	serverRouter.handler(addr).ServeHTTP(rr, req)
+	return rr.Code
+}
+
+func TestServer_ReloadClosesResourcesAfterInFlightRequests(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.AuditLogFile = filepath.Join(t.TempDir(), "audit.log")
+	conf.FileSizeLimit = 10
+	server := newTestServer(t, conf)
+	inFlight, release := server.acquire()
+
+	newConf := *conf
+	newConf.FileSizeLimit = 100
+	server.reload(newTestServer(t, &newConf))
+
+	// New requests are handled by the new server
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/new-request", strings.NewReader("more than 10 bytes"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	// Requests that started before the reload are finished with the previous config and audit log
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/in-flight-request", strings.NewReader("more than 10 bytes"))
+	inFlight.handle(rr, req)
+	test.Status(t, rr, http.StatusRequestEntityTooLarge)
+	release()
+
+	contents, _ := ioutil.ReadFile(conf.AuditLogFile)
+	test.StrContains(t, string(contents), `"id":"new-request"`)
+	test.StrContains(t, string(contents), `"id":"in-flight-request"`)
+}
+
+func TestServer_ReloadWhileHandlingRequests(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.LimitPUT = rate.Inf
+	server := newTestServer(t, conf)
+	server.startManager()
+	defer server.stopManager()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				rr := httptest.NewRecorder()
+				req, _ := http.NewRequest("PUT", fmt.Sprintf("/file-%d-%d", i, j), strings.NewReader("some content"))
+				server.Handle(rr, req)
+				test.Status(t, rr, http.StatusCreated)
+			}
+		}(i)
+	}
+	for i := 0; i < 10; i++ {
+		newConf := *conf
+		newConf.FileSizeLimit = int64(1000 + i)
+		server.reload(newTestServer(t, &newConf))
+	}
+	wg.Wait()
+	test.Int64Equals(t, 1009, server.current.Load().(*Server).config.FileSizeLimit)
+}
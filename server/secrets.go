@@ -0,0 +1,73 @@
+package server
+
+import (
+	"heckel.io/pcopy/util"
+	"math"
+	"regexp"
+	"strings"
+)
+
+const (
+	// secretMinEntropy is the minimum Shannon entropy (in bits per character) of a value in an assignment
+	// (e.g. API_KEY=...) to be considered a secret. Random tokens are typically well above 4, while words and
+	// placeholders are below.
+	secretMinEntropy = 3.5
+
+	// secretMinLength is the minimum length of a value in an assignment to be considered a secret
+	secretMinLength = 12
+)
+
+// secretPatterns are the patterns of well-known secrets that are detected in text uploads, see detectSecrets
+var secretPatterns = []struct {
+	name  string
+	regex *regexp.Regexp
+}{
+	{"private key", regexp.MustCompile(`-----BEGIN ((RSA|DSA|EC|OPENSSH|ENCRYPTED|PGP) )?PRIVATE KEY( BLOCK)?-----`)},
+	{"AWS access key", regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"GitHub token", regexp.MustCompile(`\b(gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,})\b`)},
+	{"Slack token", regexp.MustCompile(`\b(xox[abprs]-[A-Za-z0-9-]{10,}|https://hooks\.slack\.com/services/[A-Za-z0-9/]+)`)},
+}
+
+// secretAssignmentRegex matches assignments of secret-looking variables, e.g. in .env files, shell scripts,
+// JSON or YAML ("DB_PASSWORD=...", "export API_KEY=...", "client_secret: ..."). The value is the last group.
+var secretAssignmentRegex = regexp.MustCompile(`(?im)^[ \t]*(?:export[ \t]+)?["']?[a-z0-9_.-]*(?:secret|token|passw(?:or)?d|pwd|api[_-]?key|access[_-]?key|private[_-]?key|credentials?)[a-z0-9_.-]*["']?[ \t]*[:=][ \t]*["']?([^\s"',#]+)`)
+
+// detectSecrets returns the kinds of secrets (e.g. "private key") that were found in the given data, or an
+// empty slice if there are none. Only text is checked.
+func detectSecrets(data []byte) []string {
+	secrets := make([]string, 0)
+	if !strings.HasPrefix(util.DetectContentType(data), "text/") {
+		return secrets
+	}
+	for _, pattern := range secretPatterns {
+		if pattern.regex.Match(data) {
+			secrets = append(secrets, pattern.name)
+		}
+	}
+	if len(secrets) > 0 {
+		return secrets // Assignments are only checked as a fallback, since they often contain the tokens above
+	}
+	for _, matches := range secretAssignmentRegex.FindAllSubmatch(data, -1) {
+		value := string(matches[1])
+		if len(value) >= secretMinLength && !strings.HasPrefix(value, "$") && shannonEntropy(value) >= secretMinEntropy {
+			secrets = append(secrets, "password or API key")
+			break
+		}
+	}
+	return secrets
+}
+
+// shannonEntropy returns the Shannon entropy of the given string in bits per character
+func shannonEntropy(s string) float64 {
+	counts := make(map[rune]int)
+	for _, r := range s {
+		counts[r]++
+	}
+	entropy := 0.0
+	length := float64(len([]rune(s)))
+	for _, count := range counts {
+		p := float64(count) / length
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
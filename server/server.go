@@ -29,17 +29,21 @@ import (
 	"heckel.io/pcopy/clipboard"
 	"heckel.io/pcopy/config"
 	"heckel.io/pcopy/crypto"
+	"heckel.io/pcopy/log"
 	"heckel.io/pcopy/util"
 	htmltemplate "html/template"
 	"io"
-	"log"
+	"math"
 	"net"
 	"net/http"
 	"net/url"
+	"path"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"text/template"
 	"time"
 	"unicode/utf8"
@@ -65,12 +69,23 @@ const (
 	// HeaderReserve can be sent in PUT requests to enable reservation mode
 	HeaderReserve = "X-Reserve"
 
-	// HeaderReserveEnabled is a value for X-Reserve that enabled reservation mode; no other values are possible
+	// HeaderReserveEnabled is a value for X-Reserve that enabled reservation mode
 	HeaderReserveEnabled = "1"
 
+	// HeaderReserveSlot is a value for X-Reserve that creates an upload slot: the returned URL allows anyone holding
+	// it to upload to the reserved file ID exactly once, without any other credentials (see also HeaderMaxSize)
+	HeaderReserveSlot = "slot"
+
+	// HeaderMaxSize can be sent along with X-Reserve: slot to limit the size of the file uploaded to the slot
+	HeaderMaxSize = "X-Max-Size"
+
 	// HeaderNoRedirect prevents the redirect handler from redirecting to HTTPS
 	HeaderNoRedirect = "X-No-Redirect"
 
+	// HeaderRequestID identifies a request in the server logs. It is taken from the request if it is valid (e.g. if
+	// set by a reverse proxy or the TCP forwarder), or generated otherwise, and always returned in the response.
+	HeaderRequestID = "X-Request-ID"
+
 	// HeaderFormat can be set in PUT requests to define the response format (default if not set: HeaderFormatText)
 	HeaderFormat = "X-Format"
 
@@ -104,6 +119,34 @@ const (
 	// HeaderCurl is a response header containing the curl command that can be used to retrieve the clipboard file
 	HeaderCurl = "X-Curl"
 
+	// HeaderServerTime is a response header containing the current unix timestamp of the server. It is sent in
+	// responses to /info and in all 401 responses, so that clients can detect and correct clock skew.
+	HeaderServerTime = "X-Server-Time"
+
+	// HeaderKeyRotated is a response header that is set if the client authenticated with a previous (rotated) key.
+	// Clients should re-join the clipboard to pick up the current key.
+	HeaderKeyRotated = "X-Key-Rotated"
+
+	// HeaderKeyRotatedEnabled is the value for the X-Key-Rotated header; no other values are possible
+	HeaderKeyRotatedEnabled = "1"
+
+	// HeaderAllowSecrets can be sent in PUT requests to skip the detection of secrets (see config.SecretDetection)
+	HeaderAllowSecrets = "X-Allow-Secrets"
+
+	// HeaderAllowSecretsEnabled is the value for the X-Allow-Secrets header that skips the detection of secrets
+	HeaderAllowSecretsEnabled = "1"
+
+	// HeaderSecrets is a response header containing a comma-separated list of the kinds of secrets that were
+	// detected in the uploaded file (see config.SecretDetection), e.g. "private key,AWS access key"
+	HeaderSecrets = "X-Secrets"
+
+	// HeaderBurn is a response header that is set if the uploaded file is deleted after the first download, because
+	// it contains secrets (see config.SecretDetectionBurn)
+	HeaderBurn = "X-Burn"
+
+	// HeaderBurnEnabled is the value for the X-Burn header; no other values are possible
+	HeaderBurnEnabled = "1"
+
 	queryParamAuth          = "a"
 	queryParamStreamReserve = "r"
 	queryParamStream        = "s"
@@ -122,6 +165,8 @@ const (
 var (
 	authHmacRegex       = regexp.MustCompile(`^HMAC (\d+) (\d+) (.+)$`)
 	authBasicRegex      = regexp.MustCompile(`^Basic (\S+)$`)
+	requestIDRegex      = regexp.MustCompile(`^[-_.a-zA-Z0-9]{1,64}$`)
+	forwardedHostRegex  = regexp.MustCompile(`^[-_.a-zA-Z0-9]+(:\d+)?$|^\[[0-9a-fA-F:.]+\](:\d+)?$`)
 	clipboardPathFormat = "/%s"
 	templateFnMap       = template.FuncMap{
 		"expandServerAddr":   config.ExpandServerAddr,
@@ -150,12 +195,36 @@ var (
 )
 
 // Server is the main HTTP server struct. It's the one with all the good stuff.
+//
+// The config and the resources created from it (clipboard, audit log, webhooks, certificate) are not modified
+// once the server handles requests. When the config is reloaded, a new Server replaces the running one, and
+// takes over its state (see serverState and reload). Each request is handled entirely by the Server that was
+// current when the request started, see acquire.
 type Server struct {
-	config      *config.Config
-	clipboard   *clipboard.Clipboard
+	config    *config.Config
+	clipboard *clipboard.Clipboard
+	clientCAs *x509.CertPool
+	auditLog  *auditLog
+	webhooks  *webhookNotifier
+	cert      *certReloader
+	routes    []route
+	refs      sync.WaitGroup // Requests that are handled by this server, see acquire
+	retired   bool           // Server was replaced by a reload, see retire
+	refsMu    sync.Mutex     // Protects retired, and makes sure that refs is not increased once retired
+	*serverState
+}
+
+// serverState is the state of a clipboard that is kept when the config is reloaded, see Server
+type serverState struct {
+	inFlight    int64        // Number of requests currently being handled, accessed atomically
+	current     atomic.Value // Server that handles new requests (*Server), see reload
 	visitors    map[string]*visitor
-	routes      []route
+	idFailures  map[string]*authFailures
+	metrics     *metrics
+	claimed     map[string]bool // Upload slots that are currently being uploaded to, see claimSlot
+	streams     map[string]bool // File IDs of active streams, see closeStreams
 	managerChan chan bool
+	managerLast time.Time // Last run of the manager goroutine, see checkManager
 	mu          sync.Mutex
 }
 
@@ -166,15 +235,27 @@ type File struct {
 	TTL     time.Duration
 	Expires time.Time
 	Curl    string
+	Slot    bool
+	Secrets []string // Kinds of secrets that were detected in the file, see config.SecretDetection
+	Burn    bool     // File is deleted after the first download, see config.SecretDetectionBurn
 }
 
 // visitor represents an API user, and its associated rate.Limiter used for rate limiting
 type visitor struct {
 	limiterGET *rate.Limiter
 	limiterPUT *rate.Limiter
+	failures   *authFailures
 	lastSeen   time.Time
 }
 
+// authFailures counts failed authentication attempts (for a visitor or for a file ID), and
+// keeps track of the resulting lockout
+type authFailures struct {
+	count       int
+	lockedUntil time.Time
+	lastSeen    time.Time
+}
+
 // Info contains information about the server needed o join a server.
 type Info struct {
 	ServerAddr string            `json:"serverAddr"`
@@ -185,11 +266,14 @@ type Info struct {
 
 // httpResponseFileInfo is the response returned when uploading a file
 type httpResponseFileInfo struct {
-	URL     string `json:"url"`
-	File    string `json:"file"`
-	TTL     int    `json:"ttl"`
-	Expires int64  `json:"expires"`
-	Curl    string `json:"curl"`
+	URL     string   `json:"url"`
+	File    string   `json:"file"`
+	TTL     int      `json:"ttl"`
+	Expires int64    `json:"expires"`
+	Curl    string   `json:"curl"`
+	Slot    bool     `json:"slot,omitempty"`
+	Secrets []string `json:"secrets,omitempty"`
+	Burn    bool     `json:"burn,omitempty"`
 }
 
 // handleFunc extends the normal http.HandlerFunc to be able to easily return errors
@@ -200,15 +284,42 @@ type route struct {
 	method  string
 	regex   *regexp.Regexp
 	handler handleFunc
+	name    string // Used as label in metrics, e.g. "/{id}"
 }
 
 func newRoute(method, pattern string, handler handleFunc) route {
-	return route{method, regexp.MustCompile("^" + pattern + "$"), handler}
+	name := strings.Replace(pattern, "/"+clipboard.FileRegexPart, routeFileID, 1)
+	return route{method, regexp.MustCompile("^" + pattern + "$"), handler, name}
 }
 
 // routeCtx is a marker struct used to find fields in route matches
 type routeCtx struct{}
 
+// requestIDCtx is a marker struct used to find the request ID in the request context
+type requestIDCtx struct{}
+
+// authResultCtx is a marker struct used to find the authResult in the request context
+type authResultCtx struct{}
+
+// forwardedCtx is a marker struct used to find the forwarded protocol and host in the request context
+type forwardedCtx struct{}
+
+// forwarded contains the protocol and host of the original request, as reported by a trusted proxy
+// via the Forwarded or X-Forwarded-Proto/X-Forwarded-Host headers
+type forwarded struct {
+	proto string
+	host  string
+}
+
+// authResult is passed down to the authorize functions via the request context, so they can
+// report details about a successful authentication
+type authResult struct {
+	previousKey bool
+	user        string
+	slot        bool // Authorized using the secret of an upload slot
+	secret      bool // Authorized using the secret of a file (or upload slot) instead of the key
+}
+
 // webTemplateConfig is a struct defining all the things required to render the web root
 type webTemplateConfig struct {
 	KeyDerivIter int
@@ -216,16 +327,18 @@ type webTemplateConfig struct {
 	DefaultPort  int
 	TCPHost      string
 	TCPPort      string
+	ServerURL    string
 	Config       *config.Config
+	UploadSlot   *clipboard.File
 }
 
 // New creates a new instance of a Server using the given config. It does a few sanity checks to ensure
 // the config will likely work.
 func New(conf *config.Config) (*Server, error) {
-	if conf.ListenHTTPS == "" && conf.ListenHTTP == "" {
+	if len(conf.ListenHTTPS) == 0 && len(conf.ListenHTTP) == 0 {
 		return nil, errListenAddrMissing
 	}
-	if conf.ListenHTTPS != "" {
+	if len(conf.ListenHTTPS) > 0 || conf.AdminListenHTTPS {
 		if conf.KeyFile == "" {
 			return nil, errKeyFileMissing
 		}
@@ -233,43 +346,300 @@ func New(conf *config.Config) (*Server, error) {
 			return nil, errCertFileMissing
 		}
 	}
+	var clientCAs *x509.CertPool
+	if conf.ClientCAFile != "" {
+		certs, err := crypto.LoadCertsFromFile(conf.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load client CA file: %w", err)
+		}
+		clientCAs = x509.NewCertPool()
+		for _, cert := range certs {
+			clientCAs.AddCert(cert)
+		}
+	}
+	var audit *auditLog
+	if conf.AuditLogFile != "" {
+		var err error
+		audit, err = newAuditLog(conf.AuditLogFile, conf.AuditLogMaxSize, conf.AuditLogMaxFiles)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open audit log: %w", err)
+		}
+	}
 	clip, err := clipboard.New(conf)
 	if err != nil {
 		return nil, err
 	}
-	return &Server{
+	var webhooks *webhookNotifier
+	if len(conf.Webhooks) > 0 {
+		webhooks = newWebhookNotifier(conf.Webhooks, log.With("clipboard", config.CollapseServerAddr(serverURL(conf))))
+	}
+	s := &Server{
 		config:    conf,
 		clipboard: clip,
-		visitors:  make(map[string]*visitor),
+		clientCAs: clientCAs,
+		auditLog:  audit,
+		webhooks:  webhooks,
 		routes:    nil,
-	}, nil
+		serverState: &serverState{
+			visitors:   make(map[string]*visitor),
+			idFailures: make(map[string]*authFailures),
+			claimed:    make(map[string]bool),
+			streams:    make(map[string]bool),
+			metrics:    newMetrics(),
+		},
+	}
+	s.current.Store(s)
+	return s, nil
 }
 
-// Handle is the delegating handler function for a clipboard's server. It uses the routeList to find a matching route
-// and delegates to it.
+// Handle is the delegating handler function for a clipboard's server. The request is handled by the current
+// server (see acquire), which uses the routeList to find a matching route and delegates to it. Once the request
+// is handled, it is written to the access log.
 func (s *Server) Handle(w http.ResponseWriter, r *http.Request) {
+	current, release := s.acquire()
+	defer release()
+	current.handle(w, r)
+}
+
+// acquire returns the server that currently handles requests for this clipboard (which is s, unless the config
+// was reloaded), and a function to release it. Until it is released, the resources of the returned server
+// are not closed, even if it is replaced by a reload in the meantime, see retire.
+func (s *Server) acquire() (*Server, func()) {
+	for {
+		current := s.current.Load().(*Server)
+		current.refsMu.Lock()
+		if !current.retired {
+			current.refs.Add(1)
+			current.refsMu.Unlock()
+			return current, current.refs.Done
+		}
+		current.refsMu.Unlock() // Replaced in the meantime, try again
+	}
+}
+
+// retire marks the server as replaced (by a reload), or removed, and closes its resources once all requests
+// that are handled by it have finished, see acquire
+func (s *Server) retire() {
+	s.refsMu.Lock()
+	s.retired = true
+	s.refsMu.Unlock()
+	go func() {
+		s.refs.Wait()
+		closeServers([]*Server{s})
+	}()
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	atomic.AddInt64(&s.inFlight, 1)
+	defer atomic.AddInt64(&s.inFlight, -1)
+	r = s.withRequestID(s.withClientAddr(s.withForwarded(r)))
+	w.Header().Set(HeaderRequestID, requestID(r))
+	body := &auditReadCloser{ReadCloser: r.Body}
+	if r.Body != nil {
+		r.Body = body
+	}
+	rw := &auditResponseWriter{ResponseWriter: w}
+	defer func() {
+		status := rw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		entry := s.logger(r).With("status", status, "bytes_in", body.read, "bytes_out", rw.written, "duration", time.Since(start))
+		if r.URL.Path == healthzPath || r.URL.Path == readyzPath {
+			entry.Debug("request handled") // Probes would flood the log otherwise
+		} else {
+			entry.Info("request handled")
+		}
+	}()
+	s.logger(r).Debug("request received")
 	for _, route := range s.routeList() {
 		matches := route.regex.FindStringSubmatch(r.URL.Path)
 		if len(matches) > 0 && r.Method == route.method {
-			log.Printf("[%s] %s - %s %s", config.CollapseServerAddr(s.config.ServerAddr), r.RemoteAddr, r.Method, r.RequestURI)
+			defer func() {
+				status := rw.status
+				if status == 0 {
+					status = http.StatusOK
+				}
+				s.metrics.observeRequest(route.name, r.Method, status, body.read, rw.written, time.Since(start))
+			}()
 			ctx := context.WithValue(r.Context(), routeCtx{}, matches[1:])
-			if err := route.handler(w, r.WithContext(ctx)); err != nil {
+			err := s.checkAccess(r)
+			if err == nil {
+				err = route.handler(rw, r.WithContext(ctx))
+			}
+			if err != nil {
 				if err == clipboard.ErrInvalidFileID {
-					s.fail(w, r, http.StatusBadRequest, err)
+					s.fail(rw, r, http.StatusBadRequest, err)
 				} else if e, ok := err.(*ErrHTTP); ok {
-					s.fail(w, r, e.Code, e)
+					s.fail(rw, r, e.Code, e)
 				} else {
-					s.fail(w, r, http.StatusInternalServerError, err)
+					s.fail(rw, r, http.StatusInternalServerError, err)
 				}
 			}
 			return
 		}
 	}
 	if r.Method == http.MethodGet {
-		s.fail(w, r, http.StatusNotFound, errNoMatchingRoute)
+		s.fail(rw, r, http.StatusNotFound, errNoMatchingRoute)
+	} else {
+		s.fail(rw, r, http.StatusBadRequest, errNoMatchingRoute)
+	}
+}
+
+// withRequestID returns a request with a request ID in its context. The ID is taken from the X-Request-ID header
+// if it is valid, or generated otherwise.
+func (s *Server) withRequestID(r *http.Request) *http.Request {
+	id := r.Header.Get(HeaderRequestID)
+	if !requestIDRegex.MatchString(id) {
+		id = randomRequestID()
+	}
+	return r.WithContext(context.WithValue(r.Context(), requestIDCtx{}, id))
+}
+
+// requestID returns the request ID of the given request, or an empty string if it has none
+func requestID(r *http.Request) string {
+	if id, ok := r.Context().Value(requestIDCtx{}).(string); ok {
+		return id
+	}
+	return ""
+}
+
+// logger returns a log entry with fields identifying the clipboard and (if r is not nil) the request
+func (s *Server) logger(r *http.Request) *log.Entry {
+	entry := log.With("clipboard", config.CollapseServerAddr(serverURL(s.config)))
+	if r == nil {
+		return entry
+	}
+	return entry.With("request_id", requestID(r), "remote_addr", r.RemoteAddr, "method", r.Method, "uri", r.RequestURI)
+}
+
+// withClientAddr returns a request with the RemoteAddr set to the actual client address, if the request
+// was forwarded by one of the TrustedProxies. The client address is taken from the X-Forwarded-For header,
+// or (if not set) from the X-Real-IP header. If the request was not forwarded, it is returned unchanged.
+func (s *Server) withClientAddr(r *http.Request) *http.Request {
+	if len(s.config.TrustedProxies) == 0 || !util.IPNetsContain(s.config.TrustedProxies, util.RemoteIP(r.RemoteAddr)) {
+		return r
+	}
+	clientIP := ""
+	if forwardedFor := r.Header.Get("X-Forwarded-For"); forwardedFor != "" {
+		// Walk the list from the right, skipping our own trusted proxies
+		addrs := strings.Split(forwardedFor, ",")
+		for i := len(addrs) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(addrs[i]))
+			if ip == nil {
+				break
+			}
+			clientIP = ip.String()
+			if !util.IPNetsContain(s.config.TrustedProxies, ip) {
+				break
+			}
+		}
+	} else if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		clientIP = ip.String()
+	}
+	if clientIP == "" {
+		return r
+	}
+	forwarded := r.WithContext(r.Context())
+	forwarded.RemoteAddr = clientIP
+	return forwarded
+}
+
+// withForwarded returns a request with the protocol and host of the original request in its context, if the request
+// was forwarded by one of the TrustedProxies (see requestProto and requestHost). The standard Forwarded header
+// takes precedence over the X-Forwarded-Proto and X-Forwarded-Host headers. Since the original request is the one
+// sent by the client, the first hop is used. If the request was not forwarded, it is returned unchanged.
+func (s *Server) withForwarded(r *http.Request) *http.Request {
+	if len(s.config.TrustedProxies) == 0 || !util.IPNetsContain(s.config.TrustedProxies, util.RemoteIP(r.RemoteAddr)) {
+		return r
+	}
+	f := &forwarded{}
+	if header := r.Header.Get("Forwarded"); header != "" {
+		firstHop := strings.Split(header, ",")[0]
+		for _, pair := range strings.Split(firstHop, ";") {
+			kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			value := strings.Trim(kv[1], `"`)
+			switch strings.ToLower(kv[0]) {
+			case "proto":
+				f.proto = strings.ToLower(value)
+			case "host":
+				f.host = value
+			}
+		}
 	} else {
-		s.fail(w, r, http.StatusBadRequest, errNoMatchingRoute)
+		f.proto = strings.ToLower(strings.TrimSpace(strings.Split(r.Header.Get("X-Forwarded-Proto"), ",")[0]))
+		f.host = strings.TrimSpace(strings.Split(r.Header.Get("X-Forwarded-Host"), ",")[0])
+	}
+	if f.proto != "http" && f.proto != "https" {
+		f.proto = ""
+	}
+	if !forwardedHostRegex.MatchString(f.host) {
+		f.host = ""
+	}
+	if f.proto == "" && f.host == "" {
+		return r
 	}
+	return r.WithContext(context.WithValue(r.Context(), forwardedCtx{}, f))
+}
+
+// requestProto returns the protocol (http or https) the client used for the given request. If the request was
+// forwarded by a trusted proxy, this is the protocol of the request to the proxy.
+func requestProto(r *http.Request) string {
+	if f, ok := r.Context().Value(forwardedCtx{}).(*forwarded); ok && f.proto != "" {
+		return f.proto
+	} else if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// requestHost returns the host (and port, if any) the client used for the given request. If the request was
+// forwarded by a trusted proxy, this is the host of the request to the proxy.
+func requestHost(r *http.Request) string {
+	if f, ok := r.Context().Value(forwardedCtx{}).(*forwarded); ok && f.host != "" {
+		return f.host
+	}
+	return r.Host
+}
+
+// isForwarded returns true if the request was forwarded by a trusted proxy, see withForwarded
+func isForwarded(r *http.Request) bool {
+	_, ok := r.Context().Value(forwardedCtx{}).(*forwarded)
+	return ok
+}
+
+// publicURL returns the URL of the clipboard that is advertised to the client of the given request. If the ServerAddr
+// is set, it is used (see serverURL). Otherwise, the URL is derived from the request, so that the same server works
+// both when accessed directly (e.g. on the LAN) and when accessed via a reverse proxy.
+func (s *Server) publicURL(r *http.Request) string {
+	if s.config.ServerAddr != "" || r == nil || requestHost(r) == "" {
+		return serverURL(s.config)
+	}
+	return fmt.Sprintf("%s://%s%s", requestProto(r), requestHost(r), s.config.BasePath)
+}
+
+// checkAccess checks the client address against the allow/deny lists for reading (GET/HEAD)
+// or writing (all other methods), and returns ErrHTTPForbidden if the address is not allowed.
+func (s *Server) checkAccess(r *http.Request) error {
+	if r.URL.Path == healthzPath || r.URL.Path == readyzPath {
+		return nil // Probes are typically sent from internal addresses that are not in the allow lists
+	}
+	allow, deny := s.config.AllowWrite, s.config.DenyWrite
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		allow, deny = s.config.AllowRead, s.config.DenyRead
+	}
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil
+	}
+	ip := util.RemoteIP(r.RemoteAddr)
+	if util.IPNetsContain(deny, ip) || (len(allow) > 0 && !util.IPNetsContain(allow, ip)) {
+		return ErrHTTPForbidden
+	}
+	return nil
 }
 
 func (s *Server) routeList() []route {
@@ -282,44 +652,51 @@ func (s *Server) routeList() []route {
 	fileRoute := "/" + clipboard.FileRegexPart
 	s.routes = []route{
 		newRoute("GET", "/", s.limit(s.handleRoot)),
+		newRoute("GET", healthzPath, s.handleHealthz),
+		newRoute("GET", readyzPath, s.handleReadyz),
 		newRoute("GET", "/curl", s.limit(s.handleCurlRoot)),
 		newRoute("GET", "/nc", s.limit(s.handleNcRoot)),
-		newRoute("PUT", "/(random)?", s.limit(s.auth(s.handleClipboardPutRandom))),
-		newRoute("POST", "/(random)?", s.limit(s.auth(s.handleClipboardPutRandom))),
+		newRoute("PUT", "/(random)?", s.limit(s.audit(EventUpload, s.auth(s.handleClipboardPutRandom)))),
+		newRoute("POST", "/(random)?", s.limit(s.audit(EventUpload, s.auth(s.handleClipboardPutRandom)))),
 		newRoute("GET", "/static/.+", s.limit(s.handleStatic)),
 		newRoute("GET", "/favicon.ico", s.limit(s.handleFavicon)),
 		newRoute("GET", "/info", s.limit(s.handleInfo)),
 		newRoute("GET", "/verify", s.limit(s.auth(s.handleVerify))),
-		newRoute("PUT", fileRoute, s.limit(s.authFile(s.handleClipboardPut))),
-		newRoute("POST", fileRoute, s.limit(s.authFile(s.handleClipboardPut))),
-		newRoute("GET", fileRoute, s.limit(s.authFile(s.handleClipboardGet))),
-		newRoute("HEAD", fileRoute, s.limit(s.authFile(s.handleClipboardHead))),
 	}
+	if s.config.Metrics == config.MetricsOn && s.config.MetricsListenAddr == "" {
+		s.routes = append(s.routes, newRoute("GET", metricsPath, s.limit(s.handleMetrics)))
+	} else if s.config.Metrics == config.MetricsAuth && s.config.MetricsListenAddr == "" {
+		s.routes = append(s.routes, newRoute("GET", metricsPath, s.limit(s.auth(s.handleMetrics))))
+	}
+	s.routes = append(s.routes,
+		newRoute("PUT", fileRoute, s.limit(s.audit(EventUpload, s.authFile(s.handleClipboardPut)))),
+		newRoute("POST", fileRoute, s.limit(s.audit(EventUpload, s.authFile(s.handleClipboardPut)))),
+		newRoute("GET", fileRoute, s.limit(s.audit(EventDownload, s.authFile(s.handleClipboardGet)))),
+		newRoute("HEAD", fileRoute, s.limit(s.audit(EventDownload, s.authFile(s.handleClipboardHead)))),
+	)
 	return s.routes
 }
 
 func (s *Server) handleInfo(w http.ResponseWriter, r *http.Request) error {
-	log.Printf("[%s] %s - %s %s", config.CollapseServerAddr(s.config.ServerAddr), r.RemoteAddr, r.Method, r.RequestURI)
-
 	var salt []byte
 	if s.config.Key != nil {
 		salt = s.config.Key.Salt
 	}
 
 	response := &Info{
-		ServerAddr: s.config.ServerAddr,
+		ServerAddr: s.publicURL(r),
 		DefaultID:  s.config.DefaultID,
 		Salt:       salt,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(HeaderServerTime, fmt.Sprintf("%d", time.Now().Unix()))
 	w.WriteHeader(http.StatusOK)
 
 	return json.NewEncoder(w).Encode(response)
 }
 
 func (s *Server) handleVerify(w http.ResponseWriter, r *http.Request) error {
-	log.Printf("[%s] %s - %s %s", config.CollapseServerAddr(s.config.ServerAddr), r.RemoteAddr, r.Method, r.RequestURI)
 	return nil
 }
 
@@ -331,31 +708,30 @@ func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) error {
 }
 
 func (s *Server) handleWebRoot(w http.ResponseWriter, r *http.Request) error {
-	return webTemplate.Execute(w, s.webTemplateConfig())
+	return webTemplate.Execute(w, s.webTemplateConfig(r))
 }
 
 func (s *Server) handleCurlRoot(w http.ResponseWriter, r *http.Request) error {
-	return curlTemplate.Execute(w, s.webTemplateConfig())
+	return curlTemplate.Execute(w, s.webTemplateConfig(r))
 }
 
 func (s *Server) handleNcRoot(w http.ResponseWriter, r *http.Request) error {
-	return ncTemplate.Execute(w, s.webTemplateConfig())
+	return ncTemplate.Execute(w, s.webTemplateConfig(r))
 }
 
-func (s *Server) webTemplateConfig() *webTemplateConfig {
+func (s *Server) webTemplateConfig(r *http.Request) *webTemplateConfig {
 	tcpHost, tcpPort := "", ""
-	if u, err := url.Parse(config.ExpandServerAddr(s.config.ServerAddr)); err == nil {
+	if u, err := url.Parse(s.publicURL(r)); err == nil {
 		tcpHost = u.Hostname()
 	}
-	if _, port, err := net.SplitHostPort(s.config.ListenTCP); err == nil {
-		tcpPort = port
-	}
+	tcpPort = listenPort(s.config.ListenTCP)
 	return &webTemplateConfig{
 		KeyDerivIter: crypto.KeyDerivIter,
 		KeyLenBytes:  crypto.KeyLenBytes,
 		DefaultPort:  config.DefaultPort,
 		TCPHost:      tcpHost,
 		TCPPort:      tcpPort,
+		ServerURL:    s.publicURL(r),
 		Config:       s.config,
 	}
 }
@@ -384,16 +760,38 @@ func (s *Server) handleClipboardGet(w http.ResponseWriter, r *http.Request) erro
 	stat, err := s.clipboard.Stat(id)
 	if err != nil {
 		return ErrHTTPNotFound
+	} else if stat.Slot {
+		return s.handleUploadSlotGet(w, r, stat)
 	}
 	if !stat.Pipe {
 		w.Header().Set("Length", fmt.Sprintf("%d", stat.Size))
 	}
 	defer func() {
-		if stat.Pipe {
+		if stat.Pipe || stat.Burn {
 			s.clipboard.DeleteFile(id)
 		}
 	}()
-	return s.clipboard.ReadFile(id, util.NewContentTypeWriter(w, filename, download))
+	writer := util.NewContentTypeWriter(w, filename, download)
+	writer.ForceDownload = func(contentType string) bool {
+		policy := s.config.ContentPolicy(contentType)
+		return policy != nil && policy.Download
+	}
+	if err := s.clipboard.ReadFile(id, writer); err != nil {
+		return err
+	}
+	s.notify(config.WebhookEventDownload, id, stat.Size)
+	return nil
+}
+
+// handleUploadSlotGet renders the web UI to upload a file to the given upload slot, if the request comes from a
+// browser. Since there is nothing to download yet, all other clients get a 404.
+func (s *Server) handleUploadSlotGet(w http.ResponseWriter, r *http.Request, slot *clipboard.File) error {
+	if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		return ErrHTTPNotFound
+	}
+	templateConfig := s.webTemplateConfig(r)
+	templateConfig.UploadSlot = slot
+	return webTemplate.Execute(w, templateConfig)
 }
 
 func (s *Server) handleClipboardHead(w http.ResponseWriter, r *http.Request) error {
@@ -410,7 +808,7 @@ func (s *Server) handleClipboardHead(w http.ResponseWriter, r *http.Request) err
 	if ttl < -1 {
 		ttl = 0
 	}
-	return s.writeFileInfoOutput(w, http.StatusOK, id, stat.Expires, ttl, HeaderFormatNone, stat.Secret)
+	return s.writeFileInfoOutput(w, r, http.StatusOK, id, stat.Expires, ttl, HeaderFormatNone, stat.Secret, stat.Slot)
 }
 
 func (s *Server) handleClipboardPutRandom(w http.ResponseWriter, r *http.Request) error {
@@ -428,6 +826,14 @@ func (s *Server) handleClipboardPut(w http.ResponseWriter, r *http.Request) erro
 		return err
 	}
 
+	// If the file is an upload slot, claim it, so that it can only be uploaded to once
+	slot, err := s.claimSlot(r, id)
+	if err != nil {
+		return err
+	} else if slot != nil {
+		defer s.releaseSlot(id)
+	}
+
 	// Peak body, i.e. read up to 512 KB of the body into memory. This is needed two things:
 	//
 	// 1. Text-only TTL: to be able to determine if the body is UTF-8, we need to read it all. I have not figured
@@ -445,25 +851,60 @@ func (s *Server) handleClipboardPut(w http.ResponseWriter, r *http.Request) erro
 	// Read query params & peak body
 	format := s.getOutputFormat(r)
 	reserve := s.isReserve(r)
+	reserveSlot := s.isReserveSlot(r)
 	streamMode, err := s.getStreamMode(r)
 	if err != nil {
 		return err
 	}
-	fileMode, err := s.getFileMode(r)
-	if err != nil {
-		return err
+	if slot != nil && (reserve || reserveSlot || streamMode != HeaderStreamDisabled) {
+		return ErrHTTPBadRequest // Slots can only be reserved with the key, and uploaded to exactly once
+	} else if reserveSlot && (reserve || streamMode != HeaderStreamDisabled) {
+		return ErrHTTPBadRequest
 	}
-	ttl, err := s.getTTL(r, body)
-	if err != nil {
-		return err
+	scan := s.config.UploadScan != "" && !reserve && !reserveSlot
+	if scan && streamMode != HeaderStreamDisabled {
+		return errHTTPStreamNotScannable
+	}
+	var policy *config.ContentPolicy
+	var secrets []string
+	if !reserve && !reserveSlot {
+		if policy, err = s.getContentPolicy(body); err != nil {
+			return err
+		}
+		if secrets, err = s.checkSecrets(r, id, body); err != nil {
+			return err
+		}
+	}
+	burn := len(secrets) > 0 && s.config.SecretDetection == config.SecretDetectionBurn
+	var maxSize int64
+	var fileMode string
+	var ttl time.Duration
+	if slot != nil {
+		// Uploads to a slot cannot choose their own size limit, mode or TTL: the limits were set when the
+		// slot was reserved, and the file expires like any other file uploaded without a TTL
+		maxSize, fileMode = slot.MaxSize, slot.Mode
+		ttl = s.limitTTL(s.config.FileExpireAfterDefault, body, policy)
+	} else {
+		if maxSize, err = s.getMaxSize(r); err != nil {
+			return err
+		}
+		if fileMode, err = s.getFileMode(r); err != nil {
+			return err
+		}
+		if ttl, err = s.getTTL(r, body, policy); err != nil {
+			return err
+		}
+	}
+	if burn && (ttl == 0 || ttl > s.config.SecretDetectionTTL) {
+		ttl = s.config.SecretDetectionTTL
 	}
 	expires := int64(0)
 	if ttl > 0 {
 		expires = time.Now().Add(ttl).Unix()
 	}
 	secret := ""
-	if s.config.Key != nil {
-		secret = randomSecret()
+	if reserveSlot || (s.isProtected() && slot == nil) {
+		secret = randomSecret() // Files uploaded to a slot have no secret, so only the key can read them
 	}
 
 	// Always delete file first to avoid awkward FIFO/regular-file behavior
@@ -472,9 +913,17 @@ func (s *Server) handleClipboardPut(w http.ResponseWriter, r *http.Request) erro
 	// Ensure that we update the limiters and such!
 	defer s.updateStatsAndExpire()
 
-	// For streaming mode a short-time reservation is necessary
+	// For streaming mode a short-time reservation is necessary. Upload slots are reserved until they expire.
 	var meta *clipboard.File
-	if reserve {
+	if reserveSlot {
+		meta = &clipboard.File{
+			Mode:    config.FileModeReadWrite,
+			Expires: expires,
+			Secret:  secret,
+			Slot:    true,
+			MaxSize: maxSize,
+		}
+	} else if reserve {
 		meta = &clipboard.File{
 			Mode:    config.FileModeReadWrite,
 			Expires: time.Now().Add(reserveTTL).Unix(),
@@ -485,6 +934,21 @@ func (s *Server) handleClipboardPut(w http.ResponseWriter, r *http.Request) erro
 			Mode:    fileMode,
 			Expires: expires,
 			Secret:  secret,
+			Burn:    burn,
+		}
+		if slot != nil {
+			meta.MaxSize = maxSize
+		}
+		if policy != nil && policy.MaxSize > 0 && (meta.MaxSize == 0 || policy.MaxSize < meta.MaxSize) {
+			meta.MaxSize = policy.MaxSize
+		}
+	}
+
+	// Warn the uploader about detected secrets, see writeFileInfoOutput
+	if len(secrets) > 0 {
+		w.Header().Set(HeaderSecrets, strings.Join(secrets, ","))
+		if burn {
+			w.Header().Set(HeaderBurn, HeaderBurnEnabled)
 		}
 	}
 
@@ -494,17 +958,31 @@ func (s *Server) handleClipboardPut(w http.ResponseWriter, r *http.Request) erro
 		if err := s.clipboard.MakePipe(id); err != nil {
 			return err
 		}
+		s.metrics.addStream(1)
+		defer s.metrics.addStream(-1)
+		s.addStream(id)
+		defer s.removeStream(id)
 		if streamMode == HeaderStreamImmediateHeaders {
 			// For this to work with curl, we have to have peaked the body for short payloads, since we're technically
 			// writing a response before fully reading the body. See above when we peak the body.
-			if err := s.writeFileInfoOutput(w, http.StatusCreated, id, expires, ttl, format, secret); err != nil {
+			if err := s.writeFileInfoOutput(w, r, http.StatusCreated, id, expires, ttl, format, secret, false); err != nil {
 				return err
 			}
 		}
 	}
 
-	// Copy file contents (with file limit & total limit)
-	if err := s.clipboard.WriteFile(id, meta, body); err != nil {
+	// Copy file contents (with file limit & total limit). If uploads are scanned, the file is only published
+	// after the scan has passed.
+	counter := &auditReadCloser{ReadCloser: body}
+	if scan {
+		err = s.writeFileScanned(r, id, meta, counter)
+	} else {
+		err = s.clipboard.WriteFile(id, meta, counter)
+	}
+	if err != nil {
+		if slot != nil {
+			s.restoreSlot(r, slot)
+		}
 		if err == util.ErrLimitReached {
 			return ErrHTTPPayloadTooLarge
 		} else if err == clipboard.ErrBrokenPipe {
@@ -516,15 +994,95 @@ func (s *Server) handleClipboardPut(w http.ResponseWriter, r *http.Request) erro
 
 	// Output URL, TTL, etc.
 	if streamMode == HeaderStreamDisabled || streamMode == HeaderStreamDelayHeaders {
-		if err := s.writeFileInfoOutput(w, http.StatusCreated, id, expires, ttl, format, secret); err != nil {
+		if err := s.writeFileInfoOutput(w, r, http.StatusCreated, id, expires, ttl, format, secret, reserveSlot); err != nil {
 			s.clipboard.DeleteFile(id)
 			return err
 		}
 	}
 
+	if !reserve && !reserveSlot {
+		s.notify(config.WebhookEventUpload, id, counter.read)
+		s.runPostUploadHook(r, id, counter.read)
+	}
 	return nil
 }
 
+// writeFileScanned writes the file to the quarantine, runs the UploadScan hook against it, and publishes it
+// only if the scan passes. If it does not, the file is removed, and the configured error is returned.
+func (s *Server) writeFileScanned(r *http.Request, id string, meta *clipboard.File, rc *auditReadCloser) error {
+	q, err := s.clipboard.Quarantine(id, meta, rc)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), s.config.UploadHookTimeout)
+	defer cancel()
+	info := &uploadHookInfo{
+		Clipboard:  serverURL(s.config),
+		ID:         id,
+		Path:       q.Path,
+		Size:       rc.read,
+		RemoteAddr: r.RemoteAddr,
+	}
+	if err := runUploadHook(ctx, s.config.UploadScan, info); err != nil {
+		s.clipboard.Discard(q)
+		s.logger(r).With("id", id, "error", err).Warn("upload rejected by scan")
+		return &ErrHTTP{Code: http.StatusUnprocessableEntity, Status: s.config.UploadScanError}
+	}
+	return s.clipboard.Publish(q)
+}
+
+// runPostUploadHook runs the UploadHook (if any) for the given file in the background
+func (s *Server) runPostUploadHook(r *http.Request, id string, size int64) {
+	if s.config.UploadHook == "" {
+		return
+	}
+	info := &uploadHookInfo{
+		Clipboard:  serverURL(s.config),
+		ID:         id,
+		Path:       filepath.Join(s.config.ClipboardDir, id),
+		Size:       size,
+		RemoteAddr: r.RemoteAddr,
+	}
+	hook, timeout, logger := s.config.UploadHook, s.config.UploadHookTimeout, s.logger(r)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := runUploadHook(ctx, hook, info); err != nil {
+			logger.With("id", id, "error", err).Warn("upload hook failed")
+		}
+	}()
+}
+
+func (s *Server) addStream(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.streams[id] = true
+}
+
+func (s *Server) removeStream(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.streams, id)
+}
+
+// closeStreams unblocks all active streams that are still waiting for a reader, so that their uploads
+// are aborted instead of blocking the shutdown forever, and removes their FIFOs.
+func (s *Server) closeStreams() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id := range s.streams {
+		if err := s.clipboard.ClosePipe(id); err != nil {
+			s.logger(nil).With("id", id, "error", err).Debug("cannot close stream")
+		}
+		s.clipboard.DeleteFile(id) // Short streams may fit into the pipe buffer, so the writer does not fail
+	}
+}
+
+// requestsInFlight returns the number of requests that are currently being handled
+func (s *Server) requestsInFlight() int64 {
+	return atomic.LoadInt64(&s.inFlight)
+}
+
 // checkPUT verifies that the PUT against the given ID is allowed
 func (s *Server) checkPUT(id string, remoteAddr string) error {
 	stat, _ := s.clipboard.Stat(id)
@@ -547,13 +1105,54 @@ func (s *Server) checkPUT(id string, remoteAddr string) error {
 	return nil
 }
 
-func (s *Server) writeFileInfoOutput(w http.ResponseWriter, statusCode int, id string, expires int64, ttl time.Duration, format string, secret string) error {
+// claimSlot marks the upload slot with the given ID as claimed and returns it. If the file is not an upload slot,
+// nil is returned. Claimed slots must be released using releaseSlot. If the slot is already claimed, or if the
+// request was authorized with the secret of a slot that has since been used, ErrHTTPConflict is returned.
+func (s *Server) claimSlot(r *http.Request, id string) (*clipboard.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	authorizedBySlot := false
+	if result, ok := r.Context().Value(authResultCtx{}).(*authResult); ok {
+		authorizedBySlot = result.slot
+	}
+	stat, err := s.clipboard.Stat(id)
+	if err != nil || !stat.Slot {
+		if authorizedBySlot {
+			return nil, ErrHTTPConflict
+		}
+		return nil, nil
+	} else if s.claimed[id] {
+		return nil, ErrHTTPConflict
+	}
+	s.claimed[id] = true
+	return stat, nil
+}
+
+func (s *Server) releaseSlot(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.claimed, id)
+}
+
+// restoreSlot re-creates an upload slot after a failed upload, so that the upload can be retried
+func (s *Server) restoreSlot(r *http.Request, slot *clipboard.File) {
+	if err := s.clipboard.WriteFile(slot.ID, slot, io.NopCloser(strings.NewReader(""))); err != nil {
+		s.logger(r).With("error", err).Error("cannot restore upload slot")
+	}
+}
+
+func (s *Server) writeFileInfoOutput(w http.ResponseWriter, r *http.Request, statusCode int, id string, expires int64, ttl time.Duration, format string, secret string, slot bool) error {
 	path := fmt.Sprintf(clipboardPathFormat, id)
-	url, err := generateURL(s.config, path, secret)
+	url, err := generateURL(s.publicURL(r), path, secret)
 	if err != nil {
 		return err
 	}
-	curl, err := generateCurlCommand(s.config, url)
+	var curl string
+	if slot {
+		curl, err = generateCurlUploadCommand(s.config, url)
+	} else {
+		curl, err = generateCurlCommand(s.config, url)
+	}
 	if err != nil {
 		curl = ""
 	}
@@ -565,6 +1164,14 @@ func (s *Server) writeFileInfoOutput(w http.ResponseWriter, statusCode int, id s
 	w.Header().Set(HeaderCurl, curl)
 	w.WriteHeader(statusCode)
 
+	// Detected secrets are passed in the response headers (see handleClipboardPut), but the warning is also
+	// included in the response body, so that curl users see it
+	var secrets []string
+	if w.Header().Get(HeaderSecrets) != "" {
+		secrets = strings.Split(w.Header().Get(HeaderSecrets), ",")
+	}
+	burn := w.Header().Get(HeaderBurn) == HeaderBurnEnabled
+
 	if format == HeaderFormatJSON {
 		response := &httpResponseFileInfo{
 			URL:     url,
@@ -572,6 +1179,9 @@ func (s *Server) writeFileInfoOutput(w http.ResponseWriter, statusCode int, id s
 			TTL:     int(ttl.Seconds()),
 			Expires: expires,
 			Curl:    curl,
+			Slot:    slot,
+			Secrets: secrets,
+			Burn:    burn,
 		}
 		if err := json.NewEncoder(w).Encode(response); err != nil {
 			return err
@@ -583,8 +1193,11 @@ func (s *Server) writeFileInfoOutput(w http.ResponseWriter, statusCode int, id s
 			TTL:     ttl,
 			Expires: time.Unix(expires, 0),
 			Curl:    curl,
+			Slot:    slot,
+			Secrets: secrets,
+			Burn:    burn,
 		}
-		if _, err := w.Write([]byte(FileInfoInstructions(info))); err != nil {
+		if _, err := w.Write([]byte(SecretsWarning(info) + FileInfoInstructions(info))); err != nil {
 			return err
 		}
 	}
@@ -613,7 +1226,37 @@ func (s *Server) getFileMode(r *http.Request) (string, error) {
 	return "", ErrHTTPBadRequest
 }
 
-func (s *Server) getTTL(r *http.Request, peakedBody *util.PeakedReadCloser) (time.Duration, error) {
+// checkSecrets detects secrets in the peaked body (see config.SecretDetection), unless detection is disabled or
+// skipped by the client via HeaderAllowSecrets. It returns the kinds of detected secrets, or an error if uploads
+// with secrets are rejected.
+func (s *Server) checkSecrets(r *http.Request, id string, peakedBody *util.PeakedReadCloser) ([]string, error) {
+	if s.config.SecretDetection == "" || s.config.SecretDetection == config.SecretDetectionOff || r.Header.Get(HeaderAllowSecrets) == HeaderAllowSecretsEnabled {
+		return nil, nil
+	}
+	secrets := detectSecrets(peakedBody.PeakedBytes)
+	if len(secrets) == 0 {
+		return nil, nil
+	}
+	s.logger(r).With("id", id, "secrets", strings.Join(secrets, ","), "mode", s.config.SecretDetection).Info("secrets detected in upload")
+	if s.config.SecretDetection == config.SecretDetectionReject {
+		return nil, &ErrHTTP{Code: http.StatusUnprocessableEntity, Status: fmt.Sprintf("upload rejected, it looks like it contains secrets (%s); use --allow-secrets to upload anyway", strings.Join(secrets, ", "))}
+	}
+	return secrets, nil
+}
+
+// getContentPolicy returns the content policy (see config.ContentPolicies) for the content type of the peaked
+// body, or nil if there is none. If the policy denies the content type, an error is returned.
+func (s *Server) getContentPolicy(peakedBody *util.PeakedReadCloser) (*config.ContentPolicy, error) {
+	contentType := util.DetectContentType(peakedBody.PeakedBytes)
+	policy := s.config.ContentPolicy(contentType)
+	if policy != nil && policy.Deny {
+		mediaType := strings.TrimSpace(strings.Split(contentType, ";")[0])
+		return nil, &ErrHTTP{Code: http.StatusUnsupportedMediaType, Status: fmt.Sprintf("content type %s is not allowed", mediaType)}
+	}
+	return policy, nil
+}
+
+func (s *Server) getTTL(r *http.Request, peakedBody *util.PeakedReadCloser, policy *config.ContentPolicy) (time.Duration, error) {
 	var err error
 	var ttl time.Duration
 
@@ -628,7 +1271,11 @@ func (s *Server) getTTL(r *http.Request, peakedBody *util.PeakedReadCloser) (tim
 	if err != nil {
 		return 0, ErrHTTPBadRequest
 	}
+	return s.limitTTL(ttl, peakedBody, policy), nil
+}
 
+// limitTTL caps the given TTL to the max TTL for the type of the body, and to the max TTL of the content policy
+func (s *Server) limitTTL(ttl time.Duration, peakedBody *util.PeakedReadCloser, policy *config.ContentPolicy) time.Duration {
 	// If the given TTL is larger than the max allowed value, set it to the max value.
 	// Special handling for text: if the body is a short text (as per our peaking), the text max value applies.
 	// It may be a little inefficient to always check for UTF-8, but I think it's fine.
@@ -643,7 +1290,12 @@ func (s *Server) getTTL(r *http.Request, peakedBody *util.PeakedReadCloser) (tim
 		}
 	}
 
-	return ttl, nil
+	// The content policy's max TTL also applies to files that would otherwise never expire
+	if policy != nil && policy.MaxTTL > 0 && (ttl == 0 || ttl > policy.MaxTTL) {
+		ttl = policy.MaxTTL
+	}
+
+	return ttl
 }
 
 func (s *Server) getStreamMode(r *http.Request) (string, error) {
@@ -663,6 +1315,21 @@ func (s *Server) isReserve(r *http.Request) bool {
 	return r.Header.Get(HeaderReserve) == HeaderReserveEnabled || r.URL.Query().Get(queryParamStreamReserve) == HeaderReserveEnabled
 }
 
+func (s *Server) isReserveSlot(r *http.Request) bool {
+	return r.Header.Get(HeaderReserve) == HeaderReserveSlot || r.URL.Query().Get(queryParamStreamReserve) == HeaderReserveSlot
+}
+
+func (s *Server) getMaxSize(r *http.Request) (int64, error) {
+	if r.Header.Get(HeaderMaxSize) == "" {
+		return 0, nil
+	}
+	maxSize, err := util.ParseSize(r.Header.Get(HeaderMaxSize))
+	if err != nil || maxSize < 0 {
+		return 0, ErrHTTPBadRequest
+	}
+	return maxSize, nil
+}
+
 func (s *Server) getOutputFormat(r *http.Request) string {
 	if r.Header.Get(HeaderFormat) == HeaderFormatJSON || r.URL.Query().Get(queryParamFormat) == HeaderFormatJSON {
 		return HeaderFormatJSON
@@ -674,7 +1341,7 @@ func (s *Server) getOutputFormat(r *http.Request) string {
 
 func (s *Server) auth(next handleFunc) handleFunc {
 	return func(w http.ResponseWriter, r *http.Request) error {
-		if err := s.authorize(r); err != nil {
+		if err := s.authorizeWithLockout(w, r, "", s.authorize); err != nil {
 			return err
 		}
 		return next(w, r)
@@ -683,13 +1350,221 @@ func (s *Server) auth(next handleFunc) handleFunc {
 
 func (s *Server) authFile(next handleFunc) handleFunc {
 	return func(w http.ResponseWriter, r *http.Request) error {
-		if err := s.authorizeFileWithFallback(r); err != nil {
+		fields := r.Context().Value(routeCtx{}).([]string)
+		if _, ok := r.Context().Value(authResultCtx{}).(*authResult); !ok {
+			r = r.WithContext(context.WithValue(r.Context(), authResultCtx{}, &authResult{})) // Needed for claimSlot
+		}
+		if err := s.authorizeWithLockout(w, r, fields[0], s.authorizeFileWithFallback); err != nil {
 			return err
 		}
 		return next(w, r)
 	}
 }
 
+// audit writes an event for the given action to the audit log (if enabled) after the request has been handled.
+// Failed authentication attempts are not written here, since they are already written by authorizeWithLockout.
+func (s *Server) audit(action string, next handleFunc) handleFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if s.auditLog == nil {
+			return next(w, r)
+		}
+		r = r.WithContext(context.WithValue(r.Context(), authResultCtx{}, &authResult{}))
+		body := &auditReadCloser{ReadCloser: r.Body}
+		if r.Body != nil {
+			r.Body = body
+		}
+		aw := &auditResponseWriter{ResponseWriter: w}
+		err := next(aw, r)
+		status := aw.status
+		if e, ok := err.(*ErrHTTP); ok {
+			status = e.Code
+		} else if err == clipboard.ErrInvalidFileID {
+			status = http.StatusBadRequest
+		} else if err != nil {
+			status = http.StatusInternalServerError
+		} else if status == 0 {
+			status = http.StatusOK
+		}
+		if status == http.StatusUnauthorized {
+			return err
+		}
+		id := w.Header().Get(HeaderFile)
+		if fields, ok := r.Context().Value(routeCtx{}).([]string); ok && id == "" && len(fields) > 0 {
+			id = fields[0]
+		}
+		size := aw.written
+		if action == EventUpload {
+			size = body.read
+		}
+		s.writeEvent(r, action, id, size, status)
+		return err
+	}
+}
+
+// writeEvent writes an event to the audit log, if enabled. The request r may be nil for events that are not
+// triggered by a request, e.g. deleting expired files.
+func (s *Server) writeEvent(r *http.Request, action string, id string, size int64, status int) {
+	if s.auditLog == nil {
+		return
+	}
+	event := &Event{
+		Time:   time.Now(),
+		Action: action,
+		ID:     id,
+		Size:   size,
+		Status: status,
+	}
+	if r != nil {
+		event.RemoteAddr = r.RemoteAddr
+		event.UserAgent = r.UserAgent()
+		if result, ok := r.Context().Value(authResultCtx{}).(*authResult); ok {
+			event.User = result.user
+		}
+	}
+	if err := s.auditLog.Write(event); err != nil {
+		s.logger(nil).With("error", err).Error("cannot write to audit log")
+	}
+}
+
+// notify sends the event for the given file ID to the webhooks, if any (see config.Webhook). It never blocks.
+func (s *Server) notify(event string, id string, size int64) {
+	if s.webhooks == nil {
+		return
+	}
+	s.webhooks.Notify(&WebhookEvent{
+		Event:     event,
+		Clipboard: serverURL(s.config),
+		ID:        id,
+		Size:      size,
+		Time:      time.Now(),
+	})
+}
+
+// authorizeWithLockout calls the given authorize function, unless the visitor is currently locked out due to too
+// many failed authentication attempts. Failed attempts are counted per IP and per file ID. If a lockout is active,
+// a 429 with a Retry-After header is returned.
+//
+// While a file ID is locked, it cannot be accessed with its secret at all (not even with the correct one), so that
+// guessing the secret from many IPs is slowed down. Requests with a valid key are never rejected because of a file
+// lockout, so that failed attempts from other IPs cannot lock out the owners of the clipboard.
+func (s *Server) authorizeWithLockout(w http.ResponseWriter, r *http.Request, id string, authorize func(*http.Request) error) error {
+	if s.config.AuthLockoutThreshold == 0 {
+		err := s.authorizeWithResult(w, r, authorize)
+		if err == ErrHTTPUnauthorized {
+			s.writeEvent(r, EventAuthFailure, id, 0, http.StatusUnauthorized)
+			s.metrics.addAuthFailure()
+		}
+		return err
+	}
+	v := s.getVisitor(r.RemoteAddr)
+	if retryAfter := s.visitorLockedOutFor(v); retryAfter > 0 {
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(retryAfter.Seconds()))))
+		return ErrHTTPTooManyRequests
+	}
+	err := s.authorizeWithResult(w, r, authorize)
+	if err == ErrHTTPUnauthorized {
+		s.writeEvent(r, EventAuthFailure, id, 0, http.StatusUnauthorized)
+		s.metrics.addAuthFailure()
+		retryAfter := s.fileLockedOutFor(id)
+		s.addAuthFailure(r, v, id)
+		if retryAfter > 0 {
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(retryAfter.Seconds()))))
+			return ErrHTTPTooManyRequests
+		}
+	} else if err == nil {
+		if result, ok := r.Context().Value(authResultCtx{}).(*authResult); ok && result.secret {
+			if retryAfter := s.fileLockedOutFor(id); retryAfter > 0 {
+				w.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(retryAfter.Seconds()))))
+				return ErrHTTPTooManyRequests
+			}
+		}
+		s.resetAuthFailures(v)
+	}
+	return err
+}
+
+// authorizeWithResult calls the given authorize function and sets the X-Key-Rotated response header if the
+// request was authorized using a previous key.
+func (s *Server) authorizeWithResult(w http.ResponseWriter, r *http.Request, authorize func(*http.Request) error) error {
+	result, ok := r.Context().Value(authResultCtx{}).(*authResult)
+	if !ok {
+		result = &authResult{}
+		r = r.WithContext(context.WithValue(r.Context(), authResultCtx{}, result))
+	}
+	if err := authorize(r); err != nil {
+		return err
+	}
+	if result.previousKey {
+		s.logger(r).Info("authorized with previous key, client should re-join")
+		w.Header().Set(HeaderKeyRotated, HeaderKeyRotatedEnabled)
+	}
+	return nil
+}
+
+// visitorLockedOutFor returns the remaining lockout duration for the given visitor, or 0 if it is not locked out
+func (s *Server) visitorLockedOutFor(v *visitor) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Until(v.failures.lockedUntil)
+}
+
+// fileLockedOutFor returns the remaining lockout duration for the given file ID, or 0 if it is not locked out
+func (s *Server) fileLockedOutFor(id string) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f, ok := s.idFailures[id]; ok && id != "" {
+		return time.Until(f.lockedUntil)
+	}
+	return 0
+}
+
+func (s *Server) addAuthFailure(r *http.Request, v *visitor, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if lockout := s.addAuthFailureAndLock(v.failures); lockout > 0 {
+		s.logger(r).Warn("locked out IP for %s after %d failed auth attempts", lockout, v.failures.count)
+	}
+	if id == "" {
+		return
+	}
+	f, ok := s.idFailures[id]
+	if !ok {
+		f = &authFailures{}
+		s.idFailures[id] = f
+	}
+	if lockout := s.addAuthFailureAndLock(f); lockout > 0 {
+		s.logger(r).Warn("locked out file %s for %s after %d failed auth attempts", id, lockout, f.count)
+	}
+}
+
+// addAuthFailureAndLock increases the failure counter and locks f if the lockout threshold has been reached. The
+// lockout duration doubles with every failed attempt beyond the threshold. The method returns the lockout duration,
+// or 0 if f was not locked. It must be called with s.mu held.
+func (s *Server) addAuthFailureAndLock(f *authFailures) time.Duration {
+	f.count++
+	f.lastSeen = time.Now()
+	if f.count < s.config.AuthLockoutThreshold {
+		return 0
+	}
+	lockout := s.config.AuthLockoutDuration
+	for i := s.config.AuthLockoutThreshold; i < f.count && lockout < s.config.AuthLockoutMaxDuration; i++ {
+		lockout *= 2
+	}
+	if lockout > s.config.AuthLockoutMaxDuration {
+		lockout = s.config.AuthLockoutMaxDuration
+	}
+	f.lockedUntil = time.Now().Add(lockout)
+	return lockout
+}
+
+// resetAuthFailures resets the failure counter of the visitor after a successful attempt. Failed attempts against
+// a file ID are not reset, since they may come from anyone; they expire in updateStatsAndExpire.
+func (s *Server) resetAuthFailures(v *visitor) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v.failures.count = 0
+}
+
 func (s *Server) authorizeFileWithFallback(r *http.Request) error {
 	fields := r.Context().Value(routeCtx{}).([]string)
 	id := fields[0]
@@ -704,14 +1579,32 @@ func (s *Server) authorizeFileWithFallback(r *http.Request) error {
 	if !ok || subtle.ConstantTimeCompare([]byte(stat.Secret), []byte(secret[0])) != 1 {
 		return s.authorize(r)
 	}
+	if result, ok := r.Context().Value(authResultCtx{}).(*authResult); ok {
+		result.slot, result.secret = stat.Slot, true
+	}
 	return nil
 }
 
+// isProtected returns true if the clipboard requires authentication, either via key or via client certificate
+func (s *Server) isProtected() bool {
+	return s.config.Key != nil || s.clientCAs != nil
+}
+
 func (s *Server) authorize(r *http.Request) error {
-	if s.config.Key == nil {
+	if !s.isProtected() {
 		return nil
 	}
 
+	if s.clientCAs != nil && r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		if err := s.authorizeClientCert(r); err == nil {
+			return nil
+		}
+	}
+	if s.config.Key == nil {
+		s.logger(r).Debug("missing or invalid client cert")
+		return ErrHTTPUnauthorized
+	}
+
 	auth := r.Header.Get("Authorization")
 	if authParams, ok := r.URL.Query()[queryParamAuth]; ok && len(authParams) > 0 {
 		auth = authParams[0]
@@ -724,43 +1617,91 @@ func (s *Server) authorize(r *http.Request) error {
 	} else if auth != "" {
 		return s.authorizePlain(r, auth)
 	} else {
-		log.Printf("[%s] %s - %s %s - invalid or missing auth", config.CollapseServerAddr(s.config.ServerAddr), r.RemoteAddr, r.Method, r.RequestURI)
+		s.logger(r).Debug("invalid or missing auth")
 		return ErrHTTPUnauthorized
 	}
 }
 
+// authorizeClientCert verifies the TLS client certificate against the configured client CAs, and (if
+// configured) checks that its subject or one of its SANs matches one of the ClientCertAllow patterns.
+func (s *Server) authorizeClientCert(r *http.Request) error {
+	cert := r.TLS.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, c := range r.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(c)
+	}
+	opts := x509.VerifyOptions{
+		Roots:         s.clientCAs,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if _, err := cert.Verify(opts); err != nil {
+		s.logger(r).With("error", err).Debug("client cert verification")
+		return ErrHTTPUnauthorized
+	}
+	if len(s.config.ClientCertAllow) == 0 {
+		s.setAuthUser(r, cert.Subject.CommonName)
+		return nil
+	}
+	names := []string{cert.Subject.CommonName}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+	for _, pattern := range s.config.ClientCertAllow {
+		for _, name := range names {
+			if matched, _ := path.Match(pattern, name); matched && name != "" {
+				s.setAuthUser(r, cert.Subject.CommonName)
+				return nil
+			}
+		}
+	}
+	s.logger(r).Debug("client cert %s not allowed", cert.Subject.CommonName)
+	return ErrHTTPUnauthorized
+}
+
 func (s *Server) authorizeHmac(r *http.Request, matches []string) error {
 	timestamp, err := strconv.Atoi(matches[1])
 	if err != nil {
-		log.Printf("[%s] %s - %s %s - hmac timestamp conversion: %s", config.CollapseServerAddr(s.config.ServerAddr), r.RemoteAddr, r.Method, r.RequestURI, err.Error())
+		s.logger(r).With("error", err).Debug("hmac timestamp conversion")
 		return ErrHTTPUnauthorized
 	}
 
 	ttlSecs, err := strconv.Atoi(matches[2])
 	if err != nil {
-		log.Printf("[%s] %s - %s %s - hmac ttl conversion: %s", config.CollapseServerAddr(s.config.ServerAddr), r.RemoteAddr, r.Method, r.RequestURI, err.Error())
+		s.logger(r).With("error", err).Debug("hmac ttl conversion")
 		return ErrHTTPUnauthorized
 	}
 
 	hash, err := base64.StdEncoding.DecodeString(matches[3])
 	if err != nil {
-		log.Printf("[%s] %s - %s %s - hmac base64 conversion: %s", config.CollapseServerAddr(s.config.ServerAddr), r.RemoteAddr, r.Method, r.RequestURI, err.Error())
+		s.logger(r).With("error", err).Debug("hmac base64 conversion")
 		return ErrHTTPUnauthorized
 	}
 
-	// Recalculate HMAC
+	// Recalculate HMAC; clients sign the full path, including the base path stripped by the router
 	// TODO this should include the query string
-	data := []byte(fmt.Sprintf("%d:%d:%s:%s", timestamp, ttlSecs, r.Method, r.URL.Path))
-	hm := hmac.New(sha256.New, s.config.Key.Bytes)
-	if _, err := hm.Write(data); err != nil {
-		log.Printf("[%s] %s - %s %s - hmac calculation: %s", config.CollapseServerAddr(s.config.ServerAddr), r.RemoteAddr, r.Method, r.RequestURI, err.Error())
-		return ErrHTTPUnauthorized
-	}
-	rehash := hm.Sum(nil)
+	data := []byte(fmt.Sprintf("%d:%d:%s:%s%s", timestamp, ttlSecs, r.Method, s.config.BasePath, r.URL.Path))
+	matched := -1
+	for i, key := range s.acceptedKeys() {
+		hm := hmac.New(sha256.New, key.Bytes)
+		if _, err := hm.Write(data); err != nil {
+			s.logger(r).With("error", err).Debug("hmac calculation")
+			return ErrHTTPUnauthorized
+		}
+		rehash := hm.Sum(nil)
 
-	// Compare HMAC in constant time (to prevent timing attacks)
-	if subtle.ConstantTimeCompare(hash, rehash) != 1 {
-		log.Printf("[%s] %s - %s %s - hmac invalid", config.CollapseServerAddr(s.config.ServerAddr), r.RemoteAddr, r.Method, r.RequestURI)
+		// Compare HMAC in constant time (to prevent timing attacks), and check all keys
+		if subtle.ConstantTimeCompare(hash, rehash) == 1 {
+			matched = i
+		}
+	}
+	if matched == -1 {
+		s.logger(r).Debug("hmac invalid")
 		return ErrHTTPUnauthorized
 	}
 
@@ -772,34 +1713,35 @@ func (s *Server) authorizeHmac(r *http.Request, matches []string) error {
 	if maxAge > 0 {
 		age := time.Since(time.Unix(int64(timestamp), 0))
 		if age > maxAge {
-			log.Printf("[%s] %s - %s %s - hmac request age mismatch", config.CollapseServerAddr(s.config.ServerAddr), r.RemoteAddr, r.Method, r.RequestURI)
+			s.logger(r).Debug("hmac request age mismatch")
 			return ErrHTTPUnauthorized
 		}
 	}
 
+	s.setAuthResult(r, matched)
 	return nil
 }
 
 func (s *Server) authorizeBasic(r *http.Request, matches []string) error {
 	userPassBytes, err := base64.StdEncoding.DecodeString(matches[1])
 	if err != nil {
-		log.Printf("[%s] %s - %s %s - basic base64 conversion: %s", config.CollapseServerAddr(s.config.ServerAddr), r.RemoteAddr, r.Method, r.RequestURI, err.Error())
+		s.logger(r).With("error", err).Debug("basic base64 conversion")
 		return ErrHTTPUnauthorized
 	}
 
 	userPassParts := strings.Split(string(userPassBytes), ":")
 	if len(userPassParts) != 2 {
-		log.Printf("[%s] %s - %s %s - basic invalid user/pass format", config.CollapseServerAddr(s.config.ServerAddr), r.RemoteAddr, r.Method, r.RequestURI)
+		s.logger(r).Debug("basic invalid user/pass format")
 		return ErrHTTPUnauthorized
 	}
 	passwordBytes := []byte(userPassParts[1])
 
-	// Compare HMAC in constant time (to prevent timing attacks)
-	key := crypto.DeriveKey(passwordBytes, s.config.Key.Salt)
-	if subtle.ConstantTimeCompare(key.Bytes, s.config.Key.Bytes) != 1 {
-		log.Printf("[%s] %s - %s %s - basic invalid", config.CollapseServerAddr(s.config.ServerAddr), r.RemoteAddr, r.Method, r.RequestURI)
+	matched := s.matchPassword(passwordBytes)
+	if matched == -1 {
+		s.logger(r).Debug("basic invalid")
 		return ErrHTTPUnauthorized
 	}
+	s.setAuthResult(r, matched)
 
 	return nil
 }
@@ -807,16 +1749,57 @@ func (s *Server) authorizeBasic(r *http.Request, matches []string) error {
 func (s *Server) authorizePlain(r *http.Request, auth string) error {
 	passwordBytes := []byte(auth)
 
-	// Compare HMAC in constant time (to prevent timing attacks)
-	key := crypto.DeriveKey(passwordBytes, s.config.Key.Salt)
-	if subtle.ConstantTimeCompare(key.Bytes, s.config.Key.Bytes) != 1 {
-		log.Printf("[%s] %s - %s %s - plain invalid", config.CollapseServerAddr(s.config.ServerAddr), r.RemoteAddr, r.Method, r.RequestURI)
+	matched := s.matchPassword(passwordBytes)
+	if matched == -1 {
+		s.logger(r).Debug("plain invalid")
 		return ErrHTTPUnauthorized
 	}
+	s.setAuthResult(r, matched)
 
 	return nil
 }
 
+// matchPassword derives a key from the given password for each of the accepted keys, and returns the index
+// of the matching key (see acceptedKeys), or -1 if the password does not match any key. All keys are checked,
+// and keys are compared in constant time (to prevent timing attacks).
+func (s *Server) matchPassword(passwordBytes []byte) int {
+	matched := -1
+	for i, key := range s.acceptedKeys() {
+		derived := crypto.DeriveKey(passwordBytes, key.Salt)
+		if subtle.ConstantTimeCompare(derived.Bytes, key.Bytes) == 1 {
+			matched = i
+		}
+	}
+	return matched
+}
+
+// acceptedKeys returns the primary key, followed by all previous keys that have not been retired yet
+func (s *Server) acceptedKeys() []*crypto.Key {
+	keys := []*crypto.Key{s.config.Key}
+	for _, previousKey := range s.config.PreviousKeys {
+		if !previousKey.Retired() {
+			keys = append(keys, previousKey.Key)
+		}
+	}
+	return keys
+}
+
+// setAuthUser records the authenticated user (e.g. the client certificate's common name) in the request
+// context's authResult (if any), so that it can be written to the audit log
+func (s *Server) setAuthUser(r *http.Request, user string) {
+	if result, ok := r.Context().Value(authResultCtx{}).(*authResult); ok {
+		result.user = user
+	}
+}
+
+// setAuthResult records in the request context's authResult (if any) whether the request was authorized using
+// a previous key, i.e. a key other than the primary key (index 0, see acceptedKeys)
+func (s *Server) setAuthResult(r *http.Request, matched int) {
+	if result, ok := r.Context().Value(authResultCtx{}).(*authResult); ok {
+		result.previousKey = matched > 0
+	}
+}
+
 // startManager will start the server manager background process that will update the stats and expire
 // files for which the TTL has been reached. This method exits immediately and will spin up a goroutine.
 func (s *Server) startManager() {
@@ -826,18 +1809,23 @@ func (s *Server) startManager() {
 		return
 	}
 	s.managerChan = make(chan bool)
+	s.managerLast = time.Now() // Counts as a run, so the server is ready while the first run is in progress
+	stop := s.managerChan
 	s.mu.Unlock()
 
 	go func() {
 		ticker := time.NewTicker(s.config.ManagerInterval)
+		defer ticker.Stop()
 		for {
-			s.updateStatsAndExpire()
+			current, release := s.acquire() // The config may have been reloaded in the meantime
+			current.updateStatsAndExpire()
+			release()
+			s.mu.Lock()
+			s.managerLast = time.Now()
+			s.mu.Unlock()
 			select {
 			case <-ticker.C:
-			case <-s.managerChan:
-				s.mu.Lock()
-				s.managerChan = nil
-				s.mu.Unlock()
+			case <-stop:
 				return
 			}
 		}
@@ -850,31 +1838,58 @@ func (s *Server) stopManager() {
 	defer s.mu.Unlock()
 	if s.managerChan != nil {
 		close(s.managerChan)
+		s.managerChan = nil
 	}
 }
 
-func (s *Server) updateStatsAndExpire() {
+// updateStatsAndExpire expires visitors and clipboard entries, and updates the clipboard stats. It returns the
+// expired clipboard entries.
+func (s *Server) updateStatsAndExpire() []*clipboard.File {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	// Expire visitors from rate visitors map
 	for ip, v := range s.visitors {
-		if time.Since(v.lastSeen) > visitorExpungeAfter {
+		if time.Since(v.lastSeen) > visitorExpungeAfter && time.Now().After(v.failures.lockedUntil) {
 			delete(s.visitors, ip)
 		}
 	}
 
+	// Expire failed auth attempts against file IDs
+	for id, f := range s.idFailures {
+		if time.Since(f.lastSeen) > visitorExpungeAfter && time.Now().After(f.lockedUntil) {
+			delete(s.idFailures, id)
+		}
+	}
+
 	// Walk clipboard to update size/count limiters, and expire/delete files
-	if err := s.clipboard.Expire(); err != nil {
-		log.Printf("[%s] cannot expire clipboard entries: %s", config.CollapseServerAddr(s.config.ServerAddr), err.Error())
+	expired, err := s.clipboard.Expire()
+	if err != nil {
+		s.logger(nil).With("error", err).Error("cannot expire clipboard entries")
 	}
+	for _, f := range expired {
+		s.writeEvent(nil, EventDelete, f.ID, f.Size, 0)
+		s.notify(config.WebhookEventExpire, f.ID, f.Size)
+	}
+	s.metrics.addExpired(len(expired))
 
 	stats, err := s.clipboard.Stats()
 	if err != nil {
-		log.Printf("[%s] cannot get stats from clipboard: %s", config.CollapseServerAddr(s.config.ServerAddr), err.Error())
+		s.logger(nil).With("error", err).Error("cannot get stats from clipboard")
 	} else {
 		s.printStats(stats)
 	}
+
+	// Reload the TLS certificate if it changed, and warn if it is about to expire
+	if s.cert != nil {
+		s.cert.reload()
+	}
+	if s.cert != nil && s.config.CertExpiryWarning > 0 {
+		if expires := s.cert.Expires(); time.Until(expires) < s.config.CertExpiryWarning {
+			s.logger(nil).Warn("TLS certificate %s expires %s, renew it with 'pcopy cert renew'", s.config.CertFile, expires.Format(time.RFC3339))
+		}
+	}
+	return expired
 }
 
 func (s *Server) printStats(stats *clipboard.Stats) {
@@ -889,21 +1904,27 @@ func (s *Server) printStats(stats *clipboard.Stats) {
 	} else {
 		sizeLimit = fmt.Sprintf("max %s", util.BytesToHuman(s.config.ClipboardSizeLimit))
 	}
-	log.Printf("[%s] files: %d (%s), size: %s (%s), visitors: %d (last 30 minutes)",
-		config.CollapseServerAddr(s.config.ServerAddr), stats.Count, countLimit, util.BytesToHuman(stats.Size), sizeLimit, len(s.visitors))
+	var certExpires string
+	if s.cert != nil {
+		certExpires = fmt.Sprintf(", cert expires: %s", s.cert.Expires().Format("2006-01-02"))
+	}
+	s.logger(nil).Info("files: %d (%s), size: %s (%s), visitors: %d (last 30 minutes)%s",
+		stats.Count, countLimit, util.BytesToHuman(stats.Size), sizeLimit, len(s.visitors), certExpires)
 }
 
 func (s *Server) redirectHTTPS(next handleFunc) handleFunc {
 	return func(w http.ResponseWriter, r *http.Request) error {
-		if r.Header.Get(HeaderNoRedirect) == "" && r.TLS == nil && s.config.ListenHTTPS != "" {
+		if s.config.RedirectHTTPS && r.Header.Get(HeaderNoRedirect) == "" && requestProto(r) == "http" && len(s.config.ListenHTTPS) > 0 {
 			newURL := r.URL
-			newURL.Host = r.Host
+			newURL.Host = requestHost(r)
 			newURL.Scheme = "https"
+			newURL.Path = s.config.BasePath + newURL.Path // Base path was stripped by the router
+			newURL.RawPath = ""
 			if strings.Contains(newURL.Host, ":") {
 				newURL.Host, _, _ = net.SplitHostPort(newURL.Host)
 			}
-			_, port, _ := net.SplitHostPort(s.config.ListenHTTPS)
-			if port != "443" {
+			// Behind a proxy, the HTTPS port of the proxy is unknown, so we assume the default port
+			if port := listenPort(s.config.ListenHTTPS); port != "" && port != "443" && !isForwarded(r) {
 				newURL.Host = net.JoinHostPort(newURL.Host, port)
 			}
 			http.Redirect(w, r, newURL.String(), http.StatusFound)
@@ -920,10 +1941,12 @@ func (s *Server) limit(next handleFunc) handleFunc {
 		v := s.getVisitor(r.RemoteAddr)
 		if r.Method == http.MethodGet || r.Method == http.MethodHead {
 			if !v.limiterGET.Allow() {
+				s.metrics.addRateLimited()
 				return ErrHTTPTooManyRequests
 			}
 		} else {
 			if !v.limiterPUT.Allow() {
+				s.metrics.addRateLimited()
 				return ErrHTTPTooManyRequests
 			}
 		}
@@ -940,15 +1963,16 @@ func (s *Server) getVisitor(remoteAddr string) *visitor {
 
 	ip, _, err := net.SplitHostPort(remoteAddr)
 	if err != nil {
-		ip = remoteAddr // This should not happen in real life; only in tests.
+		ip = remoteAddr // Forwarded requests have no port (see withClientAddr); this also happens in tests.
 	}
 
 	v, exists := s.visitors[ip]
 	if !exists {
 		v = &visitor{
-			rate.NewLimiter(s.config.LimitGET, s.config.LimitGETBurst),
-			rate.NewLimiter(s.config.LimitPUT, s.config.LimitPUTBurst),
-			time.Now(),
+			limiterGET: rate.NewLimiter(s.config.LimitGET, s.config.LimitGETBurst),
+			limiterPUT: rate.NewLimiter(s.config.LimitPUT, s.config.LimitPUTBurst),
+			failures:   &authFailures{},
+			lastSeen:   time.Now(),
 		}
 		s.visitors[ip] = v
 		return v
@@ -959,7 +1983,18 @@ func (s *Server) getVisitor(remoteAddr string) *visitor {
 }
 
 func (s *Server) fail(w http.ResponseWriter, r *http.Request, code int, err error) {
-	log.Printf("[%s] %s - %s %s - %s", config.CollapseServerAddr(s.config.ServerAddr), r.RemoteAddr, r.Method, r.RequestURI, err.Error())
+	if code >= http.StatusInternalServerError {
+		s.logger(r).With("error", err).Error("request failed")
+	} else {
+		s.logger(r).With("error", err).Debug("request failed")
+	}
+	if code == http.StatusUnauthorized {
+		w.Header().Set(HeaderServerTime, fmt.Sprintf("%d", time.Now().Unix()))
+	}
+	status := http.StatusText(code)
+	if e, ok := err.(*ErrHTTP); ok && e.Status != "" {
+		status = e.Status
+	}
 	w.WriteHeader(code)
-	io.WriteString(w, fmt.Sprintf("%s\n", http.StatusText(code)))
+	io.WriteString(w, fmt.Sprintf("%s\n", status))
 }
@@ -1,24 +1,52 @@
 package server
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"heckel.io/pcopy/config"
-	"log"
+	"heckel.io/pcopy/crypto"
+	"heckel.io/pcopy/log"
+	"net"
 	"net/http"
 	"net/url"
+	"sort"
 	"strings"
 	"sync"
+	"time"
+)
+
+const (
+	listenerHTTP       = "http"
+	listenerHTTPS      = "https"
+	listenerMetrics    = "metrics"
+	listenerAdmin      = "admin"
+	listenerAdminHTTPS = "admin-https"
 )
 
 // Router is a simple vhost delegator to be able to run multiple clipboards on the same port.
 // It runs the actual HTTP(S) servers and delegates based on the configured hostname.
 type Router struct {
 	servers       []*Server
-	httpServers   []*http.Server
-	tcpForwarders []*tcpForwarder
+	listeners     map[string]*listener     // Keyed by listen address
+	tcpForwarders map[string]*tcpForwarder // Keyed by listen address
+	tlsConfigs    map[string]*tls.Config   // Keyed by listen address, see tlsConfigFunc
+	errChan       chan error
+	stopped       chan struct{} // Closed by Stop and Shutdown, makes Start return
+	stopOnce      sync.Once
 	mu            sync.Mutex
+	adminMu       sync.Mutex // Serializes changes via the admin API, see adminHandler
+}
+
+// listener is an HTTP(S) server listening on a single address. Requests are dispatched to the clipboards that are
+// currently configured for that address (see serverFor), so clipboards can be added and removed while it is running.
+type listener struct {
+	addr      string
+	kind      string // listenerHTTP, listenerHTTPS, listenerMetrics, listenerAdmin or listenerAdminHTTPS
+	server    *http.Server
+	listeners []net.Listener // More than one for systemd:NAME addresses, see listen
 }
 
 // Serve starts a server and listens for incoming HTTPS requests. The server handles all management operations (info,
@@ -48,81 +76,171 @@ func NewRouter(configs ...*config.Config) (*Router, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Router{servers: servers}, nil
+	return &Router{
+		servers:       servers,
+		listeners:     make(map[string]*listener),
+		tcpForwarders: make(map[string]*tcpForwarder),
+		errChan:       make(chan error),
+		stopped:       make(chan struct{}),
+	}, nil
 }
 
-// Start starts the HTTP(S) server
+// Start starts the HTTP(S) server. It blocks until the server fails, or until Stop or Shutdown is called.
+// In the latter case, nil is returned.
 func (r *Router) Start() error {
-	r.mu.Lock()
+	if err := r.start(); err != nil {
+		return err
+	}
+	select {
+	case err := <-r.errChan:
+		return err
+	case <-r.stopped:
+		return nil
+	}
+}
 
-	var err error
-	r.httpServers, err = r.createHTTPServers()
+func (r *Router) start() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range r.servers {
+		if err := s.loadCert(); err != nil {
+			return err
+		}
+	}
+	listeners, err := createListeners(r.servers)
 	if err != nil {
 		return err
 	}
-	r.tcpForwarders, err = r.createTCPForwarders()
+	r.tlsConfigs, err = createTLSConfigs(r.servers)
 	if err != nil {
 		return err
 	}
+	forwarders := createTCPForwarders(r.servers)
+	if err := r.listen(listeners, forwarders); err != nil {
+		return err
+	}
+	r.listeners, r.tcpForwarders = listeners, forwarders
 	r.printListenInfo()
+	r.serve(listeners, forwarders)
+	for _, s := range r.servers {
+		s.startManager()
+	}
+	return nil
+}
 
-	errChan := make(chan error)
-	for _, s := range r.httpServers {
-		go func(s *http.Server) {
-			if s.TLSConfig != nil {
-				listener, err := tls.Listen("tcp", s.Addr, s.TLSConfig)
-				if err != nil {
-					errChan <- err
-					return
-				}
-				if err := s.Serve(listener); err != nil {
-					errChan <- err
-				}
-			} else {
-				if err := s.ListenAndServe(); err != nil {
-					errChan <- err
-				}
-			}
-		}(s)
+// Stop immediately shuts down the HTTP(S) server. This is not a graceful shutdown, see Shutdown.
+func (r *Router) Stop() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	defer r.closeStopped()
+	for _, l := range r.listeners {
+		if err := l.server.Close(); err != nil {
+			return err
+		}
 	}
 	for _, s := range r.tcpForwarders {
+		s.shutdown()
+	}
+	for _, s := range r.servers {
+		s.stopManager()
+	}
+	r.listeners = make(map[string]*listener)
+	r.tcpForwarders = make(map[string]*tcpForwarder)
+	return nil
+}
+
+// Shutdown gracefully shuts down the HTTP(S) server: It stops accepting new connections and waits for in-flight
+// requests (uploads, downloads and streams) to finish, up to the configured ShutdownTimeout. Requests that are still
+// running after that are aborted, and streams still waiting for a reader are closed. Once all requests are finished
+// or aborted, the manager is stopped and Start returns.
+//
+// Stop may be called while Shutdown is waiting, to abort all requests immediately.
+func (r *Router) Shutdown() error {
+	defer r.closeStopped()
+	r.mu.Lock()
+	listeners, tcpForwarders := r.listeners, r.tcpForwarders
+	r.mu.Unlock()
+	inFlight := r.requestsInFlight()
+	timeout := r.shutdownTimeout()
+	log.Info("Shutting down, waiting up to %s for %d in-flight request(s) to finish", timeout, inFlight)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, l := range listeners {
+		wg.Add(1)
+		go func(s *http.Server) {
+			defer wg.Done()
+			s.Shutdown(ctx) // Returns ctx.Err() if connections are still active; we deal with them below
+		}(l.server)
+	}
+	for _, s := range tcpForwarders {
+		wg.Add(1)
 		go func(s *tcpForwarder) {
-			if err := s.listenAndServe(); err != nil {
-				errChan <- err
-			}
+			defer wg.Done()
+			s.drain(ctx)
 		}(s)
 	}
-
+	wg.Wait()
+	aborted := r.requestsInFlight()
+	if aborted > 0 {
+		log.Warn("Shutdown timeout of %s reached, aborting %d request(s)", timeout, aborted)
+		for _, s := range r.servers {
+			s.closeStreams()
+		}
+		for _, l := range listeners {
+			l.server.Close()
+		}
+	}
+	r.mu.Lock()
 	for _, s := range r.servers {
-		s.startManager()
+		s.stopManager()
 	}
-
+	r.listeners = make(map[string]*listener)
+	r.tcpForwarders = make(map[string]*tcpForwarder)
 	r.mu.Unlock()
-	err = <-errChan
-	return err
+	finished := inFlight - aborted
+	if finished < 0 {
+		finished = 0 // Requests may have started after we counted
+	}
+	log.Info("Shutdown complete: %d request(s) finished, %d aborted", finished, aborted)
+	return nil
 }
 
-// Stop immediately shuts down the HTTP(S) server. This is not a graceful shutdown.
-func (r *Router) Stop() error {
+func (r *Router) requestsInFlight() int64 {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	if r.httpServers != nil {
-		for _, s := range r.httpServers {
-			if err := s.Close(); err != nil {
-				return err
-			}
-		}
+	var inFlight int64
+	for _, s := range r.servers {
+		inFlight += s.requestsInFlight()
 	}
-	if r.tcpForwarders != nil {
-		for _, s := range r.tcpForwarders {
-			s.shutdown()
+	return inFlight
+}
+
+// shutdownTimeout returns the longest ShutdownTimeout of all clipboards, since they share the HTTP(S) servers
+func (r *Router) shutdownTimeout() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var timeout time.Duration
+	for _, s := range r.servers {
+		if s.config.ShutdownTimeout > timeout {
+			timeout = s.config.ShutdownTimeout
 		}
 	}
-	for _, s := range r.servers {
-		s.stopManager()
+	return timeout
+}
+
+func (r *Router) closeStopped() {
+	r.stopOnce.Do(func() {
+		close(r.stopped)
+	})
+}
+
+// fail passes an error of a listener to Start, unless the router has already been stopped
+func (r *Router) fail(err error) {
+	select {
+	case r.errChan <- err:
+	case <-r.stopped:
 	}
-	r.httpServers = nil
-	return nil
 }
 
 func createServers(configs []*config.Config) ([]*Server, error) {
@@ -131,90 +249,308 @@ func createServers(configs []*config.Config) ([]*Server, error) {
 		var err error
 		servers[i], err = New(conf)
 		if err != nil {
+			closeServers(servers[:i])
 			return nil, err
 		}
 	}
 	return servers, nil
 }
 
+// closeServers releases the resources of servers that were created but never started
+func closeServers(servers []*Server) {
+	for _, s := range servers {
+		if s.auditLog != nil {
+			s.auditLog.Close()
+		}
+		if s.webhooks != nil {
+			s.webhooks.Close()
+		}
+	}
+}
+
 func (r *Router) printListenInfo() {
 	listens := make([]string, 0)
-	for _, s := range r.httpServers {
-		proto := "http"
-		if s.TLSConfig != nil {
-			proto = "https"
+	for _, l := range r.listeners {
+		proto := l.kind
+		if l.kind == listenerMetrics || l.kind == listenerAdmin {
+			proto = listenerHTTP
+		} else if l.kind == listenerAdminHTTPS {
+			proto = listenerHTTPS
 		}
-		listens = append(listens, fmt.Sprintf("%s/%s", s.Addr, proto))
+		listens = append(listens, fmt.Sprintf("%s/%s", l.addr, proto))
 	}
 	for _, s := range r.tcpForwarders {
 		listens = append(listens, fmt.Sprintf("%s/tcp", s.Addr))
 	}
-	log.Printf("Listening on %s (%d clipboard(s))\n", strings.Join(listens, " "), len(r.servers))
+	sort.Strings(listens)
+	log.Info("Listening on %s (%d clipboard(s))", strings.Join(listens, " "), len(r.servers))
 }
 
-func (r *Router) createHTTPServers() ([]*http.Server, error) {
-	serversPerPort := make(map[string]int)
-	for _, s := range r.servers {
-		serversPerPort[s.config.ListenHTTP]++
-		serversPerPort[s.config.ListenHTTPS]++
+// createListeners determines the listen addresses of the given servers, and whether they are HTTP, HTTPS or
+// metrics listeners. The listeners are not bound yet, see listen.
+func createListeners(servers []*Server) (map[string]*listener, error) {
+	listeners := make(map[string]*listener)
+	add := func(addr, kind string) error {
+		if l, ok := listeners[addr]; ok && l.kind != kind {
+			return fmt.Errorf("listen address %s cannot be used for both %s and %s", addr, l.kind, kind)
+		}
+		listeners[addr] = &listener{addr: addr, kind: kind}
+		return nil
 	}
-	servers := make(map[string]*http.Server)
-	for _, s := range r.servers {
-		if s.config.ListenHTTP != "" {
-			if _, err := r.createServerOrAddHandler(servers, serversPerPort, s, s.config.ListenHTTP); err != nil {
+	for _, s := range servers {
+		if _, err := s.hostname(); err != nil {
+			return nil, err
+		}
+		for _, addr := range s.config.ListenHTTP {
+			if err := add(addr, listenerHTTP); err != nil {
 				return nil, err
 			}
 		}
-		if s.config.ListenHTTPS != "" {
-			server, err := r.createServerOrAddHandler(servers, serversPerPort, s, s.config.ListenHTTPS)
-			if err != nil {
+		for _, addr := range s.config.ListenHTTPS {
+			if err := add(addr, listenerHTTPS); err != nil {
 				return nil, err
 			}
-			cert, err := tls.LoadX509KeyPair(s.config.CertFile, s.config.KeyFile)
-			if err != nil {
-				return nil, err
+		}
+	}
+	for _, s := range servers {
+		if s.config.Metrics == config.MetricsOff || s.config.MetricsListenAddr == "" {
+			continue
+		}
+		addr := s.config.MetricsListenAddr
+		if l, ok := listeners[addr]; ok && l.kind != listenerMetrics {
+			return nil, fmt.Errorf("metrics listen address %s must differ from clipboard listen addresses", addr)
+		}
+		listeners[addr] = &listener{addr: addr, kind: listenerMetrics}
+	}
+	admin, err := adminConfig(servers)
+	if err != nil {
+		return nil, err
+	} else if admin != nil {
+		if _, ok := listeners[admin.AdminListenAddr]; ok {
+			return nil, fmt.Errorf("admin listen address %s must differ from all other listen addresses", admin.AdminListenAddr)
+		}
+		kind := listenerAdmin
+		if admin.AdminListenHTTPS {
+			kind = listenerAdminHTTPS
+		}
+		listeners[admin.AdminListenAddr] = &listener{addr: admin.AdminListenAddr, kind: kind}
+	}
+	return listeners, nil
+}
+
+// createTLSConfigs creates the TLS config for each HTTPS listen address of the given servers. The certificate
+// is selected based on the SNI of the client, and client certificates are verified against the union of the
+// client CAs of all clipboards; each Server verifies them against its own CAs in authorize. If the admin API
+// is served via HTTPS, it uses the certificate of the clipboard that enables it.
+func createTLSConfigs(servers []*Server) (map[string]*tls.Config, error) {
+	tlsConfigs := make(map[string]*tls.Config)
+	certs := make(map[string][]*certReloader)
+	for _, s := range servers {
+		for _, addr := range s.config.ListenHTTPS {
+			tlsConfig, ok := tlsConfigs[addr]
+			if !ok {
+				tlsConfig = &tls.Config{}
+				tlsConfigs[addr] = tlsConfig
 			}
-			if server.TLSConfig == nil {
-				server.TLSConfig = &tls.Config{Certificates: make([]tls.Certificate, 0)}
+			certs[addr] = append(certs[addr], s.cert)
+			if s.config.ClientCAFile != "" {
+				clientCAs, err := crypto.LoadCertsFromFile(s.config.ClientCAFile)
+				if err != nil {
+					return nil, err
+				}
+				if tlsConfig.ClientCAs == nil {
+					tlsConfig.ClientCAs = x509.NewCertPool()
+				}
+				for _, ca := range clientCAs {
+					tlsConfig.ClientCAs.AddCert(ca)
+				}
+				tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
 			}
-			server.TLSConfig.Certificates = append(server.TLSConfig.Certificates, cert)
 		}
 	}
-	serversList := make([]*http.Server, 0)
+	for addr, reloaders := range certs {
+		tlsConfigs[addr].GetCertificate = getCertificateFunc(reloaders)
+	}
 	for _, s := range servers {
-		serversList = append(serversList, s)
+		if s.config.AdminListenAddr != "" && s.config.AdminListenHTTPS {
+			tlsConfigs[s.config.AdminListenAddr] = &tls.Config{GetCertificate: getCertificateFunc([]*certReloader{s.cert})}
+		}
 	}
-	return serversList, nil
+	return tlsConfigs, nil
 }
 
-func (r *Router) createServerOrAddHandler(servers map[string]*http.Server, serversPerPort map[string]int, s *Server, listen string) (*http.Server, error) {
-	server, ok := servers[listen]
-	if !ok {
-		server = &http.Server{Addr: listen, Handler: http.NewServeMux()}
-		servers[listen] = server
+// tlsConfigFunc returns the current TLS config for the given address. Since the TLS config is looked up for each
+// connection, certificates and client CAs can be changed while the listener is running (see Reload).
+func (r *Router) tlsConfigFunc(addr string) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		tlsConfig, ok := r.tlsConfigs[addr]
+		if !ok {
+			return nil, fmt.Errorf("no TLS config for %s", addr)
+		}
+		return tlsConfig, nil
 	}
-	serverURL, err := url.ParseRequestURI(config.ExpandServerAddr(s.config.ServerAddr))
-	if err != nil {
-		return nil, err
+}
+
+func createTCPForwarders(servers []*Server) map[string]*tcpForwarder {
+	forwarders := make(map[string]*tcpForwarder)
+	for _, s := range servers {
+		for _, addr := range s.config.ListenTCP {
+			forwarder := newTCPForwarder(addr, config.ExpandServerAddr(s.config.ServerAddr), s.Handle)
+			forwarder.TrustedProxies = s.config.TrustedProxies
+			forwarders[addr] = forwarder
+		}
+	}
+	return forwarders
+}
+
+// listen binds the addresses of the given listeners and TCP forwarders. If one of them cannot be bound, the ones
+// that were already bound are closed again.
+func (r *Router) listen(listeners map[string]*listener, forwarders map[string]*tcpForwarder) error {
+	bound := make([]*listener, 0)
+	boundForwarders := make([]*tcpForwarder, 0)
+	closeBound := func() {
+		for _, l := range bound {
+			for _, ln := range l.listeners {
+				ln.Close()
+			}
+		}
+		for _, f := range boundForwarders {
+			f.shutdown()
+		}
+	}
+	for _, l := range listeners {
+		listeners, err := listen(l.addr)
+		if err != nil {
+			closeBound()
+			return err
+		}
+		l.listeners = listeners
+		l.server = &http.Server{Addr: l.addr, Handler: r.handler(l.addr)}
+		if l.kind == listenerHTTPS || l.kind == listenerAdminHTTPS {
+			for i, ln := range listeners {
+				l.listeners[i] = tls.NewListener(ln, &tls.Config{GetConfigForClient: r.tlsConfigFunc(l.addr)})
+			}
+		}
+		if l.kind == listenerMetrics {
+			l.server.Handler = r.metricsHandler(l.addr)
+		} else if l.kind == listenerAdmin || l.kind == listenerAdminHTTPS {
+			l.server.Handler = r.adminHandler()
+		}
+		bound = append(bound, l)
 	}
-	handler := server.Handler.(*http.ServeMux)
-	if serversPerPort[listen] == 1 {
-		handler.HandleFunc("/", s.Handle)
-	} else {
-		handler.HandleFunc(fmt.Sprintf("%s/", serverURL.Hostname()), s.Handle)
+	for _, f := range forwarders {
+		if err := f.listen(); err != nil {
+			closeBound()
+			return err
+		}
+		boundForwarders = append(boundForwarders, f)
 	}
-	return server, nil
+	return nil
 }
 
-func (r *Router) createTCPForwarders() ([]*tcpForwarder, error) {
-	servers := make([]*tcpForwarder, 0)
+// serve accepts connections on the given (bound) listeners and TCP forwarders in the background
+func (r *Router) serve(listeners map[string]*listener, forwarders map[string]*tcpForwarder) {
+	for _, l := range listeners {
+		for _, ln := range l.listeners {
+			go func(s *http.Server, ln net.Listener) {
+				if err := s.Serve(ln); err != nil && err != http.ErrServerClosed {
+					r.fail(err)
+				}
+			}(l.server, ln)
+		}
+	}
+	for _, f := range forwarders {
+		go func(f *tcpForwarder) {
+			if err := f.serve(); err != nil {
+				r.fail(err)
+			}
+		}(f)
+	}
+}
+
+// handler returns the handler for the given listen address. If more than one clipboard listens on the address,
+// requests are delegated based on the HTTP "Host:" header.
+func (r *Router) handler(addr string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if s := r.serverFor(addr, req.Host, req.URL.Path); s != nil {
+			stripBasePath(req, s.config.BasePath)
+			s.Handle(w, req)
+		} else {
+			http.NotFound(w, req)
+		}
+	}
+}
+
+// serverFor returns the server that handles a request to the given listen address, host and path. If more than one
+// server listens on the address, the server is selected by hostname. Among the remaining servers, the one with
+// the longest matching BasePath wins, so clipboards can be mounted under different paths of the same host.
+func (r *Router) serverFor(addr string, host string, path string) *Server {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	servers := make([]*Server, 0)
 	for _, s := range r.servers {
-		if s.config.ListenTCP != "" {
-			server := newTCPForwarder(s.config.ListenTCP, config.ExpandServerAddr(s.config.ServerAddr), s.Handle)
-			servers = append(servers, server)
+		if containsAddr(s.config.ListenHTTP, addr) || containsAddr(s.config.ListenHTTPS, addr) {
+			servers = append(servers, s)
 		}
 	}
-	return servers, nil
+	if len(servers) > 1 {
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		matching := make([]*Server, 0)
+		for _, s := range servers {
+			if hostname, _ := s.hostname(); hostname == host {
+				matching = append(matching, s)
+			}
+		}
+		servers = matching
+	}
+	var server *Server
+	for _, s := range servers {
+		if matchesBasePath(path, s.config.BasePath) && (server == nil || len(s.config.BasePath) > len(server.config.BasePath)) {
+			server = s
+		}
+	}
+	return server
+}
+
+// metricsHandler returns the handler for a separate metrics listener, see metricsHandler
+func (r *Router) metricsHandler(addr string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		r.mu.Lock()
+		servers := make([]*Server, 0)
+		for _, s := range r.servers {
+			if s.config.Metrics != config.MetricsOff && s.config.MetricsListenAddr == addr {
+				current, release := s.acquire()
+				defer release()
+				servers = append(servers, current)
+			}
+		}
+		r.mu.Unlock()
+		metricsHandler(servers)(w, req)
+	}
+}
+
+// loadCert loads the TLS certificate of the server, if it listens for HTTPS connections
+func (s *Server) loadCert() error {
+	if len(s.config.ListenHTTPS) == 0 && !s.config.AdminListenHTTPS {
+		return nil
+	}
+	var err error
+	s.cert, err = newCertReloader(s.config.ServerAddr, s.config.CertFile, s.config.KeyFile)
+	return err
+}
+
+// hostname returns the hostname of the server address, which is used to delegate requests if more than one
+// clipboard listens on the same address
+func (s *Server) hostname() (string, error) {
+	serverURL, err := url.ParseRequestURI(config.ExpandServerAddr(s.config.ServerAddr))
+	if err != nil {
+		return "", err
+	}
+	return serverURL.Hostname(), nil
 }
 
 var errInvalidNumberOfConfigs = errors.New("invalid number of configs, need at least one")
@@ -10,10 +10,13 @@ import (
 	"heckel.io/pcopy/crypto"
 	"heckel.io/pcopy/test"
 	"heckel.io/pcopy/util"
+	"io"
 	"net"
 	"net/http"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestServerRouter_InvalidConfigNoConfigs(t *testing.T) {
@@ -26,8 +29,8 @@ func TestServerRouter_InvalidConfigNoConfigs(t *testing.T) {
 func TestServerRouter_StartStopSimple(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
 	conf.ServerAddr = "https://localhost:11443"
-	conf.ListenHTTPS = ":11443"
-	conf.ListenHTTP = ":11080"
+	conf.ListenHTTPS = []string{":11443"}
+	conf.ListenHTTP = []string{":11080"}
 	serverRouter := startTestServerRouter(t, conf)
 	defer serverRouter.Stop()
 
@@ -55,12 +58,12 @@ func TestServerRouter_StartStopWithVhostOnSamePorts(t *testing.T) {
 	// This tests two clipboards listening on the same ports being multiplexed based on the "Host:" header
 	_, conf1 := configtest.NewTestConfigWithHostname(t, "some-host-1")
 	conf1.ServerAddr = "https://some-host-1:11443"
-	conf1.ListenHTTPS = ":11443"
-	conf1.ListenHTTP = ":11080"
+	conf1.ListenHTTPS = []string{":11443"}
+	conf1.ListenHTTP = []string{":11080"}
 	_, conf2 := configtest.NewTestConfigWithHostname(t, "some-host-2")
 	conf2.ServerAddr = "https://some-host-2:12443"
-	conf2.ListenHTTPS = ":11443"
-	conf2.ListenHTTP = ":11080"
+	conf2.ListenHTTPS = []string{":11443"}
+	conf2.ListenHTTP = []string{":11080"}
 	serverRouter := startTestServerRouter(t, conf1, conf2)
 
 	test.WaitForPortUp(t, "11443")
@@ -85,6 +88,166 @@ func TestServerRouter_StartStopWithVhostOnSamePorts(t *testing.T) {
 	test.WaitForPortDown(t, "11080")
 }
 
+func TestServerRouter_StartStopWithUnixSocketAndMultipleAddrs(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	socketFile := filepath.Join(t.TempDir(), "pcopy.sock")
+	conf.ServerAddr = "http://localhost:11080"
+	conf.ListenHTTPS = nil
+	conf.ListenHTTP = []string{":11080", "127.0.0.1:11081", "unix:" + socketFile}
+	serverRouter := startTestServerRouter(t, conf)
+	defer serverRouter.Stop()
+
+	test.WaitForPortUp(t, "11080")
+	test.WaitForPortUp(t, "11081")
+
+	unixClient := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socketFile)
+			},
+		},
+	}
+	req, _ := http.NewRequest("PUT", "http://localhost/unixfile", strings.NewReader("via unix socket"))
+	resp, err := unixClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.Int64Equals(t, http.StatusCreated, int64(resp.StatusCode))
+
+	resp, err = http.Get("http://127.0.0.1:11081/unixfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	test.StrEquals(t, "via unix socket", string(body))
+
+	serverRouter.Stop()
+	test.WaitForPortDown(t, "11080")
+	test.WaitForPortDown(t, "11081")
+	test.FileNotExist(t, socketFile)
+}
+
+func TestServerRouter_StartStopWithBasePathsOnSamePort(t *testing.T) {
+	_, confWork := configtest.NewTestConfig(t)
+	confWork.ServerAddr = "http://localhost:11080"
+	confWork.BasePath = "/work"
+	confWork.ListenHTTPS = nil
+	confWork.ListenHTTP = []string{":11080"}
+	_, confHome := configtest.NewTestConfig(t)
+	confHome.ServerAddr = "http://localhost:11080"
+	confHome.BasePath = "/home"
+	confHome.ListenHTTPS = nil
+	confHome.ListenHTTP = []string{":11080"}
+	serverRouter := startTestServerRouter(t, confWork, confHome)
+	defer serverRouter.Stop()
+
+	test.WaitForPortUp(t, "11080")
+
+	req, _ := http.NewRequest("PUT", "http://localhost:11080/work/file1", strings.NewReader("work file"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.Int64Equals(t, http.StatusCreated, int64(resp.StatusCode))
+	test.StrEquals(t, "http://localhost:11080/work/file1", resp.Header.Get("X-URL"))
+	clipboardtest.Content(t, confWork, "file1", "work file")
+	clipboardtest.NotExist(t, confHome, "file1")
+
+	test.Int64Equals(t, http.StatusNotFound, int64(putTestFile(t, "http://localhost:11080/other/file1", "no clipboard")))
+	test.Int64Equals(t, http.StatusCreated, int64(putTestFile(t, "http://localhost:11080/home/file1", "home file")))
+	clipboardtest.Content(t, confHome, "file1", "home file")
+
+	resp, err = http.Get("http://localhost:11080/home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	test.StrContains(t, string(body), `src="/home/static/js/app.js"`)
+	test.StrContains(t, string(body), "pcopy join http://localhost:11080/home")
+
+	resp, err = http.Get("http://localhost:11080/work/curl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	test.StrContains(t, string(body), "http://localhost:11080/work")
+}
+
+func TestServerRouter_StartWithSystemdWithoutSockets(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.ListenHTTPS = []string{"systemd:https"}
+	serverRouter, err := NewRouter(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := serverRouter.Start(); err != errNoSystemdSockets {
+		t.Fatalf("expected errNoSystemdSockets, got %v", err)
+	}
+}
+
+func TestServerRouter_ShutdownWaitsForInFlightUpload(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.ServerAddr = "http://localhost:11080"
+	conf.ListenHTTPS = nil
+	conf.ListenHTTP = []string{":11080"}
+	serverRouter, errChan := startTestServerRouterWithErrChan(t, conf)
+
+	test.WaitForPortUp(t, "11080")
+
+	// Start a slow upload, and shut down while it is in progress
+	body, bodyWriter := io.Pipe()
+	respChan := make(chan *http.Response)
+	go func() {
+		req, _ := http.NewRequest("PUT", "http://localhost:11080/slowfile", body)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			panic(err)
+		}
+		respChan <- resp
+	}()
+	bodyWriter.Write([]byte("first half, "))
+	waitForRequestsInFlight(t, serverRouter, 1)
+	go serverRouter.Shutdown()
+	test.WaitForPortDown(t, "11080")
+
+	bodyWriter.Write([]byte("second half"))
+	bodyWriter.Close()
+	resp := <-respChan
+	test.Int64Equals(t, http.StatusCreated, int64(resp.StatusCode))
+	clipboardtest.Content(t, conf, "slowfile", "first half, second half")
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerRouter_ShutdownAbortsStreamAfterTimeout(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.ServerAddr = "http://localhost:11080"
+	conf.ListenHTTPS = nil
+	conf.ListenHTTP = []string{":11080"}
+	conf.ShutdownTimeout = 100 * time.Millisecond
+	serverRouter, errChan := startTestServerRouterWithErrChan(t, conf)
+
+	test.WaitForPortUp(t, "11080")
+
+	// Nobody is reading the stream, so the upload blocks until the shutdown timeout is reached
+	go func() {
+		req, _ := http.NewRequest("PUT", "http://localhost:11080/streamfile", strings.NewReader("streamed content"))
+		req.Header.Set(HeaderStream, HeaderStreamDelayHeaders)
+		http.DefaultClient.Do(req)
+	}()
+	waitForRequestsInFlight(t, serverRouter, 1)
+	time.Sleep(100 * time.Millisecond) // Wait for the FIFO to be created
+	if err := serverRouter.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+	waitForRequestsInFlight(t, serverRouter, 0)
+	clipboardtest.NotExist(t, conf, "streamfile")
+}
+
 func newHTTPClientWithPinnedCertAndIP(pinnedCert *x509.Certificate, pinnedAddr string) *http.Client {
 	client, _ := util.NewHTTPClientWithPinnedCert(pinnedCert)
 	client.Transport.(*http.Transport).DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
@@ -106,3 +269,25 @@ func startTestServerRouter(t *testing.T, configs ...*config.Config) *Router {
 	}()
 	return server
 }
+
+func startTestServerRouterWithErrChan(t *testing.T, configs ...*config.Config) (*Router, chan error) {
+	server, err := NewRouter(configs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- server.Start()
+	}()
+	return server, errChan
+}
+
+func waitForRequestsInFlight(t *testing.T, r *Router, inFlight int64) {
+	for i := 0; i < 50; i++ {
+		if r.requestsInFlight() == inFlight {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("expected %d request(s) in flight, got %d", inFlight, r.requestsInFlight())
+}
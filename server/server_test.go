@@ -2,7 +2,12 @@ package server
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -12,10 +17,12 @@ import (
 	"heckel.io/pcopy/config"
 	"heckel.io/pcopy/config/configtest"
 	"heckel.io/pcopy/crypto"
+	"heckel.io/pcopy/log"
 	"heckel.io/pcopy/test"
+	"heckel.io/pcopy/util"
 	"io"
 	"io/ioutil"
-	"log"
+	"math/big"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
@@ -34,7 +41,7 @@ func TestMain(m *testing.M) {
 
 func TestServer_NewServerInvalidListenAddr(t *testing.T) {
 	conf := config.New()
-	conf.ListenHTTPS = ""
+	conf.ListenHTTPS = nil
 	_, err := New(conf)
 	if err == nil {
 		t.Fatalf("expected error, got none")
@@ -146,7 +153,7 @@ func TestServer_HandleWebRoot(t *testing.T) {
 
 func TestServer_HandleWebRootRedirectHTTPS(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
-	conf.ListenHTTP = ":9876"
+	conf.ListenHTTP = []string{":9876"}
 	server := newTestServer(t, conf)
 
 	rr := httptest.NewRecorder()
@@ -253,6 +260,32 @@ func TestServer_HandleClipboardPut(t *testing.T) {
 	clipboardtest.Content(t, conf, "new-thing", content)
 }
 
+func TestServer_HandleRequestIDAndAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(ioutil.Discard)
+
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/new-thing", strings.NewReader("some content"))
+	req.Header.Set("X-Request-ID", "abc-123")
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	test.StrEquals(t, "abc-123", rr.Header().Get("X-Request-ID"))
+	test.StrContains(t, buf.String(), "INFO request handled clipboard=localhost:12345 request_id=abc-123")
+	test.StrContains(t, buf.String(), "method=PUT status=201 bytes_in=12")
+
+	// Invalid IDs are replaced
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/new-thing", nil)
+	req.Header.Set("X-Request-ID", "not a valid id")
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	test.Int64Equals(t, 16, int64(len(rr.Header().Get("X-Request-ID"))))
+}
+
 func TestServer_HandleClipboardPutRandom(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
 	server := newTestServer(t, conf)
@@ -446,6 +479,51 @@ func TestServer_HandleClipboardTextPutWithoutTTL(t *testing.T) {
 	test.DurationEquals(t, time.Minute, time.Second*time.Duration(ttl))
 }
 
+func TestServer_HandleClipboardPutContentPolicies(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.ContentPolicies = []*config.ContentPolicy{
+		{Type: "application/x-executable", Deny: true},
+		{Type: "image/*", MaxSize: 20, MaxTTL: time.Hour},
+		{Type: "application/pdf", Download: true},
+	}
+	server := newTestServer(t, conf)
+
+	// Denied type
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/binary", strings.NewReader("\x7fELF\x02\x01\x01\x00 some executable"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusUnsupportedMediaType)
+	test.StrEquals(t, "content type application/x-executable is not allowed\n", rr.Body.String())
+	clipboardtest.NotExist(t, conf, "binary")
+
+	// Max TTL applies, also if the file should never expire
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/image?t=0", strings.NewReader("GIF89a..."))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	ttl, _ := strconv.Atoi(rr.Header().Get("X-TTL"))
+	test.DurationEquals(t, time.Hour, time.Second*time.Duration(ttl))
+
+	// Max size
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/large-image", strings.NewReader("GIF89a this is more than 20 bytes"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusRequestEntityTooLarge)
+
+	// Forced download
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/doc", strings.NewReader("%PDF-1.4 document"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/doc", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	test.StrEquals(t, "application/pdf", rr.Header().Get("Content-Type"))
+	test.StrEquals(t, "attachment; filename=doc.pdf", rr.Header().Get("Content-Disposition"))
+}
+
 func TestServer_HandleClipboardPutLargeFailed(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
 	conf.FileSizeLimit = 10 // bytes
@@ -641,6 +719,145 @@ func TestServer_HandleClipboardPutStreamWithReserveSuccess(t *testing.T) {
 	test.BoolEquals(t, true, stat == nil)
 }
 
+func TestServer_HandleClipboardPutUploadSlotOnlyOnce(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.Key = crypto.DeriveKey([]byte("some password"), []byte("some salt"))
+	server := newTestServer(t, conf)
+
+	// Create upload slot (with key)
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/invoice", nil)
+	hmac, _ := crypto.GenerateAuthHMAC(conf.Key.Bytes, "PUT", "/invoice", time.Minute)
+	req.Header.Set("Authorization", hmac)
+	req.Header.Set("X-Reserve", "slot")
+	req.Header.Set("X-Max-Size", "10")
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	test.StrContains(t, rr.Body.String(), "# Upload link")
+	test.StrContains(t, rr.Header().Get("X-Curl"), " -T FILE ")
+	slotURL := rr.Header().Get("X-URL")
+	secret := slotURL[strings.Index(slotURL, "?a=")+3:]
+	slotPath := "/invoice?a=" + secret
+
+	// Nothing to download yet, but browsers get the upload page
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", slotPath, nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusNotFound)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", slotPath, nil)
+	req.Header.Set("Accept", "text/html")
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	test.StrContains(t, rr.Body.String(), `UploadSlotID: "invoice"`)
+
+	// Upload too large, slot is restored
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", slotPath, strings.NewReader("more than 10 bytes"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusRequestEntityTooLarge)
+
+	// Upload without key, using the slot secret
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", slotPath, strings.NewReader("invoice"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	test.BoolEquals(t, false, strings.Contains(rr.Header().Get("X-URL"), "?a="))
+	clipboardtest.Content(t, conf, "invoice", "invoice")
+
+	// Slot cannot be used again, and the secret does not allow reading the file
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", slotPath, strings.NewReader("overwritten"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusUnauthorized)
+	clipboardtest.Content(t, conf, "invoice", "invoice")
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", slotPath, nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusUnauthorized)
+
+	// Only readable with the key
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/invoice", nil)
+	hmac, _ = crypto.GenerateAuthHMAC(conf.Key.Bytes, "GET", "/invoice", time.Minute)
+	req.Header.Set("Authorization", hmac)
+	server.Handle(rr, req)
+	test.Response(t, rr, http.StatusOK, "invoice")
+}
+
+func TestServer_HandleClipboardPutUploadSlotCannotBeReminted(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.Key = crypto.DeriveKey([]byte("some password"), []byte("some salt"))
+	conf.FileExpireAfterDefault = time.Hour
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/invoice", nil)
+	hmac, _ := crypto.GenerateAuthHMAC(conf.Key.Bytes, "PUT", "/invoice", time.Minute)
+	req.Header.Set("Authorization", hmac)
+	req.Header.Set("X-Reserve", "slot")
+	req.Header.Set("X-Max-Size", "10")
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	slotURL := rr.Header().Get("X-URL")
+	slotPath := "/invoice?a=" + slotURL[strings.Index(slotURL, "?a=")+3:]
+
+	// Slot secret cannot be used to reserve a new slot or a reservation, with the header or the query param
+	for _, reserve := range []string{"slot", "1"} {
+		rr = httptest.NewRecorder()
+		req, _ = http.NewRequest("PUT", slotPath, nil)
+		req.Header.Set("X-Reserve", reserve)
+		req.Header.Set("X-Max-Size", "1000")
+		server.Handle(rr, req)
+		test.Status(t, rr, http.StatusBadRequest)
+	}
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", slotPath+"&r=slot", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusBadRequest)
+
+	// Neither can the key
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/invoice", nil)
+	hmac, _ = crypto.GenerateAuthHMAC(conf.Key.Bytes, "PUT", "/invoice", time.Minute)
+	req.Header.Set("Authorization", hmac)
+	req.Header.Set("X-Reserve", "slot")
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusBadRequest)
+
+	// Client-supplied limits are ignored for uploads to the slot
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", slotPath, strings.NewReader(strings.Repeat("x", 100)))
+	req.Header.Set("X-Max-Size", "1000")
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusRequestEntityTooLarge)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", slotPath, strings.NewReader("invoice"))
+	req.Header.Set("X-TTL", "0")
+	req.Header.Set("X-Mode", "ro")
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	test.StrEquals(t, "3600", rr.Header().Get("X-TTL"))
+	stat, err := server.clipboard.Stat("invoice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, config.FileModeReadWrite, stat.Mode)
+}
+
+func TestServer_HandleClipboardPutUploadSlotStreamFailure(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/slot?r=slot&s=1", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusBadRequest)
+}
+
 func TestServer_HandleClipboardHeadSuccess(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
 	server := newTestServer(t, conf)
@@ -659,6 +876,40 @@ func TestServer_HandleClipboardHeadSuccess(t *testing.T) {
 	test.StrContains(t, rr.Header().Get("X-Curl"), "--pinnedpubkey")
 }
 
+func TestServer_HandleUnauthorizedWithServerTime(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.Key = crypto.DeriveKey([]byte("some password"), []byte("some salt"))
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/verify", nil)
+	hmac, _ := crypto.GenerateAuthHMACWithTime(time.Now().Add(-time.Hour), conf.Key.Bytes, "GET", "/verify", 0)
+	req.Header.Set("Authorization", hmac)
+	server.Handle(rr, req)
+
+	test.Status(t, rr, http.StatusUnauthorized)
+	serverTime, _ := strconv.ParseInt(rr.Header().Get(HeaderServerTime), 10, 64)
+	if time.Since(time.Unix(serverTime, 0)) > 5*time.Second {
+		t.Fatalf("expected current server time in header, got %s", rr.Header().Get(HeaderServerTime))
+	}
+}
+
+func TestServer_HandleVerifyWithBasePath(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.Key = crypto.DeriveKey([]byte("some password"), []byte("some salt"))
+	conf.BasePath = "/work"
+	server := newTestServer(t, conf)
+
+	// The router strips the base path, but the client signs the full path
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/work/verify", nil)
+	hmac, _ := crypto.GenerateAuthHMAC(conf.Key.Bytes, "GET", "/work/verify", time.Minute)
+	req.Header.Set("Authorization", hmac)
+	stripBasePath(req, conf.BasePath)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+}
+
 func TestServer_AuthorizeSuccessUnprotected(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
 	server := newTestServer(t, conf)
@@ -756,6 +1007,378 @@ func TestServer_AuthorizeHmacFailureWrongKeyProtected(t *testing.T) {
 	}
 }
 
+func TestServer_AuthorizeWithPreviousKeySetsKeyRotatedHeader(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	previousKey := crypto.DeriveKey([]byte("old password"), []byte("old salt"))
+	conf.Key = crypto.DeriveKey([]byte("new password"), []byte("new salt"))
+	conf.PreviousKeys = []*config.PreviousKey{{Key: previousKey}}
+	server := newTestServer(t, conf)
+
+	// HMAC with previous key
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/verify", nil)
+	hmac, _ := crypto.GenerateAuthHMAC(previousKey.Bytes, "GET", "/verify", time.Minute)
+	req.Header.Set("Authorization", hmac)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	test.StrEquals(t, HeaderKeyRotatedEnabled, rr.Header().Get(HeaderKeyRotated))
+
+	// Basic auth with previous password
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/verify", nil)
+	req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("x:old password")))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	test.StrEquals(t, HeaderKeyRotatedEnabled, rr.Header().Get(HeaderKeyRotated))
+
+	// Primary key does not set the header
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/verify", nil)
+	req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("x:new password")))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	test.StrEquals(t, "", rr.Header().Get(HeaderKeyRotated))
+
+	// Info advertises the primary salt
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/info", nil)
+	server.Handle(rr, req)
+	test.StrContains(t, rr.Body.String(), base64.StdEncoding.EncodeToString([]byte("new salt")))
+}
+
+func TestServer_AuthorizeWithRetiredPreviousKeyFailure(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	previousKey := crypto.DeriveKey([]byte("old password"), []byte("old salt"))
+	conf.Key = crypto.DeriveKey([]byte("new password"), []byte("new salt"))
+	conf.PreviousKeys = []*config.PreviousKey{{Key: previousKey, Retires: time.Now().Add(-time.Minute)}}
+	server := newTestServer(t, conf)
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("x:old password")))
+	if err := server.authorize(req); err != ErrHTTPUnauthorized {
+		t.Fatalf("expected invalid auth, got %#v", err)
+	}
+}
+
+func TestServer_AccessDeniedForWrite(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.AllowWrite, _ = util.ParseIPNets("10.0.0.0/8")
+	conf.DenyWrite, _ = util.ParseIPNets("10.1.0.0/16")
+	server := newTestServer(t, conf)
+
+	for remoteAddr, status := range map[string]int{
+		"10.2.3.4:1234":   http.StatusCreated,
+		"10.1.2.3:1234":   http.StatusForbidden,
+		"192.168.1.1:123": http.StatusForbidden,
+	} {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", "/some-file", strings.NewReader("this is a thing"))
+		req.RemoteAddr = remoteAddr
+		server.Handle(rr, req)
+		test.Status(t, rr, status)
+	}
+
+	// Reading is still allowed
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/some-file", nil)
+	req.RemoteAddr = "192.168.1.1:123"
+	server.Handle(rr, req)
+	test.Response(t, rr, http.StatusOK, "this is a thing")
+}
+
+func TestServer_AccessDeniedForReadBehindTrustedProxy(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.TrustedProxies, _ = util.ParseIPNets("127.0.0.1 10.0.0.1")
+	conf.DenyRead, _ = util.ParseIPNets("1.2.3.4")
+	server := newTestServer(t, conf)
+
+	// Client address is taken from X-Forwarded-For, skipping trusted proxies
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/info", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "5.6.7.8, 1.2.3.4, 10.0.0.1")
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusForbidden)
+
+	// X-Real-IP is used if X-Forwarded-For is not set
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/info", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	req.Header.Set("X-Real-IP", "5.6.7.8")
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+
+	// Headers from untrusted clients are ignored
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/info", nil)
+	req.RemoteAddr = "1.2.3.4:1234"
+	req.Header.Set("X-Forwarded-For", "5.6.7.8")
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusForbidden)
+}
+
+func TestServer_LimitBehindTrustedProxy(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.TrustedProxies, _ = util.ParseIPNets("127.0.0.1")
+	conf.LimitPUTBurst = 1
+	server := newTestServer(t, conf)
+
+	for i, forwardedFor := range []string{"1.1.1.1", "2.2.2.2"} {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", fmt.Sprintf("/file%d", i), strings.NewReader("this is a thing"))
+		req.RemoteAddr = "127.0.0.1:1234"
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		server.Handle(rr, req)
+		test.Status(t, rr, http.StatusCreated)
+	}
+}
+
+func TestServer_HandleWebRootNoRedirectBehindTrustedProxy(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.ListenHTTP = []string{":9876"}
+	conf.TrustedProxies, _ = util.ParseIPNets("127.0.0.1")
+	server := newTestServer(t, conf)
+
+	// Proxy terminated TLS, so the request must not be redirected
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	req.Host = "localhost:9876"
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", "pcopy.example.com")
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+
+	// Plain HTTP request to the proxy is redirected to the proxy's host and default port
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	req.Host = "localhost:9876"
+	req.Header.Set("Forwarded", `for=1.2.3.4;proto=http;host="pcopy.example.com", for=127.0.0.1;proto=http`)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusFound)
+	test.StrEquals(t, "https://pcopy.example.com/", rr.Header().Get("Location"))
+
+	// Headers from untrusted clients are ignored
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "1.2.3.4:1234"
+	req.Host = "localhost"
+	req.Header.Set("X-Forwarded-Proto", "https")
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusFound)
+	test.StrEquals(t, "https://localhost:12345/", rr.Header().Get("Location"))
+}
+
+func TestServer_HandleWebRootRedirectHTTPSDisabled(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.ListenHTTP = []string{":9876"}
+	conf.RedirectHTTPS = false
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Host = "localhost"
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+}
+
+func TestServer_HandleClipboardPutURLFromRequestWithoutServerAddr(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.ServerAddr = ""
+	conf.TrustedProxies, _ = util.ParseIPNets("127.0.0.1")
+	server := newTestServer(t, conf)
+
+	// Direct request, e.g. on the LAN
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/file1", strings.NewReader("this is a thing"))
+	req.RemoteAddr = "192.168.1.2:1234"
+	req.Host = "192.168.1.1:2586"
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	test.StrEquals(t, "http://192.168.1.1:2586/file1", rr.Header().Get("X-URL"))
+
+	// Request via reverse proxy
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/file2", strings.NewReader("this is a thing"))
+	req.RemoteAddr = "127.0.0.1:1234"
+	req.Host = "127.0.0.1:2586"
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", "pcopy.example.com")
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	test.StrEquals(t, "https://pcopy.example.com/file2", rr.Header().Get("X-URL"))
+}
+
+func TestServer_AuditLogUploadDownloadAndAuthFailure(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.Key = crypto.DeriveKey([]byte("some password"), []byte("some salt"))
+	conf.AuditLogFile = filepath.Join(t.TempDir(), "audit.log")
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/some-file", strings.NewReader("this is a thing"))
+	req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("x:some password")))
+	req.Header.Set("User-Agent", "pcopy-test")
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/some-file", nil)
+	req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("x:some password")))
+	server.Handle(rr, req)
+	test.Response(t, rr, http.StatusOK, "this is a thing")
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/some-file", nil)
+	req.RemoteAddr = "1.2.3.4:1234"
+	req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("x:wrong password")))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusUnauthorized)
+
+	events := readTestEvents(t, conf.AuditLogFile)
+	test.Int64Equals(t, 3, int64(len(events)))
+	test.StrEquals(t, EventUpload, events[0].Action)
+	test.StrEquals(t, "some-file", events[0].ID)
+	test.Int64Equals(t, 15, events[0].Size)
+	test.Int64Equals(t, http.StatusCreated, int64(events[0].Status))
+	test.StrEquals(t, "pcopy-test", events[0].UserAgent)
+	test.StrEquals(t, EventDownload, events[1].Action)
+	test.Int64Equals(t, 15, events[1].Size)
+	test.StrEquals(t, EventAuthFailure, events[2].Action)
+	test.StrEquals(t, "some-file", events[2].ID)
+	test.StrEquals(t, "1.2.3.4:1234", events[2].RemoteAddr)
+}
+
+func TestServer_AuthLockoutAfterFailedAttempts(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.Key = crypto.DeriveKey([]byte("some password"), []byte("some salt"))
+	conf.AuthLockoutThreshold = 2
+	conf.AuthLockoutDuration = time.Minute
+	conf.AuthLockoutMaxDuration = time.Hour
+	server := newTestServer(t, conf)
+
+	for i := 0; i < 2; i++ {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/verify", nil)
+		req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("x:incorrect password")))
+		server.Handle(rr, req)
+		test.Status(t, rr, http.StatusUnauthorized)
+	}
+
+	// Locked out, even with the correct password
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/verify", nil)
+	req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("x:some password")))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusTooManyRequests)
+	test.StrEquals(t, "60", rr.Header().Get("Retry-After"))
+
+	// Other IPs are not affected
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/verify", nil)
+	req.RemoteAddr = "1.2.3.4:1234"
+	req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("x:some password")))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+}
+
+func TestServer_AuthLockoutFileSecretGuessing(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.Key = &crypto.Key{Salt: []byte("some salt"), Bytes: []byte("16 bytes exactly")}
+	conf.AuthLockoutThreshold = 3
+	server := newTestServer(t, conf)
+
+	file := filepath.Join(conf.ClipboardDir, "guess-me")
+	metafile := filepath.Join(conf.ClipboardDir, "guess-me:meta")
+	ioutil.WriteFile(file, []byte("secret content"), 0700)
+	ioutil.WriteFile(metafile, []byte(`{"secret":"abc"}`), 0700)
+
+	// Guessing from different IPs still locks the file
+	for i := 0; i < 3; i++ {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/guess-me?a=wrong"+strconv.Itoa(i), nil)
+		req.RemoteAddr = fmt.Sprintf("1.2.3.%d:1234", i)
+		server.Handle(rr, req)
+		test.Status(t, rr, http.StatusUnauthorized)
+	}
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/guess-me?a=wrong", nil)
+	req.RemoteAddr = "5.6.7.8:1234"
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusTooManyRequests)
+	if rr.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected Retry-After header, got none")
+	}
+
+	// Even the correct secret is refused while the file is locked, but the key is not
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/guess-me?a=abc", nil)
+	req.RemoteAddr = "5.6.7.9:1234"
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusTooManyRequests)
+	if rr.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected Retry-After header, got none")
+	}
+
+	hmac, _ := crypto.GenerateAuthHMAC(conf.Key.Bytes, "GET", "/guess-me", time.Minute)
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/guess-me", nil)
+	req.RemoteAddr = "5.6.7.9:1234"
+	req.Header.Set("Authorization", hmac)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+}
+
+func TestServer_AuthorizeClientCertSuccess(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	caCert, caKey := newTestCA(t)
+	conf.ClientCAFile = writeTestCert(t, caCert)
+	conf.ClientCertAllow = []string{"*.fleet.example.com"}
+	server := newTestServer(t, conf)
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{newTestClientCert(t, caCert, caKey, "host1.fleet.example.com")}}
+	if err := server.authorize(req); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServer_AuthorizeClientCertFailureNotAllowed(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	caCert, caKey := newTestCA(t)
+	conf.ClientCAFile = writeTestCert(t, caCert)
+	conf.ClientCertAllow = []string{"*.fleet.example.com"}
+	server := newTestServer(t, conf)
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{newTestClientCert(t, caCert, caKey, "laptop.example.com")}}
+	if err := server.authorize(req); err != ErrHTTPUnauthorized {
+		t.Fatalf("expected invalid auth, got %#v", err)
+	}
+}
+
+func TestServer_AuthorizeClientCertFailureWrongCAWithKeyFallback(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.Key = crypto.DeriveKey([]byte("some password"), []byte("some salt"))
+	caCert, _ := newTestCA(t)
+	otherCACert, otherCAKey := newTestCA(t)
+	conf.ClientCAFile = writeTestCert(t, caCert)
+	server := newTestServer(t, conf)
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{newTestClientCert(t, otherCACert, otherCAKey, "host1")}}
+	if err := server.authorize(req); err != ErrHTTPUnauthorized {
+		t.Fatalf("expected invalid auth, got %#v", err)
+	}
+
+	req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("x:some password")))
+	if err := server.authorize(req); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestServer_ExpireSuccess(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
 	conf.FileExpireAfterDefault = time.Second
@@ -812,6 +1435,52 @@ func TestServer_StartStopManager(t *testing.T) {
 	test.StrEquals(t, "testfile2", cf.ID)
 }
 
+func newTestCA(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(rand.Int63()),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(cryptorand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+func newTestClientCert(t *testing.T, caCert *x509.Certificate, caKey *ecdsa.PrivateKey, hostname string) *x509.Certificate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(rand.Int63()),
+		Subject:      pkix.Name{CommonName: hostname},
+		DNSNames:     []string{hostname},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(cryptorand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+func writeTestCert(t *testing.T, cert *x509.Certificate) string {
+	filename := filepath.Join(t.TempDir(), "cert.crt")
+	pemCert, _ := crypto.EncodeCert(cert)
+	if err := ioutil.WriteFile(filename, pemCert, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
 func newTestServer(t *testing.T, config *config.Config) *Server {
 	server, err := New(config)
 	if err != nil {
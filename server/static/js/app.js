@@ -40,6 +40,8 @@ let infoUploadHeaderActive = document.getElementById("info-upload-header-active"
 let infoUploadHeaderFinished = document.getElementById("info-upload-header-finished")
 let infoUploadTitleActive = document.getElementById("info-upload-title-active")
 
+let infoSlotHeaderFinished = document.getElementById("info-slot-header-finished")
+
 let infoStreamHeaderActive = document.getElementById("info-stream-header-active")
 let infoStreamHeaderFinished = document.getElementById("info-stream-header-finished")
 let infoStreamHeaderInterrupted = document.getElementById("info-stream-header-interrupted")
@@ -96,7 +98,7 @@ function login(e) {
     });
 
     let method = 'GET'
-    let path = '/verify'
+    let path = config.BasePath + '/verify'
     let url = location.protocol + '//' + location.host + path
 
     let xhr = new XMLHttpRequest()
@@ -258,6 +260,20 @@ function changeClientSideEnabled(enabled) {
     }
 }
 
+/* Upload slot: a link created via 'pcopy request' allows uploading one file without logging in */
+
+if (config.UploadSlotID) {
+    headerFileId.value = config.UploadSlotID
+    headerFileId.disabled = true
+    headerRandomFileId.checked = false
+    headerRandomFileId.disabled = true
+    headerStream.checked = false
+    headerStream.disabled = true
+    headerClientSide.checked = false
+    headerClientSide.disabled = true
+    headerTTL.disabled = true
+}
+
 function handleHashChange() {
     let base64 = location.hash.substr(1);
     if (base64.length > 0) {
@@ -271,7 +287,7 @@ function handleHashChange() {
 }
 
 function decompressClientSide(base64) {
-    const lzma = new LZMA("static/vendor/lzma_worker.js");
+    const lzma = new LZMA(config.BasePath + "/static/vendor/lzma_worker.js");
     const req = new XMLHttpRequest();
     req.open('GET', 'data:application/octet;base64,' + base64);
     req.responseType = 'arraybuffer';
@@ -379,7 +395,7 @@ async function save() {
 }
 
 async function saveClientSide() {
-    const lzma = new LZMA("static/vendor/lzma_worker.js");
+    const lzma = new LZMA(config.BasePath + "/static/vendor/lzma_worker.js");
     let body = text.value
 
     progressStart()
@@ -424,10 +440,14 @@ async function saveServerSide() {
             return progressFailed(e.response.status)
         }
     }
+    let path = `/${file}`
+    if (config.UploadSlotID) {
+        path += `?a=${encodeURIComponent(config.UploadSlotSecret)}`
+    }
     let body = text.value
 
     progressStart()
-    req('PUT', `/${file}`, body, headers)
+    req('PUT', path, body, headers)
         .then(response => {
             if (response.status === 201 || response.status === 206) {
                 progressFinish(
@@ -569,6 +589,10 @@ function progressFinish(code, file, url, curl, ttl, expires, nameHint) {
         updateLinkFields(file, url, curl, ttl, expires, nameHint)
         infoLinks.classList.remove('hidden')
         infoClientSideHeaderFinished.classList.remove('hidden')
+    } else if (config.UploadSlotID) {
+        // The uploaded file can only be read with the clipboard key, so there are no links to show
+        infoLinks.classList.add('hidden')
+        infoSlotHeaderFinished.classList.remove('hidden')
     } else if (streamEnabled()) {
         infoLinks.classList.add('hidden')
         if (code === 206) {
@@ -610,9 +634,9 @@ function progressHideHeaders() {
 async function req(method, path, body, headers) {
     const key = loadKey()
     if (key) {
-        headers['Authorization'] = generateAuthHMAC(key, method, path)
+        headers['Authorization'] = generateAuthHMAC(key, method, config.BasePath + path)
     }
-    return await fetch(path, {method: method, headers: headers, body: body})
+    return await fetch(config.BasePath + path, {method: method, headers: headers, body: body})
 }
 
 async function reserveAndUpdateLinkFields(file, nameHint) {
@@ -647,6 +671,9 @@ async function uploadFile(file) {
         // See https://gist.github.com/binwiederhier/627f146d1959799be207ad8c17a8f345
         progressFailed(413)
         return
+    } else if (config.UploadSlotMaxSize > 0 && file.size > config.UploadSlotMaxSize) {
+        progressFailed(413)
+        return
     }
 
     let fileId = getFileId()
@@ -660,8 +687,11 @@ async function uploadFile(file) {
     let streaming = streamEnabled()
     let key = loadKey()
     let method = 'PUT'
-    let path = '/' + fileId
+    let path = config.BasePath + '/' + fileId
     let url = location.protocol + '//' + location.host + path
+    if (config.UploadSlotID) {
+        url = prependQueryParam(url, 'a', config.UploadSlotSecret)
+    }
     let ttl = headerTTL.value
 
     progressStart()
@@ -798,7 +828,7 @@ infoCommandLineCopy.addEventListener('mouseout', function() {
 
 /* Show/hide password area */
 
-let loggedIn = !config.KeySalt || loadKey()
+let loggedIn = !config.KeySalt || loadKey() || config.UploadSlotID
 if (loggedIn) {
     showMainArea()
 } else {
@@ -854,7 +884,9 @@ function clearKey() {
 }
 
 function getFileId() {
-    if (randomFileNameEnabled()) {
+    if (config.UploadSlotID) {
+        return config.UploadSlotID
+    } else if (randomFileNameEnabled()) {
         return ""
     } else if (headerFileId.value) {
         return headerFileId.value
@@ -866,11 +898,15 @@ function getFileId() {
 }
 
 function storeRandomFileIdEnabled(randomFileId) {
-    localStorage.setItem('randomName', randomFileId)
+    if (!config.UploadSlotID) {
+        localStorage.setItem('randomName', randomFileId)
+    }
 }
 
 function randomFileNameEnabled() {
-    if (localStorage.getItem('randomName') !== null) {
+    if (config.UploadSlotID) {
+        return false
+    } else if (localStorage.getItem('randomName') !== null) {
         return localStorage.getItem('randomName') === 'true'
     } else {
         return true
@@ -878,11 +914,15 @@ function randomFileNameEnabled() {
 }
 
 function storeStreamEnabled(streamEnabled) {
-    localStorage.setItem('streamEnabled', streamEnabled)
+    if (!config.UploadSlotID) {
+        localStorage.setItem('streamEnabled', streamEnabled)
+    }
 }
 
 function streamEnabled() {
-    if (localStorage.getItem('streamEnabled') !== null) {
+    if (config.UploadSlotID) {
+        return false
+    } else if (localStorage.getItem('streamEnabled') !== null) {
         return localStorage.getItem('streamEnabled') === 'true'
     } else {
         return false
@@ -890,11 +930,15 @@ function streamEnabled() {
 }
 
 function storeClientSideEnabled(clientSideEnabled) {
-    localStorage.setItem('clientSideEnabled', clientSideEnabled)
+    if (!config.UploadSlotID) {
+        localStorage.setItem('clientSideEnabled', clientSideEnabled)
+    }
 }
 
 function clientSideEnabled() {
-    if (localStorage.getItem('clientSideEnabled') !== null) {
+    if (config.UploadSlotID) {
+        return false
+    } else if (localStorage.getItem('clientSideEnabled') !== null) {
         return localStorage.getItem('clientSideEnabled') === 'true'
     } else {
         return false
@@ -4,10 +4,11 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"heckel.io/pcopy/log"
 	"heckel.io/pcopy/util"
 	"io"
-	"log"
 	"net"
 	"net/http"
 	"strings"
@@ -26,8 +27,12 @@ type tcpForwarder struct {
 	Addr            string
 	UpstreamAddr    string
 	UpstreamHandler http.HandlerFunc
+	TrustedProxies  []*net.IPNet // Connections from these addresses may send a PROXY protocol (v1) header
 	ReadTimeout     time.Duration
-	cancel          context.CancelFunc
+	listeners       []net.Listener
+	conns           map[net.Conn]bool
+	closed          bool
+	wg              sync.WaitGroup
 	mu              sync.Mutex
 }
 
@@ -37,91 +42,197 @@ func newTCPForwarder(addr string, upstreamAddr string, upstreamHandler http.Hand
 		UpstreamAddr:    upstreamAddr,
 		UpstreamHandler: upstreamHandler,
 		ReadTimeout:     defaultReadTimeout,
+		conns:           make(map[net.Conn]bool),
 	}
 }
 
-// listenAndServe listens on the configured TCP address and delegates incoming connections to handleConn
-// in a new goroutine. This function does not return unless there is an error or until shutdown is called.
+// listenAndServe listens on the configured address and delegates incoming connections to handleConn
+// in a new goroutine. This function does not return unless there is an error or until shutdown or drain is called.
 func (s *tcpForwarder) listenAndServe() error {
-	listener, err := net.Listen("tcp", s.Addr)
-	if err != nil {
+	if err := s.listen(); err != nil {
 		return err
 	}
-	defer listener.Close()
+	return s.serve()
+}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	go func() {
-		for {
-			conn, err := listener.Accept()
-			if err != nil {
-				log.Printf("error accepting connection on %s: %s", s.Addr, err.Error())
-				continue
-			}
-			go func(conn net.Conn) {
-				defer conn.Close()
-				if err := s.handleConn(conn); err != nil {
-					io.WriteString(conn, fmt.Sprintf("%s\n", err.Error())) // might fail
-					log.Printf("%s - tcp forward error: %s", conn.RemoteAddr().String(), err.Error())
-				}
-			}(conn)
-		}
-	}()
+// listen binds the configured address (see listen), without accepting connections yet (see serve)
+func (s *tcpForwarder) listen() error {
+	listeners, err := listen(s.Addr)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners = listeners
+	if s.closed {
+		s.closeListener()
+	}
+	return nil
+}
 
+// serve accepts connections on the listeners created by listen, until shutdown or drain is called
+func (s *tcpForwarder) serve() error {
 	s.mu.Lock()
-	s.cancel = cancel
+	listeners := s.listeners
 	s.mu.Unlock()
-	<-ctx.Done()
+	var wg sync.WaitGroup
+	for _, listener := range listeners {
+		wg.Add(1)
+		go func(listener net.Listener) {
+			defer wg.Done()
+			s.accept(listener)
+		}(listener)
+	}
+	wg.Wait()
 	return nil
 }
 
-// shutdown cancels the listenAndServe function gracefully
+func (s *tcpForwarder) accept(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			log.With("error", err).Error("error accepting connection on %s", s.Addr)
+			continue
+		}
+		if !s.addConn(conn) {
+			continue // Connection accepted while closing the listener
+		}
+		go func(conn net.Conn) {
+			defer s.removeConn(conn)
+			requestID := randomRequestID()
+			if err := s.handleConn(conn, requestID); err != nil {
+				io.WriteString(conn, fmt.Sprintf("%s\n", err.Error())) // might fail
+				log.With("request_id", requestID, "remote_addr", conn.RemoteAddr().String(), "error", err).Warn("tcp forward error")
+			}
+		}(conn)
+	}
+}
+
+// shutdown immediately stops listening and closes all active connections
 func (s *tcpForwarder) shutdown() {
 	s.mu.Lock()
-	if s.cancel != nil {
-		s.cancel()
+	defer s.mu.Unlock()
+	s.closeListener()
+	for conn := range s.conns {
+		conn.Close()
 	}
+}
+
+// drain stops listening, and waits for active connections to finish until the context is done. If the
+// context is done before all connections are finished, the remaining connections are closed and the
+// context's error is returned.
+func (s *tcpForwarder) drain(ctx context.Context) error {
+	s.mu.Lock()
+	s.closeListener()
 	s.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.shutdown()
+		return ctx.Err()
+	}
+}
+
+// closeListener closes the listeners, which makes listenAndServe return. It must be called with s.mu held.
+func (s *tcpForwarder) closeListener() {
+	s.closed = true
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+}
+
+// setUpstream replaces the upstream and the trusted proxies of a running forwarder, e.g. after a config reload
+func (s *tcpForwarder) setUpstream(upstreamAddr string, upstreamHandler http.HandlerFunc, trustedProxies []*net.IPNet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.UpstreamAddr, s.UpstreamHandler, s.TrustedProxies = upstreamAddr, upstreamHandler, trustedProxies
+}
+
+func (s *tcpForwarder) upstream() (string, http.HandlerFunc, []*net.IPNet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.UpstreamAddr, s.UpstreamHandler, s.TrustedProxies
+}
+
+func (s *tcpForwarder) addConn(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		conn.Close()
+		return false
+	}
+	s.conns[conn] = true
+	s.wg.Add(1)
+	return true
+}
+
+func (s *tcpForwarder) removeConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conn.Close()
+	delete(s.conns, conn)
+	s.wg.Done()
 }
 
 // handleConn reads from the TCP socket and forwards it to the HTTP handler. This method does NOT close the underlying
 // connection. This is done in listenAndServe to ensure that error messages (if any) can be sent to the client.
-func (s *tcpForwarder) handleConn(conn net.Conn) error {
+// The request ID is passed upstream, so that log entries of the forwarder and the HTTP handler can be correlated.
+func (s *tcpForwarder) handleConn(conn net.Conn, requestID string) error {
 	// Peak connection to detect "pcopy:..." prefix and extract path
 	connReadCloser := io.NopCloser(&connTimeoutReader{conn: conn, timeout: s.ReadTimeout}) // Closing happens in listenAndServe!
 	peaked, err := util.Peak(connReadCloser, bufferSizeBytes)
 	if err != nil {
 		return fmt.Errorf("cannot peak: %w", err)
-	} else if strings.TrimSpace(string(peaked.PeakedBytes)) == "help" || strings.TrimSpace(string(peaked.PeakedBytes)) == "" {
-		return s.handleHelp(conn)
 	}
-	path, offset := extractPath(peaked.PeakedBytes)
+	upstreamAddr, upstreamHandler, trustedProxies := s.upstream()
+	remoteAddr, peakedBytes := conn.RemoteAddr().String(), peaked.PeakedBytes
+	if util.IPNetsContain(trustedProxies, util.RemoteIP(remoteAddr)) {
+		if clientAddr, offset := extractProxyHeader(peakedBytes); clientAddr != "" {
+			remoteAddr, peakedBytes = clientAddr, peakedBytes[offset:]
+		}
+	}
+	if strings.TrimSpace(string(peakedBytes)) == "help" || strings.TrimSpace(string(peakedBytes)) == "" {
+		return s.handleHelp(conn, remoteAddr, requestID)
+	}
+	path, offset := extractPath(peakedBytes)
 
 	// Forward upstream HTTP request to UpstreamHandler and response to downstream conn
-	rawURL := fmt.Sprintf("%s/%s", s.UpstreamAddr, path)
-	body := io.MultiReader(bytes.NewReader(peaked.PeakedBytes[offset:]), connReadCloser)
+	rawURL := fmt.Sprintf("%s/%s", upstreamAddr, path)
+	body := io.MultiReader(bytes.NewReader(peakedBytes[offset:]), connReadCloser)
 	request, err := http.NewRequest(http.MethodPut, rawURL, body)
 	if err != nil {
 		return fmt.Errorf("cannot create forwarding request: %w", err)
 	}
 	request.RequestURI = fmt.Sprintf("/%s", path)
-	request.RemoteAddr = conn.RemoteAddr().String()
+	request.RemoteAddr = remoteAddr
 	request.Header.Set(HeaderNoRedirect, "1")
-	s.UpstreamHandler.ServeHTTP(newTCPResponseWriter(conn), request)
+	request.Header.Set(HeaderRequestID, requestID)
+	upstreamHandler.ServeHTTP(newTCPResponseWriter(conn), request)
 	return nil
 }
 
 // handleHelp writes the netcat help page to the connection and exits; it does this
 // by forwarding the request to the upstream /nc page.
-func (s *tcpForwarder) handleHelp(conn net.Conn) error {
-	rawURL := fmt.Sprintf("%s/nc", s.UpstreamAddr)
+func (s *tcpForwarder) handleHelp(conn net.Conn, remoteAddr string, requestID string) error {
+	upstreamAddr, upstreamHandler, _ := s.upstream()
+	rawURL := fmt.Sprintf("%s/nc", upstreamAddr)
 	request, err := http.NewRequest(http.MethodGet, rawURL, nil)
 	if err != nil {
 		return fmt.Errorf("cannot create forwarding request: %w", err)
 	}
 	request.RequestURI = "/nc"
-	request.RemoteAddr = conn.RemoteAddr().String()
+	request.RemoteAddr = remoteAddr
 	request.Header.Set(HeaderNoRedirect, "1")
-	s.UpstreamHandler.ServeHTTP(newTCPResponseWriter(conn), request)
+	request.Header.Set(HeaderRequestID, requestID)
+	upstreamHandler.ServeHTTP(newTCPResponseWriter(conn), request)
 	return nil
 }
 
@@ -137,6 +248,22 @@ func extractPath(peaked []byte) (string, int) {
 	return strings.TrimSuffix(strings.TrimPrefix(s, "pcopy:"), "\n"), len(s)
 }
 
+// extractProxyHeader reads a PROXY protocol (v1) header from the peaked bytes and returns the client address
+// and the offset of the actual payload. An input of "PROXY TCP4 1.2.3.4 5.6.7.8 1234 9999\r\npayload" will yield
+// ("1.2.3.4:1234", 38). If there is no valid PROXY header, ("", 0) will be returned.
+func extractProxyHeader(peaked []byte) (string, int) {
+	reader := bufio.NewReader(bytes.NewReader(peaked))
+	s, err := reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(s, "PROXY ") || !strings.HasSuffix(s, "\r\n") {
+		return "", 0
+	}
+	fields := strings.Fields(s)
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") || net.ParseIP(fields[2]) == nil {
+		return "", 0
+	}
+	return net.JoinHostPort(fields[2], fields[4]), len(s)
+}
+
 // connTimeoutReader implements an io.Reader that will call SetReadDeadline before
 // every Read and will return io.EOF if a Read times out.
 type connTimeoutReader struct {
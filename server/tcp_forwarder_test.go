@@ -201,9 +201,9 @@ func TestTCPForwarder_WithTimeoutWithoutNParamContentCutoff(t *testing.T) {
 func TestTCPForwarder_Stream(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
 	conf.ServerAddr = "localhost:11443"
-	conf.ListenHTTP = ":11080"
-	conf.ListenHTTPS = ":11443"
-	conf.ListenTCP = ":19999"
+	conf.ListenHTTP = []string{":11080"}
+	conf.ListenHTTPS = []string{":11443"}
+	conf.ListenTCP = []string{":19999"}
 	serverRouter := startTestServerRouter(t, conf)
 	test.WaitForPortUp(t, "11443")
 	test.WaitForPortUp(t, "11080")
@@ -227,3 +227,21 @@ func TestTCPForwarder_Stream(t *testing.T) {
 	test.WaitForPortDown(t, "11080")
 	test.WaitForPortDown(t, "19999")
 }
+
+func TestTCPForwarder_ExtractProxyHeader(t *testing.T) {
+	clientAddr, offset := extractProxyHeader([]byte("PROXY TCP4 1.2.3.4 5.6.7.8 1234 9999\r\npcopy:abc\npayload"))
+	test.StrEquals(t, "1.2.3.4:1234", clientAddr)
+	test.Int64Equals(t, 38, int64(offset))
+
+	clientAddr, offset = extractProxyHeader([]byte("PROXY TCP6 ::1 ::2 1234 9999\r\npayload"))
+	test.StrEquals(t, "[::1]:1234", clientAddr)
+	test.Int64Equals(t, 30, int64(offset))
+
+	clientAddr, offset = extractProxyHeader([]byte("PROXY UNKNOWN\r\npayload"))
+	test.StrEquals(t, "", clientAddr)
+	test.Int64Equals(t, 0, int64(offset))
+
+	clientAddr, offset = extractProxyHeader([]byte("just a payload"))
+	test.StrEquals(t, "", clientAddr)
+	test.Int64Equals(t, 0, int64(offset))
+}
@@ -5,12 +5,15 @@ import (
 	"heckel.io/pcopy/config"
 	"heckel.io/pcopy/crypto"
 	"heckel.io/pcopy/util"
+	"net/http"
+	"net/url"
 	"strings"
 )
 
 const (
 	randomFileIDLength  = 10
 	randomFileIDCharset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	requestIDLength     = 16
 )
 
 // FileInfoInstructions generates instruction text to download links
@@ -23,6 +26,17 @@ func FileInfoInstructions(info *File) string {
 	if info.TTL == 0 {
 		validFor = "valid forever, does not expire"
 	}
+	if info.Slot {
+		return fmt.Sprintf(`# Upload link (%s, can be used once)
+%s
+
+# Upload via pcopy
+pcp '%s' < FILE
+
+# Upload via curl
+%s
+`, validFor, info.URL, info.URL, info.Curl)
+	}
 	return fmt.Sprintf(`# Direct link (%s)
 %s
 
@@ -34,9 +48,23 @@ ppaste %s
 `, validFor, info.URL, id, info.Curl)
 }
 
-// generateURL generates a URL for the given path. If a secret is given, it is appended as the auth param.
-func generateURL(conf *config.Config, path string, secret string) (string, error) {
-	server := strings.ReplaceAll(config.ExpandServerAddr(conf.ServerAddr), ":443", "")
+// SecretsWarning generates a warning text if secrets were detected in the file (see config.SecretDetection), or
+// an empty string otherwise
+func SecretsWarning(info *File) string {
+	if len(info.Secrets) == 0 {
+		return ""
+	}
+	warning := fmt.Sprintf("# Warning: this looks like it contains secrets (%s)", strings.Join(info.Secrets, ", "))
+	if info.Burn {
+		warning += ", so it will be deleted after it was pasted once"
+	}
+	return warning + "\n\n"
+}
+
+// generateURL generates a URL for the given path, relative to the given server URL (see serverURL and
+// Server.publicURL). If a secret is given, it is appended as the auth param.
+func generateURL(serverURL string, path string, secret string) (string, error) {
+	server := strings.ReplaceAll(serverURL, ":443", "")
 	url := fmt.Sprintf("%s%s", server, path)
 	if secret != "" {
 		url = fmt.Sprintf("%s?%s=%s", url, queryParamAuth, secret)
@@ -44,11 +72,64 @@ func generateURL(conf *config.Config, path string, secret string) (string, error
 	return url, nil
 }
 
-// generateCurlCommand creates a curl command to download the given path
+// serverURL returns the URL of the clipboard that is advertised to clients, including the BasePath, e.g.
+// https://example.com/work. If the ServerAddr already contains a path, the ServerAddr is returned as is.
+func serverURL(conf *config.Config) string {
+	serverURL := config.ExpandServerAddr(conf.ServerAddr)
+	if u, err := url.Parse(serverURL); err == nil && u.Path == "" {
+		return serverURL + conf.BasePath
+	}
+	return serverURL
+}
+
+// matchesBasePath returns true if the given request path is the base path, or if it is below the base path
+func matchesBasePath(path string, basePath string) bool {
+	return basePath == "" || path == basePath || strings.HasPrefix(path, basePath+"/")
+}
+
+// stripBasePath removes the base path from the request URL, so that the request can be routed like a
+// request to the root path, e.g. /work/abc becomes /abc, and /work becomes /
+func stripBasePath(r *http.Request, basePath string) {
+	if basePath == "" {
+		return
+	}
+	r.URL.Path = strings.TrimPrefix(r.URL.Path, basePath)
+	if r.URL.Path == "" {
+		r.URL.Path = "/"
+	}
+	if strings.HasPrefix(r.URL.RawPath, basePath) {
+		r.URL.RawPath = strings.TrimPrefix(r.URL.RawPath, basePath)
+	} else {
+		r.URL.RawPath = ""
+	}
+}
+
+// generateCurlCommand creates a curl command to download the given path. If the server certificate is
+// self-signed or was issued by a local CA, the public key of the server certificate is pinned.
 func generateCurlCommand(conf *config.Config, url string) (string, error) {
+	return fmt.Sprintf("curl %s '%s'", strings.Join(curlTLSArgs(conf), " "), url), nil
+}
+
+// generateCurlUploadCommand creates a curl command to upload a file to the given upload slot URL
+func generateCurlUploadCommand(conf *config.Config, url string) (string, error) {
+	return fmt.Sprintf("curl %s -T FILE '%s'", strings.Join(curlTLSArgs(conf), " "), url), nil
+}
+
+// curlTLSArgs returns the curl arguments to verify the server certificate, see generateCurlCommand
+//
+// The CA file cannot be passed to curl (--cacert), since the generated commands are run on other hosts,
+// so the server certificate itself is pinned if it was issued by a local CA.
+func curlTLSArgs(conf *config.Config) []string {
 	args := make([]string, 0)
 	if conf.CertFile == "" {
 		args = append(args, "-sSL")
+	} else if conf.CAFile != "" {
+		pin, err := readCurlPinnedServerPublicKey(conf.CertFile)
+		if err != nil {
+			args = append(args, "-sSLk")
+		} else {
+			args = append(args, "-sSLk", fmt.Sprintf("--pinnedpubkey %s", pin))
+		}
 	} else {
 		pin, err := crypto.ReadCurlPinnedPublicKeyFromFile(conf.CertFile)
 		if err != nil {
@@ -59,7 +140,21 @@ func generateCurlCommand(conf *config.Config, url string) (string, error) {
 			args = append(args, "-sSL")
 		}
 	}
-	return fmt.Sprintf("curl %s '%s'", strings.Join(args, " "), url), nil
+	return args
+}
+
+// readCurlPinnedServerPublicKey reads the server certificate (the first certificate in the file) and returns
+// the hash of its public key in the format of curl's --pinnedpubkey option
+func readCurlPinnedServerPublicKey(filename string) (string, error) {
+	cert, err := crypto.LoadCertFromFile(filename)
+	if err != nil {
+		return "", err
+	}
+	hash, err := crypto.CalculatePublicKeyHash(cert)
+	if err != nil {
+		return "", err
+	}
+	return crypto.EncodeCurlPinnedPublicKeyHash(hash), nil
 }
 
 // randomFileID generates a random file name
@@ -67,6 +162,11 @@ func randomFileID() string {
 	return util.RandomStringWithCharset(randomFileIDLength, randomFileIDCharset)
 }
 
+// randomRequestID generates a random request ID, see HeaderRequestID
+func randomRequestID() string {
+	return util.RandomStringWithCharset(requestIDLength, randomFileIDCharset)
+}
+
 // randomSecret generates a random secret
 func randomSecret() string {
 	return randomFileID()
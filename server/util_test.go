@@ -4,6 +4,8 @@ import (
 	"heckel.io/pcopy/config"
 	"heckel.io/pcopy/crypto"
 	"heckel.io/pcopy/test"
+	"io/ioutil"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -12,7 +14,7 @@ func TestGenerateURLUnprotected(t *testing.T) {
 	conf := config.New()
 	conf.ServerAddr = "some-host.com"
 
-	url, err := generateURL(conf, "/some-path", "secreT")
+	url, err := generateURL(serverURL(conf), "/some-path", "secreT")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -24,7 +26,7 @@ func TestGenerateURLProtected(t *testing.T) {
 	conf.ServerAddr = "some-host.com"
 	conf.Key = &crypto.Key{Salt: []byte("some salt"), Bytes: []byte("16 bytes exactly")}
 
-	url, err := generateURL(conf, "/some-path", "my-secret")
+	url, err := generateURL(serverURL(conf), "/some-path", "my-secret")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -37,7 +39,7 @@ func TestConfig_GenerateURL443(t *testing.T) {
 	conf := config.New()
 	conf.ServerAddr = "some-host.com:443"
 
-	url, err := generateURL(conf, "/some-path", "some-secret")
+	url, err := generateURL(serverURL(conf), "/some-path", "some-secret")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -45,3 +47,51 @@ func TestConfig_GenerateURL443(t *testing.T) {
 		t.Fatalf("expected URL mismatched, got %s", url)
 	}
 }
+
+func TestGenerateURLWithBasePath(t *testing.T) {
+	conf := config.New()
+	conf.ServerAddr = "some-host.com:443"
+	conf.BasePath = "/work"
+
+	url, err := generateURL(serverURL(conf), "/some-path", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, "https://some-host.com/work/some-path", url)
+
+	conf.ServerAddr = "https://proxy.example.com/pcopy/work" // Path in ServerAddr wins
+	url, err = generateURL(serverURL(conf), "/some-path", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, "https://proxy.example.com/pcopy/work/some-path", url)
+}
+
+func TestGenerateCurlCommandWithCA(t *testing.T) {
+	dir := t.TempDir()
+	caKeyPEM, caCertPEM, err := crypto.GenerateCA("pcopy CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := config.New()
+	conf.CAFile = filepath.Join(dir, "server.ca.crt")
+	conf.CAKeyFile = filepath.Join(dir, "server.ca.key")
+	conf.CertFile = filepath.Join(dir, "server.crt")
+	ioutil.WriteFile(conf.CAFile, []byte(caCertPEM), 0600)
+	ioutil.WriteFile(conf.CAKeyFile, []byte(caKeyPEM), 0600)
+	caKey, _ := crypto.LoadPrivateKeyFromFile(conf.CAKeyFile)
+	caCert, _ := crypto.LoadCertFromFile(conf.CAFile)
+	_, certPEM, err := crypto.GenerateKeyAndCertWithCA(caKey, caCert, "some-host.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(conf.CertFile, []byte(certPEM), 0600)
+
+	cert, _ := crypto.LoadCertFromFile(conf.CertFile)
+	hash, _ := crypto.CalculatePublicKeyHash(cert)
+	curl, err := generateCurlCommand(conf, "https://some-host.com:2586/some-path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, "curl -sSLk --pinnedpubkey "+crypto.EncodeCurlPinnedPublicKeyHash(hash)+" 'https://some-host.com:2586/some-path'", curl)
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"heckel.io/pcopy/config"
+	"heckel.io/pcopy/log"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// HeaderWebhookEvent is the header that contains the event name in webhook requests, see config.Webhook
+	HeaderWebhookEvent = "X-Pcopy-Event"
+
+	// HeaderWebhookSignature is the header that contains the signature of the body in webhook requests, if the
+	// webhook has a secret. The format is "sha256=<hex-encoded HMAC-SHA256 of the body>".
+	HeaderWebhookSignature = "X-Pcopy-Signature"
+
+	webhookQueueSize    = 1000
+	webhookWorkers      = 2
+	webhookMaxAttempts  = 3
+	webhookRetryBackoff = 2 * time.Second
+	webhookTimeout      = 10 * time.Second
+)
+
+// WebhookEvent is the JSON payload that is POSTed to webhooks
+type WebhookEvent struct {
+	Event     string    `json:"event"`
+	Clipboard string    `json:"clipboard"`
+	ID        string    `json:"id"`
+	Size      int64     `json:"size"`
+	Time      time.Time `json:"time"`
+}
+
+// webhookDelivery is a single event that is queued to be sent to a webhook
+type webhookDelivery struct {
+	webhook *config.Webhook
+	event   string
+	body    []byte
+}
+
+// webhookNotifier sends clipboard events to the configured webhooks. Events are put in a bounded queue, and sent
+// by a fixed number of workers in the background, so that slow receivers never block requests. If the queue is
+// full, events are dropped. Failed deliveries are retried with a linear backoff.
+type webhookNotifier struct {
+	webhooks []*config.Webhook
+	client   *http.Client
+	queue    chan *webhookDelivery
+	backoff  time.Duration
+	logger   *log.Entry
+	closed   bool
+	mu       sync.Mutex
+}
+
+func newWebhookNotifier(webhooks []*config.Webhook, logger *log.Entry) *webhookNotifier {
+	n := &webhookNotifier{
+		webhooks: webhooks,
+		client:   &http.Client{Timeout: webhookTimeout},
+		queue:    make(chan *webhookDelivery, webhookQueueSize),
+		backoff:  webhookRetryBackoff,
+		logger:   logger,
+	}
+	for i := 0; i < webhookWorkers; i++ {
+		go n.work()
+	}
+	return n
+}
+
+// Notify queues the event for all webhooks that match it. It never blocks.
+func (n *webhookNotifier) Notify(event *WebhookEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		n.logger.With("error", err).Error("cannot encode webhook event")
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return
+	}
+	for _, webhook := range n.webhooks {
+		if !webhook.Matches(event.Event, event.ID) {
+			continue
+		}
+		select {
+		case n.queue <- &webhookDelivery{webhook: webhook, event: event.Event, body: body}:
+		default:
+			n.logger.With("webhook", webhook.URL, "event", event.Event, "id", event.ID).Warn("webhook queue full, dropping event")
+		}
+	}
+}
+
+// Close stops accepting new events. Events that are already queued are still sent in the background.
+func (n *webhookNotifier) Close() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.closed {
+		n.closed = true
+		close(n.queue)
+	}
+}
+
+func (n *webhookNotifier) work() {
+	for d := range n.queue {
+		var err error
+		for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+			if err = n.send(d); err == nil {
+				break
+			} else if attempt < webhookMaxAttempts {
+				time.Sleep(time.Duration(attempt) * n.backoff)
+			}
+		}
+		if err != nil {
+			n.logger.With("webhook", d.webhook.URL, "event", d.event, "error", err).Warn("cannot send webhook event, giving up after %d attempts", webhookMaxAttempts)
+		}
+	}
+}
+
+func (n *webhookNotifier) send(d *webhookDelivery) error {
+	req, err := http.NewRequest(http.MethodPost, d.webhook.URL, bytes.NewReader(d.body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "pcopy")
+	req.Header.Set(HeaderWebhookEvent, d.event)
+	if d.webhook.Secret != "" {
+		req.Header.Set(HeaderWebhookSignature, webhookSignature(d.webhook.Secret, d.body))
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024)) // Allow connection reuse
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// webhookSignature returns the value of the HeaderWebhookSignature header for the given body
+func webhookSignature(secret string, body []byte) string {
+	hash := hmac.New(sha256.New, []byte(secret))
+	hash.Write(body)
+	return "sha256=" + hex.EncodeToString(hash.Sum(nil))
+}
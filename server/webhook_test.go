@@ -0,0 +1,160 @@
+package server
+
+import (
+	"encoding/json"
+	"heckel.io/pcopy/config"
+	"heckel.io/pcopy/config/configtest"
+	"heckel.io/pcopy/log"
+	"heckel.io/pcopy/test"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type webhookTestRequest struct {
+	event     *WebhookEvent
+	header    string
+	signature string
+	body      []byte
+}
+
+func TestServer_WebhooksUploadDownloadExpire(t *testing.T) {
+	requests := make(chan *webhookTestRequest, 10)
+	receiver := newTestWebhookReceiver(t, requests, nil)
+	defer receiver.Close()
+
+	_, conf := configtest.NewTestConfig(t)
+	conf.Webhooks = []*config.Webhook{
+		{URL: receiver.URL + "/all", Secret: "s3cr3t"},
+		{URL: receiver.URL + "/uploads", Events: []string{config.WebhookEventUpload}, Prefix: "build-"},
+	}
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/build-123", strings.NewReader("build output"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	first, second := waitForWebhookRequest(t, requests), waitForWebhookRequest(t, requests)
+	if first.signature == "" {
+		first, second = second, first // Order is not guaranteed, only the "all" webhook has a secret
+	}
+	test.StrEquals(t, config.WebhookEventUpload, first.event.Event)
+	test.StrEquals(t, config.WebhookEventUpload, first.header)
+	test.StrEquals(t, "build-123", first.event.ID)
+	test.Int64Equals(t, 12, first.event.Size)
+	test.StrEquals(t, "https://localhost:12345", first.event.Clipboard)
+	test.StrEquals(t, webhookSignature("s3cr3t", first.body), first.signature)
+	test.StrEquals(t, "build-123", second.event.ID)
+	test.StrEquals(t, "", second.signature)
+
+	// Download only goes to the "all" webhook
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/build-123", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	download := waitForWebhookRequest(t, requests)
+	test.StrEquals(t, config.WebhookEventDownload, download.event.Event)
+	test.StrEquals(t, "build-123", download.event.ID)
+
+	// Upload without prefix only goes to the "all" webhook
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/other?t=1s", strings.NewReader("other"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	upload := waitForWebhookRequest(t, requests)
+	test.StrEquals(t, "other", upload.event.ID)
+
+	// Expire
+	time.Sleep(1100 * time.Millisecond)
+	server.updateStatsAndExpire()
+	expire := waitForWebhookRequest(t, requests)
+	test.StrEquals(t, config.WebhookEventExpire, expire.event.Event)
+	test.StrEquals(t, "other", expire.event.ID)
+
+	select {
+	case r := <-requests:
+		t.Fatalf("unexpected webhook request: %#v", r.event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWebhookNotifier_Retry(t *testing.T) {
+	requests := make(chan *webhookTestRequest, 10)
+	var attempts int32
+	receiver := newTestWebhookReceiver(t, requests, func() int {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	})
+	defer receiver.Close()
+
+	notifier := newWebhookNotifier([]*config.Webhook{{URL: receiver.URL}}, log.With())
+	notifier.backoff = 10 * time.Millisecond
+	defer notifier.Close()
+	notifier.Notify(&WebhookEvent{Event: config.WebhookEventUpload, ID: "retried"})
+
+	for i := 0; i < 3; i++ {
+		test.StrEquals(t, "retried", waitForWebhookRequest(t, requests).event.ID)
+	}
+	test.Int64Equals(t, 3, int64(atomic.LoadInt32(&attempts)))
+}
+
+func TestWebhookNotifier_SlowReceiverDoesNotBlock(t *testing.T) {
+	block := make(chan struct{})
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer receiver.Close()
+	defer close(block)
+
+	notifier := newWebhookNotifier([]*config.Webhook{{URL: receiver.URL}}, log.With())
+	notifier.backoff = time.Millisecond
+	defer notifier.Close()
+	start := time.Now()
+	for i := 0; i < webhookQueueSize*2; i++ {
+		notifier.Notify(&WebhookEvent{Event: config.WebhookEventUpload, ID: "file"})
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("expected notify to never block, but it took %s", time.Since(start))
+	}
+	test.Int64Equals(t, webhookQueueSize, int64(len(notifier.queue)))
+
+	// Events after close are ignored
+	notifier.Close()
+	notifier.Notify(&WebhookEvent{Event: config.WebhookEventUpload, ID: "file"})
+}
+
+func newTestWebhookReceiver(t *testing.T, requests chan *webhookTestRequest, status func() int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var event WebhookEvent
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Errorf("invalid webhook body: %s", err.Error())
+		}
+		requests <- &webhookTestRequest{
+			event:     &event,
+			header:    r.Header.Get(HeaderWebhookEvent),
+			signature: r.Header.Get(HeaderWebhookSignature),
+			body:      body,
+		}
+		if status != nil {
+			w.WriteHeader(status())
+		}
+	}))
+}
+
+func waitForWebhookRequest(t *testing.T, requests chan *webhookTestRequest) *webhookTestRequest {
+	select {
+	case r := <-requests:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for webhook request")
+	}
+	return nil
+}
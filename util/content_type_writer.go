@@ -1,6 +1,8 @@
 package util
 
 import (
+	"bytes"
+	"encoding/binary"
 	"mime"
 	"net/http"
 	"strings"
@@ -10,24 +12,53 @@ var contentTypeExtOverrides = map[string]string{
 	"text/plain": ".txt",
 }
 
+var (
+	elfSignature   = []byte("\x7fELF")
+	machOSignature = [][]byte{{0xfe, 0xed, 0xfa, 0xce}, {0xfe, 0xed, 0xfa, 0xcf}, {0xce, 0xfa, 0xed, 0xfe}, {0xcf, 0xfa, 0xed, 0xfe}}
+	peSignature    = []byte("PE\x00\x00")
+)
+
+// DetectContentType works like http.DetectContentType, but additionally detects executables (ELF, Mach-O
+// and Windows PE), which http.DetectContentType reports as "application/octet-stream".
+func DetectContentType(data []byte) string {
+	if bytes.HasPrefix(data, elfSignature) {
+		return "application/x-executable"
+	}
+	for _, signature := range machOSignature {
+		if bytes.HasPrefix(data, signature) {
+			return "application/x-mach-binary"
+		}
+	}
+	if bytes.HasPrefix(data, []byte("MZ")) && len(data) >= 0x40 {
+		// The DOS header ("MZ") is followed by the PE header, whose offset is stored at 0x3c
+		offset := int(binary.LittleEndian.Uint32(data[0x3c:]))
+		if offset > 0 && offset+len(peSignature) <= len(data) && bytes.Equal(data[offset:offset+len(peSignature)], peSignature) {
+			return "application/vnd.microsoft.portable-executable"
+		}
+	}
+	return http.DetectContentType(data)
+}
+
 // ContentTypeWriter is an implementation of io.Writer that will detect the content type and set the
 // Content-Type and (optionally) Content-Disposition headers accordingly.
 //
-// It will always set a Content-Type based on http.DetectContentType, but will never send the "text/html"
+// It will always set a Content-Type based on DetectContentType, but will never send the "text/html"
 // content type.
 //
-// If "download" is set, the Content-Disposition header will be set to "attachment", and will include a
-// filename based on what is passed into the constructor function.
+// If "download" is set, or if ForceDownload returns true for the detected content type, the Content-Disposition
+// header will be set to "attachment", and will include a filename based on what is passed into the constructor
+// function.
 type ContentTypeWriter struct {
-	w        http.ResponseWriter
-	filename string
-	download bool
-	sniffed  bool
+	ForceDownload func(contentType string) bool
+	w             http.ResponseWriter
+	filename      string
+	download      bool
+	sniffed       bool
 }
 
 // NewContentTypeWriter creates a new ContentTypeWriter
 func NewContentTypeWriter(w http.ResponseWriter, filename string, download bool) *ContentTypeWriter {
-	return &ContentTypeWriter{w, filename, download, false}
+	return &ContentTypeWriter{nil, w, filename, download, false}
 }
 
 func (w *ContentTypeWriter) Write(p []byte) (n int, err error) {
@@ -36,7 +67,10 @@ func (w *ContentTypeWriter) Write(p []byte) (n int, err error) {
 	}
 
 	// Detect and set Content-Type header
-	contentType := http.DetectContentType(p)
+	contentType := DetectContentType(p)
+	if w.ForceDownload != nil && w.ForceDownload(contentType) {
+		w.download = true
+	}
 	if !w.download {
 		// Fix content types that we don't want to inline-render in the browser. In particular,
 		// we don't want to render HTML in the browser for security reasons.
@@ -74,3 +74,27 @@ func TestSniffWriter_DownloadWithUnknownMimeType(t *testing.T) {
 	test.StrEquals(t, "application/octet-stream", rr.Header().Get("Content-Type"))
 	test.StrEquals(t, `attachment; filename=abcdef.bin`, rr.Header().Get("Content-Disposition"))
 }
+
+func TestSniffWriter_ForceDownload(t *testing.T) {
+	rr := httptest.NewRecorder()
+	sw := NewContentTypeWriter(rr, "report", false)
+	sw.ForceDownload = func(contentType string) bool {
+		return contentType == "application/pdf"
+	}
+	sw.Write([]byte{0x25, 0x50, 0x44, 0x46, 0x2d, 0x11, 0x22, 0x33})
+	test.StrEquals(t, "application/pdf", rr.Header().Get("Content-Type"))
+	test.StrEquals(t, `attachment; filename=report.pdf`, rr.Header().Get("Content-Disposition"))
+}
+
+func TestDetectContentType_Executables(t *testing.T) {
+	test.StrEquals(t, "application/x-executable", DetectContentType([]byte("\x7fELF\x02\x01\x01\x00")))
+	test.StrEquals(t, "application/x-mach-binary", DetectContentType([]byte{0xcf, 0xfa, 0xed, 0xfe, 0x07, 0x00}))
+
+	pe := make([]byte, 0x80)
+	copy(pe, "MZ")
+	pe[0x3c] = 0x40
+	copy(pe[0x40:], "PE\x00\x00")
+	test.StrEquals(t, "application/vnd.microsoft.portable-executable", DetectContentType(pe))
+
+	test.StrEquals(t, "text/plain; charset=utf-8", DetectContentType([]byte("MZ is not an executable")))
+}
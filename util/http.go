@@ -17,7 +17,9 @@ const (
 	defaultHTTPClientTimeout = 5 * time.Second
 )
 
-var errNoTrustedCertMatch = errors.New("no trusted cert matches")
+// ErrPinnedCertMismatch is returned (wrapped) by HTTP clients created with NewHTTPClientWithPinnedCert if
+// the server certificate does not match the pinned certificate
+var ErrPinnedCertMismatch = errors.New("no trusted cert matches")
 
 // NewHTTPClient returns a HTTP client
 func NewHTTPClient() *http.Client {
@@ -35,17 +37,34 @@ func NewHTTPClientWithInsecureTransport() *http.Client {
 }
 
 // NewHTTPClientWithPinnedCert is a helper function to create a HTTP client with a pinned TLS certificate.
-// Communication with a HTTPS server with a different certificate will fail.
+// Communication with a HTTPS server with a certificate with a different public key will fail. Only the public
+// key is compared, so that the server certificate can be renewed with the same key (see 'pcopy cert renew').
+//
+// If the pinned certificate is a CA certificate, the server certificate must instead be issued by that CA (it
+// is the only trusted root), and it must be valid for the server's hostname. This allows server certificates
+// to be renewed without having to re-pin them on the clients.
 func NewHTTPClientWithPinnedCert(pinned *x509.Certificate) (*http.Client, error) {
+	if pinned.IsCA {
+		roots := x509.NewCertPool()
+		roots.AddCert(pinned)
+		return &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: roots},
+			},
+		}, nil
+	}
 	verifyCertFn := func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
-		for _, r := range rawCerts {
-			if bytes.Equal(pinned.Raw, r) {
-				return nil
-			}
+		if len(rawCerts) == 0 {
+			return ErrPinnedCertMismatch
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		} else if !bytes.Equal(pinned.RawSubjectPublicKeyInfo, cert.RawSubjectPublicKeyInfo) {
+			return ErrPinnedCertMismatch
 		}
-		return errNoTrustedCertMatch
+		return nil
 	}
-
 	return &http.Client{
 		Transport: &http.Transport{
 			TLSClientConfig: &tls.Config{
@@ -56,6 +75,20 @@ func NewHTTPClientWithPinnedCert(pinned *x509.Certificate) (*http.Client, error)
 	}, nil
 }
 
+// WithClientCert configures the given client to present the given TLS client certificate to the server
+func WithClientCert(client *http.Client, cert tls.Certificate) *http.Client {
+	transport, ok := client.Transport.(*http.Transport)
+	if !ok || transport == nil {
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+		client.Transport = transport
+	}
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+	transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	return client
+}
+
 // WithTimeout adds a timeout to the given client
 func WithTimeout(client *http.Client) *http.Client {
 	client.Timeout = getHTTPClientTimeout()
@@ -1,8 +1,10 @@
 package util
 
 import (
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
+	"heckel.io/pcopy/crypto"
 	"heckel.io/pcopy/test"
 	"io"
 	"net/http"
@@ -70,3 +72,51 @@ eTzmbC8o65uD4keYyszxUIk8bBPGM74=
 		t.Fatal("expected error, got none")
 	}
 }
+
+func TestNewHTTPClientWithPinnedCert_CASuccess(t *testing.T) {
+	ca, server := newTestServerWithCA(t, "127.0.0.1")
+	defer server.Close()
+
+	client, _ := NewHTTPClientWithPinnedCert(ca)
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	test.StrEquals(t, "issued by CA", string(b))
+}
+
+func TestNewHTTPClientWithPinnedCert_CAFailureWrongHostname(t *testing.T) {
+	ca, server := newTestServerWithCA(t, "example.com")
+	defer server.Close()
+
+	client, _ := NewHTTPClientWithPinnedCert(ca)
+	if _, err := client.Get(server.URL); err == nil {
+		t.Fatal("expected error, got none")
+	}
+}
+
+func newTestServerWithCA(t *testing.T, hosts ...string) (*x509.Certificate, *httptest.Server) {
+	caKeyPEM, caCertPEM, err := crypto.GenerateCA("test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	caKeyBlock, _ := pem.Decode([]byte(caKeyPEM))
+	caKey, _ := x509.ParseECPrivateKey(caKeyBlock.Bytes)
+	caCertBlock, _ := pem.Decode([]byte(caCertPEM))
+	caCert, _ := x509.ParseCertificate(caCertBlock.Bytes)
+	keyPEM, certPEM, err := crypto.GenerateKeyAndCertWithCA(caKey, caCert, hosts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("issued by CA"))
+	}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	server.StartTLS()
+	return caCert, server
+}
@@ -0,0 +1,65 @@
+package util
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ParseIPNets parses a space-separated list of IP addresses and CIDR ranges (e.g. "10.0.0.0/8 192.168.1.1")
+// into a list of networks. Single IP addresses are turned into /32 (IPv4) or /128 (IPv6) networks.
+func ParseIPNets(s string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0)
+	for _, field := range strings.Fields(s) {
+		if !strings.Contains(field, "/") {
+			ip := net.ParseIP(field)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %s", field)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(field)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// IPNetsToString converts a list of networks into a space-separated string, the inverse of ParseIPNets
+func IPNetsToString(nets []*net.IPNet) string {
+	s := make([]string, 0)
+	for _, ipNet := range nets {
+		s = append(s, ipNet.String())
+	}
+	return strings.Join(s, " ")
+}
+
+// IPNetsContain returns true if any of the given networks contains the IP address
+func IPNetsContain(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoteIP extracts the IP address from a remote address in the form host:port. The port is optional.
+// The function returns nil if the address cannot be parsed.
+func RemoteIP(remoteAddr string) net.IP {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	return net.ParseIP(host)
+}
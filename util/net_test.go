@@ -0,0 +1,38 @@
+package util
+
+import (
+	"heckel.io/pcopy/test"
+	"net"
+	"testing"
+)
+
+func TestParseIPNets_Success(t *testing.T) {
+	nets, err := ParseIPNets("10.0.0.0/8 192.168.1.1 ::1 fd00::/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, "10.0.0.0/8 192.168.1.1/32 ::1/128 fd00::/8", IPNetsToString(nets))
+	test.BoolEquals(t, true, IPNetsContain(nets, net.ParseIP("10.1.2.3")))
+	test.BoolEquals(t, true, IPNetsContain(nets, net.ParseIP("192.168.1.1")))
+	test.BoolEquals(t, false, IPNetsContain(nets, net.ParseIP("192.168.1.2")))
+	test.BoolEquals(t, false, IPNetsContain(nets, nil))
+}
+
+func TestParseIPNets_FailureInvalidCIDR(t *testing.T) {
+	if _, err := ParseIPNets("10.0.0.0/33"); err == nil {
+		t.Fatalf("expected error, got none")
+	}
+}
+
+func TestParseIPNets_FailureInvalidIP(t *testing.T) {
+	if _, err := ParseIPNets("not-an-ip"); err == nil {
+		t.Fatalf("expected error, got none")
+	}
+}
+
+func TestRemoteIP(t *testing.T) {
+	test.StrEquals(t, "1.2.3.4", RemoteIP("1.2.3.4:1234").String())
+	test.StrEquals(t, "::1", RemoteIP("[::1]:1234").String())
+	test.StrEquals(t, "1.2.3.4", RemoteIP("1.2.3.4").String())
+	test.BoolEquals(t, true, RemoteIP("garbage") == nil)
+}
@@ -0,0 +1,94 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// RotatingFile is an append-only file that is rotated when it reaches maxSize. Rotated files are renamed
+// to filename.1, filename.2, and so on; only maxFiles rotated files are kept. Each call to Write is
+// kept in one file, so callers should write whole lines. RotatingFile may be used by multiple goroutines.
+type RotatingFile struct {
+	filename string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+	mu       sync.Mutex
+}
+
+// NewRotatingFile opens (or creates) the given file for appending
+func NewRotatingFile(filename string, maxSize int64, maxFiles int) (*RotatingFile, error) {
+	f := &RotatingFile{
+		filename: filename,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Write appends p to the file, and rotates the file first if it would exceed the max size
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Close closes the underlying file
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, stat.Size()
+	return nil
+}
+
+// rotate closes the current file, shifts all rotated files by one (dropping the oldest one), and re-opens
+// the file. It must be called with f.mu held.
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	if f.maxFiles == 0 {
+		if err := os.Remove(f.filename); err != nil {
+			return err
+		}
+		return f.open()
+	}
+	os.Remove(fmt.Sprintf("%s.%d", f.filename, f.maxFiles)) // Might not exist
+	for i := f.maxFiles - 1; i >= 1; i-- {
+		from := fmt.Sprintf("%s.%d", f.filename, i)
+		if _, err := os.Stat(from); err == nil {
+			if err := os.Rename(from, fmt.Sprintf("%s.%d", f.filename, i+1)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := os.Rename(f.filename, f.filename+".1"); err != nil {
+		return err
+	}
+	return f.open()
+}
@@ -0,0 +1,27 @@
+package util
+
+import (
+	"heckel.io/pcopy/test"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotatingFile_WriteAndRotate(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "some.log")
+	file, err := NewRotatingFile(filename, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	file.Write([]byte("line 1\n"))
+	file.Write([]byte("line 2\n"))
+	file.Write([]byte("line 3\n"))
+
+	test.FileNotExist(t, filename+".2")
+	current, _ := os.ReadFile(filename)
+	rotated, _ := os.ReadFile(filename + ".1")
+	test.StrEquals(t, "line 3\n", string(current))
+	test.StrEquals(t, "line 2\n", string(rotated))
+}
@@ -2,11 +2,12 @@
 package util
 
 import (
+	"crypto/rand"
 	"errors"
 	"fmt"
 	"golang.org/x/term"
 	"io"
-	"math/rand"
+	"math/big"
 	"os"
 	"path"
 	"path/filepath"
@@ -17,7 +18,6 @@ import (
 )
 
 var (
-	random                         = rand.New(rand.NewSource(time.Now().UnixNano()))
 	durationStrSecondsOnlyRegex    = regexp.MustCompile(`(?i)^(\d+)$`)
 	durationStrLongPeriodOnlyRegex = regexp.MustCompile(`(?i)^(\d+)([dwy]|mo)$`)
 	sizeStrRegex                   = regexp.MustCompile(`(?i)^(\d+)([gmkb])?$`)
@@ -145,11 +145,17 @@ func ParseSize(s string) (int64, error) {
 	}
 }
 
-// RandomStringWithCharset returns a random string with a given length, using the defined charset
+// RandomStringWithCharset returns a random string with a given length, using the defined charset. The string
+// is generated using crypto/rand, so it is safe for concurrent use and can be used for secrets.
 func RandomStringWithCharset(length int, charset string) string {
 	b := make([]byte, length)
+	max := big.NewInt(int64(len(charset)))
 	for i := range b {
-		b[i] = charset[random.Intn(len(charset))]
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			panic(err) // crypto/rand does not fail on supported platforms
+		}
+		b[i] = charset[n.Int64()]
 	}
 	return string(b)
 }